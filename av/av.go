@@ -122,6 +122,12 @@ var (
 	PCM_ALAW  = MakeAudioCodecType(avCodecTypeMagic + 3)
 	SPEEX = MakeAudioCodecType(avCodecTypeMagic + 4)
 	NELLYMOSER = MakeAudioCodecType(avCodecTypeMagic + 5)
+	H265 = MakeVideoCodecType(avCodecTypeMagic + 2)
+	VP8 = MakeVideoCodecType(avCodecTypeMagic + 3)
+	VP9 = MakeVideoCodecType(avCodecTypeMagic + 4)
+	OPUS = MakeAudioCodecType(avCodecTypeMagic + 6)
+	PCM = MakeAudioCodecType(avCodecTypeMagic + 7) // uncompressed little endian interleaved samples
+	AV1 = MakeVideoCodecType(avCodecTypeMagic + 5)
 )
 
 const codecTypeAudioBit = 0x1
@@ -141,6 +147,18 @@ func (self CodecType) String() string {
 		return "SPEEX"
 	case NELLYMOSER:
 		return "NELLYMOSER"
+	case H265:
+		return "H265"
+	case VP8:
+		return "VP8"
+	case VP9:
+		return "VP9"
+	case OPUS:
+		return "OPUS"
+	case PCM:
+		return "PCM"
+	case AV1:
+		return "AV1"
 	}
 	return ""
 }
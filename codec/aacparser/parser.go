@@ -92,7 +92,7 @@ var chanConfigTable = []av.ChannelLayout{
 }
 
 func ParseADTSHeader(frame []byte) (config MPEG4AudioConfig, hdrlen int, framelen int, samples int, err error) {
-	if frame[0] != 0xff || frame[1]&0xf6 != 0xf0 {
+	if len(frame) < 7 || frame[0] != 0xff || frame[1]&0xf6 != 0xf0 {
 		err = fmt.Errorf("aacparser: not adts header")
 		return
 	}
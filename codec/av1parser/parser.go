@@ -0,0 +1,579 @@
+// Package av1parser parses AV1 OBUs, the sequence header and the
+// AV1CodecConfigurationRecord used by MP4, Matroska and Enhanced RTMP.
+package av1parser
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/utils/bits"
+)
+
+const (
+	OBU_SEQUENCE_HEADER        = 1
+	OBU_TEMPORAL_DELIMITER     = 2
+	OBU_FRAME_HEADER           = 3
+	OBU_TILE_GROUP             = 4
+	OBU_METADATA               = 5
+	OBU_FRAME                  = 6
+	OBU_REDUNDANT_FRAME_HEADER = 7
+	OBU_TILE_LIST              = 8
+	OBU_PADDING                = 15
+)
+
+// OBUType returns obu_type from the OBU header.
+func OBUType(b []byte) int {
+	return int(b[0]>>3) & 0xf
+}
+
+// ReadLEB128 returns the leb128() value at the start of b and its length.
+func ReadLEB128(b []byte) (v uint64, n int, err error) {
+	for i := 0; i < 8; i++ {
+		if i >= len(b) {
+			break
+		}
+		v |= uint64(b[i]&0x7f) << uint(i*7)
+		if b[i]&0x80 == 0 {
+			n = i + 1
+			return
+		}
+	}
+	err = fmt.Errorf("av1parser: invalid leb128")
+	return
+}
+
+// SplitOBUs splits a low overhead bitstream into OBUs, headers included.
+// The last OBU may have no size field.
+func SplitOBUs(b []byte) (obus [][]byte, err error) {
+	for len(b) > 0 {
+		hdrlen := 1
+		if b[0]&0x4 != 0 { // obu_extension_flag
+			hdrlen++
+		}
+		if len(b) < hdrlen {
+			err = fmt.Errorf("av1parser: OBU header truncated")
+			return
+		}
+		size := len(b)
+		if b[0]&0x2 != 0 { // obu_has_size_field
+			var v uint64
+			var n int
+			if v, n, err = ReadLEB128(b[hdrlen:]); err != nil {
+				return
+			}
+			hdrlen += n
+			if v > uint64(len(b)-hdrlen) {
+				err = fmt.Errorf("av1parser: OBU size invalid")
+				return
+			}
+			size = hdrlen + int(v)
+		}
+		obus = append(obus, b[:size])
+		b = b[size:]
+	}
+	return
+}
+
+// OBUPayload returns the OBU without its header.
+// It returns nil if the header is truncated.
+func OBUPayload(obu []byte) []byte {
+	if len(obu) == 0 {
+		return nil
+	}
+	hdrlen := 1
+	if obu[0]&0x4 != 0 {
+		hdrlen++
+	}
+	if hdrlen > len(obu) {
+		return nil
+	}
+	if obu[0]&0x2 != 0 {
+		_, n, err := ReadLEB128(obu[hdrlen:])
+		if err != nil {
+			return nil
+		}
+		hdrlen += n
+	}
+	return obu[hdrlen:]
+}
+
+type SequenceHeader struct {
+	SeqProfile   uint
+	StillPicture bool
+	SeqLevelIdx0 uint
+	SeqTier0     uint
+
+	MaxFrameWidth  uint
+	MaxFrameHeight uint
+
+	HighBitdepth         bool
+	TwelveBit            bool
+	MonoChrome           bool
+	ChromaSubsamplingX   uint
+	ChromaSubsamplingY   uint
+	ChromaSamplePosition uint
+}
+
+// ParseSequenceHeader parses the payload of a sequence header OBU.
+func ParseSequenceHeader(data []byte) (self SequenceHeader, err error) {
+	r := &bits.GolombBitReader{R: bytes.NewReader(data)}
+	var v uint
+
+	if self.SeqProfile, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if v, err = r.ReadBit(); err != nil {
+		return
+	}
+	self.StillPicture = v != 0
+
+	var reduced_still_picture_header uint
+	if reduced_still_picture_header, err = r.ReadBit(); err != nil {
+		return
+	}
+
+	if reduced_still_picture_header != 0 {
+		if self.SeqLevelIdx0, err = r.ReadBits(5); err != nil {
+			return
+		}
+	} else {
+		var timing_info_present_flag, decoder_model_info_present_flag uint
+		var buffer_delay_length_minus_1 uint
+		if timing_info_present_flag, err = r.ReadBit(); err != nil {
+			return
+		}
+		if timing_info_present_flag != 0 {
+			// num_units_in_display_tick, time_scale
+			if _, err = r.ReadBits(32); err != nil {
+				return
+			}
+			if _, err = r.ReadBits(32); err != nil {
+				return
+			}
+			// equal_picture_interval
+			if v, err = r.ReadBit(); err != nil {
+				return
+			}
+			if v != 0 {
+				// num_ticks_per_picture_minus_1 uvlc()
+				if err = skipUVLC(r); err != nil {
+					return
+				}
+			}
+			if decoder_model_info_present_flag, err = r.ReadBit(); err != nil {
+				return
+			}
+			if decoder_model_info_present_flag != 0 {
+				if buffer_delay_length_minus_1, err = r.ReadBits(5); err != nil {
+					return
+				}
+				// num_units_in_decoding_tick
+				if _, err = r.ReadBits(32); err != nil {
+					return
+				}
+				// buffer_removal_time_length_minus_1, frame_presentation_time_length_minus_1
+				if _, err = r.ReadBits(10); err != nil {
+					return
+				}
+			}
+		}
+
+		var initial_display_delay_present_flag, operating_points_cnt_minus_1 uint
+		if initial_display_delay_present_flag, err = r.ReadBit(); err != nil {
+			return
+		}
+		if operating_points_cnt_minus_1, err = r.ReadBits(5); err != nil {
+			return
+		}
+		for i := uint(0); i <= operating_points_cnt_minus_1; i++ {
+			// operating_point_idc
+			if _, err = r.ReadBits(12); err != nil {
+				return
+			}
+			var seq_level_idx, seq_tier uint
+			if seq_level_idx, err = r.ReadBits(5); err != nil {
+				return
+			}
+			if seq_level_idx > 7 {
+				if seq_tier, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+			if i == 0 {
+				self.SeqLevelIdx0 = seq_level_idx
+				self.SeqTier0 = seq_tier
+			}
+			if decoder_model_info_present_flag != 0 {
+				if v, err = r.ReadBit(); err != nil {
+					return
+				}
+				if v != 0 {
+					// decoder_buffer_delay, encoder_buffer_delay, low_delay_mode_flag
+					if _, err = r.ReadBits(int(buffer_delay_length_minus_1+1)*2 + 1); err != nil {
+						return
+					}
+				}
+			}
+			if initial_display_delay_present_flag != 0 {
+				if v, err = r.ReadBit(); err != nil {
+					return
+				}
+				if v != 0 {
+					// initial_display_delay_minus_1
+					if _, err = r.ReadBits(4); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+
+	var frame_width_bits_minus_1, frame_height_bits_minus_1 uint
+	if frame_width_bits_minus_1, err = r.ReadBits(4); err != nil {
+		return
+	}
+	if frame_height_bits_minus_1, err = r.ReadBits(4); err != nil {
+		return
+	}
+	if v, err = r.ReadBits(int(frame_width_bits_minus_1 + 1)); err != nil {
+		return
+	}
+	self.MaxFrameWidth = v + 1
+	if v, err = r.ReadBits(int(frame_height_bits_minus_1 + 1)); err != nil {
+		return
+	}
+	self.MaxFrameHeight = v + 1
+
+	if reduced_still_picture_header == 0 {
+		// frame_id_numbers_present_flag
+		if v, err = r.ReadBit(); err != nil {
+			return
+		}
+		if v != 0 {
+			// delta_frame_id_length_minus_2, additional_frame_id_length_minus_1
+			if _, err = r.ReadBits(7); err != nil {
+				return
+			}
+		}
+	}
+
+	// use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+	if _, err = r.ReadBits(3); err != nil {
+		return
+	}
+
+	if reduced_still_picture_header == 0 {
+		// enable_interintra_compound, enable_masked_compound,
+		// enable_warped_motion, enable_dual_filter
+		if _, err = r.ReadBits(4); err != nil {
+			return
+		}
+		var enable_order_hint uint
+		if enable_order_hint, err = r.ReadBit(); err != nil {
+			return
+		}
+		if enable_order_hint != 0 {
+			// enable_jnt_comp, enable_ref_frame_mvs
+			if _, err = r.ReadBits(2); err != nil {
+				return
+			}
+		}
+		seq_force_screen_content_tools := uint(2)
+		// seq_choose_screen_content_tools
+		if v, err = r.ReadBit(); err != nil {
+			return
+		}
+		if v == 0 {
+			if seq_force_screen_content_tools, err = r.ReadBit(); err != nil {
+				return
+			}
+		}
+		if seq_force_screen_content_tools > 0 {
+			// seq_choose_integer_mv
+			if v, err = r.ReadBit(); err != nil {
+				return
+			}
+			if v == 0 {
+				// seq_force_integer_mv
+				if _, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+		}
+		if enable_order_hint != 0 {
+			// order_hint_bits_minus_1
+			if _, err = r.ReadBits(3); err != nil {
+				return
+			}
+		}
+	}
+
+	// enable_superres, enable_cdef, enable_restoration
+	if _, err = r.ReadBits(3); err != nil {
+		return
+	}
+
+	err = self.parseColorConfig(r)
+	return
+}
+
+func (self *SequenceHeader) parseColorConfig(r *bits.GolombBitReader) (err error) {
+	var v uint
+
+	if v, err = r.ReadBit(); err != nil {
+		return
+	}
+	self.HighBitdepth = v != 0
+	if self.SeqProfile == 2 && self.HighBitdepth {
+		if v, err = r.ReadBit(); err != nil {
+			return
+		}
+		self.TwelveBit = v != 0
+	}
+	if self.SeqProfile != 1 {
+		if v, err = r.ReadBit(); err != nil {
+			return
+		}
+		self.MonoChrome = v != 0
+	}
+
+	color_primaries, transfer_characteristics, matrix_coefficients := uint(2), uint(2), uint(2)
+	// color_description_present_flag
+	if v, err = r.ReadBit(); err != nil {
+		return
+	}
+	if v != 0 {
+		if color_primaries, err = r.ReadBits(8); err != nil {
+			return
+		}
+		if transfer_characteristics, err = r.ReadBits(8); err != nil {
+			return
+		}
+		if matrix_coefficients, err = r.ReadBits(8); err != nil {
+			return
+		}
+	}
+
+	switch {
+	case self.MonoChrome:
+		self.ChromaSubsamplingX, self.ChromaSubsamplingY = 1, 1
+		return
+
+	case color_primaries == 1 && transfer_characteristics == 13 && matrix_coefficients == 0:
+		// sRGB, 4:4:4
+		return
+	}
+
+	// color_range
+	if _, err = r.ReadBit(); err != nil {
+		return
+	}
+	switch self.SeqProfile {
+	case 0:
+		self.ChromaSubsamplingX, self.ChromaSubsamplingY = 1, 1
+	case 1:
+	default:
+		if self.TwelveBit {
+			if self.ChromaSubsamplingX, err = r.ReadBit(); err != nil {
+				return
+			}
+			if self.ChromaSubsamplingX != 0 {
+				if self.ChromaSubsamplingY, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+		} else {
+			self.ChromaSubsamplingX = 1
+		}
+	}
+	if self.ChromaSubsamplingX != 0 && self.ChromaSubsamplingY != 0 {
+		if self.ChromaSamplePosition, err = r.ReadBits(2); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func skipUVLC(r *bits.GolombBitReader) (err error) {
+	leadingZeros := 0
+	for {
+		var bit uint
+		if bit, err = r.ReadBit(); err != nil {
+			return
+		}
+		if bit != 0 {
+			break
+		}
+		leadingZeros++
+	}
+	if leadingZeros < 32 {
+		_, err = r.ReadBits(leadingZeros)
+	}
+	return
+}
+
+type CodecData struct {
+	Record     []byte
+	RecordInfo AV1DecoderConfRecord
+	SeqHdr     SequenceHeader
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.AV1
+}
+
+func (self CodecData) AV1DecoderConfRecordBytes() []byte {
+	return self.Record
+}
+
+// SequenceHeaderOBU returns the sequence header OBU of the record.
+func (self CodecData) SequenceHeaderOBU() []byte {
+	return self.RecordInfo.SequenceHeader
+}
+
+func (self CodecData) Width() int {
+	return int(self.SeqHdr.MaxFrameWidth)
+}
+
+func (self CodecData) Height() int {
+	return int(self.SeqHdr.MaxFrameHeight)
+}
+
+func NewCodecDataFromAV1DecoderConfRecord(record []byte) (self CodecData, err error) {
+	self.Record = record
+	if _, err = (&self.RecordInfo).Unmarshal(record); err != nil {
+		return
+	}
+	if self.RecordInfo.SequenceHeader == nil {
+		err = fmt.Errorf("av1parser: no sequence header found in AV1DecoderConfRecord")
+		return
+	}
+	if self.SeqHdr, err = ParseSequenceHeader(OBUPayload(self.RecordInfo.SequenceHeader)); err != nil {
+		err = fmt.Errorf("av1parser: parse sequence header failed(%s)", err)
+		return
+	}
+	return
+}
+
+// NewCodecDataFromSequenceHeader builds the record of a sequence header
+// OBU, which must have obu_has_size_field set.
+func NewCodecDataFromSequenceHeader(obu []byte) (self CodecData, err error) {
+	if len(obu) == 0 || OBUType(obu) != OBU_SEQUENCE_HEADER {
+		err = fmt.Errorf("av1parser: not a sequence header OBU")
+		return
+	}
+	if self.SeqHdr, err = ParseSequenceHeader(OBUPayload(obu)); err != nil {
+		return
+	}
+	hdr := self.SeqHdr
+
+	recordinfo := AV1DecoderConfRecord{}
+	recordinfo.SeqProfile = uint8(hdr.SeqProfile)
+	recordinfo.SeqLevelIdx0 = uint8(hdr.SeqLevelIdx0)
+	recordinfo.SeqTier0 = uint8(hdr.SeqTier0)
+	recordinfo.HighBitdepth = hdr.HighBitdepth
+	recordinfo.TwelveBit = hdr.TwelveBit
+	recordinfo.MonoChrome = hdr.MonoChrome
+	recordinfo.ChromaSubsamplingX = uint8(hdr.ChromaSubsamplingX)
+	recordinfo.ChromaSubsamplingY = uint8(hdr.ChromaSubsamplingY)
+	recordinfo.ChromaSamplePosition = uint8(hdr.ChromaSamplePosition)
+	recordinfo.SequenceHeader = obu
+	recordinfo.ConfigOBUs = obu
+
+	buf := make([]byte, recordinfo.Len())
+	recordinfo.Marshal(buf)
+
+	self.RecordInfo = recordinfo
+	self.Record = buf
+	return
+}
+
+// AV1DecoderConfRecord is AV1CodecConfigurationRecord of the AV1 ISOBMFF
+// binding.
+type AV1DecoderConfRecord struct {
+	SeqProfile           uint8
+	SeqLevelIdx0         uint8
+	SeqTier0             uint8
+	HighBitdepth         bool
+	TwelveBit            bool
+	MonoChrome           bool
+	ChromaSubsamplingX   uint8
+	ChromaSubsamplingY   uint8
+	ChromaSamplePosition uint8
+
+	// InitialPresentationDelayMinusOne is used when
+	// InitialPresentationDelayPresent is set.
+	InitialPresentationDelayPresent  bool
+	InitialPresentationDelayMinusOne uint8
+
+	// ConfigOBUs are the OBUs following the 4 bytes header, SequenceHeader
+	// is the sequence header among them.
+	ConfigOBUs     []byte
+	SequenceHeader []byte
+}
+
+var ErrDecconfInvalid = fmt.Errorf("av1parser: AV1DecoderConfRecord invalid")
+
+func (self *AV1DecoderConfRecord) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 4 {
+		err = ErrDecconfInvalid
+		return
+	}
+	// marker(1)=1 version(7)=1
+	if b[0] != 0x81 {
+		err = ErrDecconfInvalid
+		return
+	}
+	self.SeqProfile = b[1] >> 5
+	self.SeqLevelIdx0 = b[1] & 0x1f
+	self.SeqTier0 = b[2] >> 7
+	self.HighBitdepth = b[2]&0x40 != 0
+	self.TwelveBit = b[2]&0x20 != 0
+	self.MonoChrome = b[2]&0x10 != 0
+	self.ChromaSubsamplingX = (b[2] >> 3) & 1
+	self.ChromaSubsamplingY = (b[2] >> 2) & 1
+	self.ChromaSamplePosition = b[2] & 3
+	self.InitialPresentationDelayPresent = b[3]&0x10 != 0
+	self.InitialPresentationDelayMinusOne = b[3] & 0xf
+	n += 4
+
+	self.ConfigOBUs = b[n:]
+	var obus [][]byte
+	if obus, err = SplitOBUs(self.ConfigOBUs); err != nil {
+		return
+	}
+	for _, obu := range obus {
+		if OBUType(obu) == OBU_SEQUENCE_HEADER {
+			self.SequenceHeader = obu
+			break
+		}
+	}
+	n = len(b)
+	return
+}
+
+func (self AV1DecoderConfRecord) Len() (n int) {
+	return 4 + len(self.ConfigOBUs)
+}
+
+func boolBit(v bool, shift uint) uint8 {
+	if v {
+		return 1 << shift
+	}
+	return 0
+}
+
+func (self AV1DecoderConfRecord) Marshal(b []byte) (n int) {
+	b[0] = 0x81
+	b[1] = self.SeqProfile<<5 | self.SeqLevelIdx0&0x1f
+	b[2] = (self.SeqTier0&1)<<7 | boolBit(self.HighBitdepth, 6) | boolBit(self.TwelveBit, 5) | boolBit(self.MonoChrome, 4) |
+		(self.ChromaSubsamplingX&1)<<3 | (self.ChromaSubsamplingY&1)<<2 | self.ChromaSamplePosition&3
+	b[3] = boolBit(self.InitialPresentationDelayPresent, 4)
+	if self.InitialPresentationDelayPresent {
+		b[3] |= self.InitialPresentationDelayMinusOne & 0xf
+	}
+	n += 4
+	n += copy(b[n:], self.ConfigOBUs)
+	return
+}
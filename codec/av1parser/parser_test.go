@@ -0,0 +1,70 @@
+package av1parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+// a 1280x720 main profile sequence header OBU with obu_has_size_field
+var testSequenceHeader = []byte{0x0a, 0x0b, 0x00, 0x00, 0x00, 0x42, 0xaa, 0x7f, 0xac, 0xf0, 0x09, 0xe0, 0x02}
+
+func TestOBUPayload(t *testing.T) {
+	for _, c := range []struct {
+		obu, payload []byte
+	}{
+		{[]byte{}, nil},
+		{[]byte{0x12, 0x00}, []byte{}},
+		{[]byte{0x32, 0x01, 0xaa}, []byte{0xaa}},
+		{[]byte{0x30, 0xaa}, []byte{0xaa}},
+		{[]byte{0x36, 0x00, 0x01, 0xaa}, []byte{0xaa}},
+		// truncated extension and size field
+		{[]byte{0x34}, nil},
+		{[]byte{0x36, 0x00}, nil},
+		{[]byte{0x32, 0x80}, nil},
+	} {
+		if payload := OBUPayload(c.obu); !bytes.Equal(payload, c.payload) || (payload == nil) != (c.payload == nil) {
+			t.Errorf("OBUPayload(% x) = % x", c.obu, payload)
+		}
+	}
+}
+
+func TestSplitOBUs(t *testing.T) {
+	b := append([]byte{0x12, 0x00}, testSequenceHeader...)
+	b = append(b, 0x30, 0xaa, 0xbb)
+	obus, err := SplitOBUs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obus) != 3 || OBUType(obus[0]) != OBU_TEMPORAL_DELIMITER || OBUType(obus[1]) != OBU_SEQUENCE_HEADER || len(obus[2]) != 3 {
+		t.Errorf("got OBUs % x", obus)
+	}
+
+	if _, err = SplitOBUs([]byte{0x12, 0x05, 0x00}); err == nil {
+		t.Error("OBU size over the buffer accepted")
+	}
+}
+
+func TestCodecDataFromSequenceHeader(t *testing.T) {
+	codec, err := NewCodecDataFromSequenceHeader(testSequenceHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.Width() != 1280 || codec.Height() != 720 {
+		t.Errorf("got %dx%d", codec.Width(), codec.Height())
+	}
+	if codec.RecordInfo.SeqLevelIdx0 != 8 {
+		t.Errorf("got level %d", codec.RecordInfo.SeqLevelIdx0)
+	}
+
+	parsed, err := NewCodecDataFromAV1DecoderConfRecord(codec.AV1DecoderConfRecordBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.RecordInfo.SeqLevelIdx0 != 8 || !bytes.Equal(parsed.SequenceHeaderOBU(), testSequenceHeader) || parsed.SeqHdr != codec.SeqHdr {
+		t.Errorf("got record %+v", parsed.RecordInfo)
+	}
+
+	if _, err = NewCodecDataFromAV1DecoderConfRecord([]byte{0x81, 0, 0, 0, 0x0a}); err == nil {
+		t.Error("truncated sequence header accepted")
+	}
+}
@@ -1,8 +1,12 @@
 package codec
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/fake"
+	"github.com/nareix/joy4/utils/bits"
+	"github.com/nareix/joy4/utils/bits/pio"
 	"time"
 )
 
@@ -42,6 +46,29 @@ func NewPCMAlawCodecData() av.AudioCodecData {
 	}
 }
 
+// PCMCodecData is uncompressed audio, packets hold little endian samples of
+// SampleFormat_ interleaved.
+type PCMCodecData struct {
+	fake.CodecData
+}
+
+func (self PCMCodecData) PacketDuration(data []byte) (time.Duration, error) {
+	size := self.SampleFormat_.BytesPerSample() * self.ChannelLayout_.Count()
+	if size == 0 || self.SampleRate_ == 0 {
+		return 0, fmt.Errorf("pcm: invalid codec data")
+	}
+	return time.Duration(len(data)/size) * time.Second / time.Duration(self.SampleRate_), nil
+}
+
+func NewPCMCodecData(sf av.SampleFormat, sr int, cl av.ChannelLayout) PCMCodecData {
+	codec := PCMCodecData{}
+	codec.CodecType_ = av.PCM
+	codec.SampleFormat_ = sf
+	codec.SampleRate_ = sr
+	codec.ChannelLayout_ = cl
+	return codec
+}
+
 type SpeexCodecData struct {
 	fake.CodecData
 }
@@ -62,3 +89,208 @@ func NewSpeexCodecData(sr int, cl av.ChannelLayout) SpeexCodecData {
 	return codec
 }
 
+// OpusCodecData is Opus audio, Header is the OpusHead identification header
+// used as codec private data by Matroska and MP4.
+type OpusCodecData struct {
+	fake.CodecData
+	Header []byte
+}
+
+// PacketDuration returns the duration of an Opus packet from its TOC byte.
+func (self OpusCodecData) PacketDuration(data []byte) (time.Duration, error) {
+	if len(data) < 1 {
+		return 0, fmt.Errorf("opus: empty packet")
+	}
+	toc := data[0]
+	config := toc >> 3
+	var frame time.Duration
+	switch {
+	case config < 12:
+		frame = []time.Duration{10, 20, 40, 60}[config&3] * time.Millisecond
+	case config < 16:
+		frame = []time.Duration{10, 20}[config&1] * time.Millisecond
+	default:
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config&3] * time.Microsecond
+	}
+	count := 1
+	switch toc & 3 {
+	case 1, 2:
+		count = 2
+	case 3:
+		if len(data) < 2 {
+			return 0, fmt.Errorf("opus: invalid packet")
+		}
+		count = int(data[1] & 0x3f)
+	}
+	return frame * time.Duration(count), nil
+}
+
+// PreSkip returns the number of 48kHz samples to drop at the start of decoding.
+func (self OpusCodecData) PreSkip() int {
+	if len(self.Header) < 19 {
+		return 0
+	}
+	return int(pio.U16LE(self.Header[10:12]))
+}
+
+func opusChannelLayout(channels int) av.ChannelLayout {
+	switch channels {
+	case 1:
+		return av.CH_MONO
+	case 2:
+		return av.CH_STEREO
+	}
+	return av.ChannelLayout(1<<uint(channels) - 1)
+}
+
+// NewOpusCodecData returns Opus codec data with a default OpusHead.
+func NewOpusCodecData(sr int, cl av.ChannelLayout) OpusCodecData {
+	codec := OpusCodecData{}
+	codec.CodecType_ = av.OPUS
+	codec.SampleFormat_ = av.FLT
+	codec.SampleRate_ = 48000
+	codec.ChannelLayout_ = cl
+	b := make([]byte, 19)
+	copy(b, "OpusHead")
+	b[8] = 1
+	b[9] = byte(cl.Count())
+	pio.PutU16LE(b[10:12], 312)
+	pio.PutU32LE(b[12:16], uint32(sr))
+	codec.Header = b
+	return codec
+}
+
+// NewOpusCodecDataFromHeader parses an OpusHead identification header.
+func NewOpusCodecDataFromHeader(b []byte) (codec OpusCodecData, err error) {
+	if len(b) < 19 || string(b[0:8]) != "OpusHead" {
+		err = fmt.Errorf("opus: invalid OpusHead")
+		return
+	}
+	codec.CodecType_ = av.OPUS
+	codec.SampleFormat_ = av.FLT
+	codec.SampleRate_ = 48000
+	codec.ChannelLayout_ = opusChannelLayout(int(b[9]))
+	codec.Header = append([]byte{}, b...)
+	return
+}
+
+// VPXCodecData is VP8 or VP9 video, their frames need no out of band
+// parameters.
+type VPXCodecData struct {
+	typ           av.CodecType
+	width, height int
+}
+
+func (self VPXCodecData) Type() av.CodecType {
+	return self.typ
+}
+
+func (self VPXCodecData) Width() int {
+	return self.width
+}
+
+func (self VPXCodecData) Height() int {
+	return self.height
+}
+
+func NewVP8CodecData(width, height int) VPXCodecData {
+	return VPXCodecData{typ: av.VP8, width: width, height: height}
+}
+
+func NewVP9CodecData(width, height int) VPXCodecData {
+	return VPXCodecData{typ: av.VP9, width: width, height: height}
+}
+
+// NewVP9CodecDataFromKeyFrame reads the frame size from the uncompressed
+// header of a VP9 keyframe, for containers without it.
+func NewVP9CodecDataFromKeyFrame(frame []byte) (codec VPXCodecData, err error) {
+	r := &bits.GolombBitReader{R: bytes.NewReader(frame)}
+	var v, profile uint
+
+	// frame_marker
+	if v, err = r.ReadBits(2); err != nil {
+		return
+	}
+	if v != 2 {
+		err = fmt.Errorf("vp9: invalid frame marker")
+		return
+	}
+	// profile_low_bit, profile_high_bit
+	if v, err = r.ReadBits(2); err != nil {
+		return
+	}
+	profile = (v&1)<<1 | v>>1
+	if profile == 3 {
+		// reserved_zero
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	// show_existing_frame
+	if v, err = r.ReadBit(); err != nil {
+		return
+	}
+	if v != 0 {
+		err = fmt.Errorf("vp9: not a keyframe")
+		return
+	}
+	// frame_type
+	if v, err = r.ReadBit(); err != nil {
+		return
+	}
+	if v != 0 {
+		err = fmt.Errorf("vp9: not a keyframe")
+		return
+	}
+	// show_frame, error_resilient_mode
+	if _, err = r.ReadBits(2); err != nil {
+		return
+	}
+	// frame_sync_code
+	if v, err = r.ReadBits(24); err != nil {
+		return
+	}
+	if v != 0x498342 {
+		err = fmt.Errorf("vp9: invalid sync code")
+		return
+	}
+
+	// color_config
+	if profile >= 2 {
+		// ten_or_twelve_bit
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	var colorspace uint
+	if colorspace, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if colorspace != 7 { // CS_RGB
+		// color_range
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+		if profile == 1 || profile == 3 {
+			// subsampling_x, subsampling_y, reserved_zero
+			if _, err = r.ReadBits(3); err != nil {
+				return
+			}
+		}
+	} else if profile == 1 || profile == 3 {
+		// reserved_zero
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+
+	var w, h uint
+	if w, err = r.ReadBits(16); err != nil {
+		return
+	}
+	if h, err = r.ReadBits(16); err != nil {
+		return
+	}
+	codec = NewVP9CodecData(int(w)+1, int(h)+1)
+	return
+}
@@ -304,10 +304,43 @@ type SPSInfo struct {
 
 	Width  uint
 	Height uint
+
+	// VUI timing, zero when the SPS has none
+	NumUnitsInTick uint
+	TimeScale      uint
+	FixedFrameRate bool
+}
+
+// FrameRate returns the frame rate given by the VUI timing, a frame is two
+// ticks. It's zero when the SPS has no timing.
+func (self SPSInfo) FrameRate() float64 {
+	if self.NumUnitsInTick == 0 || self.TimeScale == 0 {
+		return 0
+	}
+	return float64(self.TimeScale) / float64(self.NumUnitsInTick*2)
+}
+
+// unescapeRBSP removes emulation_prevention_three_byte.
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
 }
 
 func ParseSPS(data []byte) (self SPSInfo, err error) {
-	r := &bits.GolombBitReader{R: bytes.NewReader(data)}
+	r := &bits.GolombBitReader{R: bytes.NewReader(unescapeRBSP(data))}
 
 	if _, err = r.ReadBits(8); err != nil {
 		return
@@ -495,6 +528,108 @@ func ParseSPS(data []byte) (self SPSInfo, err error) {
 	self.Width = (self.MbWidth * 16) - self.CropLeft*2 - self.CropRight*2
 	self.Height = ((2 - frame_mbs_only_flag) * self.MbHeight * 16) - self.CropTop*2 - self.CropBottom*2
 
+	var vui_parameters_present_flag uint
+	if vui_parameters_present_flag, err = r.ReadBit(); err != nil {
+		// some encoders cut the SPS after the picture size
+		err = nil
+		return
+	}
+	if vui_parameters_present_flag != 0 {
+		// only timing is needed, a broken VUI doesn't make the SPS invalid
+		self.parseVUI(r)
+	}
+
+	return
+}
+
+func (self *SPSInfo) parseVUI(r *bits.GolombBitReader) (err error) {
+	var flag uint
+
+	// aspect_ratio_info_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		var aspect_ratio_idc uint
+		if aspect_ratio_idc, err = r.ReadBits(8); err != nil {
+			return
+		}
+		// Extended_SAR
+		if aspect_ratio_idc == 255 {
+			// sar_width, sar_height
+			if _, err = r.ReadBits(32); err != nil {
+				return
+			}
+		}
+	}
+
+	// overscan_info_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		// overscan_appropriate_flag
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+
+	// video_signal_type_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		// video_format, video_full_range_flag
+		if _, err = r.ReadBits(4); err != nil {
+			return
+		}
+		// colour_description_present_flag
+		if flag, err = r.ReadBit(); err != nil {
+			return
+		}
+		if flag != 0 {
+			// colour_primaries, transfer_characteristics, matrix_coefficients
+			if _, err = r.ReadBits(24); err != nil {
+				return
+			}
+		}
+	}
+
+	// chroma_loc_info_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		// chroma_sample_loc_type_top_field
+		if _, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		// chroma_sample_loc_type_bottom_field
+		if _, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+	}
+
+	// timing_info_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		var num_units_in_tick, time_scale, fixed_frame_rate_flag uint
+		if num_units_in_tick, err = r.ReadBits(32); err != nil {
+			return
+		}
+		if time_scale, err = r.ReadBits(32); err != nil {
+			return
+		}
+		if fixed_frame_rate_flag, err = r.ReadBit(); err != nil {
+			return
+		}
+		self.NumUnitsInTick = num_units_in_tick
+		self.TimeScale = time_scale
+		self.FixedFrameRate = fixed_frame_rate_flag != 0
+	}
+
 	return
 }
 
@@ -0,0 +1,453 @@
+package h265parser
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/utils/bits"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+const (
+	NALU_IDR_W_RADL = 19
+	NALU_IDR_N_LP   = 20
+	NALU_CRA        = 21
+	NALU_VPS        = 32
+	NALU_SPS        = 33
+	NALU_PPS        = 34
+	NALU_AUD        = 35
+	NALU_SEI_PREFIX = 39
+	NALU_SEI_SUFFIX = 40
+)
+
+var StartCodeBytes = []byte{0, 0, 1}
+var AUDBytes = []byte{0, 0, 0, 1, 0x46, 0x01, 0x50, 0, 0, 0, 1} // AUD
+
+// NALUType returns nal_unit_type from the 2 bytes NAL unit header.
+func NALUType(b []byte) int {
+	return int(b[0]>>1) & 0x3f
+}
+
+// IsDataNALU reports whether b is a VCL NAL unit.
+func IsDataNALU(b []byte) bool {
+	return NALUType(b) < 32
+}
+
+// IsKeyFrameNALU reports whether b is a slice of an IRAP picture.
+func IsKeyFrameNALU(b []byte) bool {
+	typ := NALUType(b)
+	return typ >= 16 && typ <= 23
+}
+
+// unescapeRBSP removes emulation_prevention_three_byte.
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+type SPSInfo struct {
+	ProfileSpace         uint
+	TierFlag             uint
+	ProfileIdc           uint
+	ProfileCompatibility uint32
+	ConstraintIndicator  uint64 // 48 bits
+	LevelIdc             uint
+
+	ChromaFormatIdc      uint
+	BitDepthLumaMinus8   uint
+	BitDepthChromaMinus8 uint
+
+	Width  uint
+	Height uint
+}
+
+func ParseSPS(data []byte) (self SPSInfo, err error) {
+	rbsp := unescapeRBSP(data)
+	if len(rbsp) < 15 {
+		err = fmt.Errorf("h265parser: SPS too short")
+		return
+	}
+	r := &bits.GolombBitReader{R: bytes.NewReader(rbsp)}
+
+	// nal_unit_header(16)
+	if _, err = r.ReadBits(16); err != nil {
+		return
+	}
+	// sps_video_parameter_set_id(4)
+	if _, err = r.ReadBits(4); err != nil {
+		return
+	}
+	var maxsublayersminus1 uint
+	if maxsublayersminus1, err = r.ReadBits(3); err != nil {
+		return
+	}
+	// sps_temporal_id_nesting_flag
+	if _, err = r.ReadBit(); err != nil {
+		return
+	}
+
+	// profile_tier_level
+	if self.ProfileSpace, err = r.ReadBits(2); err != nil {
+		return
+	}
+	if self.TierFlag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if self.ProfileIdc, err = r.ReadBits(5); err != nil {
+		return
+	}
+	var v uint
+	if v, err = r.ReadBits(32); err != nil {
+		return
+	}
+	self.ProfileCompatibility = uint32(v)
+	if v, err = r.ReadBits(16); err != nil {
+		return
+	}
+	self.ConstraintIndicator = uint64(v) << 32
+	if v, err = r.ReadBits(32); err != nil {
+		return
+	}
+	self.ConstraintIndicator |= uint64(v)
+	if self.LevelIdc, err = r.ReadBits(8); err != nil {
+		return
+	}
+
+	var profilepresent, levelpresent [8]uint
+	for i := uint(0); i < maxsublayersminus1; i++ {
+		if profilepresent[i], err = r.ReadBit(); err != nil {
+			return
+		}
+		if levelpresent[i], err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	if maxsublayersminus1 > 0 {
+		// reserved_zero_2bits
+		if _, err = r.ReadBits(int(8-maxsublayersminus1) * 2); err != nil {
+			return
+		}
+	}
+	for i := uint(0); i < maxsublayersminus1; i++ {
+		if profilepresent[i] != 0 {
+			// sub_layer profile_space ... sub_layer_reserved_zero_43bits/inbld_flag
+			for _, n := range []int{32, 32, 24} {
+				if _, err = r.ReadBits(n); err != nil {
+					return
+				}
+			}
+		}
+		if levelpresent[i] != 0 {
+			// sub_layer_level_idc
+			if _, err = r.ReadBits(8); err != nil {
+				return
+			}
+		}
+	}
+
+	// sps_seq_parameter_set_id
+	if _, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.ChromaFormatIdc, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.ChromaFormatIdc == 3 {
+		// separate_colour_plane_flag
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+
+	var width, height uint
+	if width, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if height, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+
+	var conformance_window_flag uint
+	if conformance_window_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if conformance_window_flag != 0 {
+		var left, right, top, bottom uint
+		if left, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if right, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if top, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if bottom, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		subwidth, subheight := uint(1), uint(1)
+		switch self.ChromaFormatIdc {
+		case 1:
+			subwidth, subheight = 2, 2
+		case 2:
+			subwidth = 2
+		}
+		width -= subwidth * (left + right)
+		height -= subheight * (top + bottom)
+	}
+	self.Width = width
+	self.Height = height
+
+	if self.BitDepthLumaMinus8, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.BitDepthChromaMinus8, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	return
+}
+
+type CodecData struct {
+	Record     []byte
+	RecordInfo HEVCDecoderConfRecord
+	SPSInfo    SPSInfo
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.H265
+}
+
+func (self CodecData) HEVCDecoderConfRecordBytes() []byte {
+	return self.Record
+}
+
+func (self CodecData) VPS() []byte {
+	return self.RecordInfo.VPS[0]
+}
+
+func (self CodecData) SPS() []byte {
+	return self.RecordInfo.SPS[0]
+}
+
+func (self CodecData) PPS() []byte {
+	return self.RecordInfo.PPS[0]
+}
+
+func (self CodecData) Width() int {
+	return int(self.SPSInfo.Width)
+}
+
+func (self CodecData) Height() int {
+	return int(self.SPSInfo.Height)
+}
+
+func NewCodecDataFromHEVCDecoderConfRecord(record []byte) (self CodecData, err error) {
+	self.Record = record
+	if _, err = (&self.RecordInfo).Unmarshal(record); err != nil {
+		return
+	}
+	if len(self.RecordInfo.VPS) == 0 {
+		err = fmt.Errorf("h265parser: no VPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if len(self.RecordInfo.SPS) == 0 {
+		err = fmt.Errorf("h265parser: no SPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if len(self.RecordInfo.PPS) == 0 {
+		err = fmt.Errorf("h265parser: no PPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if self.SPSInfo, err = ParseSPS(self.RecordInfo.SPS[0]); err != nil {
+		err = fmt.Errorf("h265parser: parse SPS failed(%s)", err)
+		return
+	}
+	return
+}
+
+func NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps []byte) (self CodecData, err error) {
+	if self.SPSInfo, err = ParseSPS(sps); err != nil {
+		return
+	}
+	info := self.SPSInfo
+
+	recordinfo := HEVCDecoderConfRecord{}
+	recordinfo.GeneralProfileSpace = uint8(info.ProfileSpace)
+	recordinfo.GeneralTierFlag = uint8(info.TierFlag)
+	recordinfo.GeneralProfileIdc = uint8(info.ProfileIdc)
+	recordinfo.GeneralProfileCompatibility = info.ProfileCompatibility
+	recordinfo.GeneralConstraintIndicator = info.ConstraintIndicator
+	recordinfo.GeneralLevelIdc = uint8(info.LevelIdc)
+	recordinfo.ChromaFormat = uint8(info.ChromaFormatIdc)
+	recordinfo.BitDepthLumaMinus8 = uint8(info.BitDepthLumaMinus8)
+	recordinfo.BitDepthChromaMinus8 = uint8(info.BitDepthChromaMinus8)
+	recordinfo.NumTemporalLayers = 1
+	recordinfo.LengthSizeMinusOne = 3
+	recordinfo.VPS = [][]byte{vps}
+	recordinfo.SPS = [][]byte{sps}
+	recordinfo.PPS = [][]byte{pps}
+
+	buf := make([]byte, recordinfo.Len())
+	recordinfo.Marshal(buf)
+
+	self.RecordInfo = recordinfo
+	self.Record = buf
+	return
+}
+
+// HEVCDecoderConfRecord is HEVCDecoderConfigurationRecord of ISO/IEC 14496-15.
+type HEVCDecoderConfRecord struct {
+	GeneralProfileSpace         uint8
+	GeneralTierFlag             uint8
+	GeneralProfileIdc           uint8
+	GeneralProfileCompatibility uint32
+	GeneralConstraintIndicator  uint64
+	GeneralLevelIdc             uint8
+	MinSpatialSegmentationIdc   uint16
+	ParallelismType             uint8
+	ChromaFormat                uint8
+	BitDepthLumaMinus8          uint8
+	BitDepthChromaMinus8        uint8
+	AvgFrameRate                uint16
+	ConstantFrameRate           uint8
+	NumTemporalLayers           uint8
+	TemporalIdNested            uint8
+	LengthSizeMinusOne          uint8
+	VPS                         [][]byte
+	SPS                         [][]byte
+	PPS                         [][]byte
+}
+
+var ErrDecconfInvalid = fmt.Errorf("h265parser: HEVCDecoderConfRecord invalid")
+
+func (self *HEVCDecoderConfRecord) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 23 {
+		err = ErrDecconfInvalid
+		return
+	}
+
+	self.GeneralProfileSpace = b[1] >> 6
+	self.GeneralTierFlag = (b[1] >> 5) & 1
+	self.GeneralProfileIdc = b[1] & 0x1f
+	self.GeneralProfileCompatibility = pio.U32BE(b[2:])
+	self.GeneralConstraintIndicator = uint64(pio.U16BE(b[6:]))<<32 | uint64(pio.U32BE(b[8:]))
+	self.GeneralLevelIdc = b[12]
+	self.MinSpatialSegmentationIdc = pio.U16BE(b[13:]) & 0xfff
+	self.ParallelismType = b[15] & 3
+	self.ChromaFormat = b[16] & 3
+	self.BitDepthLumaMinus8 = b[17] & 7
+	self.BitDepthChromaMinus8 = b[18] & 7
+	self.AvgFrameRate = pio.U16BE(b[19:])
+	self.ConstantFrameRate = b[21] >> 6
+	self.NumTemporalLayers = (b[21] >> 3) & 7
+	self.TemporalIdNested = (b[21] >> 2) & 1
+	self.LengthSizeMinusOne = b[21] & 3
+	numarrays := int(b[22])
+	n += 23
+
+	for i := 0; i < numarrays; i++ {
+		if len(b) < n+3 {
+			err = ErrDecconfInvalid
+			return
+		}
+		typ := int(b[n] & 0x3f)
+		count := int(pio.U16BE(b[n+1:]))
+		n += 3
+
+		for j := 0; j < count; j++ {
+			if len(b) < n+2 {
+				err = ErrDecconfInvalid
+				return
+			}
+			size := int(pio.U16BE(b[n:]))
+			n += 2
+			if len(b) < n+size {
+				err = ErrDecconfInvalid
+				return
+			}
+			nalu := b[n : n+size]
+			n += size
+
+			switch typ {
+			case NALU_VPS:
+				self.VPS = append(self.VPS, nalu)
+			case NALU_SPS:
+				self.SPS = append(self.SPS, nalu)
+			case NALU_PPS:
+				self.PPS = append(self.PPS, nalu)
+			}
+		}
+	}
+
+	return
+}
+
+func (self HEVCDecoderConfRecord) arrays() [][][]byte {
+	return [][][]byte{self.VPS, self.SPS, self.PPS}
+}
+
+func (self HEVCDecoderConfRecord) Len() (n int) {
+	n = 23
+	for _, nalus := range self.arrays() {
+		if len(nalus) == 0 {
+			continue
+		}
+		n += 3
+		for _, nalu := range nalus {
+			n += 2 + len(nalu)
+		}
+	}
+	return
+}
+
+func (self HEVCDecoderConfRecord) Marshal(b []byte) (n int) {
+	b[0] = 1
+	b[1] = self.GeneralProfileSpace<<6 | (self.GeneralTierFlag&1)<<5 | self.GeneralProfileIdc&0x1f
+	pio.PutU32BE(b[2:], self.GeneralProfileCompatibility)
+	pio.PutU16BE(b[6:], uint16(self.GeneralConstraintIndicator>>32))
+	pio.PutU32BE(b[8:], uint32(self.GeneralConstraintIndicator))
+	b[12] = self.GeneralLevelIdc
+	pio.PutU16BE(b[13:], 0xf000|self.MinSpatialSegmentationIdc&0xfff)
+	b[15] = 0xfc | self.ParallelismType&3
+	b[16] = 0xfc | self.ChromaFormat&3
+	b[17] = 0xf8 | self.BitDepthLumaMinus8&7
+	b[18] = 0xf8 | self.BitDepthChromaMinus8&7
+	pio.PutU16BE(b[19:], self.AvgFrameRate)
+	b[21] = self.ConstantFrameRate<<6 | (self.NumTemporalLayers&7)<<3 | (self.TemporalIdNested&1)<<2 | self.LengthSizeMinusOne&3
+	n += 23
+
+	types := []uint8{NALU_VPS, NALU_SPS, NALU_PPS}
+	numarrays := 0
+	for i, nalus := range self.arrays() {
+		if len(nalus) == 0 {
+			continue
+		}
+		numarrays++
+		// array_completeness(1)=1 reserved(1)=0 NAL_unit_type(6)
+		b[n] = 0x80 | types[i]
+		pio.PutU16BE(b[n+1:], uint16(len(nalus)))
+		n += 3
+		for _, nalu := range nalus {
+			pio.PutU16BE(b[n:], uint16(len(nalu)))
+			n += 2
+			n += copy(b[n:], nalu)
+		}
+	}
+	b[22] = uint8(numarrays)
+
+	return
+}
@@ -0,0 +1,209 @@
+package dash
+
+import (
+	"fmt"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/mp4/mp4io"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+const (
+	sampleFlagsKeyFrame    = 0x02000000 // sample_depends_on=2
+	sampleFlagsNonKeyFrame = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+type sample struct {
+	data       []byte
+	duration   uint32
+	cts        uint32
+	iskeyframe bool
+}
+
+func fileTypeAtom(tag string, major string, compatible ...string) []byte {
+	b := make([]byte, 16+4*len(compatible))
+	pio.PutU32BE(b[0:], uint32(len(b)))
+	copy(b[4:], tag)
+	copy(b[8:], major)
+	n := 16
+	for _, brand := range compatible {
+		copy(b[n:], brand)
+		n += 4
+	}
+	return b
+}
+
+func newTrackAtom(codec av.CodecData, trackid int, timescale int) (track *mp4io.Track, err error) {
+	sample := &mp4io.SampleTable{
+		SampleDesc:    &mp4io.SampleDesc{},
+		TimeToSample:  &mp4io.TimeToSample{},
+		SampleToChunk: &mp4io.SampleToChunk{},
+		SampleSize:    &mp4io.SampleSize{},
+		ChunkOffset:   &mp4io.ChunkOffset{},
+	}
+
+	track = &mp4io.Track{
+		Header: &mp4io.TrackHeader{
+			TrackId: int32(trackid),
+			Flags:   0x0003, // Track enabled | Track in movie
+			Matrix:  [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+		},
+		Media: &mp4io.Media{
+			Header: &mp4io.MediaHeader{
+				TimeScale: int32(timescale),
+				Language:  21956,
+			},
+			Info: &mp4io.MediaInfo{
+				Sample: sample,
+				Data: &mp4io.DataInfo{
+					Refer: &mp4io.DataRefer{
+						Url: &mp4io.DataReferUrl{
+							Flags: 0x000001, // Self reference
+						},
+					},
+				},
+			},
+		},
+	}
+
+	switch codec.Type() {
+	case av.H264:
+		codec := codec.(h264parser.CodecData)
+		width, height := codec.Width(), codec.Height()
+		sample.SampleDesc.AVC1Desc = &mp4io.AVC1Desc{
+			DataRefIdx:           1,
+			HorizontalResolution: 72,
+			VorizontalResolution: 72,
+			Width:                int16(width),
+			Height:               int16(height),
+			FrameCount:           1,
+			Depth:                24,
+			ColorTableId:         -1,
+			Conf:                 &mp4io.AVC1Conf{Data: codec.AVCDecoderConfRecordBytes()},
+		}
+		track.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'v', 'i', 'd', 'e'},
+			Name:    []byte("Video Media Handler"),
+		}
+		track.Media.Info.Video = &mp4io.VideoMediaInfo{
+			Flags: 0x000001,
+		}
+		track.Header.TrackWidth = float64(width)
+		track.Header.TrackHeight = float64(height)
+
+	case av.AAC:
+		codec := codec.(aacparser.CodecData)
+		sample.SampleDesc.MP4ADesc = &mp4io.MP4ADesc{
+			DataRefIdx:       1,
+			NumberOfChannels: int16(codec.ChannelLayout().Count()),
+			SampleSize:       16,
+			SampleRate:       float64(codec.SampleRate()),
+			Conf: &mp4io.ElemStreamDesc{
+				DecConfig: codec.MPEG4AudioConfigBytes(),
+			},
+		}
+		track.Header.Volume = 1
+		track.Header.AlternateGroup = 1
+		track.Media.Handler = &mp4io.HandlerRefer{
+			SubType: [4]byte{'s', 'o', 'u', 'n'},
+			Name:    []byte("Sound Handler"),
+		}
+		track.Media.Info.Sound = &mp4io.SoundMediaInfo{}
+
+	default:
+		err = fmt.Errorf("dash: codec type=%v is not supported", codec.Type())
+	}
+	return
+}
+
+// initSegment returns ftyp and a moov with an empty sample table and mvex,
+// describing a single track with id 1.
+func initSegment(codec av.CodecData, timescale int) (b []byte, err error) {
+	var track *mp4io.Track
+	if track, err = newTrackAtom(codec, 1, timescale); err != nil {
+		return
+	}
+
+	moov := &mp4io.Movie{
+		Header: &mp4io.MovieHeader{
+			TimeScale:       1000,
+			PreferredRate:   1,
+			PreferredVolume: 1,
+			Matrix:          [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+			NextTrackId:     2,
+		},
+		MovieExtend: &mp4io.MovieExtend{
+			Tracks: []*mp4io.TrackExtend{
+				{
+					TrackId:              1,
+					DefaultSampleDescIdx: 1,
+				},
+			},
+		},
+		Tracks: []*mp4io.Track{track},
+	}
+
+	ftyp := fileTypeAtom("ftyp", "iso6", "iso6", "dash", "mp41")
+	b = make([]byte, len(ftyp)+moov.Len())
+	copy(b, ftyp)
+	moov.Marshal(b[len(ftyp):])
+	return
+}
+
+// mediaSegment returns styp, moof and mdat holding samples of track 1 that
+// start at decodetime.
+func mediaSegment(seqnum int, decodetime uint64, samples []sample) []byte {
+	run := &mp4io.TrackFragRun{
+		Flags: mp4io.TRUN_DATA_OFFSET | mp4io.TRUN_SAMPLE_DURATION | mp4io.TRUN_SAMPLE_SIZE | mp4io.TRUN_SAMPLE_FLAGS | mp4io.TRUN_SAMPLE_CTS,
+	}
+	mdatsize := 8
+	for _, s := range samples {
+		entry := mp4io.TrackFragRunEntry{
+			Duration: s.duration,
+			Size:     uint32(len(s.data)),
+			Cts:      s.cts,
+		}
+		if s.iskeyframe {
+			entry.Flags = sampleFlagsKeyFrame
+		} else {
+			entry.Flags = sampleFlagsNonKeyFrame
+		}
+		run.Entries = append(run.Entries, entry)
+		mdatsize += len(s.data)
+	}
+
+	moof := &mp4io.MovieFrag{
+		Header: &mp4io.MovieFragHeader{
+			Seqnum: uint32(seqnum),
+		},
+		Tracks: []*mp4io.TrackFrag{
+			{
+				Header: &mp4io.TrackFragHeader{
+					Flags:   mp4io.TFHD_DEFAULT_BASE_IS_MOOF,
+					TrackId: 1,
+				},
+				DecodeTime: &mp4io.TrackFragDecodeTime{
+					Version:    1,
+					DecodeTime: decodetime,
+				},
+				Run: run,
+			},
+		},
+	}
+	// sample data starts right after the mdat header
+	run.DataOffset = uint32(moof.Len() + 8)
+
+	styp := fileTypeAtom("styp", "msdh", "msdh", "msix")
+	b := make([]byte, len(styp)+moof.Len()+mdatsize)
+	n := copy(b, styp)
+	n += moof.Marshal(b[n:])
+	pio.PutU32BE(b[n:], uint32(mdatsize))
+	pio.PutU32BE(b[n+4:], uint32(mp4io.MDAT))
+	n += 8
+	for _, s := range samples {
+		n += copy(b[n:], s.data)
+	}
+	return b
+}
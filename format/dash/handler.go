@@ -0,0 +1,36 @@
+package dash
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/format/hls"
+)
+
+var CodecTypes = []av.CodecType{av.H264, av.AAC}
+
+type closeMuxer struct {
+	*Muxer
+}
+
+func (self closeMuxer) Close() error {
+	return nil
+}
+
+func Handler(h *avutil.RegisterHandler) {
+	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
+		if !strings.HasSuffix(uri, ".mpd") || strings.Contains(uri, "://") {
+			return
+		}
+		ok = true
+		dir, name := filepath.Split(uri)
+		m := NewMuxer(hls.NewDirStorage(dir))
+		m.ManifestName = name
+		muxer = closeMuxer{Muxer: m}
+		return
+	}
+
+	h.CodecTypes = CodecTypes
+}
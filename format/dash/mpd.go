@@ -0,0 +1,110 @@
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// TimelineEntry is a S element of SegmentTimeline, Repeat counts the
+// following segments having the same duration.
+type TimelineEntry struct {
+	Time     uint64
+	Duration uint64
+	Repeat   int
+}
+
+// Representation is a single stream in the MPD addressed by a SegmentTemplate.
+type Representation struct {
+	Id                string
+	Codecs            string
+	Bandwidth         int
+	Width             int
+	Height            int
+	AudioSamplingRate int
+
+	Timescale      int
+	Initialization string
+	Media          string
+	StartNumber    int
+	Timeline       []TimelineEntry
+}
+
+type AdaptationSet struct {
+	ContentType     string
+	MimeType        string
+	Representations []Representation
+}
+
+// MPD is a DASH media presentation description with a single period.
+type MPD struct {
+	Dynamic                   bool
+	AvailabilityStartTime     time.Time
+	PublishTime               time.Time
+	MediaPresentationDuration time.Duration
+	MinimumUpdatePeriod       time.Duration
+	MinBufferTime             time.Duration
+	TimeShiftBufferDepth      time.Duration
+	AdaptationSets            []AdaptationSet
+}
+
+func xsDuration(dur time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", float64(dur)/float64(time.Second))
+}
+
+func xsDateTime(tm time.Time) string {
+	return tm.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (self MPD) Marshal() []byte {
+	b := &bytes.Buffer{}
+
+	fmt.Fprintf(b, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	fmt.Fprintf(b, "<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\"")
+	if self.Dynamic {
+		fmt.Fprintf(b, " profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"dynamic\"")
+		fmt.Fprintf(b, " availabilityStartTime=\"%s\"", xsDateTime(self.AvailabilityStartTime))
+		fmt.Fprintf(b, " publishTime=\"%s\"", xsDateTime(self.PublishTime))
+		fmt.Fprintf(b, " minimumUpdatePeriod=\"%s\"", xsDuration(self.MinimumUpdatePeriod))
+		if self.TimeShiftBufferDepth != 0 {
+			fmt.Fprintf(b, " timeShiftBufferDepth=\"%s\"", xsDuration(self.TimeShiftBufferDepth))
+		}
+	} else {
+		fmt.Fprintf(b, " profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"static\"")
+		fmt.Fprintf(b, " mediaPresentationDuration=\"%s\"", xsDuration(self.MediaPresentationDuration))
+	}
+	fmt.Fprintf(b, " minBufferTime=\"%s\">\n", xsDuration(self.MinBufferTime))
+
+	fmt.Fprintf(b, "  <Period id=\"0\" start=\"PT0S\">\n")
+	for i, set := range self.AdaptationSets {
+		fmt.Fprintf(b, "    <AdaptationSet id=\"%d\" contentType=\"%s\" mimeType=\"%s\" segmentAlignment=\"true\">\n",
+			i, set.ContentType, set.MimeType)
+		for _, rep := range set.Representations {
+			fmt.Fprintf(b, "      <Representation id=\"%s\" codecs=\"%s\" bandwidth=\"%d\"", rep.Id, rep.Codecs, rep.Bandwidth)
+			if rep.Width != 0 {
+				fmt.Fprintf(b, " width=\"%d\" height=\"%d\"", rep.Width, rep.Height)
+			}
+			if rep.AudioSamplingRate != 0 {
+				fmt.Fprintf(b, " audioSamplingRate=\"%d\"", rep.AudioSamplingRate)
+			}
+			fmt.Fprintf(b, ">\n")
+			fmt.Fprintf(b, "        <SegmentTemplate timescale=\"%d\" initialization=\"%s\" media=\"%s\" startNumber=\"%d\">\n",
+				rep.Timescale, rep.Initialization, rep.Media, rep.StartNumber)
+			fmt.Fprintf(b, "          <SegmentTimeline>\n")
+			for _, s := range rep.Timeline {
+				if s.Repeat != 0 {
+					fmt.Fprintf(b, "            <S t=\"%d\" d=\"%d\" r=\"%d\"/>\n", s.Time, s.Duration, s.Repeat)
+				} else {
+					fmt.Fprintf(b, "            <S t=\"%d\" d=\"%d\"/>\n", s.Time, s.Duration)
+				}
+			}
+			fmt.Fprintf(b, "          </SegmentTimeline>\n")
+			fmt.Fprintf(b, "        </SegmentTemplate>\n")
+			fmt.Fprintf(b, "      </Representation>\n")
+		}
+		fmt.Fprintf(b, "    </AdaptationSet>\n")
+	}
+	fmt.Fprintf(b, "  </Period>\n")
+	fmt.Fprintf(b, "</MPD>\n")
+	return b.Bytes()
+}
@@ -0,0 +1,336 @@
+package dash
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+const (
+	initTemplate  = "init-$RepresentationID$.mp4"
+	mediaTemplate = "chunk-$RepresentationID$-$Number$.m4s"
+)
+
+// Storage is where Muxer puts segments and the manifest, hls.DirStorage
+// can be used to write into a local directory.
+type Storage interface {
+	Create(name string) (io.WriteCloser, error)
+	Remove(name string) error
+}
+
+type segmentInfo struct {
+	number   int
+	time     uint64
+	duration uint64
+	uri      string
+}
+
+type Stream struct {
+	av.CodecData
+
+	id        string
+	timescale int64
+
+	pending    *av.Packet
+	samples    []sample
+	decodetime uint64
+
+	number   int // of the next segment
+	segments []segmentInfo
+	removed  []string
+	bytes    int64
+	duration uint64
+}
+
+func (self *Stream) timeToTs(tm time.Duration) int64 {
+	return int64(tm * time.Duration(self.timescale) / time.Second)
+}
+
+func (self *Stream) tsToTime(ts uint64) time.Duration {
+	return time.Duration(ts) * time.Second / time.Duration(self.timescale)
+}
+
+func (self *Stream) segmentName(number int) string {
+	return fmt.Sprintf("chunk-%s-%d.m4s", self.id, number)
+}
+
+func (self *Stream) codecs() string {
+	switch codec := self.CodecData.(type) {
+	case h264parser.CodecData:
+		sps := codec.SPS()
+		if len(sps) >= 4 {
+			return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+		}
+		return "avc1"
+	case aacparser.CodecData:
+		return fmt.Sprintf("mp4a.40.%d", codec.Config.ObjectType)
+	}
+	return ""
+}
+
+// Muxer writes a fragmented MP4 init segment and media segments for each
+// stream and keeps an MPD using SegmentTemplate with SegmentTimeline.
+type Muxer struct {
+	SegmentDuration time.Duration // minimum segment duration, default 4s
+	Dynamic         bool          // write a live (type="dynamic") MPD
+	WindowSize      int           // segments kept in a dynamic MPD, 0 keeps all
+	DeleteSegments  bool          // remove segments that left the MPD from storage
+	MinBufferTime   time.Duration // default 2s
+	ManifestName    string        // default manifest.mpd
+
+	storage  Storage
+	streams  []*Stream
+	hasvideo bool
+
+	gotpkt    bool
+	basetime  time.Duration
+	segstart  time.Duration
+	starttime time.Time
+}
+
+func NewMuxer(storage Storage) *Muxer {
+	return &Muxer{
+		SegmentDuration: time.Second * 4,
+		MinBufferTime:   time.Second * 2,
+		ManifestName:    "manifest.mpd",
+		storage:         storage,
+	}
+}
+
+func (self *Muxer) writeFile(name string, data []byte) (err error) {
+	var w io.WriteCloser
+	if w, err = self.storage.Create(name); err != nil {
+		return
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return
+	}
+	return w.Close()
+}
+
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	self.streams = []*Stream{}
+	for i, codec := range streams {
+		stream := &Stream{
+			CodecData: codec,
+			id:        strconv.Itoa(i),
+			number:    1,
+		}
+		if codec.Type().IsVideo() {
+			self.hasvideo = true
+			stream.timescale = 90000
+		} else if acodec, ok := codec.(av.AudioCodecData); ok {
+			stream.timescale = int64(acodec.SampleRate())
+		}
+		if stream.timescale == 0 {
+			stream.timescale = 90000
+		}
+
+		var init []byte
+		if init, err = initSegment(codec, int(stream.timescale)); err != nil {
+			return
+		}
+		if err = self.writeFile(fmt.Sprintf("init-%s.mp4", stream.id), init); err != nil {
+			return
+		}
+		self.streams = append(self.streams, stream)
+	}
+	return
+}
+
+func (self *Muxer) appendSample(stream *Stream, pkt av.Packet, next time.Duration) (err error) {
+	if next < pkt.Time {
+		err = fmt.Errorf("dash: stream#%d time=%v < lasttime=%v", pkt.Idx, next, pkt.Time)
+		return
+	}
+	dts := stream.timeToTs(pkt.Time - self.basetime)
+	nextdts := stream.timeToTs(next - self.basetime)
+	if len(stream.samples) == 0 {
+		stream.decodetime = uint64(dts)
+	}
+	stream.samples = append(stream.samples, sample{
+		data:       pkt.Data,
+		duration:   uint32(nextdts - dts),
+		cts:        uint32(stream.timeToTs(pkt.CompositionTime)),
+		iskeyframe: pkt.IsKeyFrame || !stream.Type().IsVideo(),
+	})
+	return
+}
+
+func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	stream := self.streams[pkt.Idx]
+
+	if !self.gotpkt {
+		self.basetime = pkt.Time
+		self.segstart = pkt.Time
+		self.starttime = time.Now()
+		self.gotpkt = true
+	}
+	if pkt.Time < self.basetime {
+		err = fmt.Errorf("dash: stream#%d time=%v before start time=%v", pkt.Idx, pkt.Time, self.basetime)
+		return
+	}
+
+	if stream.pending != nil {
+		if err = self.appendSample(stream, *stream.pending, pkt.Time); err != nil {
+			return
+		}
+		stream.pending = nil
+	}
+
+	if !self.hasvideo || (stream.Type().IsVideo() && pkt.IsKeyFrame) {
+		if pkt.Time-self.segstart >= self.SegmentDuration {
+			if err = self.flushSegment(); err != nil {
+				return
+			}
+			self.segstart = pkt.Time
+		}
+	}
+
+	stream.pending = &pkt
+	return
+}
+
+func (self *Muxer) flushSegment() (err error) {
+	for _, stream := range self.streams {
+		if len(stream.samples) == 0 {
+			continue
+		}
+		seg := segmentInfo{
+			number: stream.number,
+			time:   stream.decodetime,
+			uri:    stream.segmentName(stream.number),
+		}
+		for _, s := range stream.samples {
+			seg.duration += uint64(s.duration)
+		}
+		data := mediaSegment(stream.number, stream.decodetime, stream.samples)
+		if err = self.writeFile(seg.uri, data); err != nil {
+			return
+		}
+		stream.samples = nil
+		stream.bytes += int64(len(data))
+		stream.duration += seg.duration
+		stream.segments = append(stream.segments, seg)
+		stream.number++
+
+		if self.Dynamic && self.WindowSize > 0 {
+			for len(stream.segments) > self.WindowSize {
+				stream.removed = append(stream.removed, stream.segments[0].uri)
+				stream.segments = stream.segments[1:]
+			}
+		}
+	}
+	if err = self.writeManifest(self.Dynamic); err != nil {
+		return
+	}
+
+	// removed segments stay for one more window
+	if self.DeleteSegments {
+		for _, stream := range self.streams {
+			for len(stream.removed) > self.WindowSize {
+				if err = self.storage.Remove(stream.removed[0]); err != nil {
+					return
+				}
+				stream.removed = stream.removed[1:]
+			}
+		}
+	}
+	return
+}
+
+func (self *Muxer) writeManifest(dynamic bool) (err error) {
+	mpd := MPD{
+		Dynamic:       dynamic,
+		MinBufferTime: self.MinBufferTime,
+	}
+	if dynamic {
+		mpd.AvailabilityStartTime = self.starttime
+		mpd.PublishTime = time.Now()
+		mpd.MinimumUpdatePeriod = self.SegmentDuration
+		if self.WindowSize > 0 {
+			mpd.TimeShiftBufferDepth = self.SegmentDuration * time.Duration(self.WindowSize)
+		}
+	}
+
+	for _, stream := range self.streams {
+		rep := Representation{
+			Id:             stream.id,
+			Codecs:         stream.codecs(),
+			Timescale:      int(stream.timescale),
+			Initialization: initTemplate,
+			Media:          mediaTemplate,
+			StartNumber:    stream.number,
+		}
+		if dur := stream.tsToTime(stream.duration); dur > 0 {
+			rep.Bandwidth = int(float64(stream.bytes*8) / dur.Seconds())
+		}
+
+		for i, seg := range stream.segments {
+			if i == 0 {
+				rep.StartNumber = seg.number
+			}
+			n := len(rep.Timeline)
+			if n > 0 {
+				last := &rep.Timeline[n-1]
+				if last.Duration == seg.duration && last.Time+last.Duration*uint64(last.Repeat+1) == seg.time {
+					last.Repeat++
+					continue
+				}
+			}
+			rep.Timeline = append(rep.Timeline, TimelineEntry{Time: seg.time, Duration: seg.duration})
+		}
+		if n := len(stream.segments); n > 0 && !dynamic {
+			last := stream.segments[n-1]
+			if end := stream.tsToTime(last.time + last.duration); end > mpd.MediaPresentationDuration {
+				mpd.MediaPresentationDuration = end
+			}
+		}
+
+		set := AdaptationSet{Representations: []Representation{rep}}
+		if stream.Type().IsVideo() {
+			set.ContentType, set.MimeType = "video", "video/mp4"
+			if vcodec, ok := stream.CodecData.(av.VideoCodecData); ok {
+				set.Representations[0].Width = vcodec.Width()
+				set.Representations[0].Height = vcodec.Height()
+			}
+		} else {
+			set.ContentType, set.MimeType = "audio", "audio/mp4"
+			set.Representations[0].AudioSamplingRate = int(stream.timescale)
+		}
+		mpd.AdaptationSets = append(mpd.AdaptationSets, set)
+	}
+
+	return self.writeFile(self.ManifestName, mpd.Marshal())
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	for _, stream := range self.streams {
+		if stream.pending == nil {
+			continue
+		}
+		// the last packet gets the duration of the one before it
+		next := stream.pending.Time
+		if n := len(stream.samples); n > 0 {
+			next += stream.tsToTime(uint64(stream.samples[n-1].duration))
+		}
+		if err = self.appendSample(stream, *stream.pending, next); err != nil {
+			return
+		}
+		stream.pending = nil
+	}
+	if err = self.flushSegment(); err != nil {
+		return
+	}
+	// the presentation is complete, a static MPD lets players seek all of it
+	if err = self.writeManifest(false); err != nil {
+		return
+	}
+	return
+}
@@ -0,0 +1,143 @@
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+type memStorage map[string][]byte
+
+type memStorageFile struct {
+	bytes.Buffer
+	storage memStorage
+	name    string
+}
+
+func (self *memStorageFile) Close() error {
+	self.storage[self.name] = self.Bytes()
+	return nil
+}
+
+func (self memStorage) Create(name string) (io.WriteCloser, error) {
+	return &memStorageFile{storage: self, name: name}, nil
+}
+
+func (self memStorage) Remove(name string) error {
+	delete(self, name)
+	return nil
+}
+
+func testStreams(t *testing.T) []av.CodecData {
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+func TestMuxerSilentStream(t *testing.T) {
+	storage := memStorage{}
+	muxer := NewMuxer(storage)
+	muxer.SegmentDuration = time.Second
+	if err := muxer.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	// three 1s segments, the audio is silent during the second one
+	for i := 0; i < 75; i++ {
+		tm := time.Duration(i) * 40 * time.Millisecond
+		key := i%25 == 0
+		if err := muxer.WritePacket(av.Packet{Idx: 0, IsKeyFrame: key, Time: tm, Data: []byte{0, 0, 0, 1, 0x65}}); err != nil {
+			t.Fatal(err)
+		}
+		if tm < time.Second || tm >= 2*time.Second {
+			if err := muxer.WritePacket(av.Packet{Idx: 1, Time: tm, Data: make([]byte, 16)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"chunk-0-1.m4s", "chunk-0-2.m4s", "chunk-0-3.m4s", "chunk-1-1.m4s", "chunk-1-2.m4s"} {
+		if storage[name] == nil {
+			t.Errorf("missing %s", name)
+		}
+	}
+	if storage["chunk-1-3.m4s"] != nil {
+		t.Error("audio segment numbers have a gap")
+	}
+	mpd := string(storage["manifest.mpd"])
+	if strings.Count(mpd, `startNumber="1"`) != 2 {
+		t.Errorf("got manifest:\n%s", mpd)
+	}
+}
+
+func TestMuxerTimelineWindow(t *testing.T) {
+	storage := memStorage{}
+	muxer := NewMuxer(storage)
+	muxer.SegmentDuration = time.Second
+	muxer.Dynamic = true
+	muxer.WindowSize = 3
+	muxer.DeleteSegments = true
+	if err := muxer.WriteHeader(testStreams(t)[:1]); err != nil {
+		t.Fatal(err)
+	}
+	// 1s segments, the keyframe at 5s comes 400ms late and the one at 6s is
+	// too early to end a segment
+	writeVideo := func(from, to int) {
+		for i := from; i < to; i++ {
+			tm := time.Duration(i) * 40 * time.Millisecond
+			key := i%25 == 0 && i != 125 || i == 135
+			if err := muxer.WritePacket(av.Packet{IsKeyFrame: key, Time: tm, Data: []byte{0, 0, 0, 1, 0x65}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	writeVideo(0, 126)
+	mpd := string(storage["manifest.mpd"])
+	want := `startNumber="2">
+          <SegmentTimeline>
+            <S t="90000" d="90000" r="2"/>
+          </SegmentTimeline>`
+	if !strings.Contains(mpd, want) || !strings.Contains(mpd, `type="dynamic"`) {
+		t.Errorf("got manifest:\n%s", mpd)
+	}
+
+	writeVideo(126, 226)
+	mpd = string(storage["manifest.mpd"])
+	want = `startNumber="6">
+          <SegmentTimeline>
+            <S t="486000" d="144000"/>
+            <S t="630000" d="90000" r="1"/>
+          </SegmentTimeline>`
+	if !strings.Contains(mpd, want) {
+		t.Errorf("got manifest:\n%s", mpd)
+	}
+	// removed from the manifest, kept for one more window
+	for i := 1; i <= 8; i++ {
+		name := fmt.Sprintf("chunk-0-%d.m4s", i)
+		if (storage[name] != nil) != (i > 2) {
+			t.Errorf("%s kept %v", name, storage[name] != nil)
+		}
+	}
+}
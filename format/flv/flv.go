@@ -8,10 +8,13 @@ import (
 	"github.com/nareix/joy4/av/avutil"
 	"github.com/nareix/joy4/codec"
 	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/av1parser"
 	"github.com/nareix/joy4/codec/fake"
 	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
 	"github.com/nareix/joy4/format/flv/flvio"
 	"io"
+	"time"
 )
 
 var MaxProbePacketCount = 20
@@ -28,6 +31,9 @@ func NewMetadataByStreams(streams []av.CodecData) (metadata flvio.AMFMap, err er
 			case av.H264:
 				metadata["videocodecid"] = flvio.VIDEO_H264
 
+			case av.H265, av.AV1, av.VP9:
+				metadata["videocodecid"] = exVideoFourCC(typ)
+
 			default:
 				err = fmt.Errorf("flv: metadata: unsupported video codecType=%v", stream.Type())
 				return
@@ -47,6 +53,9 @@ func NewMetadataByStreams(streams []av.CodecData) (metadata flvio.AMFMap, err er
 			case av.SPEEX:
 				metadata["audiocodecid"] = flvio.SOUND_SPEEX
 
+			case av.OPUS:
+				metadata["audiocodecid"] = flvio.FOURCC_OPUS
+
 			default:
 				err = fmt.Errorf("flv: metadata: unsupported audio codecType=%v", stream.Type())
 				return
@@ -81,6 +90,10 @@ func (self *Prober) PushTag(tag flvio.Tag, timestamp int32) (err error) {
 		return
 	}
 
+	if tag.IsExHeader {
+		return self.pushExTag(tag, timestamp)
+	}
+
 	switch tag.Type {
 	case flvio.TAG_VIDEO:
 		switch tag.AVCPacketType {
@@ -149,6 +162,101 @@ func (self *Prober) PushTag(tag flvio.Tag, timestamp int32) (err error) {
 	return
 }
 
+func (self *Prober) addVideoStream(stream av.CodecData) {
+	self.VideoStreamIdx = len(self.Streams)
+	self.Streams = append(self.Streams, stream)
+	self.GotVideo = true
+}
+
+func (self *Prober) addAudioStream(stream av.CodecData) {
+	self.AudioStreamIdx = len(self.Streams)
+	self.Streams = append(self.Streams, stream)
+	self.GotAudio = true
+}
+
+// pushExTag handles Enhanced RTMP tags. VP9 has no frame size in its
+// sequence start so the stream is added at the first keyframe, Opus may
+// have no sequence start at all.
+func (self *Prober) pushExTag(tag flvio.Tag, timestamp int32) (err error) {
+	switch tag.Type {
+	case flvio.TAG_VIDEO:
+		switch tag.PacketType {
+		case flvio.PKTTYPE_SEQUENCE_START:
+			if self.GotVideo {
+				return
+			}
+			var stream av.CodecData
+			switch tag.FourCC {
+			case flvio.FOURCC_AVC1:
+				if stream, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(tag.Data); err != nil {
+					err = fmt.Errorf("flv: h264 seqhdr invalid")
+					return
+				}
+			case flvio.FOURCC_HVC1:
+				if stream, err = h265parser.NewCodecDataFromHEVCDecoderConfRecord(tag.Data); err != nil {
+					err = fmt.Errorf("flv: h265 seqhdr invalid")
+					return
+				}
+			case flvio.FOURCC_AV01:
+				if stream, err = av1parser.NewCodecDataFromAV1DecoderConfRecord(tag.Data); err != nil {
+					err = fmt.Errorf("flv: av1 seqhdr invalid")
+					return
+				}
+			default:
+				return
+			}
+			self.addVideoStream(stream)
+
+		case flvio.PKTTYPE_CODED_FRAMES, flvio.PKTTYPE_CODED_FRAMESX:
+			if !self.GotVideo && tag.FourCC == flvio.FOURCC_VP09 && tag.FrameType == flvio.FRAME_KEY {
+				var stream codec.VPXCodecData
+				if stream, err = codec.NewVP9CodecDataFromKeyFrame(tag.Data); err != nil {
+					err = fmt.Errorf("flv: vp9 keyframe invalid")
+					return
+				}
+				self.addVideoStream(stream)
+			}
+			if self.GotVideo {
+				self.CacheTag(tag, timestamp)
+			}
+		}
+
+	case flvio.TAG_AUDIO:
+		switch tag.PacketType {
+		case flvio.PKTTYPE_SEQUENCE_START:
+			if self.GotAudio {
+				return
+			}
+			var stream av.CodecData
+			switch tag.FourCC {
+			case flvio.FOURCC_MP4A:
+				if stream, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(tag.Data); err != nil {
+					err = fmt.Errorf("flv: aac seqhdr invalid")
+					return
+				}
+			case flvio.FOURCC_OPUS:
+				if stream, err = codec.NewOpusCodecDataFromHeader(tag.Data); err != nil {
+					err = fmt.Errorf("flv: opus seqhdr invalid")
+					return
+				}
+			default:
+				return
+			}
+			self.addAudioStream(stream)
+
+		case flvio.PKTTYPE_CODED_FRAMES:
+			if !self.GotAudio && tag.FourCC == flvio.FOURCC_OPUS {
+				self.addAudioStream(codec.NewOpusCodecData(48000, av.CH_STEREO))
+			}
+			if self.GotAudio {
+				self.CacheTag(tag, timestamp)
+			}
+		}
+	}
+
+	return
+}
+
 func (self *Prober) Probed() (ok bool) {
 	if self.HasAudio || self.HasVideo {
 		if self.HasAudio == self.GotAudio && self.HasVideo == self.GotVideo {
@@ -163,6 +271,10 @@ func (self *Prober) Probed() (ok bool) {
 }
 
 func (self *Prober) TagToPacket(tag flvio.Tag, timestamp int32) (pkt av.Packet, ok bool) {
+	if tag.IsExHeader {
+		return self.exTagToPacket(tag, timestamp)
+	}
+
 	switch tag.Type {
 	case flvio.TAG_VIDEO:
 		pkt.Idx = int8(self.VideoStreamIdx)
@@ -198,6 +310,31 @@ func (self *Prober) TagToPacket(tag flvio.Tag, timestamp int32) (pkt av.Packet,
 	return
 }
 
+func (self *Prober) exTagToPacket(tag flvio.Tag, timestamp int32) (pkt av.Packet, ok bool) {
+	switch tag.Type {
+	case flvio.TAG_VIDEO:
+		pkt.Idx = int8(self.VideoStreamIdx)
+		switch tag.PacketType {
+		case flvio.PKTTYPE_CODED_FRAMES, flvio.PKTTYPE_CODED_FRAMESX:
+			ok = true
+			pkt.Data = tag.Data
+			pkt.CompositionTime = flvio.TsToTime(tag.CompositionTime)
+			pkt.IsKeyFrame = tag.FrameType == flvio.FRAME_KEY
+		}
+
+	case flvio.TAG_AUDIO:
+		pkt.Idx = int8(self.AudioStreamIdx)
+		switch tag.PacketType {
+		case flvio.PKTTYPE_CODED_FRAMES:
+			ok = true
+			pkt.Data = tag.Data
+		}
+	}
+
+	pkt.Time = flvio.TsToTime(timestamp)
+	return
+}
+
 func (self *Prober) Empty() bool {
 	return len(self.CachedPkts) == 0
 }
@@ -208,6 +345,25 @@ func (self *Prober) PopPacket() av.Packet {
 	return pkt
 }
 
+// exVideoFourCC returns the FourCC of codecs only carried by Enhanced RTMP.
+func exVideoFourCC(typ av.CodecType) uint32 {
+	switch typ {
+	case av.H265:
+		return flvio.FOURCC_HVC1
+	case av.AV1:
+		return flvio.FOURCC_AV01
+	case av.VP9:
+		return flvio.FOURCC_VP09
+	}
+	return 0
+}
+
+// vp9Record returns a VPCodecConfigurationRecord with its version and flags
+// for 8 bits 4:2:0, the frames are all a VP9 decoder needs.
+func vp9Record() []byte {
+	return []byte{1, 0, 0, 0, 0, 0, 8<<4 | 1<<1, 2, 2, 2, 0, 0}
+}
+
 func CodecDataToTag(stream av.CodecData) (_tag flvio.Tag, ok bool, err error) {
 	switch stream.Type() {
 	case av.H264:
@@ -222,6 +378,38 @@ func CodecDataToTag(stream av.CodecData) (_tag flvio.Tag, ok bool, err error) {
 		ok = true
 		_tag = tag
 
+	case av.H265, av.AV1, av.VP9:
+		tag := flvio.Tag{
+			Type:       flvio.TAG_VIDEO,
+			IsExHeader: true,
+			PacketType: flvio.PKTTYPE_SEQUENCE_START,
+			FourCC:     exVideoFourCC(stream.Type()),
+			FrameType:  flvio.FRAME_KEY,
+		}
+		switch stream.Type() {
+		case av.H265:
+			tag.Data = stream.(h265parser.CodecData).HEVCDecoderConfRecordBytes()
+		case av.AV1:
+			tag.Data = stream.(av1parser.CodecData).AV1DecoderConfRecordBytes()
+		case av.VP9:
+			tag.Data = vp9Record()
+		}
+		ok = true
+		_tag = tag
+
+	case av.OPUS:
+		tag := flvio.Tag{
+			Type:       flvio.TAG_AUDIO,
+			IsExHeader: true,
+			PacketType: flvio.PKTTYPE_SEQUENCE_START,
+			FourCC:     flvio.FOURCC_OPUS,
+		}
+		if opus, isopus := stream.(codec.OpusCodecData); isopus {
+			tag.Data = opus.Header
+		}
+		ok = true
+		_tag = tag
+
 	case av.NELLYMOSER:
 	case av.SPEEX:
 
@@ -294,6 +482,33 @@ func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp i
 			tag.SoundType = flvio.SOUND_STEREO
 		}
 
+	case av.H265, av.AV1, av.VP9:
+		tag = flvio.Tag{
+			Type:            flvio.TAG_VIDEO,
+			IsExHeader:      true,
+			PacketType:      flvio.PKTTYPE_CODED_FRAMES,
+			FourCC:          exVideoFourCC(stream.Type()),
+			Data:            pkt.Data,
+			CompositionTime: flvio.TimeToTs(pkt.CompositionTime),
+		}
+		if stream.Type() == av.H265 && tag.CompositionTime == 0 {
+			tag.PacketType = flvio.PKTTYPE_CODED_FRAMESX
+		}
+		if pkt.IsKeyFrame {
+			tag.FrameType = flvio.FRAME_KEY
+		} else {
+			tag.FrameType = flvio.FRAME_INTER
+		}
+
+	case av.OPUS:
+		tag = flvio.Tag{
+			Type:       flvio.TAG_AUDIO,
+			IsExHeader: true,
+			PacketType: flvio.PKTTYPE_CODED_FRAMES,
+			FourCC:     flvio.FOURCC_OPUS,
+			Data:       pkt.Data,
+		}
+
 	case av.SPEEX:
 		tag = flvio.Tag{
 			Type:        flvio.TAG_AUDIO,
@@ -313,10 +528,32 @@ func PacketToTag(pkt av.Packet, stream av.CodecData) (tag flvio.Tag, timestamp i
 	return
 }
 
+// Muxer writes onMetaData before the streams. When the writer is an
+// io.WriteSeeker, duration, filesize and the keyframes index are filled in
+// by WriteTrailer.
 type Muxer struct {
+	// Keyframes is the number of keyframes index entries reserved in
+	// onMetaData, zero writes no index. Set it before WriteHeader. Longer
+	// files keep every other keyframe each time the index is full.
+	Keyframes int
+
 	bufw    writeFlusher
+	w       *countWriter
 	b       []byte
 	streams []av.CodecData
+
+	ws   io.WriteSeeker
+	base int64
+
+	metadata  flvio.AMFMap
+	metapos   int64
+	metalen   int
+	duration  time.Duration
+	lasttimes []time.Duration
+	gotstream []bool
+	keyframes []keyframe
+	kfcount   int
+	kfstep    int
 }
 
 type writeFlusher interface {
@@ -324,18 +561,44 @@ type writeFlusher interface {
 	Flush() error
 }
 
+type countWriter struct {
+	io.Writer
+	n int64
+}
+
+func (self *countWriter) Write(p []byte) (n int, err error) {
+	n, err = self.Writer.Write(p)
+	self.n += int64(n)
+	return
+}
+
 func NewMuxerWriteFlusher(w writeFlusher) *Muxer {
-	return &Muxer{
-		bufw: w,
-		b:    make([]byte, 256),
+	self := &Muxer{
+		bufw:   w,
+		w:      &countWriter{Writer: w},
+		b:      make([]byte, 256),
+		kfstep: 1,
 	}
+	self.setWriteSeeker(w)
+	return self
 }
 
 func NewMuxer(w io.Writer) *Muxer {
-	return NewMuxerWriteFlusher(bufio.NewWriterSize(w, pio.RecommendBufioSize))
+	self := NewMuxerWriteFlusher(bufio.NewWriterSize(w, pio.RecommendBufioSize))
+	self.setWriteSeeker(w)
+	return self
+}
+
+func (self *Muxer) setWriteSeeker(w io.Writer) {
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if pos, err := ws.Seek(0, 1); err == nil {
+			self.ws = ws
+			self.base = pos
+		}
+	}
 }
 
-var CodecTypes = []av.CodecType{av.H264, av.AAC, av.SPEEX}
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AV1, av.VP9, av.AAC, av.SPEEX, av.OPUS}
 
 func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	var flags uint8
@@ -348,7 +611,14 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	}
 
 	n := flvio.FillFileHeader(self.b, flags)
-	if _, err = self.bufw.Write(self.b[:n]); err != nil {
+	if _, err = self.w.Write(self.b[:n]); err != nil {
+		return
+	}
+
+	self.streams = streams
+	self.lasttimes = make([]time.Duration, len(streams))
+	self.gotstream = make([]bool, len(streams))
+	if err = self.writeMetadata(); err != nil {
 		return
 	}
 
@@ -359,13 +629,12 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 			return
 		}
 		if ok {
-			if err = flvio.WriteTag(self.bufw, tag, 0, self.b); err != nil {
+			if err = flvio.WriteTag(self.w, tag, 0, self.b); err != nil {
 				return
 			}
 		}
 	}
 
-	self.streams = streams
 	return
 }
 
@@ -373,7 +642,16 @@ func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 	stream := self.streams[pkt.Idx]
 	tag, timestamp := PacketToTag(pkt, stream)
 
-	if err = flvio.WriteTag(self.bufw, tag, timestamp, self.b); err != nil {
+	if end := pkt.Time + self.packetDuration(pkt, stream); end > self.duration {
+		self.duration = end
+	}
+	self.lasttimes[pkt.Idx] = pkt.Time
+	self.gotstream[pkt.Idx] = true
+	if pkt.IsKeyFrame && stream.Type().IsVideo() {
+		self.addKeyframe(flvio.TsToTime(timestamp), self.w.n)
+	}
+
+	if err = flvio.WriteTag(self.w, tag, timestamp, self.b); err != nil {
 		return
 	}
 	return
@@ -383,22 +661,44 @@ func (self *Muxer) WriteTrailer() (err error) {
 	if err = self.bufw.Flush(); err != nil {
 		return
 	}
+	if err = self.patchMetadata(); err != nil {
+		return
+	}
 	return
 }
 
+// Demuxer reads FLV. SeekToTime uses the keyframes index of onMetaData, or
+// scans the tags when there is none, it needs an io.ReadSeeker.
 type Demuxer struct {
 	prober *Prober
 	bufr   *bufio.Reader
 	b      []byte
 	stage  int
+
+	rs       io.ReadSeeker
+	base     int64
+	firsttag int64
+
+	metadata flvio.AMFMap
+	index    []keyframe
+	scanpos  int64
+	scantime time.Duration
+	scanned  bool
 }
 
 func NewDemuxer(r io.Reader) *Demuxer {
-	return &Demuxer{
+	self := &Demuxer{
 		bufr:   bufio.NewReaderSize(r, pio.RecommendBufioSize),
 		prober: &Prober{},
 		b:      make([]byte, 256),
 	}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if pos, err := rs.Seek(0, 1); err == nil {
+			self.rs = rs
+			self.base = pos
+		}
+	}
+	return self
 }
 
 func (self *Demuxer) prepare() (err error) {
@@ -416,6 +716,7 @@ func (self *Demuxer) prepare() (err error) {
 			if _, err = self.bufr.Discard(skip); err != nil {
 				return
 			}
+			self.firsttag = int64(flvio.FileHeaderLength + skip)
 			if flags&flvio.FILE_HAS_AUDIO != 0 {
 				self.prober.HasAudio = true
 			}
@@ -431,6 +732,10 @@ func (self *Demuxer) prepare() (err error) {
 				if tag, timestamp, err = flvio.ReadTag(self.bufr, self.b); err != nil {
 					return
 				}
+				if tag.Type == flvio.TAG_SCRIPTDATA {
+					self.handleScriptData(tag.Data)
+					continue
+				}
 				if err = self.prober.PushTag(tag, timestamp); err != nil {
 					return
 				}
@@ -465,6 +770,10 @@ func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
 		if tag, timestamp, err = flvio.ReadTag(self.bufr, self.b); err != nil {
 			return
 		}
+		if tag.Type == flvio.TAG_SCRIPTDATA {
+			self.handleScriptData(tag.Data)
+			continue
+		}
 
 		var ok bool
 		if pkt, ok = self.prober.TagToPacket(tag, timestamp); ok {
@@ -0,0 +1,337 @@
+package flv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/av1parser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
+	"github.com/nareix/joy4/format/flv/flvio"
+)
+
+var (
+	testVPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09}
+	testSPS = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93, 0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x00, 0x01, 0xf4, 0x80, 0x00, 0x3a, 0x98, 0x04}
+	testPPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+
+	// 1280x720 AV1 sequence header OBU
+	testAV1SequenceHeader = []byte{0x0a, 0x0b, 0x00, 0x00, 0x00, 0x42, 0xaa, 0x7f, 0xac, 0xf0, 0x09, 0xe0, 0x02}
+
+	// uncompressed header of a 352x288 profile 0 VP9 keyframe
+	testVP9KeyFrame = []byte{0x82, 0x49, 0x83, 0x42, 0x20, 0x15, 0xf0, 0x11, 0xf0, 0x09}
+)
+
+// probe pushes the tags of the streams and packets to a Prober like
+// Demuxer does, then returns the probed streams and packets.
+func probe(t *testing.T, streams []av.CodecData, pkts []av.Packet, sequenceStart bool) (prober *Prober, got []av.Packet) {
+	prober = &Prober{}
+	for _, stream := range streams {
+		if stream.Type().IsVideo() {
+			prober.HasVideo = true
+		} else {
+			prober.HasAudio = true
+		}
+		if !sequenceStart {
+			continue
+		}
+		tag, ok, err := CodecDataToTag(stream)
+		if err != nil || !ok {
+			t.Fatalf("%v: no sequence start, %v", stream.Type(), err)
+		}
+		if err = prober.PushTag(tag, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, pkt := range pkts {
+		tag, timestamp := PacketToTag(pkt, streams[pkt.Idx])
+		if !tag.IsExHeader {
+			t.Fatalf("%v: no extended header", streams[pkt.Idx].Type())
+		}
+		if prober.Probed() {
+			if pkt, ok := prober.TagToPacket(tag, timestamp); ok {
+				got = append(got, pkt)
+			}
+		} else if err := prober.PushTag(tag, timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !prober.Probed() {
+		t.Fatal("not probed")
+	}
+	got = append(prober.CachedPkts, got...)
+	return
+}
+
+func checkPackets(t *testing.T, prober *Prober, streams []av.CodecData, got, pkts []av.Packet) {
+	if len(got) != len(pkts) {
+		t.Fatalf("got %d packets", len(got))
+	}
+	for i, pkt := range pkts {
+		g := got[i]
+		if prober.Streams[g.Idx].Type() != streams[pkt.Idx].Type() || g.Time != pkt.Time || g.CompositionTime != pkt.CompositionTime ||
+			g.IsKeyFrame != pkt.IsKeyFrame || !bytes.Equal(g.Data, pkt.Data) {
+			t.Errorf("packet %d: got %+v", i, g)
+		}
+	}
+}
+
+func TestProberHEVC(t *testing.T) {
+	hevc, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(testVPS, testSPS, testPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opus := codec.NewOpusCodecData(48000, av.CH_MONO)
+	streams := []av.CodecData{hevc, opus}
+	ms := time.Millisecond
+	pkts := []av.Packet{
+		{Idx: 0, IsKeyFrame: true, CompositionTime: 80 * ms, Data: []byte{0, 0, 0, 2, 0x26, 1}},
+		{Idx: 1, Data: []byte{0xfc, 1, 2}},
+		{Idx: 0, Time: 40 * ms, Data: []byte{0, 0, 0, 2, 2, 1}},
+		{Idx: 1, Time: 20 * ms, Data: []byte{0xfc, 1, 3}},
+	}
+	prober, got := probe(t, streams, pkts, true)
+
+	vcodec := prober.Streams[prober.VideoStreamIdx].(h265parser.CodecData)
+	if vcodec.Width() != hevc.Width() || vcodec.Height() != hevc.Height() {
+		t.Errorf("got %dx%d", vcodec.Width(), vcodec.Height())
+	}
+	acodec := prober.Streams[prober.AudioStreamIdx].(codec.OpusCodecData)
+	if acodec.ChannelLayout() != av.CH_MONO {
+		t.Errorf("got opus %v", acodec.ChannelLayout())
+	}
+	checkPackets(t, prober, streams, got, pkts)
+}
+
+func TestProberAV1(t *testing.T) {
+	av1, err := av1parser.NewCodecDataFromSequenceHeader(testAV1SequenceHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := []av.CodecData{av1}
+	pkts := []av.Packet{
+		{Idx: 0, IsKeyFrame: true, Data: []byte{0x12, 0, 0x32, 1, 2}},
+		{Idx: 0, Time: 40 * time.Millisecond, Data: []byte{0x12, 0, 0x32, 1, 3}},
+	}
+	prober, got := probe(t, streams, pkts, true)
+
+	vcodec := prober.Streams[0].(av1parser.CodecData)
+	if vcodec.Width() != 1280 || vcodec.Height() != 720 || !bytes.Equal(vcodec.SequenceHeaderOBU(), testAV1SequenceHeader) {
+		t.Errorf("got %dx%d", vcodec.Width(), vcodec.Height())
+	}
+	checkPackets(t, prober, streams, got, pkts)
+}
+
+func TestProberVP9(t *testing.T) {
+	// the frame size comes from the first keyframe
+	streams := []av.CodecData{codec.NewVP9CodecData(352, 288)}
+	pkts := []av.Packet{
+		{Idx: 0, Data: []byte{0x86, 0}},
+		{Idx: 0, IsKeyFrame: true, Time: 40 * time.Millisecond, Data: testVP9KeyFrame},
+		{Idx: 0, Time: 80 * time.Millisecond, Data: []byte{0x86, 1}},
+	}
+	prober, got := probe(t, streams, pkts, true)
+
+	vcodec := prober.Streams[0].(codec.VPXCodecData)
+	if vcodec.Type() != av.VP9 || vcodec.Width() != 352 || vcodec.Height() != 288 {
+		t.Errorf("got %v %dx%d", vcodec.Type(), vcodec.Width(), vcodec.Height())
+	}
+	checkPackets(t, prober, streams, got, pkts[1:])
+}
+
+func TestProberOpus(t *testing.T) {
+	// without a sequence start Opus is 48kHz stereo
+	streams := []av.CodecData{codec.NewOpusCodecData(48000, av.CH_MONO)}
+	pkts := []av.Packet{
+		{Idx: 0, Data: []byte{0xfc, 1}},
+		{Idx: 0, Time: 20 * time.Millisecond, Data: []byte{0xfc, 2}},
+	}
+	prober, got := probe(t, streams, pkts, false)
+
+	acodec := prober.Streams[0].(codec.OpusCodecData)
+	if acodec.SampleRate() != 48000 || acodec.ChannelLayout() != av.CH_STEREO {
+		t.Errorf("got opus %d %v", acodec.SampleRate(), acodec.ChannelLayout())
+	}
+	checkPackets(t, prober, streams, got, pkts)
+
+	// a sequence start with a damaged OpusHead fails
+	prober = &Prober{HasAudio: true}
+	tag := flvio.Tag{Type: flvio.TAG_AUDIO, IsExHeader: true, PacketType: flvio.PKTTYPE_SEQUENCE_START, FourCC: flvio.FOURCC_OPUS, Data: []byte("OpusHead")}
+	if err := prober.PushTag(tag, 0); err == nil {
+		t.Error("damaged OpusHead accepted")
+	}
+}
+
+// muxSeekable writes 10s of H264 and AAC with a keyframe every second to a
+// file after some junk, and returns it opened at the start of the FLV.
+func muxSeekable(t *testing.T, keyframes int) (file *os.File, base int64) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x05, 0x07, 0xe4, 0x20}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	h264, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aac, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{ObjectType: 2, SampleRate: 44100, ChannelLayout: av.CH_STEREO})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file, err = os.Create(filepath.Join(t.TempDir(), "out.flv")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	base = 4
+	if _, err = file.Write([]byte("junk")); err != nil {
+		t.Fatal(err)
+	}
+
+	muxer := NewMuxer(file)
+	muxer.Keyframes = keyframes
+	if err = muxer.WriteHeader([]av.CodecData{h264, aac}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 250; i++ {
+		tm := time.Duration(i) * 40 * time.Millisecond
+		if err = muxer.WritePacket(av.Packet{Idx: 0, IsKeyFrame: i%25 == 0, Time: tm, Data: []byte{0, 0, 0, 2, 0x65, byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		if err = muxer.WritePacket(av.Packet{Idx: 1, Time: tm, Data: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = file.Seek(base, 0); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func checkSeek(t *testing.T, demuxer *Demuxer, seeks map[time.Duration]time.Duration) {
+	for tm, keytime := range seeks {
+		if err := demuxer.SeekToTime(tm); err != nil {
+			t.Fatal(err)
+		}
+		pkt, err := demuxer.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Idx != 0 || !pkt.IsKeyFrame || pkt.Time != keytime {
+			t.Errorf("seek to %v: got packet %d at %v", tm, pkt.Idx, pkt.Time)
+		}
+	}
+}
+
+func TestMuxerKeyframes(t *testing.T) {
+	file, base := muxSeekable(t, 20)
+	demuxer := NewDemuxer(file)
+	metadata, err := demuxer.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dur, _ := demuxer.Duration(); dur != 10*time.Second {
+		t.Errorf("got duration %v", dur)
+	}
+	info, _ := file.Stat()
+	if metadata["filesize"] != float64(info.Size()-base) {
+		t.Errorf("got filesize %v", metadata["filesize"])
+	}
+
+	keyframes, _ := metadata["keyframes"].(flvio.AMFMap)
+	times := amfFloat64s(keyframes["times"])
+	filepositions := amfFloat64s(keyframes["filepositions"])
+	if len(times) != 20 || len(filepositions) != 20 {
+		t.Fatalf("got keyframes %v", keyframes)
+	}
+	for i := range times {
+		// the arrays are padded with the last keyframe
+		k := i
+		if k > 9 {
+			k = 9
+		}
+		if times[i] != float64(k) {
+			t.Errorf("keyframe %d at %vs", i, times[i])
+		}
+		b := make([]byte, flvio.TagHeaderLength+1)
+		if _, err = file.ReadAt(b, base+int64(filepositions[i])); err != nil {
+			t.Fatal(err)
+		}
+		tag, ts, _, _ := flvio.ParseTagHeader(b)
+		if tag.Type != flvio.TAG_VIDEO || b[flvio.TagHeaderLength]>>4 != flvio.FRAME_KEY || ts != int32(k*1000) {
+			t.Errorf("keyframe %d at %v is not a keyframe tag", i, filepositions[i])
+		}
+	}
+
+	if len(demuxer.index) != 10 {
+		t.Errorf("got %d keyframes indexed", len(demuxer.index))
+	}
+	checkSeek(t, demuxer, map[time.Duration]time.Duration{
+		5500 * time.Millisecond: 5 * time.Second,
+		0:                       0,
+		20 * time.Second:        9 * time.Second,
+		3 * time.Second:         3 * time.Second,
+	})
+}
+
+func TestMuxerKeyframesFull(t *testing.T) {
+	// every other keyframe is dropped each time the index is full
+	file, _ := muxSeekable(t, 4)
+	demuxer := NewDemuxer(file)
+	if _, err := demuxer.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	var times []time.Duration
+	for _, kf := range demuxer.index {
+		times = append(times, kf.time)
+	}
+	if len(times) != 3 || times[0] != 0 || times[1] != 4*time.Second || times[2] != 8*time.Second {
+		t.Errorf("got keyframes at %v", times)
+	}
+	checkSeek(t, demuxer, map[time.Duration]time.Duration{
+		5500 * time.Millisecond: 4 * time.Second,
+		9 * time.Second:         8 * time.Second,
+	})
+}
+
+func TestDemuxerSeekScan(t *testing.T) {
+	file, _ := muxSeekable(t, 0)
+	demuxer := NewDemuxer(file)
+	metadata, err := demuxer.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := metadata["keyframes"]; ok || len(demuxer.index) != 0 {
+		t.Fatal("got a keyframes index")
+	}
+	checkSeek(t, demuxer, map[time.Duration]time.Duration{
+		5500 * time.Millisecond: 5 * time.Second,
+		2 * time.Second:         2 * time.Second,
+		0:                       0,
+		20 * time.Second:        9 * time.Second,
+	})
+
+	// the packets after a seek are in order
+	if err = demuxer.SeekToTime(8 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		if _, err = demuxer.ReadPacket(); err != nil {
+			break
+		}
+		n++
+	}
+	if n != 2*50 {
+		t.Errorf("got %d packets after 8s", n)
+	}
+}
@@ -35,6 +35,14 @@ type AMFMap map[string]interface{}
 type AMFArray []interface{}
 type AMFECMAArray map[string]interface{}
 
+// AMFTypedObject is an object with a registered class name.
+type AMFTypedObject struct {
+	ClassName string
+	Values AMFMap
+}
+
+type AMFXMLDocument string
+
 func parseBEFloat64(b []byte) float64 {
 	return math.Float64frombits(pio.U64BE(b))
 }
@@ -123,7 +131,7 @@ func LenAMF0Val(_val interface{}) (n int) {
 
 	case string:
 		u := len(val)
-		if u <= 65536 {
+		if u <= 65535 {
 			n += 3
 		} else {
 			n += 5
@@ -154,6 +162,22 @@ func LenAMF0Val(_val interface{}) (n int) {
 			n += LenAMF0Val(v)
 		}
 
+	case AMFTypedObject:
+		n += 3+len(val.ClassName)
+		for k, v := range val.Values {
+			if len(k) > 0 {
+				n += 2+len(k)
+				n += LenAMF0Val(v)
+			}
+		}
+		n += 3
+
+	case AMFXMLDocument:
+		n += 5+len(val)
+
+	case AMF3Object, AMF3XML, AMF3Dictionary, []byte, []int32, []uint32, []float64:
+		n += 1+len(AppendAMF3Val(nil, val))
+
 	case time.Time:
 		n += 1+8+2
 
@@ -196,7 +220,7 @@ func FillAMF0Val(b []byte, _val interface{}) (n int) {
 
 	case string:
 		u := len(val)
-		if u <= 65536 {
+		if u <= 65535 {
 			b[n] = stringmarker
 			n++
 			pio.PutU16BE(b[n:], uint16(u))
@@ -249,6 +273,39 @@ func FillAMF0Val(b []byte, _val interface{}) (n int) {
 			n += FillAMF0Val(b[n:], v)
 		}
 
+	case AMFTypedObject:
+		b[n] = typedobjectmarker
+		n++
+		pio.PutU16BE(b[n:], uint16(len(val.ClassName)))
+		n += 2
+		copy(b[n:], []byte(val.ClassName))
+		n += len(val.ClassName)
+		for k, v := range val.Values {
+			if len(k) > 0 {
+				pio.PutU16BE(b[n:], uint16(len(k)))
+				n += 2
+				copy(b[n:], []byte(k))
+				n += len(k)
+				n += FillAMF0Val(b[n:], v)
+			}
+		}
+		pio.PutU24BE(b[n:], 0x000009)
+		n += 3
+
+	case AMFXMLDocument:
+		b[n] = xmldocumentmarker
+		n++
+		pio.PutU32BE(b[n:], uint32(len(val)))
+		n += 4
+		copy(b[n:], []byte(val))
+		n += len(val)
+
+	// values only AMF3 can represent are written after the avmplus marker
+	case AMF3Object, AMF3XML, AMF3Dictionary, []byte, []int32, []uint32, []float64:
+		b[n] = avmplusobjectmarker
+		n++
+		n += copy(b[n:], AppendAMF3Val(nil, val))
+
 	case time.Time:
 		b[n] = datemarker
 		n++
@@ -280,10 +337,71 @@ func FillAMF0Val(b []byte, _val interface{}) (n int) {
 
 
 func ParseAMF0Val(b []byte) (val interface{}, n int, err error) {
-	return parseAMF0Val(b, 0)
+	return (&amf0Decoder{}).parseVal(b, 0)
 }
 
-func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
+// ParseAMF0Vals parses all values of b, like the name and arguments of a
+// command. They share one reference table, so a value can refer to an
+// object of an earlier one.
+func ParseAMF0Vals(b []byte) (vals []interface{}, err error) {
+	d := &amf0Decoder{}
+	n := 0
+	for n < len(b) {
+		var val interface{}
+		var size int
+		if val, size, err = d.parseVal(b[n:], n); err != nil {
+			return
+		}
+		n += size
+		vals = append(vals, val)
+	}
+	return
+}
+
+// amf0Decoder holds the reference table of one AMF0 value. Objects, typed
+// objects and arrays are numbered in the order they begin.
+type amf0Decoder struct {
+	objects []interface{}
+}
+
+func (self *amf0Decoder) parseProps(b []byte, offset int, obj map[string]interface{}, name string) (n int, err error) {
+	for {
+		if len(b) < n+2 {
+			err = amf0ParseErr(name+".key.length", offset+n, err)
+			return
+		}
+		length := int(pio.U16BE(b[n:]))
+		n += 2
+		if length == 0 {
+			break
+		}
+
+		if len(b) < n+length {
+			err = amf0ParseErr(name+".key.body", offset+n, err)
+			return
+		}
+		okey := string(b[n:n+length])
+		n += length
+
+		var nval int
+		var oval interface{}
+		if oval, nval, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf0ParseErr(name+".val", offset+n, err)
+			return
+		}
+		n += nval
+
+		obj[okey] = oval
+	}
+	if len(b) < n+1 {
+		err = amf0ParseErr(name+".end", offset+n, err)
+		return
+	}
+	n++
+	return
+}
+
+func (self *amf0Decoder) parseVal(b []byte, offset int) (val interface{}, n int, err error) {
 	if len(b) < n+1 {
 		err = amf0ParseErr("marker", offset+n, err)
 		return
@@ -325,43 +443,30 @@ func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
 
 	case objectmarker:
 		obj := AMFMap{}
-		for {
-			if len(b) < n+2 {
-				err = amf0ParseErr("object.key.length", offset+n, err)
-				return
-			}
-			length := int(pio.U16BE(b[n:]))
-			n += 2
-			if length == 0 {
-				break
-			}
-
-			if len(b) < n+length {
-				err = amf0ParseErr("object.key.body", offset+n, err)
-				return
-			}
-			okey := string(b[n:n+length])
-			n += length
-
-			var nval int
-			var oval interface{}
-			if oval, nval, err = parseAMF0Val(b[n:], offset+n); err != nil {
-				err = amf0ParseErr("object.val", offset+n, err)
-				return
-			}
-			n += nval
-
-			obj[okey] = oval
-		}
-		if len(b) < n+1 {
-			err = amf0ParseErr("object.end", offset+n, err)
+		self.objects = append(self.objects, obj)
+		var nprops int
+		if nprops, err = self.parseProps(b[n:], offset+n, obj, "object"); err != nil {
 			return
 		}
-		n++
+		n += nprops
 		val = obj
 
 	case nullmarker:
 	case undefinedmarker:
+	case unsupportedmarker:
+
+	case referencemarker:
+		if len(b) < n+2 {
+			err = amf0ParseErr("reference", offset+n, err)
+			return
+		}
+		idx := int(pio.U16BE(b[n:]))
+		n += 2
+		if idx >= len(self.objects) {
+			err = amf0ParseErr(fmt.Sprintf("reference=%d", idx), offset+n, err)
+			return
+		}
+		val = self.objects[idx]
 
 	case ecmaarraymarker:
 		if len(b) < n+4 {
@@ -370,41 +475,14 @@ func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
 		}
 		n += 4
 
+		// decoded as AMFMap, as onMetaData is usually sent as an ECMA array
 		obj := AMFMap{}
-		for {
-			if len(b) < n+2 {
-				err = amf0ParseErr("array.key.length", offset+n, err)
-				return
-			}
-			length := int(pio.U16BE(b[n:]))
-			n += 2
-
-			if length == 0 {
-				break
-			}
-
-			if len(b) < n+length {
-				err = amf0ParseErr("array.key.body", offset+n, err)
-				return
-			}
-			okey := string(b[n:n+length])
-			n += length
-
-			var nval int
-			var oval interface{}
-			if oval, nval, err = parseAMF0Val(b[n:], offset+n); err != nil {
-				err = amf0ParseErr("array.val", offset+n, err)
-				return
-			}
-			n += nval
-
-			obj[okey] = oval
-		}
-		if len(b) < n+1 {
-			err = amf0ParseErr("array.end", offset+n, err)
+		self.objects = append(self.objects, obj)
+		var nprops int
+		if nprops, err = self.parseProps(b[n:], offset+n, obj, "array"); err != nil {
 			return
 		}
-		n += 1
+		n += nprops
 		val = obj
 
 	case objectendmarker:
@@ -422,10 +500,16 @@ func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
 		count := int(pio.U32BE(b[n:]))
 		n += 4
 
+		// every value takes at least one byte
+		if count < 0 || len(b) < n+count {
+			err = amf0ParseErr("strictarray.count", offset+n, err)
+			return
+		}
 		obj := make(AMFArray, count)
+		self.objects = append(self.objects, obj)
 		for i := 0; i < int(count); i++ {
 			var nval int
-			if obj[i], nval, err = parseAMF0Val(b[n:], offset+n); err != nil {
+			if obj[i], nval, err = self.parseVal(b[n:], offset+n); err != nil {
 				err = amf0ParseErr("strictarray.val", offset+n, err)
 				return
 			}
@@ -443,7 +527,7 @@ func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
 
 		val = time.Unix(int64(ts/1000), (int64(ts)%1000)*1000000)
 
-	case longstringmarker:
+	case longstringmarker, xmldocumentmarker:
 		if len(b) < n+4 {
 			err = amf0ParseErr("longstring.length", offset+n, err)
 			return
@@ -451,13 +535,52 @@ func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
 		length := int(pio.U32BE(b[n:]))
 		n += 4
 
-		if len(b) < n+length {
+		if length < 0 || len(b) < n+length {
 			err = amf0ParseErr("longstring.body", offset+n, err)
 			return
 		}
-		val = string(b[n:n+length])
+		s := string(b[n:n+length])
+		n += length
+		if marker == xmldocumentmarker {
+			val = AMFXMLDocument(s)
+		} else {
+			val = s
+		}
+
+	case typedobjectmarker:
+		if len(b) < n+2 {
+			err = amf0ParseErr("typedobject.classname.length", offset+n, err)
+			return
+		}
+		length := int(pio.U16BE(b[n:]))
+		n += 2
+
+		if len(b) < n+length {
+			err = amf0ParseErr("typedobject.classname.body", offset+n, err)
+			return
+		}
+		obj := AMFTypedObject{
+			ClassName: string(b[n:n+length]),
+			Values: AMFMap{},
+		}
 		n += length
 
+		self.objects = append(self.objects, obj)
+		var nprops int
+		if nprops, err = self.parseProps(b[n:], offset+n, obj.Values, "typedobject"); err != nil {
+			return
+		}
+		n += nprops
+		val = obj
+
+	case avmplusobjectmarker:
+		var nval int
+		if val, nval, err = (&amf3Decoder{}).parseVal(b[n:], offset+n); err != nil {
+			err = amf0ParseErr("avmplusobject", offset+n, err)
+			return
+		}
+		n += nval
+
 	default:
 		err = amf0ParseErr(fmt.Sprintf("invalidmarker=%d", marker), offset+n, err)
 		return
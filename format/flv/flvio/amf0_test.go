@@ -0,0 +1,140 @@
+package flvio
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAMF0RoundTrip(t *testing.T) {
+	vals := []interface{}{
+		nil,
+		true,
+		float64(-1.5),
+		"hello",
+		strings.Repeat("x", 65535),
+		strings.Repeat("x", 65536),
+		AMFXMLDocument("<doc/>"),
+		AMFArray{"a", float64(1), AMFMap{"k": "v"}},
+		AMFMap{"app": "live", "nested": AMFMap{"x": float64(1)}},
+		AMFTypedObject{ClassName: "com.example.Point", Values: AMFMap{"x": float64(1), "y": float64(2)}},
+		AMF3Object{ClassName: "Point", Sealed: []string{"x"}, Values: AMFMap{"x": float64(1)}},
+		[]byte{1, 2, 3},
+	}
+	for _, val := range vals {
+		b := make([]byte, LenAMF0Val(val))
+		if n := FillAMF0Val(b, val); n != len(b) {
+			t.Errorf("%T: filled %d of %d bytes", val, n, len(b))
+		}
+		got, n, err := ParseAMF0Val(b)
+		if err != nil {
+			t.Errorf("%T: %s", val, err)
+			continue
+		}
+		if n != len(b) || !reflect.DeepEqual(got, val) {
+			t.Errorf("%T: got %#v n=%d", val, got, n)
+		}
+	}
+}
+
+func TestAMF0Reference(t *testing.T) {
+	// strict array holding an object and a reference to it
+	b := []byte{
+		strictarraymarker, 0, 0, 0, 2,
+		objectmarker, 0, 1, 'k', booleanmarker, 1, 0, 0, objectendmarker,
+		referencemarker, 0, 1,
+	}
+	got, n, err := ParseAMF0Val(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AMFArray{AMFMap{"k": true}, AMFMap{"k": true}}
+	if n != len(b) || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v n=%d", got, n)
+	}
+}
+
+func TestAMF0ValsReference(t *testing.T) {
+	// the second value refers to the object of the first one
+	b := []byte{
+		objectmarker, 0, 1, 'k', booleanmarker, 1, 0, 0, objectendmarker,
+		referencemarker, 0, 0,
+	}
+	if _, _, err := ParseAMF0Val(b[9:]); err == nil {
+		t.Error("reference of a single value resolved")
+	}
+	got, err := ParseAMF0Vals(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{AMFMap{"k": true}, AMFMap{"k": true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v", got)
+	}
+}
+
+type testConnectParams struct {
+	App            string `amf:"app"`
+	TcUrl          string `amf:"tcUrl"`
+	Fpad           bool   `amf:"fpad"`
+	ObjectEncoding int    `amf:"objectEncoding"`
+	Codecs         []string
+	Extra          map[string]interface{} `amf:",omitempty"`
+	Page           *string                `amf:"pageUrl,omitempty"`
+	Ignored        string                 `amf:"-"`
+}
+
+func TestMarshal(t *testing.T) {
+	page := "http://example.com"
+	params := testConnectParams{
+		App:            "live",
+		TcUrl:          "rtmp://localhost/live",
+		ObjectEncoding: 3,
+		Codecs:         []string{"avc1", "mp4a"},
+		Page:           &page,
+		Ignored:        "x",
+	}
+	b, err := Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, _, err := ParseAMF0Val(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AMFMap{
+		"app":            "live",
+		"tcUrl":          "rtmp://localhost/live",
+		"fpad":           false,
+		"objectEncoding": float64(3),
+		"Codecs":         AMFArray{"avc1", "mp4a"},
+		"pageUrl":        page,
+	}
+	if !reflect.DeepEqual(val, want) {
+		t.Errorf("got %#v", val)
+	}
+
+	var got testConnectParams
+	if err = Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	params.Ignored = ""
+	if !reflect.DeepEqual(got, params) {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestUnmarshalValue(t *testing.T) {
+	var got testConnectParams
+	err := UnmarshalValue(AMFMap{"app": "live", "tcurl": "rtmp://h/live", "objectEncoding": float64(0)}, &got)
+	if err != nil || got.App != "live" || got.TcUrl != "rtmp://h/live" {
+		t.Errorf("got %#v %v", got, err)
+	}
+
+	if err = UnmarshalValue(AMFMap{"objectEncoding": 1.5}, &got); err == nil {
+		t.Error("fractional number unmarshalled into int")
+	}
+	if err = UnmarshalValue(AMFMap{"app": float64(1)}, &got); err == nil {
+		t.Error("number unmarshalled into string")
+	}
+}
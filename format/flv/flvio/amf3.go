@@ -0,0 +1,742 @@
+package flvio
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// AMF3Object is an AMF3 object with a class name or sealed members.
+// Anonymous dynamic objects are decoded as AMFMap.
+type AMF3Object struct {
+	ClassName string
+	Sealed    []string // sealed member names, in encoding order
+	Dynamic   bool
+	Values    AMFMap // sealed and dynamic members
+}
+
+type AMF3XML string
+
+type AMF3Dictionary struct {
+	WeakKeys bool
+	Keys     []interface{}
+	Values   []interface{}
+}
+
+const (
+	amf3IntMin = -(1 << 28)
+	amf3IntMax = 1<<28 - 1
+)
+
+type amf3Traits struct {
+	classname      string
+	sealed         []string
+	dynamic        bool
+	externalizable bool
+}
+
+// amf3Decoder holds the reference tables of one AMF3 value.
+type amf3Decoder struct {
+	strings []string
+	objects []interface{}
+	traits  []*amf3Traits
+}
+
+func amf3ParseErr(message string, offset int, err error) error {
+	return amf0ParseErr("amf3."+message, offset, err)
+}
+
+func parseAMF3U29(b []byte, offset int) (u uint32, n int, err error) {
+	for i := 0; i < 4; i++ {
+		if len(b) < n+1 {
+			err = amf3ParseErr("u29", offset+n, nil)
+			return
+		}
+		c := b[n]
+		n++
+		if i == 3 {
+			u = u<<8 | uint32(c)
+			return
+		}
+		u = u<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			return
+		}
+	}
+	return
+}
+
+// ParseAMF3Val parses one AMF3 value with fresh reference tables.
+func ParseAMF3Val(b []byte) (val interface{}, n int, err error) {
+	return (&amf3Decoder{}).parseVal(b, 0)
+}
+
+func (self *amf3Decoder) parseString(b []byte, offset int) (s string, n int, err error) {
+	var u uint32
+	if u, n, err = parseAMF3U29(b, offset); err != nil {
+		return
+	}
+	if u&1 == 0 {
+		idx := int(u >> 1)
+		if idx >= len(self.strings) {
+			err = amf3ParseErr(fmt.Sprintf("string.ref=%d", idx), offset+n, nil)
+			return
+		}
+		s = self.strings[idx]
+		return
+	}
+	length := int(u >> 1)
+	if len(b) < n+length {
+		err = amf3ParseErr("string.body", offset+n, nil)
+		return
+	}
+	s = string(b[n : n+length])
+	n += length
+	if s != "" {
+		self.strings = append(self.strings, s)
+	}
+	return
+}
+
+// parseRef reads the U29 header shared by all reference-able types. When the
+// low bit is clear the value is a reference and ref is set.
+func (self *amf3Decoder) parseRef(b []byte, offset int, name string) (u uint32, ref interface{}, isref bool, n int, err error) {
+	if u, n, err = parseAMF3U29(b, offset); err != nil {
+		return
+	}
+	if u&1 == 0 {
+		idx := int(u >> 1)
+		if idx >= len(self.objects) {
+			err = amf3ParseErr(fmt.Sprintf("%s.ref=%d", name, idx), offset+n, nil)
+			return
+		}
+		ref = self.objects[idx]
+		isref = true
+		return
+	}
+	u >>= 1
+	return
+}
+
+func (self *amf3Decoder) parseTraits(u uint32, b []byte, offset int) (traits *amf3Traits, n int, err error) {
+	if u&1 == 0 {
+		idx := int(u >> 1)
+		if idx >= len(self.traits) {
+			err = amf3ParseErr(fmt.Sprintf("traits.ref=%d", idx), offset, nil)
+			return
+		}
+		traits = self.traits[idx]
+		return
+	}
+	traits = &amf3Traits{
+		externalizable: u&2 != 0,
+		dynamic:        u&4 != 0,
+	}
+	count := int(u >> 3)
+	var size int
+	if traits.classname, size, err = self.parseString(b[n:], offset+n); err != nil {
+		err = amf3ParseErr("traits.classname", offset+n, err)
+		return
+	}
+	n += size
+	if len(b) < n+count {
+		err = amf3ParseErr("traits.count", offset+n, nil)
+		return
+	}
+	for i := 0; i < count; i++ {
+		var name string
+		if name, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("traits.sealed", offset+n, err)
+			return
+		}
+		n += size
+		traits.sealed = append(traits.sealed, name)
+	}
+	self.traits = append(self.traits, traits)
+	return
+}
+
+func (self *amf3Decoder) parseVal(b []byte, offset int) (val interface{}, n int, err error) {
+	if len(b) < n+1 {
+		err = amf3ParseErr("marker", offset+n, nil)
+		return
+	}
+	marker := b[n]
+	n++
+
+	var u uint32
+	var size int
+	var isref bool
+
+	switch marker {
+	case amf3undefinedmarker, amf3nullmarker:
+
+	case amf3falsemarker:
+		val = false
+
+	case amf3truemarker:
+		val = true
+
+	case amf3integermarker:
+		if u, size, err = parseAMF3U29(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+		i := int32(u)
+		if u&0x10000000 != 0 {
+			i -= 1 << 29
+		}
+		val = float64(i)
+
+	case amf3doublemarker:
+		if len(b) < n+8 {
+			err = amf3ParseErr("double", offset+n, nil)
+			return
+		}
+		val = parseBEFloat64(b[n:])
+		n += 8
+
+	case amf3stringmarker:
+		if val, size, err = self.parseString(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3xmldocmarker, amf3xmlmarker:
+		if u, val, isref, size, err = self.parseRef(b[n:], offset+n, "xml"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			return
+		}
+		length := int(u)
+		if len(b) < n+length {
+			err = amf3ParseErr("xml.body", offset+n, nil)
+			return
+		}
+		s := string(b[n : n+length])
+		n += length
+		if marker == amf3xmlmarker {
+			val = AMF3XML(s)
+		} else {
+			val = AMFXMLDocument(s)
+		}
+		self.objects = append(self.objects, val)
+
+	case amf3datemarker:
+		if _, val, isref, size, err = self.parseRef(b[n:], offset+n, "date"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			return
+		}
+		if len(b) < n+8 {
+			err = amf3ParseErr("date", offset+n, nil)
+			return
+		}
+		ts := parseBEFloat64(b[n:])
+		n += 8
+		val = time.Unix(int64(ts/1000), (int64(ts)%1000)*1000000)
+		self.objects = append(self.objects, val)
+
+	case amf3arraymarker:
+		if u, val, isref, size, err = self.parseRef(b[n:], offset+n, "array"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			return
+		}
+		count := int(u)
+		idx := len(self.objects)
+		self.objects = append(self.objects, nil)
+
+		var assoc AMFECMAArray
+		for {
+			var key string
+			if key, size, err = self.parseString(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("array.key", offset+n, err)
+				return
+			}
+			n += size
+			if key == "" {
+				break
+			}
+			if assoc == nil {
+				assoc = AMFECMAArray{}
+				self.objects[idx] = assoc
+			}
+			if assoc[key], size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("array.val", offset+n, err)
+				return
+			}
+			n += size
+		}
+
+		if len(b) < n+count {
+			err = amf3ParseErr("array.count", offset+n, nil)
+			return
+		}
+		if assoc != nil {
+			for i := 0; i < count; i++ {
+				key := strconv.Itoa(i)
+				if assoc[key], size, err = self.parseVal(b[n:], offset+n); err != nil {
+					err = amf3ParseErr("array.val", offset+n, err)
+					return
+				}
+				n += size
+			}
+			val = assoc
+		} else {
+			arr := make(AMFArray, count)
+			self.objects[idx] = arr
+			for i := 0; i < count; i++ {
+				if arr[i], size, err = self.parseVal(b[n:], offset+n); err != nil {
+					err = amf3ParseErr("array.val", offset+n, err)
+					return
+				}
+				n += size
+			}
+			val = arr
+		}
+
+	case amf3objectmarker:
+		if u, val, isref, size, err = self.parseRef(b[n:], offset+n, "object"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			return
+		}
+		var traits *amf3Traits
+		if traits, size, err = self.parseTraits(u, b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+		if traits.externalizable {
+			err = amf3ParseErr(fmt.Sprintf("object.externalizable=%s", traits.classname), offset+n, nil)
+			return
+		}
+
+		obj := AMFMap{}
+		idx := len(self.objects)
+		self.objects = append(self.objects, obj)
+		for _, name := range traits.sealed {
+			if obj[name], size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("object.sealed", offset+n, err)
+				return
+			}
+			n += size
+		}
+		if traits.dynamic {
+			for {
+				var key string
+				if key, size, err = self.parseString(b[n:], offset+n); err != nil {
+					err = amf3ParseErr("object.key", offset+n, err)
+					return
+				}
+				n += size
+				if key == "" {
+					break
+				}
+				if obj[key], size, err = self.parseVal(b[n:], offset+n); err != nil {
+					err = amf3ParseErr("object.val", offset+n, err)
+					return
+				}
+				n += size
+			}
+		}
+
+		if traits.classname == "" && len(traits.sealed) == 0 {
+			val = obj
+		} else {
+			val = AMF3Object{
+				ClassName: traits.classname,
+				Sealed:    traits.sealed,
+				Dynamic:   traits.dynamic,
+				Values:    obj,
+			}
+			self.objects[idx] = val
+		}
+
+	case amf3bytearraymarker:
+		if u, val, isref, size, err = self.parseRef(b[n:], offset+n, "bytearray"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			return
+		}
+		length := int(u)
+		if len(b) < n+length {
+			err = amf3ParseErr("bytearray.body", offset+n, nil)
+			return
+		}
+		val = append([]byte(nil), b[n:n+length]...)
+		n += length
+		self.objects = append(self.objects, val)
+
+	case amf3vectorintmarker, amf3vectoruintmarker, amf3vectordoublemarker:
+		if u, val, isref, size, err = self.parseRef(b[n:], offset+n, "vector"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			return
+		}
+		count := int(u)
+		elemsize := 4
+		if marker == amf3vectordoublemarker {
+			elemsize = 8
+		}
+		// skip fixed-vector flag
+		n++
+		if count < 0 || len(b) < n+count*elemsize {
+			err = amf3ParseErr("vector.body", offset+n, nil)
+			return
+		}
+		switch marker {
+		case amf3vectorintmarker:
+			vec := make([]int32, count)
+			for i := range vec {
+				vec[i] = pio.I32BE(b[n:])
+				n += 4
+			}
+			val = vec
+		case amf3vectoruintmarker:
+			vec := make([]uint32, count)
+			for i := range vec {
+				vec[i] = pio.U32BE(b[n:])
+				n += 4
+			}
+			val = vec
+		default:
+			vec := make([]float64, count)
+			for i := range vec {
+				vec[i] = parseBEFloat64(b[n:])
+				n += 8
+			}
+			val = vec
+		}
+		self.objects = append(self.objects, val)
+
+	case amf3vectorobjectmarker:
+		if u, val, isref, size, err = self.parseRef(b[n:], offset+n, "vector"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			return
+		}
+		count := int(u)
+		// skip fixed-vector flag
+		n++
+		if len(b) < n {
+			err = amf3ParseErr("vector.fixed", offset+n, nil)
+			return
+		}
+		if _, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("vector.typename", offset+n, err)
+			return
+		}
+		n += size
+		if len(b) < n+count {
+			err = amf3ParseErr("vector.count", offset+n, nil)
+			return
+		}
+		arr := make(AMFArray, count)
+		self.objects = append(self.objects, arr)
+		for i := 0; i < count; i++ {
+			if arr[i], size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("vector.val", offset+n, err)
+				return
+			}
+			n += size
+		}
+		val = arr
+
+	case amf3dictionarymarker:
+		if u, val, isref, size, err = self.parseRef(b[n:], offset+n, "dictionary"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			return
+		}
+		count := int(u)
+		if len(b) < n+1+count*2 {
+			err = amf3ParseErr("dictionary.count", offset+n, nil)
+			return
+		}
+		dict := &AMF3Dictionary{WeakKeys: b[n] != 0}
+		n++
+		idx := len(self.objects)
+		self.objects = append(self.objects, nil)
+		for i := 0; i < count; i++ {
+			var k, v interface{}
+			if k, size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("dictionary.key", offset+n, err)
+				return
+			}
+			n += size
+			if v, size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("dictionary.val", offset+n, err)
+				return
+			}
+			n += size
+			dict.Keys = append(dict.Keys, k)
+			dict.Values = append(dict.Values, v)
+		}
+		val = *dict
+		self.objects[idx] = val
+
+	default:
+		err = amf3ParseErr(fmt.Sprintf("invalidmarker=%d", marker), offset+n, nil)
+		return
+	}
+
+	return
+}
+
+// amf3Encoder holds the string and traits reference tables of one AMF3
+// value. Objects are always written inline.
+type amf3Encoder struct {
+	strings map[string]int
+	traits  map[string]int
+}
+
+// AppendAMF3Val appends the AMF3 encoding of val to b with fresh reference
+// tables. Map keys are written in sorted order so the output is
+// deterministic. Values of unsupported types are written as null.
+func AppendAMF3Val(b []byte, val interface{}) []byte {
+	self := &amf3Encoder{
+		strings: map[string]int{},
+		traits:  map[string]int{},
+	}
+	return self.appendVal(b, val)
+}
+
+func sortedAMFKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendAMF3U29(b []byte, u uint32) []byte {
+	u &= 0x1fffffff
+	switch {
+	case u < 0x80:
+		return append(b, byte(u))
+	case u < 0x4000:
+		return append(b, byte(u>>7)|0x80, byte(u&0x7f))
+	case u < 0x200000:
+		return append(b, byte(u>>14)|0x80, byte(u>>7)|0x80, byte(u&0x7f))
+	default:
+		return append(b, byte(u>>22)|0x80, byte(u>>15)|0x80, byte(u>>8)|0x80, byte(u))
+	}
+}
+
+func appendAMF3Double(b []byte, f float64) []byte {
+	var buf [8]byte
+	pio.PutU64BE(buf[:], math.Float64bits(f))
+	return append(b, buf[:]...)
+}
+
+func appendAMF3Int(b []byte, i int64) []byte {
+	if i < amf3IntMin || i > amf3IntMax {
+		return appendAMF3Double(append(b, amf3doublemarker), float64(i))
+	}
+	return appendAMF3U29(append(b, amf3integermarker), uint32(i))
+}
+
+func appendAMF3Uint(b []byte, u uint64) []byte {
+	if u > amf3IntMax {
+		return appendAMF3Double(append(b, amf3doublemarker), float64(u))
+	}
+	return appendAMF3U29(append(b, amf3integermarker), uint32(u))
+}
+
+func (self *amf3Encoder) appendString(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, 0x01)
+	}
+	if idx, ok := self.strings[s]; ok {
+		return appendAMF3U29(b, uint32(idx)<<1)
+	}
+	self.strings[s] = len(self.strings)
+	b = appendAMF3U29(b, uint32(len(s))<<1|1)
+	return append(b, s...)
+}
+
+func (self *amf3Encoder) appendObject(b []byte, obj AMF3Object) []byte {
+	b = append(b, amf3objectmarker)
+
+	key := obj.ClassName + "\x00" + strconv.FormatBool(obj.Dynamic) + "\x00" + strings.Join(obj.Sealed, "\x00")
+	if idx, ok := self.traits[key]; ok {
+		b = appendAMF3U29(b, uint32(idx)<<2|0x1)
+	} else {
+		self.traits[key] = len(self.traits)
+		u := uint32(len(obj.Sealed))<<4 | 0x3
+		if obj.Dynamic {
+			u |= 0x8
+		}
+		b = appendAMF3U29(b, u)
+		b = self.appendString(b, obj.ClassName)
+		for _, name := range obj.Sealed {
+			b = self.appendString(b, name)
+		}
+	}
+
+	for _, name := range obj.Sealed {
+		b = self.appendVal(b, obj.Values[name])
+	}
+	if obj.Dynamic {
+		sealed := map[string]bool{}
+		for _, name := range obj.Sealed {
+			sealed[name] = true
+		}
+		for _, k := range sortedAMFKeys(obj.Values) {
+			if k != "" && !sealed[k] {
+				b = self.appendString(b, k)
+				b = self.appendVal(b, obj.Values[k])
+			}
+		}
+		b = self.appendString(b, "")
+	}
+	return b
+}
+
+func (self *amf3Encoder) appendVal(b []byte, _val interface{}) []byte {
+	switch val := _val.(type) {
+	case int8:
+		return appendAMF3Int(b, int64(val))
+	case int16:
+		return appendAMF3Int(b, int64(val))
+	case int32:
+		return appendAMF3Int(b, int64(val))
+	case int64:
+		return appendAMF3Int(b, val)
+	case int:
+		return appendAMF3Int(b, int64(val))
+	case uint8:
+		return appendAMF3Uint(b, uint64(val))
+	case uint16:
+		return appendAMF3Uint(b, uint64(val))
+	case uint32:
+		return appendAMF3Uint(b, uint64(val))
+	case uint64:
+		return appendAMF3Uint(b, val)
+	case uint:
+		return appendAMF3Uint(b, uint64(val))
+	case float32:
+		return appendAMF3Double(append(b, amf3doublemarker), float64(val))
+	case float64:
+		return appendAMF3Double(append(b, amf3doublemarker), val)
+
+	case bool:
+		if val {
+			return append(b, amf3truemarker)
+		}
+		return append(b, amf3falsemarker)
+
+	case string:
+		return self.appendString(append(b, amf3stringmarker), val)
+
+	case AMFXMLDocument:
+		b = appendAMF3U29(append(b, amf3xmldocmarker), uint32(len(val))<<1|1)
+		return append(b, val...)
+
+	case AMF3XML:
+		b = appendAMF3U29(append(b, amf3xmlmarker), uint32(len(val))<<1|1)
+		return append(b, val...)
+
+	case time.Time:
+		b = append(b, amf3datemarker, 0x01)
+		return appendAMF3Double(b, float64(val.UnixNano()/1000000))
+
+	case AMFArray:
+		b = appendAMF3U29(append(b, amf3arraymarker), uint32(len(val))<<1|1)
+		b = self.appendString(b, "")
+		for _, v := range val {
+			b = self.appendVal(b, v)
+		}
+		return b
+
+	case AMFECMAArray:
+		b = append(b, amf3arraymarker, 0x01)
+		for _, k := range sortedAMFKeys(val) {
+			if k != "" {
+				b = self.appendString(b, k)
+				b = self.appendVal(b, val[k])
+			}
+		}
+		return self.appendString(b, "")
+
+	case AMFMap:
+		return self.appendObject(b, AMF3Object{Dynamic: true, Values: val})
+
+	case AMF3Object:
+		return self.appendObject(b, val)
+
+	case []byte:
+		b = appendAMF3U29(append(b, amf3bytearraymarker), uint32(len(val))<<1|1)
+		return append(b, val...)
+
+	case []int32:
+		b = appendAMF3U29(append(b, amf3vectorintmarker), uint32(len(val))<<1|1)
+		b = append(b, 0)
+		for _, v := range val {
+			var buf [4]byte
+			pio.PutI32BE(buf[:], v)
+			b = append(b, buf[:]...)
+		}
+		return b
+
+	case []uint32:
+		b = appendAMF3U29(append(b, amf3vectoruintmarker), uint32(len(val))<<1|1)
+		b = append(b, 0)
+		for _, v := range val {
+			var buf [4]byte
+			pio.PutU32BE(buf[:], v)
+			b = append(b, buf[:]...)
+		}
+		return b
+
+	case []float64:
+		b = appendAMF3U29(append(b, amf3vectordoublemarker), uint32(len(val))<<1|1)
+		b = append(b, 0)
+		for _, v := range val {
+			b = appendAMF3Double(b, v)
+		}
+		return b
+
+	case AMF3Dictionary:
+		b = appendAMF3U29(append(b, amf3dictionarymarker), uint32(len(val.Keys))<<1|1)
+		if val.WeakKeys {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		for i, k := range val.Keys {
+			var v interface{}
+			if i < len(val.Values) {
+				v = val.Values[i]
+			}
+			b = self.appendVal(b, k)
+			b = self.appendVal(b, v)
+		}
+		return b
+	}
+
+	return append(b, amf3nullmarker)
+}
@@ -0,0 +1,143 @@
+package flvio
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAMF3RoundTrip(t *testing.T) {
+	date := time.Unix(1500000000, 123000000)
+	vals := []interface{}{
+		nil,
+		true,
+		false,
+		float64(0),
+		float64(127),
+		float64(-1),
+		float64(amf3IntMin),
+		float64(amf3IntMax),
+		float64(1 << 30),
+		3.25,
+		"",
+		"hello",
+		date,
+		AMF3XML("<a/>"),
+		AMFXMLDocument("<doc/>"),
+		[]byte{1, 2, 3},
+		[]int32{-1, 0, 1},
+		[]uint32{0, 0xffffffff},
+		[]float64{0.5, -2},
+		AMFArray{"a", "a", float64(1), AMFArray{}},
+		AMFECMAArray{"key": "val", "other": float64(2)},
+		AMFMap{"app": "live", "tcUrl": "rtmp://localhost/live", "objectEncoding": float64(3)},
+		AMFArray{
+			AMFMap{"x": float64(1), "y": "s"},
+			AMFMap{"x": float64(2), "y": "s"},
+		},
+		AMF3Object{
+			ClassName: "flex.messaging.messages.RemotingMessage",
+			Sealed:    []string{"operation", "body"},
+			Dynamic:   true,
+			Values:    AMFMap{"operation": "op", "body": AMFArray{"op"}, "extra": true},
+		},
+		AMF3Dictionary{
+			WeakKeys: true,
+			Keys:     []interface{}{"k", float64(1)},
+			Values:   []interface{}{"v", AMFMap{}},
+		},
+	}
+
+	for _, val := range vals {
+		b := AppendAMF3Val(nil, val)
+		got, n, err := ParseAMF3Val(b)
+		if err != nil {
+			t.Errorf("%#v: %s", val, err)
+			continue
+		}
+		if n != len(b) {
+			t.Errorf("%#v: parsed %d of %d bytes", val, n, len(b))
+		}
+		if tm, ok := val.(time.Time); ok {
+			if !tm.Equal(got.(time.Time)) {
+				t.Errorf("date: got %v want %v", got, tm)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, val) {
+			t.Errorf("got %#v want %#v", got, val)
+		}
+	}
+}
+
+func TestAMF3Integers(t *testing.T) {
+	cases := []struct {
+		val int
+		enc []byte
+	}{
+		{0, []byte{0x04, 0x00}},
+		{0x7f, []byte{0x04, 0x7f}},
+		{0x80, []byte{0x04, 0x81, 0x00}},
+		{0x3fff, []byte{0x04, 0xff, 0x7f}},
+		{0x4000, []byte{0x04, 0x81, 0x80, 0x00}},
+		{0x200000, []byte{0x04, 0x80, 0xc0, 0x80, 0x00}},
+		{-1, []byte{0x04, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, c := range cases {
+		b := AppendAMF3Val(nil, c.val)
+		if !bytes.Equal(b, c.enc) {
+			t.Errorf("%d: encoded % x want % x", c.val, b, c.enc)
+		}
+		got, _, err := ParseAMF3Val(c.enc)
+		if err != nil || got != float64(c.val) {
+			t.Errorf("%d: decoded %v %v", c.val, got, err)
+		}
+	}
+}
+
+func TestAMF3References(t *testing.T) {
+	// the second "abc" is a string reference and the second object reuses
+	// the traits of the first
+	b := AppendAMF3Val(nil, AMFArray{"abc", "abc", AMFMap{}, AMFMap{}})
+	want := []byte{
+		0x09, 0x09, 0x01,
+		0x06, 0x07, 'a', 'b', 'c',
+		0x06, 0x00,
+		0x0a, 0x0b, 0x01, 0x01,
+		0x0a, 0x01, 0x01,
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("encoded % x want % x", b, want)
+	}
+
+	// object reference: an array containing the same object twice
+	b = []byte{
+		0x09, 0x05, 0x01,
+		0x0a, 0x0b, 0x01, 0x03, 'k', 0x04, 0x01, 0x01,
+		0x0a, 0x02,
+	}
+	got, n, err := ParseAMF3Val(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) {
+		t.Errorf("parsed %d of %d bytes", n, len(b))
+	}
+	arr := got.(AMFArray)
+	if !reflect.DeepEqual(arr[0], AMFMap{"k": float64(1)}) || !reflect.DeepEqual(arr[0], arr[1]) {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestAMF0AvmplusSwitch(t *testing.T) {
+	obj := AMFMap{"code": "NetStream.Play.Start", "level": "status"}
+	b := append([]byte{avmplusobjectmarker}, AppendAMF3Val(nil, obj)...)
+	got, n, err := ParseAMF0Val(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) || !reflect.DeepEqual(got, obj) {
+		t.Errorf("got %#v n=%d", got, n)
+	}
+}
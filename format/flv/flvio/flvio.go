@@ -33,6 +33,7 @@ const (
 	SOUND_MULAW                 = 8
 	SOUND_AAC                   = 10
 	SOUND_SPEEX                 = 11
+	SOUND_EX_HEADER             = 9 // Enhanced RTMP, a FourCC follows
 
 	SOUND_5_5Khz = 0
 	SOUND_11Khz  = 1
@@ -54,12 +55,50 @@ const (
 	AVC_NALU   = 1
 	AVC_EOS    = 2
 
-	FRAME_KEY   = 1
-	FRAME_INTER = 2
+	FRAME_KEY     = 1
+	FRAME_INTER   = 2
+	FRAME_COMMAND = 5
 
 	VIDEO_H264 = 7
 )
 
+// Enhanced RTMP PacketType of the extended video and audio tag headers.
+const (
+	PKTTYPE_SEQUENCE_START         = 0
+	PKTTYPE_CODED_FRAMES           = 1
+	PKTTYPE_SEQUENCE_END           = 2
+	PKTTYPE_CODED_FRAMESX          = 3 // video only, CompositionTime is 0
+	PKTTYPE_METADATA               = 4
+	PKTTYPE_MPEG2TS_SEQUENCE_START = 5
+	PKTTYPE_MULTICHANNEL_CONFIG    = 4 // audio only
+)
+
+// Enhanced RTMP FourCC of the codecs.
+const (
+	FOURCC_AVC1 = 0x61766331 // avc1
+	FOURCC_HVC1 = 0x68766331 // hvc1
+	FOURCC_AV01 = 0x61763031 // av01
+	FOURCC_VP09 = 0x76703039 // vp09
+	FOURCC_OPUS = 0x4f707573 // Opus
+	FOURCC_MP4A = 0x6d703461 // mp4a
+	FOURCC_FLAC = 0x664c6143 // fLaC
+	FOURCC_AC3  = 0x61632d33 // ac-3
+	FOURCC_EAC3 = 0x65632d33 // ec-3
+	FOURCC_MP3  = 0x2e6d7033 // .mp3
+)
+
+// FourCCString returns the FourCC as the 4 characters used in the connect
+// command fourCcList.
+func FourCCString(fourcc uint32) string {
+	return string([]byte{byte(fourcc >> 24), byte(fourcc >> 16), byte(fourcc >> 8), byte(fourcc)})
+}
+
+// hasCompositionTime reports whether CodedFrames of the codec carry
+// CompositionTime.
+func hasCompositionTime(fourcc uint32) bool {
+	return fourcc == FOURCC_AVC1 || fourcc == FOURCC_HVC1
+}
+
 type Tag struct {
 	Type uint8
 
@@ -147,6 +186,14 @@ type Tag struct {
 	*/
 	AVCPacketType uint8
 
+	/*
+		Enhanced RTMP extended header, SoundFormat is SOUND_EX_HEADER for
+		audio. PacketType is PKTTYPE_*, FourCC is FOURCC_*.
+	*/
+	IsExHeader bool
+	PacketType uint8
+	FourCC     uint32
+
 	CompositionTime int32
 
 	Data []byte
@@ -174,6 +221,16 @@ func (self *Tag) audioParseHeader(b []byte) (n int, err error) {
 	self.SoundType = flags & 0x1
 
 	switch self.SoundFormat {
+	case SOUND_EX_HEADER:
+		if len(b) < n+4 {
+			err = fmt.Errorf("audiodata: parse invalid")
+			return
+		}
+		self.IsExHeader = true
+		self.PacketType = flags & 0xf
+		self.FourCC = pio.U32BE(b[n:])
+		n += 4
+
 	case SOUND_AAC:
 		if len(b) < n+1 {
 			err = fmt.Errorf("audiodata: parse invalid")
@@ -187,6 +244,14 @@ func (self *Tag) audioParseHeader(b []byte) (n int, err error) {
 }
 
 func (self Tag) audioFillHeader(b []byte) (n int) {
+	if self.IsExHeader {
+		b[n] = SOUND_EX_HEADER<<4 | self.PacketType&0xf
+		n++
+		pio.PutU32BE(b[n:], self.FourCC)
+		n += 4
+		return
+	}
+
 	var flags uint8
 	flags |= self.SoundFormat << 4
 	flags |= self.SoundRate << 2
@@ -210,9 +275,32 @@ func (self *Tag) videoParseHeader(b []byte) (n int, err error) {
 		return
 	}
 	flags := b[n]
+	n++
+
+	if flags&0x80 != 0 {
+		self.IsExHeader = true
+		self.FrameType = (flags >> 4) & 0x7
+		self.PacketType = flags & 0xf
+		if len(b) < n+4 {
+			err = fmt.Errorf("videodata: parse invalid")
+			return
+		}
+		self.FourCC = pio.U32BE(b[n:])
+		n += 4
+
+		if self.PacketType == PKTTYPE_CODED_FRAMES && hasCompositionTime(self.FourCC) {
+			if len(b) < n+3 {
+				err = fmt.Errorf("videodata: parse invalid")
+				return
+			}
+			self.CompositionTime = pio.I24BE(b[n:])
+			n += 3
+		}
+		return
+	}
+
 	self.FrameType = flags >> 4
 	self.CodecID = flags & 0xf
-	n++
 
 	if self.FrameType == FRAME_INTER || self.FrameType == FRAME_KEY {
 		if len(b) < n+4 {
@@ -230,6 +318,18 @@ func (self *Tag) videoParseHeader(b []byte) (n int, err error) {
 }
 
 func (self Tag) videoFillHeader(b []byte) (n int) {
+	if self.IsExHeader {
+		b[n] = 0x80 | (self.FrameType&0x7)<<4 | self.PacketType&0xf
+		n++
+		pio.PutU32BE(b[n:], self.FourCC)
+		n += 4
+		if self.PacketType == PKTTYPE_CODED_FRAMES && hasCompositionTime(self.FourCC) {
+			pio.PutI24BE(b[n:], self.CompositionTime)
+			n += 3
+		}
+		return
+	}
+
 	flags := self.FrameType<<4 | self.CodecID
 	b[n] = flags
 	n++
@@ -0,0 +1,94 @@
+package flvio
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestExTagHeaderRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		tag Tag
+		hdr []byte
+	}{
+		{
+			Tag{Type: TAG_VIDEO, IsExHeader: true, FrameType: FRAME_KEY, PacketType: PKTTYPE_SEQUENCE_START, FourCC: FOURCC_HVC1},
+			[]byte{0x90, 'h', 'v', 'c', '1'},
+		},
+		{
+			Tag{Type: TAG_VIDEO, IsExHeader: true, FrameType: FRAME_INTER, PacketType: PKTTYPE_CODED_FRAMES, FourCC: FOURCC_HVC1, CompositionTime: -40},
+			[]byte{0xa1, 'h', 'v', 'c', '1', 0xff, 0xff, 0xd8},
+		},
+		{
+			Tag{Type: TAG_VIDEO, IsExHeader: true, FrameType: FRAME_KEY, PacketType: PKTTYPE_CODED_FRAMESX, FourCC: FOURCC_HVC1},
+			[]byte{0x93, 'h', 'v', 'c', '1'},
+		},
+		{
+			// no CompositionTime for AV1 and VP9
+			Tag{Type: TAG_VIDEO, IsExHeader: true, FrameType: FRAME_KEY, PacketType: PKTTYPE_CODED_FRAMES, FourCC: FOURCC_AV01},
+			[]byte{0x91, 'a', 'v', '0', '1'},
+		},
+		{
+			Tag{Type: TAG_VIDEO, IsExHeader: true, FrameType: FRAME_INTER, PacketType: PKTTYPE_CODED_FRAMES, FourCC: FOURCC_VP09},
+			[]byte{0xa1, 'v', 'p', '0', '9'},
+		},
+		{
+			Tag{Type: TAG_AUDIO, IsExHeader: true, PacketType: PKTTYPE_SEQUENCE_START, FourCC: FOURCC_OPUS},
+			[]byte{0x90, 'O', 'p', 'u', 's'},
+		},
+		{
+			Tag{Type: TAG_AUDIO, IsExHeader: true, PacketType: PKTTYPE_CODED_FRAMES, FourCC: FOURCC_OPUS},
+			[]byte{0x91, 'O', 'p', 'u', 's'},
+		},
+	} {
+		b := make([]byte, MaxTagSubHeaderLength)
+		n := c.tag.FillHeader(b)
+		if !bytes.Equal(b[:n], c.hdr) {
+			t.Errorf("%s: filled % x", FourCCString(c.tag.FourCC), b[:n])
+			continue
+		}
+
+		tag := Tag{Type: c.tag.Type}
+		if n, err := tag.ParseHeader(append(c.hdr, 0xaa)); err != nil || n != len(c.hdr) {
+			t.Errorf("%s: parsed %d bytes, %v", FourCCString(c.tag.FourCC), n, err)
+			continue
+		}
+		if !tag.IsExHeader || tag.FrameType != c.tag.FrameType || tag.PacketType != c.tag.PacketType ||
+			tag.FourCC != c.tag.FourCC || tag.CompositionTime != c.tag.CompositionTime {
+			t.Errorf("%s: got %+v", FourCCString(c.tag.FourCC), tag)
+		}
+
+		// truncated headers
+		tag = Tag{Type: c.tag.Type}
+		if _, err := tag.ParseHeader(c.hdr[:len(c.hdr)-1]); err == nil {
+			t.Errorf("%s: truncated header accepted", FourCCString(c.tag.FourCC))
+		}
+	}
+}
+
+func TestTagHeaderRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		tag Tag
+		hdr []byte
+	}{
+		{
+			Tag{Type: TAG_VIDEO, FrameType: FRAME_KEY, CodecID: VIDEO_H264, AVCPacketType: AVC_NALU, CompositionTime: 80},
+			[]byte{0x17, 0x01, 0x00, 0x00, 0x50},
+		},
+		{
+			Tag{Type: TAG_AUDIO, SoundFormat: SOUND_AAC, SoundRate: SOUND_44Khz, SoundSize: SOUND_16BIT, SoundType: SOUND_STEREO, AACPacketType: AAC_RAW},
+			[]byte{0xaf, 0x01},
+		},
+	} {
+		b := make([]byte, MaxTagSubHeaderLength)
+		n := c.tag.FillHeader(b)
+		if !bytes.Equal(b[:n], c.hdr) {
+			t.Errorf("filled % x", b[:n])
+			continue
+		}
+		tag := Tag{Type: c.tag.Type}
+		if n, err := tag.ParseHeader(c.hdr); err != nil || n != len(c.hdr) || !reflect.DeepEqual(tag, c.tag) {
+			t.Errorf("got %+v, %d bytes, %v", tag, n, err)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package flvio
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Marshal encodes v as one AMF0 value, see MarshalValue.
+func Marshal(v interface{}) (b []byte, err error) {
+	var val interface{}
+	if val, err = MarshalValue(v); err != nil {
+		return
+	}
+	b = make([]byte, LenAMF0Val(val))
+	FillAMF0Val(b, val)
+	return
+}
+
+// Unmarshal parses one AMF0 value from b and stores it in v, see
+// UnmarshalValue.
+func Unmarshal(b []byte, v interface{}) (err error) {
+	var val interface{}
+	if val, _, err = ParseAMF0Val(b); err != nil {
+		return
+	}
+	return UnmarshalValue(val, v)
+}
+
+// MarshalValue converts a Go value to the values used by FillAMF0Val.
+// Numbers become float64, slices and arrays AMFArray, and maps with string
+// keys and structs AMFMap. The "amf" struct tag sets the key of a field,
+// "-" skips it and the "omitempty" option skips zero values, as in
+// encoding/json. Untagged fields use the field name. Embedded structs
+// without a tag have their fields flattened into the parent object.
+func MarshalValue(v interface{}) (val interface{}, err error) {
+	return marshalValue(reflect.ValueOf(v))
+}
+
+// UnmarshalValue stores an AMF value, as returned by ParseAMF0Val or
+// ParseAMF3Val, in the value pointed to by v. Object keys are matched to
+// struct fields as in MarshalValue, falling back to a case-insensitive
+// match. Keys without a matching field are ignored.
+func UnmarshalValue(val interface{}, v interface{}) (err error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		err = fmt.Errorf("flvio: UnmarshalValue needs a non-nil pointer, got %T", v)
+		return
+	}
+	return unmarshalValue(val, rv.Elem())
+}
+
+type amfField struct {
+	index     []int
+	name      string
+	omitempty bool
+}
+
+func amfStructFields(t reflect.Type) (fields []amfField) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("amf")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range amfStructFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, amfField{
+			index:     []int{i},
+			name:      name,
+			omitempty: opts == "omitempty",
+		})
+	}
+	return
+}
+
+func isEmptyValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return rv.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return rv.IsNil()
+	}
+	return false
+}
+
+var amfECMAArrayType = reflect.TypeOf(AMFECMAArray{})
+
+func marshalValue(rv reflect.Value) (val interface{}, err error) {
+	if !rv.IsValid() {
+		return
+	}
+
+	// values FillAMF0Val writes as they are
+	switch rv.Interface().(type) {
+	case time.Time, AMFTypedObject, AMFXMLDocument, AMF3Object, AMF3XML, AMF3Dictionary, []byte:
+		val = rv.Interface()
+		return
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		val = rv.Bool()
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val = float64(rv.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		val = float64(rv.Uint())
+
+	case reflect.Float32, reflect.Float64:
+		val = rv.Float()
+
+	case reflect.String:
+		val = rv.String()
+
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return
+		}
+		return marshalValue(rv.Elem())
+
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return
+		}
+		arr := make(AMFArray, rv.Len())
+		for i := range arr {
+			if arr[i], err = marshalValue(rv.Index(i)); err != nil {
+				return
+			}
+		}
+		val = arr
+
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			err = fmt.Errorf("flvio: unsupported map key type %s", rv.Type().Key())
+			return
+		}
+		if rv.IsNil() {
+			return
+		}
+		obj := map[string]interface{}{}
+		for _, k := range rv.MapKeys() {
+			if obj[k.String()], err = marshalValue(rv.MapIndex(k)); err != nil {
+				return
+			}
+		}
+		if rv.Type() == amfECMAArrayType {
+			val = AMFECMAArray(obj)
+		} else {
+			val = AMFMap(obj)
+		}
+
+	case reflect.Struct:
+		obj := AMFMap{}
+		for _, f := range amfStructFields(rv.Type()) {
+			fv := rv.FieldByIndex(f.index)
+			if f.omitempty && isEmptyValue(fv) {
+				continue
+			}
+			if obj[f.name], err = marshalValue(fv); err != nil {
+				return
+			}
+		}
+		val = obj
+
+	default:
+		err = fmt.Errorf("flvio: unsupported type %s", rv.Type())
+	}
+	return
+}
+
+func amfProps(val interface{}) (props map[string]interface{}, ok bool) {
+	switch obj := val.(type) {
+	case AMFMap:
+		return obj, true
+	case AMFECMAArray:
+		return obj, true
+	case AMFTypedObject:
+		return obj.Values, true
+	case AMF3Object:
+		return obj.Values, true
+	}
+	return
+}
+
+func unmarshalTypeErr(val interface{}, t reflect.Type) error {
+	return fmt.Errorf("flvio: cannot unmarshal %T into Go value of type %s", val, t)
+}
+
+func unmarshalValue(val interface{}, rv reflect.Value) (err error) {
+	if rv.Kind() == reflect.Ptr {
+		if val == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+			return
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return unmarshalValue(val, rv.Elem())
+	}
+
+	if val == nil {
+		rv.Set(reflect.Zero(rv.Type()))
+		return
+	}
+	if vv := reflect.ValueOf(val); vv.Type().AssignableTo(rv.Type()) {
+		rv.Set(vv)
+		return
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		b, ok := val.(bool)
+		if !ok {
+			return unmarshalTypeErr(val, rv.Type())
+		}
+		rv.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f, ok := val.(float64)
+		if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || rv.OverflowInt(int64(f)) {
+			return unmarshalTypeErr(val, rv.Type())
+		}
+		rv.SetInt(int64(f))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		f, ok := val.(float64)
+		if !ok || f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || rv.OverflowUint(uint64(f)) {
+			return unmarshalTypeErr(val, rv.Type())
+		}
+		rv.SetUint(uint64(f))
+
+	case reflect.Float32, reflect.Float64:
+		f, ok := val.(float64)
+		if !ok {
+			return unmarshalTypeErr(val, rv.Type())
+		}
+		rv.SetFloat(f)
+
+	case reflect.String:
+		switch s := val.(type) {
+		case string:
+			rv.SetString(s)
+		case AMFXMLDocument:
+			rv.SetString(string(s))
+		case AMF3XML:
+			rv.SetString(string(s))
+		default:
+			return unmarshalTypeErr(val, rv.Type())
+		}
+
+	case reflect.Slice, reflect.Array:
+		arr, ok := val.(AMFArray)
+		if !ok {
+			return unmarshalTypeErr(val, rv.Type())
+		}
+		if rv.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(rv.Type(), len(arr), len(arr)))
+		} else if len(arr) > rv.Len() {
+			return unmarshalTypeErr(val, rv.Type())
+		}
+		for i, v := range arr {
+			if err = unmarshalValue(v, rv.Index(i)); err != nil {
+				return
+			}
+		}
+
+	case reflect.Map:
+		props, ok := amfProps(val)
+		if !ok || rv.Type().Key().Kind() != reflect.String {
+			return unmarshalTypeErr(val, rv.Type())
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		for k, v := range props {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err = unmarshalValue(v, elem); err != nil {
+				return
+			}
+			rv.SetMapIndex(reflect.ValueOf(k).Convert(rv.Type().Key()), elem)
+		}
+
+	case reflect.Struct:
+		props, ok := amfProps(val)
+		if !ok {
+			return unmarshalTypeErr(val, rv.Type())
+		}
+		for _, f := range amfStructFields(rv.Type()) {
+			v, ok := props[f.name]
+			if !ok {
+				for k := range props {
+					if strings.EqualFold(k, f.name) {
+						v, ok = props[k], true
+						break
+					}
+				}
+			}
+			if !ok {
+				continue
+			}
+			if err = unmarshalValue(v, rv.FieldByIndex(f.index)); err != nil {
+				return
+			}
+		}
+
+	default:
+		return unmarshalTypeErr(val, rv.Type())
+	}
+	return
+}
@@ -0,0 +1,317 @@
+package flv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv/flvio"
+)
+
+type keyframe struct {
+	time time.Duration
+	pos  int64 // from the start of the file
+}
+
+func (self *Muxer) hasVideo() bool {
+	for _, stream := range self.streams {
+		if stream.Type().IsVideo() {
+			return true
+		}
+	}
+	return false
+}
+
+// packetDuration is the duration of audio packets, other packets are taken
+// to last as long as the gap to the previous one of their stream.
+func (self *Muxer) packetDuration(pkt av.Packet, stream av.CodecData) time.Duration {
+	if acodec, ok := stream.(av.AudioCodecData); ok {
+		if dur, err := acodec.PacketDuration(pkt.Data); err == nil {
+			return dur
+		}
+	}
+	if self.gotstream[pkt.Idx] && pkt.Time > self.lasttimes[pkt.Idx] {
+		return pkt.Time - self.lasttimes[pkt.Idx]
+	}
+	return 0
+}
+
+func (self *Muxer) addKeyframe(tm time.Duration, pos int64) {
+	if self.Keyframes <= 0 {
+		return
+	}
+	self.kfcount++
+	if (self.kfcount-1)%self.kfstep != 0 {
+		return
+	}
+	if len(self.keyframes) == self.Keyframes {
+		n := 0
+		for i := 0; i < len(self.keyframes); i += 2 {
+			self.keyframes[n] = self.keyframes[i]
+			n++
+		}
+		self.keyframes = self.keyframes[:n]
+		self.kfstep *= 2
+		if (self.kfcount-1)%self.kfstep != 0 {
+			return
+		}
+	}
+	self.keyframes = append(self.keyframes, keyframe{time: tm, pos: pos})
+}
+
+// fillMetadata sets the fields patched by WriteTrailer, arrays always have
+// Keyframes entries so the tag keeps its size.
+func (self *Muxer) fillMetadata() {
+	self.metadata["duration"] = self.duration.Seconds()
+	self.metadata["filesize"] = float64(self.w.n)
+
+	if !self.hasVideo() || self.Keyframes <= 0 {
+		return
+	}
+	times := make(flvio.AMFArray, self.Keyframes)
+	filepositions := make(flvio.AMFArray, self.Keyframes)
+	last := keyframe{}
+	for i := range times {
+		if i < len(self.keyframes) {
+			last = self.keyframes[i]
+		}
+		times[i] = last.time.Seconds()
+		filepositions[i] = float64(last.pos)
+	}
+	self.metadata["keyframes"] = flvio.AMFMap{
+		"times":         times,
+		"filepositions": filepositions,
+	}
+}
+
+func (self *Muxer) metadataTag() flvio.Tag {
+	val := flvio.AMFECMAArray(self.metadata)
+	b := make([]byte, flvio.LenAMF0Val("onMetaData")+flvio.LenAMF0Val(val))
+	n := flvio.FillAMF0Val(b, "onMetaData")
+	flvio.FillAMF0Val(b[n:], val)
+	return flvio.Tag{Type: flvio.TAG_SCRIPTDATA, Data: b}
+}
+
+func (self *Muxer) writeMetadata() (err error) {
+	if self.metadata, err = NewMetadataByStreams(self.streams); err != nil {
+		// codecs without an id in onMetaData, like Nellymoser
+		self.metadata = flvio.AMFMap{}
+		err = nil
+	}
+	if self.ws != nil {
+		self.fillMetadata()
+	}
+
+	tag := self.metadataTag()
+	self.metapos = self.w.n
+	self.metalen = len(tag.Data)
+	return flvio.WriteTag(self.w, tag, 0, self.b)
+}
+
+// patchMetadata rewrites onMetaData in place, the writer must be flushed.
+func (self *Muxer) patchMetadata() (err error) {
+	if self.ws == nil {
+		return
+	}
+	self.fillMetadata()
+	tag := self.metadataTag()
+	if len(tag.Data) != self.metalen {
+		err = fmt.Errorf("flv: onMetaData size changed")
+		return
+	}
+	if _, err = self.ws.Seek(self.base+self.metapos+flvio.TagHeaderLength, 0); err != nil {
+		return
+	}
+	if _, err = self.ws.Write(tag.Data); err != nil {
+		return
+	}
+	if _, err = self.ws.Seek(self.base+self.w.n, 0); err != nil {
+		return
+	}
+	return
+}
+
+func amfFloat64s(val interface{}) (f []float64) {
+	arr, _ := val.(flvio.AMFArray)
+	for _, v := range arr {
+		x, ok := v.(float64)
+		if !ok {
+			return nil
+		}
+		f = append(f, x)
+	}
+	return
+}
+
+func (self *Demuxer) handleScriptData(b []byte) {
+	name, n, err := flvio.ParseAMF0Val(b)
+	if err != nil || name != "onMetaData" {
+		return
+	}
+	val, _, err := flvio.ParseAMF0Val(b[n:])
+	if err != nil {
+		return
+	}
+	metadata, _ := val.(flvio.AMFMap)
+	if metadata == nil || self.metadata != nil {
+		return
+	}
+	self.metadata = metadata
+
+	keyframes, _ := metadata["keyframes"].(flvio.AMFMap)
+	times := amfFloat64s(keyframes["times"])
+	filepositions := amfFloat64s(keyframes["filepositions"])
+	if len(times) == 0 || len(times) != len(filepositions) {
+		return
+	}
+	for i := range times {
+		kf := keyframe{
+			time: time.Duration(times[i] * float64(time.Second)),
+			pos:  int64(filepositions[i]),
+		}
+		// placeholders of an unfinished file and the padding of the arrays
+		if kf.pos < self.firsttag {
+			continue
+		}
+		if n := len(self.index); n > 0 && kf.pos <= self.index[n-1].pos {
+			continue
+		}
+		self.index = append(self.index, kf)
+	}
+	if len(self.index) > 0 {
+		self.scanned = true
+	}
+}
+
+// Metadata returns the onMetaData found before the first packets, nil when
+// there is none.
+func (self *Demuxer) Metadata() (metadata flvio.AMFMap, err error) {
+	if err = self.prepare(); err != nil {
+		return
+	}
+	metadata = self.metadata
+	return
+}
+
+func (self *Demuxer) Duration() (dur time.Duration, err error) {
+	if err = self.prepare(); err != nil {
+		return
+	}
+	if d, ok := self.metadata["duration"].(float64); ok {
+		dur = time.Duration(d * float64(time.Second))
+	}
+	return
+}
+
+func (self *Demuxer) seek(pos int64) (err error) {
+	if _, err = self.rs.Seek(self.base+pos, 0); err != nil {
+		return
+	}
+	self.bufr.Reset(self.rs)
+	return
+}
+
+// scan indexes keyframes from scanpos until the first tag after tm. Files
+// without video index a tag every second.
+func (self *Demuxer) scan(tm time.Duration) (err error) {
+	if self.scanpos == 0 {
+		self.scanpos = self.firsttag
+		self.scantime = -1
+	}
+	if _, err = self.rs.Seek(self.base+self.scanpos, 0); err != nil {
+		return
+	}
+	r := bufio.NewReaderSize(self.rs, 4096)
+
+	hasvideo := self.prober.GotVideo
+	b := make([]byte, flvio.TagHeaderLength+flvio.MaxTagSubHeaderLength)
+	for !self.scanned && self.scantime <= tm {
+		if _, err = io.ReadFull(r, b[:flvio.TagHeaderLength]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				self.scanned = true
+				err = nil
+			}
+			return
+		}
+		var tag flvio.Tag
+		var ts int32
+		var datalen int
+		if tag, ts, datalen, err = flvio.ParseTagHeader(b); err != nil {
+			return
+		}
+		tagtime := flvio.TsToTime(ts)
+
+		hdrlen := datalen
+		if hdrlen > flvio.MaxTagSubHeaderLength {
+			hdrlen = flvio.MaxTagSubHeaderLength
+		}
+		hdr := b[flvio.TagHeaderLength : flvio.TagHeaderLength+hdrlen]
+		if _, err = io.ReadFull(r, hdr); err != nil {
+			return
+		}
+
+		iskey := false
+		switch {
+		case hasvideo && tag.Type == flvio.TAG_VIDEO:
+			if _, err := tag.ParseHeader(hdr); err == nil && tag.FrameType == flvio.FRAME_KEY {
+				if tag.IsExHeader {
+					iskey = tag.PacketType == flvio.PKTTYPE_CODED_FRAMES || tag.PacketType == flvio.PKTTYPE_CODED_FRAMESX
+				} else {
+					iskey = tag.AVCPacketType == flvio.AVC_NALU
+				}
+			}
+		case !hasvideo && tag.Type == flvio.TAG_AUDIO:
+			n := len(self.index)
+			iskey = n == 0 || tagtime >= self.index[n-1].time+time.Second
+		}
+		if iskey {
+			self.index = append(self.index, keyframe{time: tagtime, pos: self.scanpos})
+		}
+
+		if _, err = r.Discard(datalen - hdrlen + flvio.TagTrailerLength); err != nil {
+			if err == io.EOF {
+				self.scanned = true
+				err = nil
+			}
+			return
+		}
+		self.scanpos += int64(flvio.TagHeaderLength + datalen + flvio.TagTrailerLength)
+		self.scantime = tagtime
+	}
+	return
+}
+
+// SeekToTime moves to the last keyframe at or before tm, the first one if
+// tm is before it.
+func (self *Demuxer) SeekToTime(tm time.Duration) (err error) {
+	if err = self.prepare(); err != nil {
+		return
+	}
+	if self.rs == nil {
+		err = fmt.Errorf("flv: seeking needs an io.ReadSeeker")
+		return
+	}
+	if err = self.scan(tm); err != nil {
+		return
+	}
+	if len(self.index) == 0 {
+		err = fmt.Errorf("flv: no keyframes to seek")
+		return
+	}
+
+	kf := self.index[0]
+	for _, k := range self.index {
+		if k.time > tm {
+			break
+		}
+		kf = k
+	}
+
+	if err = self.seek(kf.pos); err != nil {
+		return
+	}
+	self.prober.CachedPkts = nil
+	return
+}
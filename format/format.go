@@ -7,6 +7,12 @@ import (
 	"github.com/nareix/joy4/format/rtsp"
 	"github.com/nareix/joy4/format/flv"
 	"github.com/nareix/joy4/format/aac"
+	"github.com/nareix/joy4/format/hls"
+	"github.com/nareix/joy4/format/mkv"
+	"github.com/nareix/joy4/format/dash"
+	"github.com/nareix/joy4/format/ps"
+	"github.com/nareix/joy4/format/wav"
+	"github.com/nareix/joy4/format/h264"
 	"github.com/nareix/joy4/av/avutil"
 )
 
@@ -17,5 +23,14 @@ func RegisterAll() {
 	avutil.DefaultHandlers.Add(rtsp.Handler)
 	avutil.DefaultHandlers.Add(flv.Handler)
 	avutil.DefaultHandlers.Add(aac.Handler)
+	avutil.DefaultHandlers.Add(hls.Handler)
+	avutil.DefaultHandlers.Add(dash.Handler)
+	avutil.DefaultHandlers.Add(ps.Handler)
+	avutil.DefaultHandlers.Add(ps.MpgHandler)
+	avutil.DefaultHandlers.Add(mkv.Handler)
+	avutil.DefaultHandlers.Add(mkv.WebmHandler)
+	avutil.DefaultHandlers.Add(wav.Handler)
+	avutil.DefaultHandlers.Add(h264.Handler)
+	avutil.DefaultHandlers.Add(h264.Handler264)
 }
 
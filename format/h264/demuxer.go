@@ -0,0 +1,238 @@
+// Package h264 reads and writes raw H264 Annex B elementary streams, the
+// .h264/.264 files dumped by cameras and encoders.
+package h264
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+var CodecTypes = []av.CodecType{av.H264}
+
+// DefaultFrameRate is used when neither Demuxer.FrameRate nor the SPS VUI
+// gives the frame rate.
+var DefaultFrameRate = 25.0
+
+var startCode = []byte{0, 0, 1}
+
+// Demuxer splits the byte stream into access units. A new one starts at an
+// AUD, SEI or parameter set after a slice, or at a slice with
+// first_mb_in_slice 0. Streams are in decode order so packets only carry
+// DTS, made from the frame count and the frame rate.
+type Demuxer struct {
+	// FrameRate overrides the VUI timing of the SPS when it's not 0.
+	FrameRate float64
+
+	r     io.Reader
+	rbuf  []byte
+	buf   []byte
+	scan  int
+	found bool
+	eof   bool
+
+	nalus    [][]byte
+	hasvcl   bool
+	keyframe bool
+
+	sps, pps  []byte
+	codecData av.CodecData
+	fps       float64
+	frames    int64
+	pkts      []av.Packet
+}
+
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:    r,
+		rbuf: make([]byte, 64*1024),
+	}
+}
+
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	streams = []av.CodecData{self.codecData}
+	return
+}
+
+func (self *Demuxer) probe() (err error) {
+	for self.codecData == nil {
+		if err = self.poll(); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("h264: SPS or PPS not found")
+			}
+			return
+		}
+	}
+	return
+}
+
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	for len(self.pkts) == 0 {
+		if err = self.poll(); err != nil {
+			return
+		}
+	}
+	pkt = self.pkts[0]
+	self.pkts = self.pkts[1:]
+	return
+}
+
+func (self *Demuxer) poll() (err error) {
+	var nalu []byte
+	if nalu, err = self.readNALU(); err != nil {
+		if err == io.EOF && self.hasvcl {
+			self.flushAU()
+			err = nil
+		}
+		return
+	}
+	err = self.handleNALU(nalu)
+	return
+}
+
+// readNALU returns the data up to the next start code, without the zeros of
+// 4 bytes start codes and trailing_zero_8bits.
+func (self *Demuxer) readNALU() (nalu []byte, err error) {
+	for {
+		if i := bytes.Index(self.buf[self.scan:], startCode); i >= 0 {
+			i += self.scan
+			nalu = bytes.TrimRight(self.buf[:i], "\x00")
+			self.buf = self.buf[i+len(startCode):]
+			self.scan = 0
+			if !self.found {
+				// garbage before the first start code
+				self.found = true
+				continue
+			}
+			if len(nalu) > 0 {
+				return
+			}
+			continue
+		}
+
+		if self.eof {
+			if self.found {
+				nalu = bytes.TrimRight(self.buf, "\x00")
+			}
+			self.buf = nil
+			self.scan = 0
+			if len(nalu) == 0 {
+				err = io.EOF
+			}
+			return
+		}
+
+		// a start code may be cut at the end of buf
+		if self.scan = len(self.buf) - (len(startCode) - 1); self.scan < 0 {
+			self.scan = 0
+		}
+		var n int
+		n, err = self.r.Read(self.rbuf)
+		self.buf = append(self.buf, self.rbuf[:n]...)
+		if err == io.EOF {
+			self.eof = true
+			err = nil
+		} else if err != nil {
+			return
+		}
+	}
+}
+
+func (self *Demuxer) handleNALU(nalu []byte) (err error) {
+	typ := nalu[0] & 0x1f
+	switch {
+	case typ >= 1 && typ <= 5:
+		// first_mb_in_slice is ue(v) 0 when its first bit is set
+		if self.hasvcl && len(nalu) > 1 && nalu[1]&0x80 != 0 {
+			self.flushAU()
+		}
+		self.hasvcl = true
+		if typ == 5 {
+			self.keyframe = true
+		}
+		self.nalus = append(self.nalus, nalu)
+
+	case typ == 6 || typ == 7 || typ == 8 || typ == 9 || (typ >= 14 && typ <= 18):
+		if self.hasvcl {
+			self.flushAU()
+		}
+		switch typ {
+		case 7:
+			self.sps = append([]byte(nil), nalu...)
+			err = self.newCodecData()
+		case 8:
+			self.pps = append([]byte(nil), nalu...)
+			err = self.newCodecData()
+		case 9:
+			// AUDs are dropped
+		default:
+			self.nalus = append(self.nalus, nalu)
+		}
+
+	default:
+		self.nalus = append(self.nalus, nalu)
+	}
+	return
+}
+
+// newCodecData uses the first SPS and PPS, later ones are dropped from the
+// packets like in the other demuxers.
+func (self *Demuxer) newCodecData() (err error) {
+	if self.codecData != nil || self.sps == nil || self.pps == nil {
+		return
+	}
+	var codecData h264parser.CodecData
+	if codecData, err = h264parser.NewCodecDataFromSPSAndPPS(self.sps, self.pps); err != nil {
+		err = fmt.Errorf("h264: parse SPS failed: %s", err)
+		return
+	}
+	self.fps = self.FrameRate
+	if self.fps <= 0 {
+		var info h264parser.SPSInfo
+		if info, err = h264parser.ParseSPS(self.sps); err != nil {
+			return
+		}
+		self.fps = info.FrameRate()
+	}
+	if self.fps <= 0 {
+		self.fps = DefaultFrameRate
+	}
+	self.codecData = codecData
+	return
+}
+
+func (self *Demuxer) flushAU() {
+	if self.hasvcl && self.codecData != nil {
+		n := 0
+		for _, nalu := range self.nalus {
+			n += 4 + len(nalu)
+		}
+		b := make([]byte, n)
+		n = 0
+		for _, nalu := range self.nalus {
+			pio.PutU32BE(b[n:], uint32(len(nalu)))
+			n += 4
+			n += copy(b[n:], nalu)
+		}
+		self.pkts = append(self.pkts, av.Packet{
+			IsKeyFrame: self.keyframe,
+			Time:       time.Duration(float64(self.frames) * float64(time.Second) / self.fps),
+			Data:       b,
+		})
+		self.frames++
+	}
+	self.nalus = self.nalus[:0]
+	self.hasvcl = false
+	self.keyframe = false
+}
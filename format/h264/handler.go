@@ -0,0 +1,55 @@
+package h264
+
+import (
+	"io"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+)
+
+// probe accepts streams starting with a start code and an AUD, SEI or SPS.
+func probe(b []byte) bool {
+	i := 0
+	for i < 3 && b[i] == 0 {
+		i++
+	}
+	if i < 2 || b[i] != 1 {
+		return false
+	}
+	hdr := b[i+1]
+	if hdr&0x80 != 0 {
+		return false
+	}
+	switch hdr & 0x1f {
+	case 6, 9:
+		return hdr&0x60 == 0
+	case 7:
+		return hdr&0x60 != 0
+	}
+	return false
+}
+
+func handler(h *avutil.RegisterHandler, ext string) {
+	h.Ext = ext
+
+	h.Probe = probe
+
+	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
+		return NewDemuxer(r)
+	}
+
+	h.WriterMuxer = func(w io.Writer) av.Muxer {
+		return NewMuxer(w)
+	}
+
+	h.CodecTypes = CodecTypes
+}
+
+func Handler(h *avutil.RegisterHandler) {
+	handler(h, ".h264")
+}
+
+// Handler264 registers the .264 extension.
+func Handler264(h *avutil.RegisterHandler) {
+	handler(h, ".264")
+}
@@ -0,0 +1,67 @@
+package h264
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// Muxer writes packets as Annex B with 4 bytes start codes. SPS and PPS
+// are written before every keyframe that doesn't carry them.
+type Muxer struct {
+	w         io.Writer
+	codecData h264parser.CodecData
+	b         []byte
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w: w,
+	}
+}
+
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	if len(streams) != 1 || streams[0].Type() != av.H264 {
+		err = fmt.Errorf("h264: must be only one h264 stream")
+		return
+	}
+	self.codecData = streams[0].(h264parser.CodecData)
+	return
+}
+
+func (self *Muxer) appendNALU(nalu []byte) {
+	self.b = append(self.b, 0, 0, 0, 1)
+	self.b = append(self.b, nalu...)
+}
+
+func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+
+	self.b = self.b[:0]
+	if pkt.IsKeyFrame {
+		hasparams := false
+		for _, nalu := range nalus {
+			if len(nalu) > 0 && nalu[0]&0x1f == 7 {
+				hasparams = true
+			}
+		}
+		if !hasparams {
+			self.appendNALU(self.codecData.SPS())
+			self.appendNALU(self.codecData.PPS())
+		}
+	}
+	for _, nalu := range nalus {
+		if len(nalu) > 0 {
+			self.appendNALU(nalu)
+		}
+	}
+
+	_, err = self.w.Write(self.b)
+	return
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	return
+}
@@ -0,0 +1,244 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/ts"
+)
+
+// LiveStartSegments is the number of segments from the end of a live
+// playlist where playback starts.
+var LiveStartSegments = 3
+
+// Demuxer reads an HLS stream through its master or media playlist and
+// returns the packets of all segments as one continuous stream.
+type Demuxer struct {
+	Fetcher Fetcher
+
+	// SelectVariant picks the variant to play from a master playlist,
+	// by default the one with the highest bandwidth.
+	SelectVariant func([]Variant) int
+
+	uri      string
+	mediauri string
+	playlist *MediaPlaylist
+	nextseq  int
+	reloaded time.Time
+
+	streams   []av.CodecData
+	seg       io.ReadCloser
+	tsdemuxer *ts.Demuxer
+
+	segdur   time.Duration
+	segstart time.Duration // output time of the first packet of the current segment
+	segpkt   bool          // got a packet from the current segment
+	offset   time.Duration // added to timestamps of the current segment
+	resync   bool
+	stage    int
+}
+
+func NewDemuxer(uri string) *Demuxer {
+	return &Demuxer{
+		uri:     uri,
+		Fetcher: DefaultFetcher{},
+	}
+}
+
+func selectHighestBandwidth(variants []Variant) (idx int) {
+	for i, variant := range variants {
+		if variant.Bandwidth > variants[idx].Bandwidth {
+			idx = i
+		}
+	}
+	return
+}
+
+func (self *Demuxer) fetchPlaylist(uri string) (master *MasterPlaylist, media *MediaPlaylist, err error) {
+	var r io.ReadCloser
+	if r, err = self.Fetcher.Fetch(uri); err != nil {
+		return
+	}
+	defer r.Close()
+	var data []byte
+	if data, err = ioutil.ReadAll(r); err != nil {
+		return
+	}
+	return ParsePlaylist(data)
+}
+
+func (self *Demuxer) loadPlaylist() (err error) {
+	var master *MasterPlaylist
+	var media *MediaPlaylist
+
+	if master, media, err = self.fetchPlaylist(self.uri); err != nil {
+		return
+	}
+	self.mediauri = self.uri
+
+	if master != nil {
+		if len(master.Variants) == 0 {
+			err = fmt.Errorf("hls: master playlist has no variants")
+			return
+		}
+		selectfn := self.SelectVariant
+		if selectfn == nil {
+			selectfn = selectHighestBandwidth
+		}
+		i := selectfn(master.Variants)
+		if i < 0 || i >= len(master.Variants) {
+			err = fmt.Errorf("hls: variant index=%d invalid", i)
+			return
+		}
+		self.mediauri = resolveURI(self.uri, master.Variants[i].URI)
+		if _, media, err = self.fetchPlaylist(self.mediauri); err != nil {
+			return
+		}
+		if media == nil {
+			err = fmt.Errorf("hls: variant %s is not a media playlist", self.mediauri)
+			return
+		}
+	}
+
+	self.playlist = media
+	self.reloaded = time.Now()
+	self.nextseq = media.MediaSequence
+	if !media.Ended && len(media.Segments) > LiveStartSegments {
+		self.nextseq += len(media.Segments) - LiveStartSegments
+	}
+	return
+}
+
+func (self *Demuxer) reloadPlaylist() (err error) {
+	// reload no more often than half the target duration as the spec recommends
+	wait := self.playlist.TargetDuration / 2
+	if elapsed := time.Since(self.reloaded); elapsed < wait {
+		time.Sleep(wait - elapsed)
+	}
+
+	var media *MediaPlaylist
+	if _, media, err = self.fetchPlaylist(self.mediauri); err != nil {
+		return
+	}
+	if media == nil {
+		err = fmt.Errorf("hls: reloaded %s is not a media playlist", self.mediauri)
+		return
+	}
+	if self.nextseq < media.MediaSequence {
+		// fell behind the live window
+		self.nextseq = media.MediaSequence
+		self.resync = true
+	}
+	self.playlist = media
+	self.reloaded = time.Now()
+	return
+}
+
+func (self *Demuxer) openNextSegment() (err error) {
+	for {
+		i := self.nextseq - self.playlist.MediaSequence
+		if i >= 0 && i < len(self.playlist.Segments) {
+			seg := self.playlist.Segments[i]
+			if self.seg != nil {
+				self.seg.Close()
+				self.seg = nil
+			}
+			if self.seg, err = self.Fetcher.Fetch(resolveURI(self.mediauri, seg.URI)); err != nil {
+				return
+			}
+			self.tsdemuxer = ts.NewDemuxer(self.seg)
+			if self.segpkt {
+				self.segstart += self.segdur
+				self.segpkt = false
+			}
+			self.segdur = seg.Duration
+			if seg.Discontinuity {
+				self.resync = true
+			}
+			self.nextseq++
+			return
+		}
+		if self.playlist.Ended {
+			err = io.EOF
+			return
+		}
+		if err = self.reloadPlaylist(); err != nil {
+			return
+		}
+	}
+}
+
+func (self *Demuxer) probe() (err error) {
+	if self.stage == 0 {
+		if err = self.loadPlaylist(); err != nil {
+			return
+		}
+		if err = self.openNextSegment(); err != nil {
+			return
+		}
+		if self.streams, err = self.tsdemuxer.Streams(); err != nil {
+			return
+		}
+		self.resync = false
+		self.stage++
+	}
+	return
+}
+
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	streams = self.streams
+	return
+}
+
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+
+	for {
+		if pkt, err = self.tsdemuxer.ReadPacket(); err == nil {
+			break
+		}
+		if err != io.EOF {
+			return
+		}
+		if err = self.openNextSegment(); err != nil {
+			return
+		}
+		var streams []av.CodecData
+		if streams, err = self.tsdemuxer.Streams(); err != nil {
+			return
+		}
+		if len(streams) != len(self.streams) {
+			err = fmt.Errorf("hls: segment stream count changed from %d to %d", len(self.streams), len(streams))
+			return
+		}
+	}
+
+	if !self.segpkt {
+		// keep timestamps continuous: after a discontinuity the first packet of
+		// the segment is placed where the previous segment ended
+		if self.resync {
+			self.offset = self.segstart - pkt.Time
+			self.resync = false
+		}
+		self.segstart = pkt.Time + self.offset
+		self.segpkt = true
+	}
+	pkt.Time += self.offset
+	return
+}
+
+func (self *Demuxer) Close() (err error) {
+	if self.seg != nil {
+		err = self.seg.Close()
+		self.seg = nil
+	}
+	return
+}
@@ -0,0 +1,204 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	data := []byte("#EXTM3U\r\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS=\"avc1.64001f,mp4a.40.2\",RESOLUTION=1280x720\r\n" +
+		"high/index.m3u8\r\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=640000,RESOLUTION=640x360\r\n" +
+		"low/index.m3u8\r\n")
+	master, media, err := ParsePlaylist(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Variant{
+		{URI: "high/index.m3u8", Bandwidth: 1280000, Codecs: "avc1.64001f,mp4a.40.2", Resolution: "1280x720"},
+		{URI: "low/index.m3u8", Bandwidth: 640000, Resolution: "640x360"},
+	}
+	if media != nil || master == nil || !reflect.DeepEqual(master.Variants, want) {
+		t.Errorf("got master %+v media %+v", master, media)
+	}
+
+	playlist := MediaPlaylist{
+		Version:               3,
+		TargetDuration:        4 * time.Second,
+		MediaSequence:         7,
+		DiscontinuitySequence: 1,
+		Segments: []Segment{
+			{URI: "index7.ts", Duration: 4 * time.Second, ProgramDateTime: time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)},
+			{URI: "index8.ts", Duration: 3500 * time.Millisecond, Discontinuity: true, CueOut: true, CueOutDuration: 30 * time.Second},
+			{URI: "index9.ts", Duration: 4 * time.Second, CueIn: true},
+		},
+		Ended: true,
+	}
+	if master, media, err = ParsePlaylist(playlist.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if master != nil || media == nil || !reflect.DeepEqual(*media, playlist) {
+		t.Errorf("got master %+v media %+v", master, media)
+	}
+
+	if _, _, err = ParsePlaylist([]byte("index0.ts\n")); err == nil {
+		t.Error("playlist without header accepted")
+	}
+}
+
+func TestResolveURI(t *testing.T) {
+	for _, c := range [][3]string{
+		{"http://example.com/live/index.m3u8", "index0.ts", "http://example.com/live/index0.ts"},
+		{"http://example.com/live/index.m3u8", "/vod/index0.ts", "http://example.com/vod/index0.ts"},
+		{"http://example.com/live/index.m3u8", "https://cdn.example.com/index0.ts", "https://cdn.example.com/index0.ts"},
+		{"out/index.m3u8", "index0.ts", filepath.Join("out", "index0.ts")},
+		{"index.m3u8", "low/index.m3u8", filepath.Join("low", "index.m3u8")},
+		{"/srv/out/index.m3u8", "index0.ts", filepath.Join("/srv/out", "index0.ts")},
+		{"out/index.m3u8", "/srv/index0.ts", "/srv/index0.ts"},
+		{"out/index.m3u8", "http://example.com/index0.ts", "http://example.com/index0.ts"},
+	} {
+		if got := resolveURI(c[0], c[1]); got != c[2] {
+			t.Errorf("resolveURI(%q, %q) = %q, want %q", c[0], c[1], got, c[2])
+		}
+	}
+}
+
+// testFetcher serves files from memory and counts the fetches of each URI.
+type testFetcher struct {
+	files   map[string][]byte
+	fetched map[string]int
+	// playlists returns the content of a playlist for its n-th fetch
+	playlists map[string]func(n int) []byte
+}
+
+func (self *testFetcher) Fetch(uri string) (io.ReadCloser, error) {
+	self.fetched[uri]++
+	if fn := self.playlists[uri]; fn != nil {
+		return ioutil.NopCloser(bytes.NewReader(fn(self.fetched[uri]))), nil
+	}
+	if data, ok := self.files[uri]; ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil, fmt.Errorf("%s not found", uri)
+}
+
+func readAll(t *testing.T, demuxer av.Demuxer) (pkts []av.Packet) {
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func countVideo(t *testing.T, pkts []av.Packet) (n int) {
+	var last time.Duration
+	for _, pkt := range pkts {
+		if pkt.Idx != 0 {
+			continue
+		}
+		if n > 0 && pkt.Time <= last {
+			t.Fatalf("video time %v after %v", pkt.Time, last)
+		}
+		last = pkt.Time
+		n++
+	}
+	return
+}
+
+func TestDemuxerLiveReload(t *testing.T) {
+	storage := memStorage{}
+	muxer := NewMuxer(storage)
+	muxer.TargetDuration = time.Second
+	if err := muxer.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	muxInterleaved(t, muxer, 0, 100)
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	_, media, err := ParsePlaylist(storage["index.m3u8"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media.Segments) != 4 {
+		t.Fatalf("got %d segments", len(media.Segments))
+	}
+
+	fetcher := &testFetcher{files: map[string][]byte{}, fetched: map[string]int{}}
+	for _, seg := range media.Segments {
+		fetcher.files["http://example.com/live/high/"+seg.URI] = storage[seg.URI]
+	}
+	fetcher.playlists = map[string]func(int) []byte{
+		"http://example.com/live/master.m3u8": func(int) []byte {
+			return []byte("#EXTM3U\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=200000\nhigh/index.m3u8\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=100000\nlow/index.m3u8\n")
+		},
+		// two segments live, then all of them and the end
+		"http://example.com/live/high/index.m3u8": func(n int) []byte {
+			live := *media
+			live.TargetDuration = 100 * time.Millisecond
+			if n == 1 {
+				live.Segments = live.Segments[:2]
+				live.Ended = false
+			}
+			return live.Marshal()
+		},
+	}
+
+	demuxer := NewDemuxer("http://example.com/live/master.m3u8")
+	demuxer.Fetcher = fetcher
+	pkts := readAll(t, demuxer)
+	if n := countVideo(t, pkts); n != 100 {
+		t.Errorf("got %d video packets", n)
+	}
+	if n := fetcher.fetched["http://example.com/live/high/index.m3u8"]; n != 2 {
+		t.Errorf("media playlist fetched %d times", n)
+	}
+	for _, seg := range media.Segments {
+		if n := fetcher.fetched["http://example.com/live/high/"+seg.URI]; n != 1 {
+			t.Errorf("%s fetched %d times", seg.URI, n)
+		}
+	}
+}
+
+func TestDemuxerRelativePath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	muxer := NewMuxer(NewDirStorage("out"))
+	if err = muxer.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	muxInterleaved(t, muxer, 0, 50)
+	if err = muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	demuxer := NewDemuxer(filepath.Join("out", "index.m3u8"))
+	defer demuxer.Close()
+	if n := countVideo(t, readAll(t, demuxer)); n != 50 {
+		t.Errorf("got %d video packets", n)
+	}
+}
@@ -0,0 +1,78 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fetcher opens playlists and segments for Demuxer.
+type Fetcher interface {
+	Fetch(uri string) (io.ReadCloser, error)
+}
+
+// HTTPFetcher fetches http:// and https:// URIs.
+type HTTPFetcher struct {
+	Client *http.Client
+}
+
+func (self HTTPFetcher) Fetch(uri string) (r io.ReadCloser, err error) {
+	client := self.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var resp *http.Response
+	if resp, err = client.Get(uri); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("hls: fetch %s failed: %s", uri, resp.Status)
+		return
+	}
+	r = resp.Body
+	return
+}
+
+// FileFetcher opens local files.
+type FileFetcher struct{}
+
+func (self FileFetcher) Fetch(uri string) (r io.ReadCloser, err error) {
+	if u, _ := url.Parse(uri); u != nil && u.Scheme == "file" {
+		uri = u.Path
+	}
+	return os.Open(uri)
+}
+
+// DefaultFetcher uses HTTPFetcher for http(s) URIs and FileFetcher for others.
+type DefaultFetcher struct {
+	HTTPFetcher
+	FileFetcher
+}
+
+func (self DefaultFetcher) Fetch(uri string) (io.ReadCloser, error) {
+	if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+		return self.HTTPFetcher.Fetch(uri)
+	}
+	return self.FileFetcher.Fetch(uri)
+}
+
+func resolveURI(base, ref string) string {
+	refu, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	baseu, err := url.Parse(base)
+	if err != nil || baseu.Scheme == "" {
+		// local playlists keep relative paths relative
+		if refu.Scheme != "" || filepath.IsAbs(ref) {
+			return ref
+		}
+		return filepath.Join(filepath.Dir(base), ref)
+	}
+	return baseu.ResolveReference(refu).String()
+}
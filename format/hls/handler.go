@@ -0,0 +1,54 @@
+package hls
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/format/ts"
+)
+
+var CodecTypes = ts.CodecTypes
+
+type closeMuxer struct {
+	*Muxer
+}
+
+func (self closeMuxer) Close() error {
+	return nil
+}
+
+func isPlaylistURI(uri string) bool {
+	if u, err := url.Parse(uri); err == nil {
+		uri = u.Path
+	}
+	return strings.HasSuffix(uri, ".m3u8")
+}
+
+func Handler(h *avutil.RegisterHandler) {
+	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
+		if !strings.HasSuffix(uri, ".m3u8") || strings.Contains(uri, "://") {
+			return
+		}
+		ok = true
+		dir, name := filepath.Split(uri)
+		m := NewMuxer(NewDirStorage(dir))
+		m.PlaylistName = name
+		m.SegmentPrefix = strings.TrimSuffix(name, ".m3u8")
+		muxer = closeMuxer{Muxer: m}
+		return
+	}
+
+	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
+		if !isPlaylistURI(uri) {
+			return
+		}
+		ok = true
+		demuxer = NewDemuxer(uri)
+		return
+	}
+
+	h.CodecTypes = CodecTypes
+}
@@ -0,0 +1,313 @@
+package hls
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/ts"
+	"github.com/nareix/joy4/format/ts/tsio"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// Muxer cuts MPEG-TS segments at keyframes and keeps a rolling media playlist.
+type Muxer struct {
+	TargetDuration  time.Duration // minimum segment duration, default 6s
+	WindowSize      int           // segments kept in the playlist, 0 keeps all
+	DeleteSegments  bool          // remove segments that left the playlist from storage
+	ProgramDateTime bool          // write EXT-X-PROGRAM-DATE-TIME for each segment
+	PlaylistName    string        // default index.m3u8
+	SegmentPrefix   string        // segments are named <prefix><sequence>.ts, default segment
+
+	// DiscontinuityThreshold is the largest forward timestamp jump of a stream
+	// treated as continuous, larger jumps and backward jumps of more than
+	// maxBackwardJump start a new segment marked with EXT-X-DISCONTINUITY.
+	DiscontinuityThreshold time.Duration
+
+	// SCTE35PID makes the segments carry the cues given to WriteSpliceInfo.
+	SCTE35PID uint16
+
+	storage  Storage
+	streams  []av.CodecData
+	tsmuxer  *ts.Muxer
+	hasvideo bool
+
+	segw      io.WriteCloser
+	segbufw   *bufio.Writer
+	seguri    string
+	segstart  time.Duration
+	segwall   time.Time
+	segdiscon bool
+	sequence  int
+
+	segcueout, segcuein bool
+	segcueoutdur        time.Duration
+
+	playlist MediaPlaylist
+	removed  []string
+
+	lasttimes     []time.Duration // last DTS of each stream
+	gotstream     []bool
+	lasttime      time.Duration // latest DTS of all streams
+	gotpkt        bool
+	discontinuity bool
+	cueout, cuein bool
+	cueoutdur     time.Duration
+	wallbase      time.Time
+	timebase      time.Duration
+}
+
+// maxBackwardJump is how far a stream may go back in time without being a
+// discontinuity.
+const maxBackwardJump = time.Second
+
+func NewMuxer(storage Storage) *Muxer {
+	return &Muxer{
+		TargetDuration:         time.Second * 6,
+		PlaylistName:           "index.m3u8",
+		SegmentPrefix:          "segment",
+		DiscontinuityThreshold: time.Second * 10,
+		storage:                storage,
+	}
+}
+
+// MarkDiscontinuity makes the muxer start a new segment marked with
+// EXT-X-DISCONTINUITY at the next keyframe.
+func (self *Muxer) MarkDiscontinuity() {
+	self.discontinuity = true
+}
+
+// CueOut starts an ad break of duration (0 if unknown) with a new segment
+// marked with EXT-X-CUE-OUT at the next keyframe.
+func (self *Muxer) CueOut(duration time.Duration) {
+	self.cueout, self.cueoutdur = true, duration
+}
+
+// CueIn ends an ad break with a new segment marked with EXT-X-CUE-IN at the
+// next keyframe.
+func (self *Muxer) CueIn() {
+	self.cuein = true
+}
+
+// WriteSpliceInfo translates a SCTE-35 splice_insert or segmentation
+// descriptor into CueOut or CueIn, the cue is also written into the segment
+// if SCTE35PID is set.
+func (self *Muxer) WriteSpliceInfo(info tsio.SpliceInfo) (err error) {
+	if insert := info.Insert; insert != nil && !insert.CancelIndicator {
+		if insert.OutOfNetwork {
+			self.CueOut(insert.BreakDuration)
+		} else {
+			self.CueIn()
+		}
+	}
+	for _, desc := range info.SegmentationDescriptors {
+		if desc.CancelIndicator {
+			continue
+		}
+		switch desc.TypeId {
+		case tsio.SegmentationBreakStart,
+			tsio.SegmentationProviderAdStart, tsio.SegmentationDistributorAdStart,
+			tsio.SegmentationProviderPlacementStart, tsio.SegmentationDistributorPlacementStart:
+			self.CueOut(desc.Duration)
+		case tsio.SegmentationBreakEnd,
+			tsio.SegmentationProviderAdEnd, tsio.SegmentationDistributorAdEnd,
+			tsio.SegmentationProviderPlacementEnd, tsio.SegmentationDistributorPlacementEnd:
+			self.CueIn()
+		}
+	}
+	if self.SCTE35PID != 0 {
+		if err = self.tsmuxer.WriteSpliceInfo(info); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// takeCue moves pending cues to the segment being started.
+func (self *Muxer) takeCue() {
+	self.segcueout, self.segcueoutdur, self.segcuein = self.cueout, self.cueoutdur, self.cuein
+	self.cueout, self.cueoutdur, self.cuein = false, 0, false
+}
+
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	self.streams = streams
+	self.lasttimes = make([]time.Duration, len(streams))
+	self.gotstream = make([]bool, len(streams))
+	for _, stream := range streams {
+		if stream.Type().IsVideo() {
+			self.hasvideo = true
+		}
+	}
+	self.playlist = MediaPlaylist{TargetDuration: self.TargetDuration}
+	if err = self.openSegment(); err != nil {
+		return
+	}
+	self.tsmuxer = ts.NewMuxer(self.segbufw)
+	self.tsmuxer.SCTE35PID = self.SCTE35PID
+	if err = self.tsmuxer.WriteHeader(streams); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Muxer) openSegment() (err error) {
+	self.seguri = fmt.Sprintf("%s%d.ts", self.SegmentPrefix, self.sequence)
+	if self.segw, err = self.storage.Create(self.seguri); err != nil {
+		return
+	}
+	if self.segbufw == nil {
+		self.segbufw = bufio.NewWriterSize(self.segw, pio.RecommendBufioSize)
+	} else {
+		self.segbufw.Reset(self.segw)
+	}
+	return
+}
+
+func (self *Muxer) closeSegment(end time.Duration) (err error) {
+	if err = self.segbufw.Flush(); err != nil {
+		return
+	}
+	if err = self.segw.Close(); err != nil {
+		return
+	}
+
+	seg := Segment{
+		URI:            self.seguri,
+		Duration:       end - self.segstart,
+		Discontinuity:  self.segdiscon,
+		CueOut:         self.segcueout,
+		CueOutDuration: self.segcueoutdur,
+		CueIn:          self.segcuein,
+	}
+	if self.ProgramDateTime {
+		seg.ProgramDateTime = self.segwall
+	}
+	self.playlist.Segments = append(self.playlist.Segments, seg)
+	self.sequence++
+
+	if self.WindowSize > 0 {
+		for len(self.playlist.Segments) > self.WindowSize {
+			old := self.playlist.Segments[0]
+			self.playlist.Segments = self.playlist.Segments[1:]
+			self.playlist.MediaSequence++
+			if old.Discontinuity {
+				self.playlist.DiscontinuitySequence++
+			}
+			self.removed = append(self.removed, old.URI)
+		}
+	}
+
+	if err = self.writePlaylist(); err != nil {
+		return
+	}
+
+	// keep removed segments around for another window so that clients
+	// which loaded an older playlist can still fetch them
+	if self.DeleteSegments {
+		for len(self.removed) > self.WindowSize {
+			if err = self.storage.Remove(self.removed[0]); err != nil {
+				return
+			}
+			self.removed = self.removed[1:]
+		}
+	}
+	return
+}
+
+func (self *Muxer) writePlaylist() (err error) {
+	var w io.WriteCloser
+	if w, err = self.storage.Create(self.PlaylistName); err != nil {
+		return
+	}
+	if _, err = w.Write(self.playlist.Marshal()); err != nil {
+		w.Close()
+		return
+	}
+	return w.Close()
+}
+
+func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	stream := self.streams[pkt.Idx]
+
+	jumped := false
+	if self.gotstream[pkt.Idx] {
+		last := self.lasttimes[pkt.Idx]
+		if pkt.Time < last-maxBackwardJump || pkt.Time-last > self.DiscontinuityThreshold {
+			jumped = true
+		}
+	}
+
+	cut := false
+	if !self.gotpkt {
+		self.segstart = pkt.Time
+		self.wallbase, self.timebase = time.Now(), pkt.Time
+		self.segwall = self.wallbase
+		self.takeCue()
+	} else if jumped {
+		cut = true
+	} else if !self.hasvideo || (stream.Type().IsVideo() && pkt.IsKeyFrame) {
+		if self.discontinuity || self.cueout || self.cuein || pkt.Time-self.segstart >= self.TargetDuration {
+			cut = true
+		}
+	}
+
+	if cut {
+		end := pkt.Time
+		if jumped {
+			end = self.lasttime
+		}
+		if err = self.closeSegment(end); err != nil {
+			return
+		}
+		if jumped {
+			// the other streams move to the new timeline too
+			for i := range self.gotstream {
+				self.gotstream[i] = false
+			}
+		}
+		if jumped || self.discontinuity {
+			self.segdiscon = true
+			self.discontinuity = false
+			self.wallbase, self.timebase = time.Now(), pkt.Time
+		} else {
+			self.segdiscon = false
+		}
+		self.segstart = pkt.Time
+		self.segwall = self.wallbase.Add(pkt.Time - self.timebase)
+		self.takeCue()
+		if err = self.openSegment(); err != nil {
+			return
+		}
+		if err = self.tsmuxer.WritePATPMT(); err != nil {
+			return
+		}
+	}
+
+	if !self.gotpkt || jumped || pkt.Time > self.lasttime {
+		self.lasttime = pkt.Time
+	}
+	self.gotpkt = true
+	self.gotstream[pkt.Idx] = true
+	self.lasttimes[pkt.Idx] = pkt.Time
+
+	if err = self.tsmuxer.WritePacket(pkt); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	if self.tsmuxer == nil {
+		return
+	}
+	if err = self.tsmuxer.WriteTrailer(); err != nil {
+		return
+	}
+	self.playlist.Ended = true
+	if err = self.closeSegment(self.lasttime); err != nil {
+		return
+	}
+	return
+}
@@ -0,0 +1,156 @@
+package hls
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+type memStorage map[string][]byte
+
+type memStorageFile struct {
+	bytes.Buffer
+	storage memStorage
+	name    string
+}
+
+func (self *memStorageFile) Close() error {
+	self.storage[self.name] = self.Bytes()
+	return nil
+}
+
+func (self memStorage) Create(name string) (io.WriteCloser, error) {
+	return &memStorageFile{storage: self, name: name}, nil
+}
+
+func (self memStorage) Remove(name string) error {
+	delete(self, name)
+	return nil
+}
+
+func testStreams(t *testing.T) []av.CodecData {
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+// muxInterleaved writes 40ms video frames with a keyframe every second, each
+// followed by an audio packet 10ms older, starting at base.
+func muxInterleaved(t *testing.T, muxer *Muxer, base time.Duration, frames int) {
+	for i := 0; i < frames; i++ {
+		tm := base + time.Duration(i)*40*time.Millisecond
+		key := i%25 == 0
+		nalu := []byte{0, 0, 0, 2, 0x41, 0x9a}
+		if key {
+			nalu[4] = 0x65
+		}
+		if err := muxer.WritePacket(av.Packet{Idx: 0, IsKeyFrame: key, Time: tm, Data: nalu}); err != nil {
+			t.Fatal(err)
+		}
+		if err := muxer.WritePacket(av.Packet{Idx: 1, Time: tm - 10*time.Millisecond, Data: make([]byte, 16)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMuxerInterleaved(t *testing.T) {
+	storage := memStorage{}
+	muxer := NewMuxer(storage)
+	muxer.TargetDuration = 2 * time.Second
+	if err := muxer.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	muxInterleaved(t, muxer, time.Second, 250)
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	playlist := string(storage["index.m3u8"])
+	if strings.Contains(playlist, "#EXT-X-DISCONTINUITY") {
+		t.Errorf("discontinuity in playlist:\n%s", playlist)
+	}
+	_, media, err := ParsePlaylist(storage["index.m3u8"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media.Segments) != 5 {
+		t.Fatalf("got %d segments:\n%s", len(media.Segments), playlist)
+	}
+	for _, seg := range media.Segments[:4] {
+		if seg.Duration != 2*time.Second {
+			t.Errorf("segment %s duration %v", seg.URI, seg.Duration)
+		}
+	}
+}
+
+func TestMuxerDiscontinuity(t *testing.T) {
+	storage := memStorage{}
+	muxer := NewMuxer(storage)
+	muxer.TargetDuration = 2 * time.Second
+	if err := muxer.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	muxInterleaved(t, muxer, time.Minute, 50)
+	// the source restarts at zero
+	muxInterleaved(t, muxer, 0, 50)
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	playlist := string(storage["index.m3u8"])
+	if n := strings.Count(playlist, "#EXT-X-DISCONTINUITY\n"); n != 1 {
+		t.Errorf("got %d discontinuities:\n%s", n, playlist)
+	}
+}
+
+func TestMuxerTrailerWithoutHeader(t *testing.T) {
+	if err := NewMuxer(memStorage{}).WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirStorageCurrentDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// what the handler gives for "index.m3u8"
+	dir, name := filepath.Split("index.m3u8")
+	muxer := NewMuxer(NewDirStorage(dir))
+	muxer.PlaylistName = name
+	if err = muxer.WriteHeader(testStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	muxInterleaved(t, muxer, 0, 50)
+	if err = muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat("index.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,247 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Segment struct {
+	URI             string
+	Duration        time.Duration
+	Discontinuity   bool
+	ProgramDateTime time.Time
+
+	// CueOut starts an ad break of CueOutDuration (0 if unknown) at the
+	// segment, CueIn ends it. Written as EXT-X-CUE-OUT and EXT-X-CUE-IN.
+	CueOut         bool
+	CueOutDuration time.Duration
+	CueIn          bool
+}
+
+// MediaPlaylist is a m3u8 media playlist.
+type MediaPlaylist struct {
+	Version               int
+	TargetDuration        time.Duration
+	MediaSequence         int
+	DiscontinuitySequence int
+	Segments              []Segment
+	Ended                 bool
+}
+
+func durationSeconds(dur time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(dur)/float64(time.Second))
+}
+
+func (self MediaPlaylist) targetDurationSeconds() int {
+	target := int(math.Ceil(float64(self.TargetDuration) / float64(time.Second)))
+	for _, seg := range self.Segments {
+		// EXTINF rounded to the nearest integer must not exceed the target duration
+		if dur := int(math.Floor(float64(seg.Duration)/float64(time.Second) + 0.5)); dur > target {
+			target = dur
+		}
+	}
+	return target
+}
+
+func (self MediaPlaylist) Marshal() []byte {
+	b := &bytes.Buffer{}
+	version := self.Version
+	if version == 0 {
+		version = 3
+	}
+
+	fmt.Fprintf(b, "#EXTM3U\n")
+	fmt.Fprintf(b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", self.targetDurationSeconds())
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", self.MediaSequence)
+	if self.DiscontinuitySequence != 0 {
+		fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", self.DiscontinuitySequence)
+	}
+
+	for _, seg := range self.Segments {
+		if seg.Discontinuity {
+			fmt.Fprintf(b, "#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.CueIn {
+			fmt.Fprintf(b, "#EXT-X-CUE-IN\n")
+		}
+		if seg.CueOut {
+			if seg.CueOutDuration > 0 {
+				fmt.Fprintf(b, "#EXT-X-CUE-OUT:%s\n", durationSeconds(seg.CueOutDuration))
+			} else {
+				fmt.Fprintf(b, "#EXT-X-CUE-OUT\n")
+			}
+		}
+		if !seg.ProgramDateTime.IsZero() {
+			fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.ProgramDateTime.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		}
+		fmt.Fprintf(b, "#EXTINF:%s,\n", durationSeconds(seg.Duration))
+		fmt.Fprintf(b, "%s\n", seg.URI)
+	}
+
+	if self.Ended {
+		fmt.Fprintf(b, "#EXT-X-ENDLIST\n")
+	}
+	return b.Bytes()
+}
+
+// Variant is a stream listed in a master playlist.
+type Variant struct {
+	URI        string
+	Bandwidth  int
+	Codecs     string
+	Resolution string
+}
+
+// MasterPlaylist is a m3u8 master playlist.
+type MasterPlaylist struct {
+	Variants []Variant
+}
+
+func parseAttrs(s string) (attrs map[string]string) {
+	attrs = map[string]string{}
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+		var val string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.IndexByte(s, ','); comma >= 0 {
+			val, s = s[:comma], s[comma:]
+		} else {
+			val, s = s, ""
+		}
+		s = strings.TrimPrefix(s, ",")
+		attrs[key] = val
+	}
+	return
+}
+
+func parseSeconds(s string) (dur time.Duration, err error) {
+	var f float64
+	if f, err = strconv.ParseFloat(s, 64); err != nil {
+		return
+	}
+	dur = time.Duration(f * float64(time.Second))
+	return
+}
+
+// ParsePlaylist parses m3u8 data, exactly one of master and media is returned.
+func ParsePlaylist(data []byte) (master *MasterPlaylist, media *MediaPlaylist, err error) {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(strings.TrimSpace(lines[0]), "#EXTM3U") {
+		err = fmt.Errorf("hls: playlist has no #EXTM3U header")
+		return
+	}
+
+	ismaster := false
+	_master := &MasterPlaylist{}
+	_media := &MediaPlaylist{}
+
+	var seg Segment
+	var variant *Variant
+
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			if variant != nil {
+				variant.URI = line
+				_master.Variants = append(_master.Variants, *variant)
+				variant = nil
+			} else {
+				seg.URI = line
+				_media.Segments = append(_media.Segments, seg)
+				seg = Segment{}
+			}
+			continue
+		}
+
+		tag, val := line, ""
+		if colon := strings.IndexByte(line, ':'); colon >= 0 {
+			tag, val = line[:colon], line[colon+1:]
+		}
+
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			ismaster = true
+			attrs := parseAttrs(val)
+			variant = &Variant{
+				Codecs:     attrs["CODECS"],
+				Resolution: attrs["RESOLUTION"],
+			}
+			variant.Bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
+
+		case "#EXT-X-VERSION":
+			_media.Version, _ = strconv.Atoi(val)
+
+		case "#EXT-X-TARGETDURATION":
+			if _media.TargetDuration, err = parseSeconds(val); err != nil {
+				err = fmt.Errorf("hls: EXT-X-TARGETDURATION invalid")
+				return
+			}
+
+		case "#EXT-X-MEDIA-SEQUENCE":
+			if _media.MediaSequence, err = strconv.Atoi(val); err != nil {
+				err = fmt.Errorf("hls: EXT-X-MEDIA-SEQUENCE invalid")
+				return
+			}
+
+		case "#EXT-X-DISCONTINUITY-SEQUENCE":
+			if _media.DiscontinuitySequence, err = strconv.Atoi(val); err != nil {
+				err = fmt.Errorf("hls: EXT-X-DISCONTINUITY-SEQUENCE invalid")
+				return
+			}
+
+		case "#EXTINF":
+			if comma := strings.IndexByte(val, ','); comma >= 0 {
+				val = val[:comma]
+			}
+			if seg.Duration, err = parseSeconds(val); err != nil {
+				err = fmt.Errorf("hls: EXTINF invalid")
+				return
+			}
+
+		case "#EXT-X-DISCONTINUITY":
+			seg.Discontinuity = true
+
+		case "#EXT-X-CUE-OUT":
+			seg.CueOut = true
+			if val != "" {
+				val = strings.TrimPrefix(val, "DURATION=")
+				seg.CueOutDuration, _ = parseSeconds(val)
+			}
+
+		case "#EXT-X-CUE-IN":
+			seg.CueIn = true
+
+		case "#EXT-X-PROGRAM-DATE-TIME":
+			seg.ProgramDateTime, _ = time.Parse(time.RFC3339Nano, val)
+
+		case "#EXT-X-ENDLIST":
+			_media.Ended = true
+		}
+	}
+
+	if ismaster {
+		master = _master
+	} else {
+		media = _media
+	}
+	return
+}
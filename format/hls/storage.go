@@ -0,0 +1,55 @@
+package hls
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage is where Muxer puts segments and playlists.
+type Storage interface {
+	Create(name string) (io.WriteCloser, error)
+	Remove(name string) error
+}
+
+// DirStorage stores files in a local directory. Files become visible under
+// their final name only when closed, so readers never see partial playlists.
+type DirStorage struct {
+	Dir string
+}
+
+func NewDirStorage(dir string) *DirStorage {
+	return &DirStorage{Dir: dir}
+}
+
+type dirStorageFile struct {
+	*os.File
+	name string
+}
+
+func (self dirStorageFile) Close() (err error) {
+	if err = self.File.Close(); err != nil {
+		return
+	}
+	return os.Rename(self.File.Name(), self.name)
+}
+
+func (self *DirStorage) Create(name string) (w io.WriteCloser, err error) {
+	// an empty Dir is the current directory
+	if self.Dir != "" {
+		if err = os.MkdirAll(self.Dir, 0755); err != nil {
+			return
+		}
+	}
+	path := filepath.Join(self.Dir, name)
+	var f *os.File
+	if f, err = os.Create(path + ".tmp"); err != nil {
+		return
+	}
+	w = dirStorageFile{File: f, name: path}
+	return
+}
+
+func (self *DirStorage) Remove(name string) error {
+	return os.Remove(filepath.Join(self.Dir, name))
+}
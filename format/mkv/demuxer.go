@@ -0,0 +1,751 @@
+package mkv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
+	"github.com/nareix/joy4/format/mkv/mkvio"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// posReader counts the bytes read to know element positions.
+type posReader struct {
+	r   *bufio.Reader
+	pos int64
+}
+
+func (self *posReader) ReadByte() (c byte, err error) {
+	if c, err = self.r.ReadByte(); err == nil {
+		self.pos++
+	}
+	return
+}
+
+func (self *posReader) readFull(n int64) (b []byte, err error) {
+	b = make([]byte, n)
+	var i int
+	i, err = io.ReadFull(self.r, b)
+	self.pos += int64(i)
+	return
+}
+
+func (self *posReader) discard(n int64) (err error) {
+	for n > 0 {
+		c := n
+		if c > 1<<30 {
+			c = 1 << 30
+		}
+		var i int
+		i, err = self.r.Discard(int(c))
+		self.pos += int64(i)
+		if err != nil {
+			return
+		}
+		n -= c
+	}
+	return
+}
+
+// maxElementSize limits the elements read into memory.
+const maxElementSize = 1 << 28
+
+type cuePoint struct {
+	time  time.Duration
+	track uint64
+	pos   int64
+}
+
+// Demuxer reads Matroska and WebM. Seeking needs an io.ReadSeeker and a
+// file with Cues.
+type Demuxer struct {
+	r  *posReader
+	rs io.ReadSeeker
+
+	streams []*Stream
+	tracks  map[uint64]*Stream
+	pkts    []*pendingPacket
+
+	timecodeScale uint64
+	duration      time.Duration
+
+	segmentPos int64
+	segmentEnd int64
+	cuesPos    int64
+	cues       []cuePoint
+	hastracks  bool
+
+	incluster   bool
+	clusterEnd  int64
+	clusterTime int64
+
+	eof   bool
+	stage int
+}
+
+func NewDemuxer(r io.Reader) *Demuxer {
+	self := &Demuxer{
+		r:             &posReader{r: bufio.NewReaderSize(r, pio.RecommendBufioSize)},
+		tracks:        map[uint64]*Stream{},
+		timecodeScale: mkvio.DefaultTimecodeScale,
+		segmentEnd:    -1,
+		cuesPos:       -1,
+	}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if pos, err := rs.Seek(0, 1); err == nil {
+			self.rs = rs
+			self.r.pos = pos
+		}
+	}
+	return self
+}
+
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	for _, stream := range self.streams {
+		streams = append(streams, stream.CodecData)
+	}
+	return
+}
+
+// Duration returns the duration written in the segment info, zero if
+// unknown.
+func (self *Demuxer) Duration() (dur time.Duration, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	dur = self.duration
+	return
+}
+
+func (self *Demuxer) readElementHeader() (id uint32, size int64, err error) {
+	id, size, _, err = mkvio.ReadElementHeader(self.r)
+	return
+}
+
+func (self *Demuxer) readElementData(size int64) (b []byte, err error) {
+	if size == mkvio.UnknownSize || size > maxElementSize {
+		err = fmt.Errorf("mkv: element too large")
+		return
+	}
+	if b, err = self.r.readFull(size); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (self *Demuxer) skipElement(size int64) (err error) {
+	if size == mkvio.UnknownSize {
+		err = fmt.Errorf("mkv: unknown size element")
+		return
+	}
+	return self.r.discard(size)
+}
+
+func (self *Demuxer) probe() (err error) {
+	if self.stage == 0 {
+		var id uint32
+		var size int64
+		var b []byte
+		if id, size, err = self.readElementHeader(); err != nil {
+			return
+		}
+		if id != mkvio.EBML {
+			err = fmt.Errorf("mkv: EBML header not found")
+			return
+		}
+		if b, err = self.readElementData(size); err != nil {
+			return
+		}
+		var elems []mkvio.Element
+		if elems, err = mkvio.ParseElements(b); err != nil {
+			return
+		}
+		for _, elem := range elems {
+			if elem.Id == mkvio.DocType {
+				if doctype := elem.String(); doctype != "matroska" && doctype != "webm" {
+					err = fmt.Errorf("mkv: doctype=%s is not supported", doctype)
+					return
+				}
+			}
+		}
+
+		for {
+			if id, size, err = self.readElementHeader(); err != nil {
+				return
+			}
+			if id == mkvio.Segment {
+				break
+			}
+			if err = self.skipElement(size); err != nil {
+				return
+			}
+		}
+		self.segmentPos = self.r.pos
+		if size != mkvio.UnknownSize {
+			self.segmentEnd = self.segmentPos + size
+		}
+
+		for !self.incluster {
+			if err = self.poll(); err != nil {
+				if err == io.EOF && self.hastracks {
+					err = nil
+					break
+				}
+				return
+			}
+		}
+		if !self.hastracks {
+			err = fmt.Errorf("mkv: tracks not found")
+			return
+		}
+		self.stage++
+	}
+	return
+}
+
+// poll reads one element of the segment or of the current cluster.
+func (self *Demuxer) poll() (err error) {
+	if self.eof {
+		return io.EOF
+	}
+	if err = self.readNext(); err == io.EOF {
+		self.eof = true
+		for _, stream := range self.streams {
+			stream.flushReorder()
+		}
+	}
+	return
+}
+
+func (self *Demuxer) readNext() (err error) {
+	if self.incluster && self.clusterEnd >= 0 && self.r.pos >= self.clusterEnd {
+		self.incluster = false
+	}
+	if self.segmentEnd >= 0 && self.r.pos >= self.segmentEnd {
+		return io.EOF
+	}
+
+	var id uint32
+	var size int64
+	if id, size, err = self.readElementHeader(); err != nil {
+		return
+	}
+
+	if self.incluster {
+		if mkvio.IsTopLevel(id) {
+			self.incluster = false
+		} else {
+			return self.readClusterElement(id, size)
+		}
+	}
+
+	switch id {
+	case mkvio.Cluster:
+		self.incluster = true
+		self.clusterTime = 0
+		if size == mkvio.UnknownSize {
+			self.clusterEnd = -1
+		} else {
+			self.clusterEnd = self.r.pos + size
+		}
+		return
+
+	case mkvio.Info, mkvio.Tracks, mkvio.SeekHead, mkvio.Cues:
+		if self.stage != 0 && id != mkvio.Cues {
+			return self.skipElement(size)
+		}
+		if id == mkvio.Cues && self.cues != nil {
+			return self.skipElement(size)
+		}
+		var b []byte
+		if b, err = self.readElementData(size); err != nil {
+			return
+		}
+		var elems []mkvio.Element
+		if elems, err = mkvio.ParseElements(b); err != nil {
+			return
+		}
+		switch id {
+		case mkvio.Info:
+			self.parseInfo(elems)
+		case mkvio.Tracks:
+			err = self.parseTracks(elems)
+		case mkvio.SeekHead:
+			self.parseSeekHead(elems)
+		case mkvio.Cues:
+			err = self.parseCues(elems)
+		}
+		return
+
+	case mkvio.EBML, mkvio.Segment:
+		// chained segments are not supported
+		return io.EOF
+	}
+
+	return self.skipElement(size)
+}
+
+func (self *Demuxer) readClusterElement(id uint32, size int64) (err error) {
+	switch id {
+	case mkvio.Timecode:
+		var b []byte
+		if b, err = self.readElementData(size); err != nil {
+			return
+		}
+		self.clusterTime = int64(mkvio.Element{Data: b}.Uint())
+
+	case mkvio.SimpleBlock:
+		var b []byte
+		if b, err = self.readElementData(size); err != nil {
+			return
+		}
+		err = self.handleBlock(b, true, false)
+
+	case mkvio.BlockGroup:
+		var b []byte
+		if b, err = self.readElementData(size); err != nil {
+			return
+		}
+		var elems []mkvio.Element
+		if elems, err = mkvio.ParseElements(b); err != nil {
+			return
+		}
+		var block []byte
+		keyframe := true
+		for _, elem := range elems {
+			switch elem.Id {
+			case mkvio.Block:
+				block = elem.Data
+			case mkvio.ReferenceBlock:
+				keyframe = false
+			}
+		}
+		if block != nil {
+			err = self.handleBlock(block, false, keyframe)
+		}
+
+	default:
+		err = self.skipElement(size)
+	}
+	return
+}
+
+func (self *Demuxer) parseInfo(elems []mkvio.Element) {
+	var duration float64
+	for _, elem := range elems {
+		switch elem.Id {
+		case mkvio.TimecodeScale:
+			if scale := elem.Uint(); scale > 0 {
+				self.timecodeScale = scale
+			}
+		case mkvio.Duration:
+			duration = elem.Float()
+		}
+	}
+	self.duration = time.Duration(duration * float64(self.timecodeScale))
+}
+
+func (self *Demuxer) parseSeekHead(elems []mkvio.Element) {
+	for _, elem := range elems {
+		if elem.Id != mkvio.Seek {
+			continue
+		}
+		children, err := elem.Children()
+		if err != nil {
+			continue
+		}
+		var id uint32
+		pos := int64(-1)
+		for _, child := range children {
+			switch child.Id {
+			case mkvio.SeekID:
+				id = uint32(child.Uint())
+			case mkvio.SeekPosition:
+				pos = int64(child.Uint())
+			}
+		}
+		if id == mkvio.Cues && pos >= 0 {
+			self.cuesPos = self.segmentPos + pos
+		}
+	}
+}
+
+func (self *Demuxer) parseCues(elems []mkvio.Element) (err error) {
+	self.cues = []cuePoint{}
+	for _, elem := range elems {
+		if elem.Id != mkvio.CuePoint {
+			continue
+		}
+		var children []mkvio.Element
+		if children, err = elem.Children(); err != nil {
+			return
+		}
+		var tm time.Duration
+		for _, child := range children {
+			if child.Id == mkvio.CueTime {
+				tm = mkvio.TimecodeToTime(int64(child.Uint()), self.timecodeScale)
+			}
+		}
+		for _, child := range children {
+			if child.Id != mkvio.CueTrackPositions {
+				continue
+			}
+			var positions []mkvio.Element
+			if positions, err = child.Children(); err != nil {
+				return
+			}
+			cue := cuePoint{time: tm, pos: -1}
+			for _, p := range positions {
+				switch p.Id {
+				case mkvio.CueTrack:
+					cue.track = p.Uint()
+				case mkvio.CueClusterPosition:
+					cue.pos = self.segmentPos + int64(p.Uint())
+				}
+			}
+			if cue.pos >= 0 {
+				self.cues = append(self.cues, cue)
+			}
+		}
+	}
+	return
+}
+
+type trackEntry struct {
+	number          uint64
+	typ             uint64
+	codecId         string
+	private         []byte
+	defaultDuration uint64
+	width, height   int
+	sampleRate      float64
+	channels        int
+	stripped        []byte
+}
+
+func (self *Demuxer) parseTracks(elems []mkvio.Element) (err error) {
+	for _, elem := range elems {
+		if elem.Id != mkvio.TrackEntry {
+			continue
+		}
+		var children []mkvio.Element
+		if children, err = elem.Children(); err != nil {
+			return
+		}
+		track := trackEntry{}
+		for _, child := range children {
+			switch child.Id {
+			case mkvio.TrackNumber:
+				track.number = child.Uint()
+			case mkvio.TrackType:
+				track.typ = child.Uint()
+			case mkvio.CodecID:
+				track.codecId = child.String()
+			case mkvio.CodecPrivate:
+				track.private = child.Data
+			case mkvio.DefaultDuration:
+				track.defaultDuration = child.Uint()
+			case mkvio.Video, mkvio.Audio, mkvio.ContentEncodings:
+				if err = track.parse(child); err != nil {
+					return
+				}
+			}
+		}
+		var stream *Stream
+		if stream, err = newStream(track); err != nil {
+			return
+		}
+		if stream != nil {
+			stream.idx = len(self.streams)
+			self.streams = append(self.streams, stream)
+			self.tracks[stream.number] = stream
+		}
+	}
+	self.hastracks = true
+	return
+}
+
+func (self *trackEntry) parse(elem mkvio.Element) (err error) {
+	var children []mkvio.Element
+	if children, err = elem.Children(); err != nil {
+		return
+	}
+	for _, child := range children {
+		switch child.Id {
+		case mkvio.PixelWidth:
+			self.width = int(child.Uint())
+		case mkvio.PixelHeight:
+			self.height = int(child.Uint())
+		case mkvio.SamplingFrequency:
+			self.sampleRate = child.Float()
+		case mkvio.Channels:
+			self.channels = int(child.Uint())
+		case mkvio.ContentEncoding, mkvio.ContentCompression:
+			if err = self.parse(child); err != nil {
+				return
+			}
+		case mkvio.ContentEncodingType:
+			if child.Uint() != 0 {
+				err = fmt.Errorf("mkv: encrypted tracks are not supported")
+				return
+			}
+		case mkvio.ContentCompAlgo:
+			// only header stripping, zlib/bzlib/lzo are rarely used
+			if child.Uint() != 3 {
+				err = fmt.Errorf("mkv: compressed tracks are not supported")
+				return
+			}
+		case mkvio.ContentCompSettings:
+			self.stripped = child.Data
+		}
+	}
+	return
+}
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+func channelLayout(channels int) av.ChannelLayout {
+	switch channels {
+	case 1:
+		return av.CH_MONO
+	case 2:
+		return av.CH_STEREO
+	}
+	return av.ChannelLayout(1<<uint(channels) - 1)
+}
+
+// newStream returns nil for tracks of codecs not supported.
+func newStream(track trackEntry) (stream *Stream, err error) {
+	stream = &Stream{
+		number:          track.number,
+		defaultDuration: time.Duration(track.defaultDuration),
+		stripped:        track.stripped,
+	}
+
+	switch {
+	case track.codecId == CodecIdH264:
+		if stream.CodecData, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(track.private); err != nil {
+			return
+		}
+		stream.reorder = true
+
+	case track.codecId == CodecIdH265:
+		if stream.CodecData, err = h265parser.NewCodecDataFromHEVCDecoderConfRecord(track.private); err != nil {
+			return
+		}
+		stream.reorder = true
+
+	case track.codecId == CodecIdVP8:
+		stream.CodecData = codec.NewVP8CodecData(track.width, track.height)
+
+	case track.codecId == CodecIdVP9:
+		stream.CodecData = codec.NewVP9CodecData(track.width, track.height)
+
+	case strings.HasPrefix(track.codecId, CodecIdAAC):
+		if len(track.private) > 0 {
+			if stream.CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(track.private); err != nil {
+				return
+			}
+			break
+		}
+		// A_AAC/MPEG4/LC and the like carry no AudioSpecificConfig
+		config := aacparser.MPEG4AudioConfig{ObjectType: 2, ChannelConfig: uint(track.channels)}
+		for i, rate := range aacSampleRates {
+			if rate == int(track.sampleRate) {
+				config.SampleRateIndex = uint(i)
+			}
+		}
+		config.Complete()
+		if stream.CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfig(config); err != nil {
+			return
+		}
+
+	case track.codecId == CodecIdOpus:
+		if len(track.private) > 0 {
+			if stream.CodecData, err = codec.NewOpusCodecDataFromHeader(track.private); err != nil {
+				return
+			}
+		} else {
+			stream.CodecData = codec.NewOpusCodecData(48000, channelLayout(track.channels))
+		}
+
+	default:
+		stream = nil
+	}
+	return
+}
+
+func (self *Demuxer) handleBlock(b []byte, simple bool, keyframe bool) (err error) {
+	track, n, err := mkvio.Vint(b)
+	if err != nil {
+		return
+	}
+	if len(b) < n+3 {
+		err = fmt.Errorf("mkv: invalid block")
+		return
+	}
+	stream := self.tracks[uint64(track)]
+	if stream == nil {
+		return
+	}
+	tc := int64(pio.I16BE(b[n:]))
+	flags := b[n+2]
+	if simple {
+		keyframe = flags&mkvio.BlockKeyFrame != 0
+	}
+
+	var frames [][]byte
+	if frames, err = mkvio.ParseLacing(flags, b[n+3:]); err != nil {
+		return
+	}
+
+	pts := mkvio.TimecodeToTime(self.clusterTime+tc, self.timecodeScale)
+	for _, frame := range frames {
+		if len(stream.stripped) > 0 {
+			frame = append(append([]byte{}, stream.stripped...), frame...)
+		}
+		p := &pendingPacket{
+			stream: stream,
+			pts:    pts,
+			Packet: av.Packet{
+				Idx:        int8(stream.idx),
+				IsKeyFrame: keyframe || stream.Type().IsAudio(),
+				Time:       pts,
+				Data:       frame,
+			},
+		}
+		self.pkts = append(self.pkts, p)
+		if stream.reorder {
+			stream.addReorder(p)
+		} else {
+			p.ready = true
+		}
+
+		if stream.defaultDuration > 0 {
+			pts += stream.defaultDuration
+		} else if acodec, ok := stream.CodecData.(av.AudioCodecData); ok {
+			if dur, err := acodec.PacketDuration(frame); err == nil {
+				pts += dur
+			}
+		}
+	}
+	return
+}
+
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	for {
+		if len(self.pkts) > 0 && self.pkts[0].ready {
+			pkt = self.pkts[0].Packet
+			self.pkts = self.pkts[1:]
+			return
+		}
+		if err = self.poll(); err != nil {
+			if err == io.EOF && len(self.pkts) > 0 {
+				err = nil
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (self *Demuxer) seek(pos int64) (err error) {
+	if _, err = self.rs.Seek(pos, 0); err != nil {
+		return
+	}
+	self.r.r.Reset(self.rs)
+	self.r.pos = pos
+	self.incluster = false
+	self.eof = false
+	return
+}
+
+func (self *Demuxer) loadCues() (err error) {
+	if self.cues != nil || self.cuesPos < 0 {
+		return
+	}
+	if err = self.seek(self.cuesPos); err != nil {
+		return
+	}
+	var id uint32
+	var size int64
+	if id, size, err = self.readElementHeader(); err != nil {
+		return
+	}
+	if id != mkvio.Cues {
+		err = fmt.Errorf("mkv: invalid cues position")
+		return
+	}
+	var b []byte
+	if b, err = self.readElementData(size); err != nil {
+		return
+	}
+	var elems []mkvio.Element
+	if elems, err = mkvio.ParseElements(b); err != nil {
+		return
+	}
+	return self.parseCues(elems)
+}
+
+// SeekToTime moves to the cluster of the last cue point at or before tm,
+// packets start at the keyframe of that cue.
+func (self *Demuxer) SeekToTime(tm time.Duration) (err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	if self.rs == nil {
+		err = fmt.Errorf("mkv: seeking needs an io.ReadSeeker")
+		return
+	}
+	if err = self.loadCues(); err != nil {
+		return
+	}
+	if len(self.cues) == 0 {
+		err = fmt.Errorf("mkv: no cues to seek")
+		return
+	}
+
+	var videotrack uint64
+	for _, stream := range self.streams {
+		if stream.Type().IsVideo() {
+			videotrack = stream.number
+			break
+		}
+	}
+	var cue *cuePoint
+	for i := range self.cues {
+		c := &self.cues[i]
+		if videotrack != 0 && c.track != videotrack {
+			continue
+		}
+		if cue == nil || (c.time <= tm && c.time >= cue.time) {
+			cue = c
+		}
+	}
+	if cue == nil {
+		cue = &self.cues[0]
+	}
+
+	if err = self.seek(cue.pos); err != nil {
+		return
+	}
+	self.pkts = nil
+	for _, stream := range self.streams {
+		stream.waiting = nil
+		stream.ptsq = nil
+	}
+	return
+}
@@ -0,0 +1,37 @@
+package mkv
+
+import (
+	"io"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+)
+
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.VP8, av.VP9, av.AAC, av.OPUS}
+
+func handler(h *avutil.RegisterHandler, ext string) {
+	h.Ext = ext
+
+	h.Probe = func(b []byte) bool {
+		return b[0] == 0x1a && b[1] == 0x45 && b[2] == 0xdf && b[3] == 0xa3
+	}
+
+	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
+		return NewDemuxer(r)
+	}
+
+	h.WriterMuxer = func(w io.Writer) av.Muxer {
+		return NewMuxer(w)
+	}
+
+	h.CodecTypes = CodecTypes
+}
+
+func Handler(h *avutil.RegisterHandler) {
+	handler(h, ".mkv")
+}
+
+// WebmHandler registers the .webm extension.
+func WebmHandler(h *avutil.RegisterHandler) {
+	handler(h, ".webm")
+}
@@ -0,0 +1,524 @@
+// Package mkvio reads and writes the EBML elements of Matroska and WebM.
+package mkvio
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+const (
+	EBML               = 0x1a45dfa3
+	EBMLVersion        = 0x4286
+	EBMLReadVersion    = 0x42f7
+	EBMLMaxIDLength    = 0x42f2
+	EBMLMaxSizeLength  = 0x42f3
+	DocType            = 0x4282
+	DocTypeVersion     = 0x4287
+	DocTypeReadVersion = 0x4285
+
+	Void  = 0xec
+	CRC32 = 0xbf
+
+	Segment = 0x18538067
+
+	SeekHead     = 0x114d9b74
+	Seek         = 0x4dbb
+	SeekID       = 0x53ab
+	SeekPosition = 0x53ac
+
+	Info          = 0x1549a966
+	TimecodeScale = 0x2ad7b1
+	Duration      = 0x4489
+	DateUTC       = 0x4461
+	Title         = 0x7ba9
+	MuxingApp     = 0x4d80
+	WritingApp    = 0x5741
+
+	Tracks            = 0x1654ae6b
+	TrackEntry        = 0xae
+	TrackNumber       = 0xd7
+	TrackUID          = 0x73c5
+	TrackType         = 0x83
+	FlagEnabled       = 0xb9
+	FlagDefault       = 0x88
+	FlagLacing        = 0x9c
+	DefaultDuration   = 0x23e383
+	Name              = 0x536e
+	Language          = 0x22b59c
+	CodecID           = 0x86
+	CodecPrivate      = 0x63a2
+	CodecName         = 0x258688
+	CodecDelay        = 0x56aa
+	SeekPreRoll       = 0x56bb
+	Video             = 0xe0
+	PixelWidth        = 0xb0
+	PixelHeight       = 0xba
+	Audio             = 0xe1
+	SamplingFrequency = 0xb5
+	Channels          = 0x9f
+	BitDepth          = 0x6264
+
+	ContentEncodings    = 0x6d80
+	ContentEncoding     = 0x6240
+	ContentEncodingType = 0x5033
+	ContentCompression  = 0x5034
+	ContentCompAlgo     = 0x4254
+	ContentCompSettings = 0x4255
+
+	Cluster        = 0x1f43b675
+	Timecode       = 0xe7
+	Position       = 0xa7
+	PrevSize       = 0xab
+	SimpleBlock    = 0xa3
+	BlockGroup     = 0xa0
+	Block          = 0xa1
+	BlockDuration  = 0x9b
+	ReferenceBlock = 0xfb
+	DiscardPadding = 0x75a2
+
+	Cues                = 0x1c53bb6b
+	CuePoint            = 0xbb
+	CueTime             = 0xb3
+	CueTrackPositions   = 0xb7
+	CueTrack            = 0xf7
+	CueClusterPosition  = 0xf1
+	CueRelativePosition = 0xf0
+
+	Chapters    = 0x1043a770
+	Tags        = 0x1254c367
+	Attachments = 0x1941a469
+)
+
+const (
+	TrackTypeVideo = 1
+	TrackTypeAudio = 2
+)
+
+// Block flags, lacing is used by both SimpleBlock and Block.
+const (
+	BlockKeyFrame    = 0x80
+	BlockInvisible   = 0x08
+	BlockLacing      = 0x06
+	BlockDiscardable = 0x01
+
+	LacingNone  = 0x00
+	LacingXiph  = 0x02
+	LacingFixed = 0x04
+	LacingEBML  = 0x06
+)
+
+// UnknownSize is the size of elements written before their length is known,
+// live streams use it for Segment and Cluster.
+const UnknownSize = -1
+
+const DefaultTimecodeScale = 1000000
+
+var ErrParse = fmt.Errorf("mkv: invalid EBML")
+
+// IsTopLevel reports whether id can follow a Cluster of unknown size.
+func IsTopLevel(id uint32) bool {
+	switch id {
+	case Cluster, Cues, SeekHead, Info, Tracks, Chapters, Tags, Attachments, EBML, Segment:
+		return true
+	}
+	return false
+}
+
+// ReadElementHeader reads an element ID and its data size, size is
+// UnknownSize if all its bits are set.
+func ReadElementHeader(r io.ByteReader) (id uint32, size int64, n int, err error) {
+	var c byte
+	if c, err = r.ReadByte(); err != nil {
+		return
+	}
+	l := lengthOf(c)
+	if l > 4 {
+		err = ErrParse
+		return
+	}
+	id = uint32(c)
+	for i := 1; i < l; i++ {
+		if c, err = r.ReadByte(); err != nil {
+			err = unexpectedEOF(err)
+			return
+		}
+		id = id<<8 | uint32(c)
+	}
+	n = l
+	var vl int
+	if size, vl, err = readVint(r); err != nil {
+		err = unexpectedEOF(err)
+		return
+	}
+	n += vl
+	return
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func lengthOf(c byte) int {
+	for i := 0; i < 8; i++ {
+		if c&(0x80>>uint(i)) != 0 {
+			return i + 1
+		}
+	}
+	return 9
+}
+
+func readVint(r io.ByteReader) (v int64, n int, err error) {
+	var c byte
+	if c, err = r.ReadByte(); err != nil {
+		return
+	}
+	n = lengthOf(c)
+	if n > 8 {
+		err = ErrParse
+		return
+	}
+	mask := byte(0xff >> uint(n))
+	v = int64(c & mask)
+	allones := c&mask == mask
+	for i := 1; i < n; i++ {
+		if c, err = r.ReadByte(); err != nil {
+			return
+		}
+		v = v<<8 | int64(c)
+		allones = allones && c == 0xff
+	}
+	if allones {
+		v = UnknownSize
+	}
+	return
+}
+
+// Vint parses a variable size integer as used in block headers and lacing.
+func Vint(b []byte) (v int64, n int, err error) {
+	if len(b) == 0 {
+		err = ErrParse
+		return
+	}
+	n = lengthOf(b[0])
+	if n > 8 || n > len(b) {
+		err = ErrParse
+		return
+	}
+	v = int64(b[0] & (0xff >> uint(n)))
+	for i := 1; i < n; i++ {
+		v = v<<8 | int64(b[i])
+	}
+	return
+}
+
+// SVint parses a signed variable size integer used by EBML lacing.
+func SVint(b []byte) (v int64, n int, err error) {
+	if v, n, err = Vint(b); err != nil {
+		return
+	}
+	v -= 1<<uint(7*n-1) - 1
+	return
+}
+
+// VintLen returns the bytes needed to write v as a size.
+func VintLen(v int64) int {
+	n := 1
+	for v >= 1<<uint(7*n)-1 && n < 8 {
+		n++
+	}
+	return n
+}
+
+// PutVint writes v in exactly n bytes, UnknownSize writes all ones.
+func PutVint(b []byte, v int64, n int) {
+	if v == UnknownSize {
+		b[0] = 0xff >> uint(n-1)
+		for i := 1; i < n; i++ {
+			b[i] = 0xff
+		}
+		return
+	}
+	for i := n - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	b[0] |= 0x80 >> uint(n-1)
+}
+
+func idLen(id uint32) int {
+	switch {
+	case id >= 1<<24:
+		return 4
+	case id >= 1<<16:
+		return 3
+	case id >= 1<<8:
+		return 2
+	}
+	return 1
+}
+
+// PutElementHeader writes id and size, size is written in sizelen bytes or
+// the shortest form if sizelen is zero.
+func PutElementHeader(b []byte, id uint32, size int64, sizelen int) (n int) {
+	l := idLen(id)
+	for i := 0; i < l; i++ {
+		b[i] = byte(id >> uint(8*(l-1-i)))
+	}
+	n = l
+	if sizelen == 0 {
+		sizelen = VintLen(size)
+	}
+	PutVint(b[n:], size, sizelen)
+	n += sizelen
+	return
+}
+
+func ElementHeaderLen(id uint32, size int64) int {
+	return idLen(id) + VintLen(size)
+}
+
+func AppendElementHeader(b []byte, id uint32, size int64) []byte {
+	var hdr [12]byte
+	n := PutElementHeader(hdr[:], id, size, 0)
+	return append(b, hdr[:n]...)
+}
+
+func AppendMaster(b []byte, id uint32, data []byte) []byte {
+	b = AppendElementHeader(b, id, int64(len(data)))
+	return append(b, data...)
+}
+
+func AppendBinary(b []byte, id uint32, data []byte) []byte {
+	return AppendMaster(b, id, data)
+}
+
+func AppendString(b []byte, id uint32, s string) []byte {
+	return AppendMaster(b, id, []byte(s))
+}
+
+func AppendUint(b []byte, id uint32, v uint64) []byte {
+	n := 1
+	for n < 8 && v>>uint(8*n) != 0 {
+		n++
+	}
+	b = AppendElementHeader(b, id, int64(n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>uint(8*i)))
+	}
+	return b
+}
+
+func AppendInt(b []byte, id uint32, v int64) []byte {
+	n := 1
+	for n < 8 && (v < -(1<<uint(8*n-1)) || v >= 1<<uint(8*n-1)) {
+		n++
+	}
+	b = AppendElementHeader(b, id, int64(n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>uint(8*i)))
+	}
+	return b
+}
+
+func AppendFloat(b []byte, id uint32, v float64) []byte {
+	b = AppendElementHeader(b, id, 8)
+	var f [8]byte
+	pio.PutU64BE(f[:], math.Float64bits(v))
+	return append(b, f[:]...)
+}
+
+// AppendVoid appends a Void element of exactly n bytes, n must be at least 2.
+func AppendVoid(b []byte, n int) []byte {
+	sizelen := 1
+	if n-2 >= 0x7f {
+		sizelen = 8
+	}
+	var hdr [9]byte
+	l := PutElementHeader(hdr[:], Void, int64(n-1-sizelen), sizelen)
+	b = append(b, hdr[:l]...)
+	return append(b, make([]byte, n-l)...)
+}
+
+// Element is an element parsed from a buffer, Data is its payload.
+type Element struct {
+	Id   uint32
+	Data []byte
+}
+
+type byteReader struct {
+	b []byte
+	n int
+}
+
+func (self *byteReader) ReadByte() (c byte, err error) {
+	if self.n >= len(self.b) {
+		err = io.EOF
+		return
+	}
+	c = self.b[self.n]
+	self.n++
+	return
+}
+
+// ParseElements splits b into the elements it contains, a child of unknown
+// size takes the rest of b.
+func ParseElements(b []byte) (elems []Element, err error) {
+	r := &byteReader{b: b}
+	for r.n < len(b) {
+		var id uint32
+		var size int64
+		if id, size, _, err = ReadElementHeader(r); err != nil {
+			err = ErrParse
+			return
+		}
+		if size == UnknownSize {
+			size = int64(len(b) - r.n)
+		}
+		if size > int64(len(b)-r.n) {
+			err = ErrParse
+			return
+		}
+		elems = append(elems, Element{Id: id, Data: b[r.n : r.n+int(size)]})
+		r.n += int(size)
+	}
+	return
+}
+
+func (self Element) Uint() (v uint64) {
+	for _, c := range self.Data {
+		v = v<<8 | uint64(c)
+	}
+	return
+}
+
+func (self Element) Int() (v int64) {
+	for i, c := range self.Data {
+		if i == 0 {
+			v = int64(int8(c))
+		} else {
+			v = v<<8 | int64(c)
+		}
+	}
+	return
+}
+
+func (self Element) Float() float64 {
+	switch len(self.Data) {
+	case 4:
+		return float64(math.Float32frombits(pio.U32BE(self.Data)))
+	case 8:
+		return math.Float64frombits(pio.U64BE(self.Data))
+	}
+	return 0
+}
+
+func (self Element) String() string {
+	s := self.Data
+	for len(s) > 0 && s[len(s)-1] == 0 {
+		s = s[:len(s)-1]
+	}
+	return string(s)
+}
+
+// Children parses the payload of a master element.
+func (self Element) Children() ([]Element, error) {
+	return ParseElements(self.Data)
+}
+
+// TimecodeToTime converts a timecode in units of scale nanoseconds.
+func TimecodeToTime(tc int64, scale uint64) time.Duration {
+	return time.Duration(tc) * time.Duration(scale)
+}
+
+func TimeToTimecode(tm time.Duration, scale uint64) int64 {
+	return int64(tm) / int64(scale)
+}
+
+// ParseLacing splits the payload of a block after its flags byte into
+// frames.
+func ParseLacing(flags uint8, b []byte) (frames [][]byte, err error) {
+	lacing := flags & BlockLacing
+	if lacing == LacingNone {
+		frames = [][]byte{b}
+		return
+	}
+	if len(b) < 1 {
+		err = ErrParse
+		return
+	}
+	count := int(b[0]) + 1
+	b = b[1:]
+	sizes := make([]int, count)
+
+	switch lacing {
+	case LacingXiph:
+		for i := 0; i < count-1; i++ {
+			for {
+				if len(b) < 1 {
+					err = ErrParse
+					return
+				}
+				c := b[0]
+				b = b[1:]
+				sizes[i] += int(c)
+				if c != 0xff {
+					break
+				}
+			}
+		}
+
+	case LacingEBML:
+		var v int64
+		var n int
+		if v, n, err = Vint(b); err != nil {
+			return
+		}
+		sizes[0] = int(v)
+		b = b[n:]
+		for i := 1; i < count-1; i++ {
+			if v, n, err = SVint(b); err != nil {
+				return
+			}
+			sizes[i] = sizes[i-1] + int(v)
+			b = b[n:]
+		}
+
+	case LacingFixed:
+		if len(b)%count != 0 {
+			err = ErrParse
+			return
+		}
+		for i := range sizes {
+			sizes[i] = len(b) / count
+		}
+	}
+
+	if lacing != LacingFixed {
+		total := 0
+		for i := 0; i < count-1; i++ {
+			if sizes[i] < 0 {
+				err = ErrParse
+				return
+			}
+			total += sizes[i]
+		}
+		if total > len(b) {
+			err = ErrParse
+			return
+		}
+		sizes[count-1] = len(b) - total
+	}
+
+	for _, size := range sizes {
+		frames = append(frames, b[:size])
+		b = b[size:]
+	}
+	return
+}
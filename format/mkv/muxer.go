@@ -0,0 +1,363 @@
+package mkv
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
+	"github.com/nareix/joy4/format/mkv/mkvio"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// MaxClusterDuration is the cluster length of files without video, video
+// clusters start at keyframes.
+var MaxClusterDuration = time.Second * 5
+
+// seekHeadSize is reserved at the start of the segment for the SeekHead
+// written by WriteTrailer.
+const seekHeadSize = 96
+
+// Muxer writes Matroska, or WebM if all streams are VP8/VP9/Opus. With an
+// io.WriteSeeker clusters get their sizes and the SeekHead, duration and
+// segment size are fixed up by WriteTrailer, otherwise the segment and its
+// clusters are written with unknown size as live streams are.
+type Muxer struct {
+	w    io.Writer
+	ws   io.WriteSeeker
+	base int64
+	pos  int64
+
+	streams  []*Stream
+	hasvideo bool
+
+	segmentSizePos int64
+	segmentPos     int64
+	infoPos        int64
+	tracksPos      int64
+	durationPos    int64
+
+	cluster     []byte
+	hascluster  bool
+	clusterPos  int64
+	clusterTime int64
+	cues        []byte
+	maxTime     time.Duration
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	self := &Muxer{w: w}
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if pos, err := ws.Seek(0, 1); err == nil {
+			self.ws = ws
+			self.base = pos
+		}
+	}
+	return self
+}
+
+func (self *Muxer) write(b []byte) (err error) {
+	var n int
+	n, err = self.w.Write(b)
+	self.pos += int64(n)
+	return
+}
+
+// writeAt overwrites b at pos and returns to the end.
+func (self *Muxer) writeAt(pos int64, b []byte) (err error) {
+	if _, err = self.ws.Seek(self.base+pos, 0); err != nil {
+		return
+	}
+	if _, err = self.w.Write(b); err != nil {
+		return
+	}
+	_, err = self.ws.Seek(self.base+self.pos, 0)
+	return
+}
+
+func (self *Muxer) newStream(codec av.CodecData) (err error) {
+	switch codec.Type() {
+	case av.H264, av.H265, av.VP8, av.VP9, av.AAC, av.OPUS:
+	default:
+		err = fmt.Errorf("mkv: codec type=%v is not supported", codec.Type())
+		return
+	}
+	stream := &Stream{
+		CodecData: codec,
+		idx:       len(self.streams),
+		number:    uint64(len(self.streams) + 1),
+	}
+	if codec.Type().IsVideo() {
+		self.hasvideo = true
+	}
+	self.streams = append(self.streams, stream)
+	return
+}
+
+func (self *Muxer) docType() string {
+	for _, stream := range self.streams {
+		switch stream.Type() {
+		case av.VP8, av.VP9, av.OPUS:
+		default:
+			return "matroska"
+		}
+	}
+	return "webm"
+}
+
+func (self *Stream) fillTrackEntry(b []byte) (_ []byte, err error) {
+	b = mkvio.AppendUint(b, mkvio.TrackNumber, self.number)
+	b = mkvio.AppendUint(b, mkvio.TrackUID, self.number)
+	b = mkvio.AppendUint(b, mkvio.FlagLacing, 0)
+	b = mkvio.AppendString(b, mkvio.Language, "und")
+
+	switch c := self.CodecData.(type) {
+	case h264parser.CodecData:
+		b = mkvio.AppendString(b, mkvio.CodecID, CodecIdH264)
+		b = mkvio.AppendBinary(b, mkvio.CodecPrivate, c.AVCDecoderConfRecordBytes())
+
+	case h265parser.CodecData:
+		b = mkvio.AppendString(b, mkvio.CodecID, CodecIdH265)
+		b = mkvio.AppendBinary(b, mkvio.CodecPrivate, c.HEVCDecoderConfRecordBytes())
+
+	case aacparser.CodecData:
+		b = mkvio.AppendString(b, mkvio.CodecID, CodecIdAAC)
+		b = mkvio.AppendBinary(b, mkvio.CodecPrivate, c.MPEG4AudioConfigBytes())
+
+	case codec.OpusCodecData:
+		b = mkvio.AppendString(b, mkvio.CodecID, CodecIdOpus)
+		header := c.Header
+		if len(header) == 0 {
+			header = codec.NewOpusCodecData(48000, c.ChannelLayout()).Header
+		}
+		b = mkvio.AppendBinary(b, mkvio.CodecPrivate, header)
+		preskip := time.Duration(pio.U16LE(header[10:12])) * time.Second / 48000
+		b = mkvio.AppendUint(b, mkvio.CodecDelay, uint64(preskip))
+		b = mkvio.AppendUint(b, mkvio.SeekPreRoll, uint64(80*time.Millisecond))
+
+	default:
+		switch self.Type() {
+		case av.VP8:
+			b = mkvio.AppendString(b, mkvio.CodecID, CodecIdVP8)
+		case av.VP9:
+			b = mkvio.AppendString(b, mkvio.CodecID, CodecIdVP9)
+		default:
+			err = fmt.Errorf("mkv: codec type=%v is not supported", self.Type())
+			return
+		}
+	}
+
+	if self.Type().IsVideo() {
+		vcodec := self.CodecData.(av.VideoCodecData)
+		b = mkvio.AppendUint(b, mkvio.TrackType, mkvio.TrackTypeVideo)
+		video := []byte{}
+		video = mkvio.AppendUint(video, mkvio.PixelWidth, uint64(vcodec.Width()))
+		video = mkvio.AppendUint(video, mkvio.PixelHeight, uint64(vcodec.Height()))
+		b = mkvio.AppendMaster(b, mkvio.Video, video)
+	} else {
+		acodec := self.CodecData.(av.AudioCodecData)
+		b = mkvio.AppendUint(b, mkvio.TrackType, mkvio.TrackTypeAudio)
+		audio := []byte{}
+		audio = mkvio.AppendFloat(audio, mkvio.SamplingFrequency, float64(acodec.SampleRate()))
+		audio = mkvio.AppendUint(audio, mkvio.Channels, uint64(acodec.ChannelLayout().Count()))
+		b = mkvio.AppendMaster(b, mkvio.Audio, audio)
+	}
+	return b, nil
+}
+
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	self.streams = []*Stream{}
+	for _, codec := range streams {
+		if err = self.newStream(codec); err != nil {
+			return
+		}
+	}
+
+	ebml := []byte{}
+	ebml = mkvio.AppendUint(ebml, mkvio.EBMLVersion, 1)
+	ebml = mkvio.AppendUint(ebml, mkvio.EBMLReadVersion, 1)
+	ebml = mkvio.AppendUint(ebml, mkvio.EBMLMaxIDLength, 4)
+	ebml = mkvio.AppendUint(ebml, mkvio.EBMLMaxSizeLength, 8)
+	ebml = mkvio.AppendString(ebml, mkvio.DocType, self.docType())
+	ebml = mkvio.AppendUint(ebml, mkvio.DocTypeVersion, 4)
+	ebml = mkvio.AppendUint(ebml, mkvio.DocTypeReadVersion, 2)
+	b := mkvio.AppendMaster(nil, mkvio.EBML, ebml)
+
+	// segment size is fixed up in WriteTrailer
+	self.segmentSizePos = int64(len(b)) + 4
+	hdr := make([]byte, 12)
+	n := mkvio.PutElementHeader(hdr, mkvio.Segment, mkvio.UnknownSize, 8)
+	b = append(b, hdr[:n]...)
+	self.segmentPos = int64(len(b))
+
+	if self.ws != nil {
+		b = mkvio.AppendVoid(b, seekHeadSize)
+	}
+
+	self.infoPos = int64(len(b)) - self.segmentPos
+	info := []byte{}
+	info = mkvio.AppendUint(info, mkvio.TimecodeScale, mkvio.DefaultTimecodeScale)
+	info = mkvio.AppendString(info, mkvio.MuxingApp, "joy4")
+	info = mkvio.AppendString(info, mkvio.WritingApp, "joy4")
+	if self.ws != nil {
+		info = mkvio.AppendFloat(info, mkvio.Duration, 0)
+		self.durationPos = int64(len(b)) + int64(mkvio.ElementHeaderLen(mkvio.Info, int64(len(info)))) + int64(len(info)) - 8
+	}
+	b = mkvio.AppendMaster(b, mkvio.Info, info)
+
+	self.tracksPos = int64(len(b)) - self.segmentPos
+	tracks := []byte{}
+	for _, stream := range self.streams {
+		var entry []byte
+		if entry, err = stream.fillTrackEntry(nil); err != nil {
+			return
+		}
+		tracks = mkvio.AppendMaster(tracks, mkvio.TrackEntry, entry)
+	}
+	b = mkvio.AppendMaster(b, mkvio.Tracks, tracks)
+
+	return self.write(b)
+}
+
+func (self *Muxer) flushCluster() (err error) {
+	if !self.hascluster || self.ws == nil {
+		return
+	}
+	b := mkvio.AppendMaster(nil, mkvio.Cluster, self.cluster)
+	self.cluster = self.cluster[:0]
+	return self.write(b)
+}
+
+func (self *Muxer) newCluster(stream *Stream, tc int64) (err error) {
+	if err = self.flushCluster(); err != nil {
+		return
+	}
+	self.hascluster = true
+	self.clusterPos = self.pos - self.segmentPos
+	self.clusterTime = tc
+
+	if !self.hasvideo || stream.Type().IsVideo() {
+		positions := []byte{}
+		positions = mkvio.AppendUint(positions, mkvio.CueTrack, stream.number)
+		positions = mkvio.AppendUint(positions, mkvio.CueClusterPosition, uint64(self.clusterPos))
+		point := []byte{}
+		point = mkvio.AppendUint(point, mkvio.CueTime, uint64(tc))
+		point = mkvio.AppendMaster(point, mkvio.CueTrackPositions, positions)
+		self.cues = mkvio.AppendMaster(self.cues, mkvio.CuePoint, point)
+	}
+
+	timecode := mkvio.AppendUint(nil, mkvio.Timecode, uint64(tc))
+	if self.ws != nil {
+		self.cluster = append(self.cluster, timecode...)
+		return
+	}
+	hdr := make([]byte, 12)
+	n := mkvio.PutElementHeader(hdr, mkvio.Cluster, mkvio.UnknownSize, 8)
+	return self.write(append(hdr[:n], timecode...))
+}
+
+func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	stream := self.streams[pkt.Idx]
+	pts := pkt.Time + pkt.CompositionTime
+	if pts < 0 {
+		pts = 0
+	}
+	tc := mkvio.TimeToTimecode(pts, mkvio.DefaultTimecodeScale)
+
+	if end := pts; end > self.maxTime {
+		self.maxTime = end
+	}
+	if acodec, ok := stream.CodecData.(av.AudioCodecData); ok {
+		if dur, err := acodec.PacketDuration(pkt.Data); err == nil && pts+dur > self.maxTime {
+			self.maxTime = pts + dur
+		}
+	}
+
+	rel := tc - self.clusterTime
+	cut := !self.hascluster || rel > math.MaxInt16 || rel < math.MinInt16
+	if self.hasvideo {
+		cut = cut || (stream.Type().IsVideo() && pkt.IsKeyFrame)
+	} else {
+		cut = cut || mkvio.TimecodeToTime(rel, mkvio.DefaultTimecodeScale) >= MaxClusterDuration
+	}
+	if cut {
+		if err = self.newCluster(stream, tc); err != nil {
+			return
+		}
+		rel = 0
+	}
+
+	var flags uint8
+	if pkt.IsKeyFrame || stream.Type().IsAudio() {
+		flags |= mkvio.BlockKeyFrame
+	}
+	hdr := make([]byte, 12)
+	n := mkvio.PutElementHeader(hdr, mkvio.SimpleBlock, int64(4+len(pkt.Data)), 0)
+	hdr[n] = 0x80 | byte(stream.number)
+	pio.PutI16BE(hdr[n+1:], int16(rel))
+	hdr[n+3] = flags
+	n += 4
+
+	if self.ws != nil {
+		self.cluster = append(self.cluster, hdr[:n]...)
+		self.cluster = append(self.cluster, pkt.Data...)
+		return
+	}
+	if err = self.write(hdr[:n]); err != nil {
+		return
+	}
+	return self.write(pkt.Data)
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	if err = self.flushCluster(); err != nil {
+		return
+	}
+
+	cuesPos := self.pos - self.segmentPos
+	if len(self.cues) > 0 {
+		if err = self.write(mkvio.AppendMaster(nil, mkvio.Cues, self.cues)); err != nil {
+			return
+		}
+	}
+	if self.ws == nil {
+		return
+	}
+
+	seeks := []byte{}
+	seekEntry := func(id uint32, pos int64) {
+		seekid := make([]byte, 4)
+		pio.PutU32BE(seekid, id)
+		seek := mkvio.AppendBinary(nil, mkvio.SeekID, seekid)
+		seek = mkvio.AppendUint(seek, mkvio.SeekPosition, uint64(pos))
+		seeks = mkvio.AppendMaster(seeks, mkvio.Seek, seek)
+	}
+	seekEntry(mkvio.Info, self.infoPos)
+	seekEntry(mkvio.Tracks, self.tracksPos)
+	if len(self.cues) > 0 {
+		seekEntry(mkvio.Cues, cuesPos)
+	}
+	seekhead := mkvio.AppendMaster(nil, mkvio.SeekHead, seeks)
+	seekhead = mkvio.AppendVoid(seekhead, seekHeadSize-len(seekhead))
+	if err = self.writeAt(self.segmentPos, seekhead); err != nil {
+		return
+	}
+
+	duration := make([]byte, 8)
+	pio.PutU64BE(duration, math.Float64bits(float64(mkvio.TimeToTimecode(self.maxTime, mkvio.DefaultTimecodeScale))))
+	if err = self.writeAt(self.durationPos, duration); err != nil {
+		return
+	}
+
+	size := make([]byte, 8)
+	mkvio.PutVint(size, self.pos-self.segmentPos, 8)
+	if err = self.writeAt(self.segmentSizePos, size); err != nil {
+		return
+	}
+	return
+}
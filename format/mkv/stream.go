@@ -0,0 +1,87 @@
+package mkv
+
+import (
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	CodecIdH264 = "V_MPEG4/ISO/AVC"
+	CodecIdH265 = "V_MPEGH/ISO/HEVC"
+	CodecIdVP8  = "V_VP8"
+	CodecIdVP9  = "V_VP9"
+	CodecIdAAC  = "A_AAC"
+	CodecIdOpus = "A_OPUS"
+)
+
+type Stream struct {
+	av.CodecData
+
+	idx    int
+	number uint64
+
+	defaultDuration time.Duration
+	stripped        []byte
+
+	// H264/H265 blocks carry PTS, DTS is rebuilt from a window of frames
+	reorder  bool
+	waiting  []*pendingPacket
+	ptsq     []time.Duration
+	delay    time.Duration
+	hasdelay bool
+}
+
+type pendingPacket struct {
+	stream *Stream
+	pts    time.Duration
+	ready  bool
+	av.Packet
+}
+
+// reorderWindow is the number of frames held to find the DTS of streams
+// with B-frames.
+const reorderWindow = 16
+
+func (self *Stream) addReorder(p *pendingPacket) {
+	self.waiting = append(self.waiting, p)
+	i := len(self.ptsq)
+	for i > 0 && self.ptsq[i-1] > p.pts {
+		i--
+	}
+	self.ptsq = append(self.ptsq, 0)
+	copy(self.ptsq[i+1:], self.ptsq[i:])
+	self.ptsq[i] = p.pts
+	if len(self.waiting) > reorderWindow {
+		self.popReorder()
+	}
+}
+
+// popReorder gives the oldest frame the smallest PTS held as DTS, minus the
+// delay needed to keep DTS <= PTS in the first window.
+func (self *Stream) popReorder() {
+	if !self.hasdelay {
+		for i, p := range self.waiting {
+			if d := self.ptsq[i] - p.pts; d > self.delay {
+				self.delay = d
+			}
+		}
+		self.hasdelay = true
+	}
+	p := self.waiting[0]
+	self.waiting = self.waiting[1:]
+	dts := self.ptsq[0] - self.delay
+	self.ptsq = self.ptsq[1:]
+	if dts > p.pts {
+		dts = p.pts
+	}
+	p.Time = dts
+	p.CompositionTime = p.pts - dts
+	p.ready = true
+}
+
+func (self *Stream) flushReorder() {
+	for len(self.waiting) > 0 {
+		self.popReorder()
+	}
+}
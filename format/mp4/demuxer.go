@@ -34,6 +34,15 @@ func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
 	return
 }
 
+// Metadata returns the tags found in moov/udta and mvhd.
+func (self *Demuxer) Metadata() (md Metadata, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	md = newMetadataFromMovie(self.movieAtom)
+	return
+}
+
 func (self *Demuxer) readat(pos int64, b []byte) (err error) {
 	if _, err = self.r.Seek(pos, 0); err != nil {
 		return
@@ -70,11 +79,22 @@ func (self *Demuxer) probe() (err error) {
 		return
 	}
 
-	self.streams = []*Stream{}
+	if self.streams, err = newStreamsFromMovie(moov); err != nil {
+		return
+	}
+	for _, stream := range self.streams {
+		stream.demuxer = self
+	}
+
+	self.movieAtom = moov
+	return
+}
+
+func newStreamsFromMovie(moov *mp4io.Movie) (streams []*Stream, err error) {
+	streams = []*Stream{}
 	for i, atrack := range moov.Tracks {
 		stream := &Stream{
 			trackAtom: atrack,
-			demuxer:   self,
 			idx:       i,
 		}
 		if atrack.Media != nil && atrack.Media.Info != nil && atrack.Media.Info.Sample != nil {
@@ -89,16 +109,14 @@ func (self *Demuxer) probe() (err error) {
 			if stream.CodecData, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(avc1.Data); err != nil {
 				return
 			}
-			self.streams = append(self.streams, stream)
+			streams = append(streams, stream)
 		} else if esds := atrack.GetElemStreamDesc(); esds != nil {
 			if stream.CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfigBytes(esds.DecConfig); err != nil {
 				return
 			}
-			self.streams = append(self.streams, stream)
+			streams = append(streams, stream)
 		}
 	}
-
-	self.movieAtom = moov
 	return
 }
 
@@ -363,19 +381,29 @@ func (self *Stream) readPacket() (pkt av.Packet, err error) {
 	}
 	//fmt.Println("readPacket", self.sampleIndex)
 
+	var sampleOffset int64
+	var sampleSize uint32
+	sampleOffset, sampleSize, pkt = self.curSample()
+
+	pkt.Data = make([]byte, sampleSize)
+	if err = self.demuxer.readat(sampleOffset, pkt.Data); err != nil {
+		return
+	}
+
+	self.incSampleIndex()
+
+	return
+}
+
+// curSample returns file position, size and packet flags of the current sample.
+func (self *Stream) curSample() (sampleOffset int64, sampleSize uint32, pkt av.Packet) {
 	chunkOffset := self.sample.ChunkOffset.Entries[self.chunkIndex]
-	sampleSize := uint32(0)
 	if self.sample.SampleSize.SampleSize != 0 {
 		sampleSize = self.sample.SampleSize.SampleSize
 	} else {
 		sampleSize = self.sample.SampleSize.Entries[self.sampleIndex]
 	}
-
-	sampleOffset := int64(chunkOffset) + self.sampleOffsetInChunk
-	pkt.Data = make([]byte, sampleSize)
-	if err = self.demuxer.readat(sampleOffset, pkt.Data); err != nil {
-		return
-	}
+	sampleOffset = int64(chunkOffset) + self.sampleOffsetInChunk
 
 	if self.sample.SyncSample != nil {
 		if self.sample.SyncSample.Entries[self.syncSampleIndex]-1 == uint32(self.sampleIndex) {
@@ -388,9 +416,6 @@ func (self *Stream) readPacket() (pkt av.Packet, err error) {
 		cts := int64(self.sample.CompositionOffset.Entries[self.cttsEntryIndex].Offset)
 		pkt.CompositionTime = self.tsToTime(cts)
 	}
-
-	self.incSampleIndex()
-
 	return
 }
 
@@ -20,7 +20,12 @@ func Handler(h *avutil.RegisterHandler) {
 	}
 
 	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
-		return NewDemuxer(r.(io.ReadSeeker))
+		if rs, ok := r.(io.ReadSeeker); ok {
+			if _, err := rs.Seek(0, 1); err == nil {
+				return NewDemuxer(rs)
+			}
+		}
+		return NewStreamDemuxer(r)
 	}
 
 	h.WriterMuxer = func(w io.Writer) av.Muxer {
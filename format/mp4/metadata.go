@@ -0,0 +1,156 @@
+package mp4
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nareix/joy4/format/mp4/mp4io"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// Metadata holds the iTunes style tags of a file. Well known keys are stored
+// as their ilst atoms (e.g. "title" as ©nam), other keys as freeform items.
+// The "creation_time" key (RFC3339) maps to the creation time in mvhd.
+type Metadata map[string]string
+
+const MetadataCreationTime = "creation_time"
+
+// FreeformMean is the namespace of freeform items written by the muxer.
+var FreeformMean = "com.apple.iTunes"
+
+var metadataTags = map[string]mp4io.Tag{
+	"title":       mp4io.ILST_NAME,
+	"artist":      mp4io.ILST_ARTIST,
+	"album":       mp4io.ILST_ALBUM,
+	"comment":     mp4io.ILST_COMMENT,
+	"date":        mp4io.ILST_DATE,
+	"encoder":     mp4io.ILST_ENCODER,
+	"genre":       mp4io.ILST_GENRE,
+	"description": mp4io.ILST_DESC,
+	"copyright":   mp4io.ILST_COPYRIGHT,
+}
+
+func metadataKeyOfTag(tag mp4io.Tag) string {
+	for k, t := range metadataTags {
+		if t == tag {
+			return k
+		}
+	}
+	var b [4]byte
+	pio.PutU32BE(b[:], uint32(tag))
+	if b[0] == 0xa9 {
+		return "©" + string(b[1:])
+	}
+	return string(b[:])
+}
+
+func (self Metadata) itemList() *mp4io.ItemList {
+	keys := []string{}
+	for k := range self {
+		if k != MetadataCreationTime {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	ilst := &mp4io.ItemList{}
+	for _, k := range keys {
+		entry := mp4io.ItemListEntry{
+			DataType: mp4io.ILST_DATA_UTF8,
+			Data:     []byte(self[k]),
+		}
+		if tag, ok := metadataTags[k]; ok {
+			entry.Tag = tag
+		} else {
+			entry.Tag = mp4io.ILST_FREEFORM
+			entry.Mean = FreeformMean
+			entry.Name = k
+		}
+		ilst.Entries = append(ilst.Entries, entry)
+	}
+	return ilst
+}
+
+func (self Metadata) creationTime() (tm time.Time, ok bool) {
+	if s, exists := self[MetadataCreationTime]; exists {
+		var err error
+		if tm, err = time.Parse(time.RFC3339, s); err == nil {
+			ok = true
+		}
+	}
+	return
+}
+
+func newMetadataFromMovie(moov *mp4io.Movie) (md Metadata) {
+	md = Metadata{}
+
+	epoch := time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if moov.Header != nil && moov.Header.CreateTime.After(epoch) {
+		md[MetadataCreationTime] = moov.Header.CreateTime.Format(time.RFC3339)
+	}
+
+	if moov.UserData == nil || moov.UserData.Meta == nil || moov.UserData.Meta.ItemList == nil {
+		return
+	}
+
+	for _, entry := range moov.UserData.Meta.ItemList.Entries {
+		var val string
+		switch entry.DataType {
+		case mp4io.ILST_DATA_UTF8:
+			val = string(entry.Data)
+
+		case mp4io.ILST_DATA_INT, mp4io.ILST_DATA_UINT:
+			var u uint64
+			for _, c := range entry.Data {
+				u = u<<8 | uint64(c)
+			}
+			if entry.DataType == mp4io.ILST_DATA_INT && len(entry.Data) > 0 && len(entry.Data) < 8 && entry.Data[0]&0x80 != 0 {
+				u -= 1 << uint(8*len(entry.Data))
+			}
+			if entry.DataType == mp4io.ILST_DATA_INT {
+				val = strconv.FormatInt(int64(u), 10)
+			} else {
+				val = strconv.FormatUint(u, 10)
+			}
+
+		default:
+			continue
+		}
+
+		if entry.Tag == mp4io.ILST_FREEFORM {
+			md[entry.Name] = val
+		} else {
+			md[metadataKeyOfTag(entry.Tag)] = val
+		}
+	}
+	return
+}
+
+func (self Metadata) fillMovie(moov *mp4io.Movie) {
+	if tm, ok := self.creationTime(); ok {
+		moov.Header.CreateTime = tm
+		moov.Header.ModifyTime = tm
+		for _, track := range moov.Tracks {
+			track.Header.CreateTime = tm
+			track.Header.ModifyTime = tm
+			track.Media.Header.CreateTime = tm
+			track.Media.Header.ModifyTime = tm
+		}
+	}
+
+	if ilst := self.itemList(); ilst != nil {
+		moov.UserData = &mp4io.UserData{
+			Meta: &mp4io.Metadata{
+				Handler: &mp4io.HandlerRefer{
+					SubType: mp4io.MDIR,
+					Name:    []byte{'a', 'p', 'p', 'l', 0, 0, 0, 0, 0, 0, 0, 0, 0},
+				},
+				ItemList: ilst,
+			},
+		}
+	}
+}
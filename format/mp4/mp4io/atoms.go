@@ -201,12 +201,31 @@ func (self SoundMediaInfo) Tag() Tag {
 	return SMHD
 }
 
+const META = Tag(0x6d657461)
+
+func (self Metadata) Tag() Tag {
+	return META
+}
+
+const UDTA = Tag(0x75647461)
+
+func (self UserData) Tag() Tag {
+	return UDTA
+}
+
+const ILST = Tag(0x696c7374)
+
+func (self ItemList) Tag() Tag {
+	return ILST
+}
+
 const MDAT = Tag(0x6d646174)
 
 type Movie struct {
 	Header		*MovieHeader
 	MovieExtend	*MovieExtend
 	Tracks		[]*Track
+	UserData	*UserData
 	Unknowns	[]Atom
 	AtomPos
 }
@@ -227,6 +246,9 @@ func (self Movie) marshal(b []byte) (n int) {
 	for _, atom := range self.Tracks {
 		n += atom.Marshal(b[n:])
 	}
+	if self.UserData != nil {
+		n += self.UserData.Marshal(b[n:])
+	}
 	for _, atom := range self.Unknowns {
 		n += atom.Marshal(b[n:])
 	}
@@ -243,6 +265,9 @@ func (self Movie) Len() (n int) {
 	for _, atom := range self.Tracks {
 		n += atom.Len()
 	}
+	if self.UserData != nil {
+		n += self.UserData.Len()
+	}
 	for _, atom := range self.Unknowns {
 		n += atom.Len()
 	}
@@ -277,6 +302,15 @@ func (self *Movie) Unmarshal(b []byte, offset int) (n int, err error) {
 				}
 				self.MovieExtend = atom
 			}
+		case UDTA:
+			{
+				atom := &UserData{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("udta", n+offset, err)
+					return
+				}
+				self.UserData = atom
+			}
 		case TRAK:
 			{
 				atom := &Track{}
@@ -310,6 +344,194 @@ func (self Movie) Children() (r []Atom) {
 	for _, atom := range self.Tracks {
 		r = append(r, atom)
 	}
+	if self.UserData != nil {
+		r = append(r, self.UserData)
+	}
+	r = append(r, self.Unknowns...)
+	return
+}
+
+type UserData struct {
+	Meta		*Metadata
+	Unknowns	[]Atom
+	AtomPos
+}
+
+func (self UserData) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(UDTA))
+	n += self.marshal(b[8:])+8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+func (self UserData) marshal(b []byte) (n int) {
+	if self.Meta != nil {
+		n += self.Meta.Marshal(b[n:])
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Marshal(b[n:])
+	}
+	return
+}
+func (self UserData) Len() (n int) {
+	n += 8
+	if self.Meta != nil {
+		n += self.Meta.Len()
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Len()
+	}
+	return
+}
+func (self *UserData) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	for n+8 < len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case META:
+			{
+				atom := &Metadata{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("meta", n+offset, err)
+					return
+				}
+				self.Meta = atom
+			}
+		default:
+			{
+				atom := &Dummy{Tag_: tag, Data: b[n:n+size]}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("", n+offset, err)
+					return
+				}
+				self.Unknowns = append(self.Unknowns, atom)
+			}
+		}
+		n += size
+	}
+	return
+}
+func (self UserData) Children() (r []Atom) {
+	if self.Meta != nil {
+		r = append(r, self.Meta)
+	}
+	r = append(r, self.Unknowns...)
+	return
+}
+
+type Metadata struct {
+	Version		uint8
+	Flags		uint32
+	Handler		*HandlerRefer
+	ItemList	*ItemList
+	Unknowns	[]Atom
+	AtomPos
+}
+
+func (self Metadata) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(META))
+	n += self.marshal(b[8:])+8
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+func (self Metadata) marshal(b []byte) (n int) {
+	pio.PutU8(b[n:], self.Version)
+	n += 1
+	pio.PutU24BE(b[n:], self.Flags)
+	n += 3
+	if self.Handler != nil {
+		n += self.Handler.Marshal(b[n:])
+	}
+	if self.ItemList != nil {
+		n += self.ItemList.Marshal(b[n:])
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Marshal(b[n:])
+	}
+	return
+}
+func (self Metadata) Len() (n int) {
+	n += 8
+	n += 1
+	n += 3
+	if self.Handler != nil {
+		n += self.Handler.Len()
+	}
+	if self.ItemList != nil {
+		n += self.ItemList.Len()
+	}
+	for _, atom := range self.Unknowns {
+		n += atom.Len()
+	}
+	return
+}
+func (self *Metadata) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	if len(b) < n+1 {
+		err = parseErr("Version", n+offset, err)
+		return
+	}
+	self.Version = pio.U8(b[n:])
+	n += 1
+	if len(b) < n+3 {
+		err = parseErr("Flags", n+offset, err)
+		return
+	}
+	self.Flags = pio.U24BE(b[n:])
+	n += 3
+	for n+8 < len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case HDLR:
+			{
+				atom := &HandlerRefer{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("hdlr", n+offset, err)
+					return
+				}
+				self.Handler = atom
+			}
+		case ILST:
+			{
+				atom := &ItemList{}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("ilst", n+offset, err)
+					return
+				}
+				self.ItemList = atom
+			}
+		default:
+			{
+				atom := &Dummy{Tag_: tag, Data: b[n:n+size]}
+				if _, err = atom.Unmarshal(b[n:n+size], offset+n); err != nil {
+					err = parseErr("", n+offset, err)
+					return
+				}
+				self.Unknowns = append(self.Unknowns, atom)
+			}
+		}
+		n += size
+	}
+	return
+}
+func (self Metadata) Children() (r []Atom) {
+	if self.Handler != nil {
+		r = append(r, self.Handler)
+	}
+	if self.ItemList != nil {
+		r = append(r, self.ItemList)
+	}
 	r = append(r, self.Unknowns...)
 	return
 }
@@ -3144,13 +3366,8 @@ func (self TrackFragRun) marshal(b []byte) (n int) {
 		}
 	}
 
-	for i, entry := range self.Entries {
-		var flags uint32
-		if i > 0 {
-			flags = self.Flags
-		} else {
-			flags = self.FirstSampleFlags
-		}
+	for _, entry := range self.Entries {
+		flags := self.Flags
 		if flags&TRUN_SAMPLE_DURATION != 0 {
 			pio.PutU32BE(b[n:], entry.Duration)
 			n += 4
@@ -3186,13 +3403,8 @@ func (self TrackFragRun) Len() (n int) {
 		}
 	}
 
-	for i := range self.Entries {
-		var flags uint32
-		if i > 0 {
-			flags = self.Flags
-		} else {
-			flags = self.FirstSampleFlags
-		}
+	for range self.Entries {
+		flags := self.Flags
 		if flags&TRUN_SAMPLE_DURATION != 0 {
 			n += 4
 		}
@@ -3249,12 +3461,7 @@ func (self *TrackFragRun) Unmarshal(b []byte, offset int) (n int, err error) {
 	}
 
 	for i := 0; i < int(_len_Entries); i++ {
-		var flags uint32
-		if i > 0 {
-			flags = self.Flags
-		} else {
-			flags = self.FirstSampleFlags
-		}
+		flags := self.Flags
 		entry := &self.Entries[i]
 		if flags&TRUN_SAMPLE_DURATION != 0 {
 			entry.Duration = pio.U32BE(b[n:])
@@ -3305,6 +3512,7 @@ const LenTrackFragRunEntry = 16
 type TrackFragHeader struct {
 	Version		uint8
 	Flags		uint32
+	TrackId		uint32
 	BaseDataOffset	uint64
 	StsdId		uint32
 	DefaultDuration	uint32
@@ -3324,6 +3532,8 @@ func (self TrackFragHeader) marshal(b []byte) (n int) {
 	n += 1
 	pio.PutU24BE(b[n:], self.Flags)
 	n += 3
+	pio.PutU32BE(b[n:], self.TrackId)
+	n += 4
 	if self.Flags&TFHD_BASE_DATA_OFFSET != 0 {
 		{
 			pio.PutU64BE(b[n:], self.BaseDataOffset)
@@ -3360,6 +3570,7 @@ func (self TrackFragHeader) Len() (n int) {
 	n += 8
 	n += 1
 	n += 3
+	n += 4
 	if self.Flags&TFHD_BASE_DATA_OFFSET != 0 {
 		{
 			n += 8
@@ -3402,6 +3613,12 @@ func (self *TrackFragHeader) Unmarshal(b []byte, offset int) (n int, err error)
 	}
 	self.Flags = pio.U24BE(b[n:])
 	n += 3
+	if len(b) < n+4 {
+		err = parseErr("TrackId", n+offset, err)
+		return
+	}
+	self.TrackId = pio.U32BE(b[n:])
+	n += 4
 	if self.Flags&TFHD_BASE_DATA_OFFSET != 0 {
 		{
 			if len(b) < n+8 {
@@ -3459,9 +3676,9 @@ func (self TrackFragHeader) Children() (r []Atom) {
 }
 
 type TrackFragDecodeTime struct {
-	Version	uint8
-	Flags	uint32
-	Time	time.Time
+	Version		uint8
+	Flags		uint32
+	DecodeTime	uint64
 	AtomPos
 }
 
@@ -3477,11 +3694,11 @@ func (self TrackFragDecodeTime) marshal(b []byte) (n int) {
 	pio.PutU24BE(b[n:], self.Flags)
 	n += 3
 	if self.Version != 0 {
-		PutTime64(b[n:], self.Time)
+		pio.PutU64BE(b[n:], self.DecodeTime)
 		n += 8
 	} else {
 
-		PutTime32(b[n:], self.Time)
+		pio.PutU32BE(b[n:], uint32(self.DecodeTime))
 		n += 4
 	}
 	return
@@ -3514,11 +3731,11 @@ func (self *TrackFragDecodeTime) Unmarshal(b []byte, offset int) (n int, err err
 	self.Flags = pio.U24BE(b[n:])
 	n += 3
 	if self.Version != 0 {
-		self.Time = GetTime64(b[n:])
+		self.DecodeTime = pio.U64BE(b[n:])
 		n += 8
 	} else {
 
-		self.Time = GetTime32(b[n:])
+		self.DecodeTime = uint64(pio.U32BE(b[n:]))
 		n += 4
 	}
 	return
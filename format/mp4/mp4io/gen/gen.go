@@ -980,6 +980,7 @@ func genatoms(filename, outfilename string) {
 
 	tagnamemap := map[string]string{}
 	tagnamemap["ElemStreamDesc"] = "esds"
+	tagnamemap["ItemList"] = "ilst"
 
 	splittagname := func(fnname string) (ok bool, tag, name string) {
 		if len(fnname) > 5 && fnname[4] == '_' {
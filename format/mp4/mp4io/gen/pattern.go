@@ -4,6 +4,20 @@ func moov_Movie() {
 	atom(Header, MovieHeader)
 	atom(MovieExtend, MovieExtend)
 	atoms(Tracks, Track)
+	atom(UserData, UserData)
+	_unknowns()
+}
+
+func udta_UserData() {
+	atom(Meta, Metadata)
+	_unknowns()
+}
+
+func meta_Metadata() {
+	uint8(Version)
+	uint24(Flags)
+	atom(Handler, HandlerRefer)
+	atom(ItemList, ItemList)
 	_unknowns()
 }
 
@@ -291,13 +305,8 @@ func trun_TrackFragRun() {
 	}))
 
 	slice(Entries, TrackFragRunEntry, _code(func() {
-		for i, entry := range self.Entries {
-			var flags uint32
-			if i > 0 {
-				flags = self.Flags
-			} else {
-				flags = self.FirstSampleFlags
-			}
+		for _, entry := range self.Entries {
+			flags := self.Flags
 			if flags&TRUN_SAMPLE_DURATION != 0 {
 				pio.PutU32BE(b[n:], entry.Duration)
 				n += 4
@@ -316,13 +325,8 @@ func trun_TrackFragRun() {
 			}
 		}
 	}, func() {
-		for i := range self.Entries {
-			var flags uint32
-			if i > 0 {
-				flags = self.Flags
-			} else {
-				flags = self.FirstSampleFlags
-			}
+		for range self.Entries {
+			flags := self.Flags
 			if flags&TRUN_SAMPLE_DURATION != 0 {
 				n += 4
 			}
@@ -338,12 +342,7 @@ func trun_TrackFragRun() {
 		}
 	}, func() {
 		for i := 0; i < int(_len_Entries); i++ {
-			var flags uint32
-			if i > 0 {
-				flags = self.Flags
-			} else {
-				flags = self.FirstSampleFlags
-			}
+			flags := self.Flags
 			entry := &self.Entries[i]
 			if flags&TRUN_SAMPLE_DURATION != 0 {
 				entry.Duration = pio.U32BE(b[n:])
@@ -375,6 +374,7 @@ func TrackFragRunEntry() {
 func tfhd_TrackFragHeader() {
 	uint8(Version)
 	uint24(Flags)
+	uint32(TrackId)
 
 	uint64(BaseDataOffset, _code(func() {
 		if self.Flags&TFHD_BASE_DATA_OFFSET != 0 {
@@ -410,12 +410,12 @@ func tfhd_TrackFragHeader() {
 func tfdt_TrackFragDecodeTime() {
 	uint8(Version)
 	uint24(Flags)
-	time64(Time, _code(func() {
+	uint64(DecodeTime, _code(func() {
 		if self.Version != 0 {
-			PutTime64(b[n:], self.Time)
+			pio.PutU64BE(b[n:], self.DecodeTime)
 			n += 8
 		} else {
-			PutTime32(b[n:], self.Time)
+			pio.PutU32BE(b[n:], uint32(self.DecodeTime))
 			n += 4
 		}
 	}, func() {
@@ -426,10 +426,10 @@ func tfdt_TrackFragDecodeTime() {
 		}
 	}, func() {
 		if self.Version != 0 {
-			self.Time = GetTime64(b[n:])
+			self.DecodeTime = pio.U64BE(b[n:])
 			n += 8
 		} else {
-			self.Time = GetTime32(b[n:])
+			self.DecodeTime = uint64(pio.U32BE(b[n:]))
 			n += 4
 		}
 	}))
@@ -0,0 +1,180 @@
+package mp4io
+
+import (
+	"fmt"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// iTunes style metadata item tags stored in moov/udta/meta/ilst.
+const (
+	ILST_NAME      = Tag(0xa96e616d) // ©nam
+	ILST_ARTIST    = Tag(0xa9415254) // ©ART
+	ILST_ALBUM     = Tag(0xa9616c62) // ©alb
+	ILST_COMMENT   = Tag(0xa9636d74) // ©cmt
+	ILST_DATE      = Tag(0xa9646179) // ©day
+	ILST_ENCODER   = Tag(0xa9746f6f) // ©too
+	ILST_GENRE     = Tag(0xa967656e) // ©gen
+	ILST_DESC      = Tag(0x64657363) // desc
+	ILST_COPYRIGHT = Tag(0x63707274) // cprt
+	ILST_FREEFORM  = Tag(0x2d2d2d2d) // ----
+)
+
+// Well-known types of the 'data' atom inside an ilst item.
+const (
+	ILST_DATA_BINARY = 0
+	ILST_DATA_UTF8   = 1
+	ILST_DATA_JPEG   = 13
+	ILST_DATA_PNG    = 14
+	ILST_DATA_INT    = 21
+	ILST_DATA_UINT   = 22
+)
+
+const (
+	MEAN = Tag(0x6d65616e)
+	NAME = Tag(0x6e616d65)
+	DATA = Tag(0x64617461)
+)
+
+// MDIR is the handler type of the meta atom holding an ilst.
+var MDIR = [4]byte{'m', 'd', 'i', 'r'}
+
+type ItemListEntry struct {
+	Tag      Tag
+	Mean     string // freeform items only, e.g. com.apple.iTunes
+	Name     string // freeform items only
+	DataType uint32
+	Locale   uint32
+	Data     []byte
+}
+
+func (self ItemListEntry) Len() (n int) {
+	n += 8
+	if self.Tag == ILST_FREEFORM {
+		n += 12 + len(self.Mean)
+		n += 12 + len(self.Name)
+	}
+	n += 16 + len(self.Data)
+	return
+}
+
+func (self ItemListEntry) marshalString(b []byte, tag Tag, s string) (n int) {
+	pio.PutU32BE(b[4:], uint32(tag))
+	n += 8
+	pio.PutU32BE(b[n:], 0) // Version+Flags
+	n += 4
+	copy(b[n:], s)
+	n += len(s)
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (self ItemListEntry) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(self.Tag))
+	n += 8
+	if self.Tag == ILST_FREEFORM {
+		n += self.marshalString(b[n:], MEAN, self.Mean)
+		n += self.marshalString(b[n:], NAME, self.Name)
+	}
+	pio.PutU32BE(b[n:], uint32(16+len(self.Data)))
+	pio.PutU32BE(b[n+4:], uint32(DATA))
+	pio.PutU32BE(b[n+8:], self.DataType&0xffffff)
+	pio.PutU32BE(b[n+12:], self.Locale)
+	n += 16
+	copy(b[n:], self.Data)
+	n += len(self.Data)
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (self *ItemListEntry) Unmarshal(b []byte, offset int) (n int, err error) {
+	self.Tag = Tag(pio.U32BE(b[4:]))
+	n += 8
+	for n+8 <= len(b) {
+		tag := Tag(pio.U32BE(b[n+4:]))
+		size := int(pio.U32BE(b[n:]))
+		if size < 8 || len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		switch tag {
+		case MEAN, NAME:
+			if size < 12 {
+				err = parseErr(tag.String(), n+offset, err)
+				return
+			}
+			if tag == MEAN {
+				self.Mean = string(b[n+12 : n+size])
+			} else {
+				self.Name = string(b[n+12 : n+size])
+			}
+		case DATA:
+			if size < 16 {
+				err = parseErr("data", n+offset, err)
+				return
+			}
+			self.DataType = pio.U32BE(b[n+8:]) & 0xffffff
+			self.Locale = pio.U32BE(b[n+12:])
+			self.Data = b[n+16 : n+size]
+		}
+		n += size
+	}
+	return
+}
+
+func (self ItemListEntry) String() string {
+	if self.Tag == ILST_FREEFORM {
+		return fmt.Sprintf("%s:%s type=%d len=%d", self.Mean, self.Name, self.DataType, len(self.Data))
+	}
+	return fmt.Sprintf("%s type=%d len=%d", self.Tag, self.DataType, len(self.Data))
+}
+
+type ItemList struct {
+	Entries []ItemListEntry
+	AtomPos
+}
+
+func (self ItemList) Children() []Atom {
+	return nil
+}
+
+func (self ItemList) Len() (n int) {
+	n += 8
+	for _, entry := range self.Entries {
+		n += entry.Len()
+	}
+	return
+}
+
+func (self ItemList) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[4:], uint32(ILST))
+	n += 8
+	for _, entry := range self.Entries {
+		n += entry.Marshal(b[n:])
+	}
+	pio.PutU32BE(b[0:], uint32(n))
+	return
+}
+
+func (self *ItemList) Unmarshal(b []byte, offset int) (n int, err error) {
+	(&self.AtomPos).setPos(offset, len(b))
+	n += 8
+	for n+8 <= len(b) {
+		size := int(pio.U32BE(b[n:]))
+		if size < 8 || len(b) < n+size {
+			err = parseErr("TagSizeInvalid", n+offset, err)
+			return
+		}
+		var entry ItemListEntry
+		if _, err = entry.Unmarshal(b[n:n+size], offset+n); err != nil {
+			err = parseErr("ilst", n+offset, err)
+			return
+		}
+		self.Entries = append(self.Entries, entry)
+		n += size
+	}
+	return
+}
+
+func (self ItemList) String() string {
+	return fmt.Sprintf("entries=%d", len(self.Entries))
+}
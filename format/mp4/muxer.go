@@ -17,6 +17,7 @@ type Muxer struct {
 	bufw       *bufio.Writer
 	wpos       int64
 	streams    []*Stream
+	metadata   Metadata
 }
 
 func NewMuxer(w io.WriteSeeker) *Muxer {
@@ -26,6 +27,11 @@ func NewMuxer(w io.WriteSeeker) *Muxer {
 	}
 }
 
+// SetMetadata sets the tags written into moov/udta by WriteTrailer.
+func (self *Muxer) SetMetadata(md Metadata) {
+	self.metadata = md
+}
+
 func (self *Muxer) newStream(codec av.CodecData) (err error) {
 	switch codec.Type() {
 	case av.H264, av.AAC:
@@ -252,6 +258,10 @@ func (self *Muxer) WriteTrailer() (err error) {
 	moov.Header.TimeScale = int32(timeScale)
 	moov.Header.Duration = int32(timeToTs(maxDur, timeScale))
 
+	if self.metadata != nil {
+		self.metadata.fillMovie(moov)
+	}
+
 	if err = self.bufw.Flush(); err != nil {
 		return
 	}
@@ -0,0 +1,251 @@
+package mp4
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/mp4/mp4io"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// StreamDemuxer reads mp4 from a non-seekable io.Reader. The 'moov' atom
+// must precede 'mdat'. Samples of all tracks are returned in file order.
+type StreamDemuxer struct {
+	r         *bufio.Reader
+	pos       int64
+	streams   []*Stream
+	movieAtom *mp4io.Movie
+
+	samples []streamSample
+	mdatend int64
+	inmdat  bool
+}
+
+type streamSample struct {
+	offset int64
+	size   uint32
+	pkt    av.Packet
+}
+
+func NewStreamDemuxer(r io.Reader) *StreamDemuxer {
+	return &StreamDemuxer{
+		r: bufio.NewReaderSize(r, pio.RecommendBufioSize),
+	}
+}
+
+func (self *StreamDemuxer) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	for _, stream := range self.streams {
+		streams = append(streams, stream.CodecData)
+	}
+	return
+}
+
+// Metadata returns the tags found in moov/udta and mvhd.
+func (self *StreamDemuxer) Metadata() (md Metadata, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	md = newMetadataFromMovie(self.movieAtom)
+	return
+}
+
+func (self *StreamDemuxer) skip(n int64) (err error) {
+	if _, err = io.CopyN(io.Discard, self.r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	self.pos += n
+	return
+}
+
+// readAtomHeader returns the atom tag and its payload size, -1 if the atom extends to the end of file.
+func (self *StreamDemuxer) readAtomHeader() (tag mp4io.Tag, size int64, err error) {
+	b := make([]byte, 16)
+	if _, err = io.ReadFull(self.r, b[:8]); err != nil {
+		return
+	}
+	self.pos += 8
+	size = int64(pio.U32BE(b[0:]))
+	tag = mp4io.Tag(pio.U32BE(b[4:]))
+
+	switch size {
+	case 0:
+		size = -1
+	case 1:
+		if _, err = io.ReadFull(self.r, b[8:16]); err != nil {
+			return
+		}
+		self.pos += 8
+		size = int64(pio.U64BE(b[8:])) - 16
+	default:
+		size -= 8
+	}
+	if size < -1 {
+		err = fmt.Errorf("mp4: atom '%s' size invalid", tag)
+		return
+	}
+	return
+}
+
+func (self *StreamDemuxer) probe() (err error) {
+	if self.movieAtom != nil {
+		return
+	}
+
+	for self.movieAtom == nil {
+		var tag mp4io.Tag
+		var size int64
+		if tag, size, err = self.readAtomHeader(); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("mp4: 'moov' atom not found")
+			}
+			return
+		}
+
+		switch tag {
+		case mp4io.MOOV:
+			if size < 0 {
+				err = fmt.Errorf("mp4: 'moov' atom size invalid")
+				return
+			}
+			b := make([]byte, 8+size)
+			if _, err = io.ReadFull(self.r, b[8:]); err != nil {
+				return
+			}
+			pio.PutU32BE(b[0:], uint32(len(b)))
+			pio.PutU32BE(b[4:], uint32(mp4io.MOOV))
+			moov := &mp4io.Movie{}
+			if _, err = moov.Unmarshal(b, int(self.pos-8)); err != nil {
+				return
+			}
+			self.pos += size
+			if self.streams, err = newStreamsFromMovie(moov); err != nil {
+				return
+			}
+			if err = self.indexSamples(); err != nil {
+				return
+			}
+			self.movieAtom = moov
+
+		case mp4io.MDAT, mp4io.MOOF:
+			err = fmt.Errorf("mp4: '%s' before 'moov' cannot be read from a non-seekable stream", tag)
+			return
+
+		default:
+			if size < 0 {
+				err = fmt.Errorf("mp4: 'moov' atom not found")
+				return
+			}
+			if err = self.skip(size); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (self *StreamDemuxer) indexSamples() (err error) {
+	self.samples = nil
+	for i, stream := range self.streams {
+		if len(stream.sample.ChunkOffset.Entries) == 0 {
+			continue
+		}
+		if err = stream.setSampleIndex(0); err != nil {
+			return
+		}
+		for stream.isSampleValid() {
+			sample := streamSample{}
+			sample.offset, sample.size, sample.pkt = stream.curSample()
+			sample.pkt.Idx = int8(i)
+			sample.pkt.Time = stream.tsToTime(stream.dts)
+			self.samples = append(self.samples, sample)
+			stream.incSampleIndex()
+		}
+	}
+	sort.SliceStable(self.samples, func(i, j int) bool {
+		return self.samples[i].offset < self.samples[j].offset
+	})
+	return
+}
+
+// seekForward skips to pos, entering mdat atoms on the way.
+func (self *StreamDemuxer) seekForward(pos int64) (err error) {
+	for {
+		if self.inmdat && (self.mdatend < 0 || pos < self.mdatend) {
+			if pos < self.pos {
+				err = fmt.Errorf("mp4: sample at offset=%d is behind read position=%d", pos, self.pos)
+				return
+			}
+			return self.skip(pos - self.pos)
+		}
+
+		if self.inmdat {
+			if err = self.skip(self.mdatend - self.pos); err != nil {
+				return
+			}
+			self.inmdat = false
+		}
+
+		var tag mp4io.Tag
+		var size int64
+		if tag, size, err = self.readAtomHeader(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if tag == mp4io.MDAT {
+			self.inmdat = true
+			if size < 0 {
+				self.mdatend = -1
+			} else {
+				self.mdatend = self.pos + size
+			}
+		} else {
+			if size < 0 {
+				err = io.ErrUnexpectedEOF
+				return
+			}
+			if err = self.skip(size); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (self *StreamDemuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	if len(self.streams) == 0 {
+		err = errors.New("mp4: no streams available while trying to read a packet")
+		return
+	}
+	if len(self.samples) == 0 {
+		err = io.EOF
+		return
+	}
+
+	sample := self.samples[0]
+	if err = self.seekForward(sample.offset); err != nil {
+		return
+	}
+	pkt = sample.pkt
+	pkt.Data = make([]byte, sample.size)
+	if _, err = io.ReadFull(self.r, pkt.Data); err != nil {
+		return
+	}
+	self.pos += int64(sample.size)
+	self.samples = self.samples[1:]
+	return
+}
@@ -0,0 +1,445 @@
+package ps
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
+	"github.com/nareix/joy4/format/ts/tsio"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// ProbePES is the number of PES packets read by Streams before giving up on
+// streams which are listed but never carried their codec parameters.
+var ProbePES = 256
+
+type Stream struct {
+	av.CodecData
+
+	streamId   uint8
+	streamType uint8
+	idx        int
+
+	pts, dts time.Duration
+	data     []byte
+}
+
+type pendingPacket struct {
+	stream *Stream
+	av.Packet
+}
+
+// Demuxer reads a program stream. A video frame may be split into several
+// PES packets, the ones without PTS continue the frame before them.
+type Demuxer struct {
+	r *bufio.Reader
+
+	pkts    []pendingPacket
+	streams []*Stream
+	psm     map[uint8]uint8
+	npes    int
+	pesbuf  []byte
+
+	stage int
+}
+
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:   bufio.NewReaderSize(r, pio.RecommendBufioSize),
+		psm: map[uint8]uint8{},
+	}
+}
+
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	for _, stream := range self.streams {
+		streams = append(streams, stream.CodecData)
+	}
+	return
+}
+
+func (self *Demuxer) probed() bool {
+	if len(self.streams) == 0 {
+		return false
+	}
+	for _, stream := range self.streams {
+		if stream.CodecData == nil {
+			return self.npes >= ProbePES
+		}
+	}
+	// without a PSM more streams may still show up
+	return len(self.psm) > 0 || self.npes >= ProbePES/8
+}
+
+func (self *Demuxer) probe() (err error) {
+	if self.stage == 0 {
+		for !self.probed() {
+			if err = self.poll(); err != nil {
+				if err == io.EOF && len(self.streams) > 0 {
+					err = nil
+					break
+				}
+				return
+			}
+		}
+		streams := []*Stream{}
+		for _, stream := range self.streams {
+			if stream.CodecData != nil {
+				stream.idx = len(streams)
+				streams = append(streams, stream)
+			} else {
+				stream.idx = -1
+			}
+		}
+		self.streams = streams
+		self.stage++
+	}
+	return
+}
+
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+
+	for {
+		for len(self.pkts) > 0 {
+			p := self.pkts[0]
+			self.pkts = self.pkts[1:]
+			if p.stream.idx >= 0 {
+				pkt = p.Packet
+				pkt.Idx = int8(p.stream.idx)
+				return
+			}
+		}
+		if err = self.poll(); err != nil {
+			return
+		}
+	}
+}
+
+func (self *Demuxer) poll() (err error) {
+	if err = self.readPacket(); err == io.EOF {
+		n := 0
+		for _, stream := range self.streams {
+			var i int
+			if i, err = self.payloadEnd(stream); err != nil {
+				return
+			}
+			n += i
+		}
+		if n == 0 {
+			err = io.EOF
+		}
+	}
+	return
+}
+
+// readStartCode skips to the next pack, system header, PSM or PES start code.
+func (self *Demuxer) readStartCode() (code uint8, err error) {
+	v := uint32(0xffffffff)
+	for {
+		var c byte
+		if c, err = self.r.ReadByte(); err != nil {
+			return
+		}
+		v = v<<8 | uint32(c)
+		if v&0xffffff00 == 0x100 && c >= StartCodeEnd {
+			code = c
+			return
+		}
+	}
+}
+
+func (self *Demuxer) readPacket() (err error) {
+	var code uint8
+	if code, err = self.readStartCode(); err != nil {
+		return
+	}
+
+	switch code {
+	case StartCodeEnd:
+		return
+
+	case StartCodePack:
+		var b []byte
+		if b, err = self.r.Peek(PackHeaderLength - 4); err != nil {
+			return
+		}
+		hdr := append([]byte{0, 0, 1, code}, b...)
+		var hdrlen int
+		if hdrlen, _, err = ParsePackHeader(hdr); err != nil {
+			return
+		}
+		_, err = self.r.Discard(hdrlen - 4)
+		return
+	}
+
+	var b []byte
+	if b, err = self.r.Peek(2); err != nil {
+		return
+	}
+	size := 6 + int(pio.U16BE(b))
+	if cap(self.pesbuf) < size {
+		self.pesbuf = make([]byte, size)
+	}
+	pkt := self.pesbuf[:size]
+	pio.PutU32BE(pkt, 0x100|uint32(code))
+	if _, err = io.ReadFull(self.r, pkt[4:]); err != nil {
+		return
+	}
+
+	switch {
+	case code == StartCodePSM:
+		psm := PSM{}
+		if _, err = psm.Unmarshal(pkt); err != nil {
+			return
+		}
+		for _, entry := range psm.Entries {
+			self.psm[entry.StreamId] = entry.StreamType
+		}
+
+	case isAudioStreamId(code) || isVideoStreamId(code):
+		self.npes++
+		err = self.handlePES(code, pkt)
+	}
+	return
+}
+
+func (self *Demuxer) findStream(id uint8, payload []byte) (stream *Stream) {
+	for _, stream = range self.streams {
+		if stream.streamId == id {
+			return
+		}
+	}
+	if self.stage != 0 {
+		return nil
+	}
+
+	typ, ok := self.psm[id]
+	if !ok {
+		typ = guessStreamType(id, payload)
+	}
+	switch typ {
+	case StreamTypeH264, StreamTypeH265, StreamTypeAAC, StreamTypeG711A, StreamTypeG711U:
+	default:
+		return nil
+	}
+	stream = &Stream{streamId: id, streamType: typ}
+	switch typ {
+	case StreamTypeG711A:
+		stream.CodecData = codec.NewPCMAlawCodecData()
+	case StreamTypeG711U:
+		stream.CodecData = codec.NewPCMMulawCodecData()
+	}
+	self.streams = append(self.streams, stream)
+	return
+}
+
+// guessStreamType is used for streams not listed in a PSM.
+func guessStreamType(id uint8, payload []byte) uint8 {
+	if isVideoStreamId(id) {
+		nalus, _ := h264parser.SplitNALUs(payload)
+		for _, nalu := range nalus {
+			if len(nalu) >= 2 && nalu[0]&0x81 == 0 && nalu[1] == 1 {
+				switch h265parser.NALUType(nalu) {
+				case h265parser.NALU_VPS, h265parser.NALU_SPS, h265parser.NALU_PPS, h265parser.NALU_AUD:
+					return StreamTypeH265
+				}
+			}
+		}
+		return StreamTypeH264
+	}
+	if len(payload) >= 2 && payload[0] == 0xff && payload[1]&0xf0 == 0xf0 {
+		return StreamTypeAAC
+	}
+	return StreamTypeG711A
+}
+
+func (self *Demuxer) handlePES(id uint8, pkt []byte) (err error) {
+	if len(pkt) < 9 || pkt[6]>>6 != 2 {
+		// not a MPEG-2 PES header
+		return
+	}
+	var hdrlen int
+	var pts, dts time.Duration
+	if hdrlen, _, _, pts, dts, err = tsio.ParsePESHeader(pkt); err != nil {
+		return
+	}
+	if hdrlen > len(pkt) {
+		err = fmt.Errorf("ps: invalid PES header")
+		return
+	}
+	payload := pkt[hdrlen:]
+	haspts := pkt[7]&0x80 != 0
+	if pkt[7]&0x40 == 0 {
+		dts = pts
+	}
+
+	stream := self.findStream(id, payload)
+	if stream == nil {
+		return
+	}
+
+	if isVideoStreamId(id) {
+		if haspts && (stream.data == nil || pts != stream.pts) {
+			if _, err = self.payloadEnd(stream); err != nil {
+				return
+			}
+			stream.pts, stream.dts = pts, dts
+			stream.data = make([]byte, 0, len(payload)*2)
+		}
+		if stream.data != nil {
+			stream.data = append(stream.data, payload...)
+		}
+	} else {
+		if haspts {
+			stream.pts, stream.dts = pts, dts
+		}
+		stream.data = append([]byte{}, payload...)
+		if _, err = self.payloadEnd(stream); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *Demuxer) addPacket(stream *Stream, data []byte, iskeyframe bool, timedelta time.Duration) {
+	pkt := av.Packet{
+		IsKeyFrame: iskeyframe,
+		Time:       stream.dts + timedelta,
+		Data:       data,
+	}
+	if stream.pts != stream.dts {
+		pkt.CompositionTime = stream.pts - stream.dts
+	}
+	self.pkts = append(self.pkts, pendingPacket{stream: stream, Packet: pkt})
+}
+
+// annexbToAVCC drops parameter sets and AUDs from nalus and returns the
+// rest in AVCC format.
+func annexbToAVCC(nalus [][]byte, isparam func([]byte) bool) (b []byte) {
+	for _, nalu := range nalus {
+		if len(nalu) == 0 || isparam(nalu) {
+			continue
+		}
+		var l [4]byte
+		pio.PutU32BE(l[:], uint32(len(nalu)))
+		b = append(b, l[:]...)
+		b = append(b, nalu...)
+	}
+	return
+}
+
+func (self *Demuxer) payloadEnd(stream *Stream) (n int, err error) {
+	payload := stream.data
+	if payload == nil {
+		return
+	}
+	stream.data = nil
+
+	switch stream.streamType {
+	case StreamTypeAAC:
+		var config aacparser.MPEG4AudioConfig
+		delta := time.Duration(0)
+		for len(payload) > 0 {
+			var hdrlen, framelen, samples int
+			if config, hdrlen, framelen, samples, err = aacparser.ParseADTSHeader(payload); err != nil {
+				return
+			}
+			if framelen > len(payload) {
+				break
+			}
+			if stream.CodecData == nil {
+				if stream.CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfig(config); err != nil {
+					return
+				}
+			}
+			self.addPacket(stream, payload[hdrlen:framelen], true, delta)
+			n++
+			delta += time.Duration(samples) * time.Second / time.Duration(config.SampleRate)
+			payload = payload[framelen:]
+		}
+
+	case StreamTypeG711A, StreamTypeG711U:
+		self.addPacket(stream, payload, true, 0)
+		n++
+
+	case StreamTypeH264:
+		nalus, _ := h264parser.SplitNALUs(payload)
+		var sps, pps []byte
+		iskeyframe := false
+		for _, nalu := range nalus {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch nalu[0] & 0x1f {
+			case 7:
+				sps = nalu
+			case 8:
+				pps = nalu
+			case 5:
+				iskeyframe = true
+			}
+		}
+		if stream.CodecData == nil && len(sps) > 0 && len(pps) > 0 {
+			if stream.CodecData, err = h264parser.NewCodecDataFromSPSAndPPS(sps, pps); err != nil {
+				return
+			}
+		}
+		isparam := func(nalu []byte) bool {
+			typ := nalu[0] & 0x1f
+			return typ == 7 || typ == 8 || typ == 9
+		}
+		if data := annexbToAVCC(nalus, isparam); len(data) > 0 && stream.CodecData != nil {
+			self.addPacket(stream, data, iskeyframe, 0)
+			n++
+		}
+
+	case StreamTypeH265:
+		nalus, _ := h264parser.SplitNALUs(payload)
+		var vps, sps, pps []byte
+		iskeyframe := false
+		for _, nalu := range nalus {
+			if len(nalu) < 2 {
+				continue
+			}
+			switch typ := h265parser.NALUType(nalu); {
+			case typ == h265parser.NALU_VPS:
+				vps = nalu
+			case typ == h265parser.NALU_SPS:
+				sps = nalu
+			case typ == h265parser.NALU_PPS:
+				pps = nalu
+			case h265parser.IsKeyFrameNALU(nalu):
+				iskeyframe = true
+			}
+		}
+		if stream.CodecData == nil && len(vps) > 0 && len(sps) > 0 && len(pps) > 0 {
+			if stream.CodecData, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps); err != nil {
+				return
+			}
+		}
+		isparam := func(nalu []byte) bool {
+			switch h265parser.NALUType(nalu) {
+			case h265parser.NALU_VPS, h265parser.NALU_SPS, h265parser.NALU_PPS, h265parser.NALU_AUD:
+				return true
+			}
+			return false
+		}
+		if data := annexbToAVCC(nalus, isparam); len(data) > 0 && stream.CodecData != nil {
+			self.addPacket(stream, data, iskeyframe, 0)
+			n++
+		}
+	}
+
+	return
+}
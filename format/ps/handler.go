@@ -0,0 +1,37 @@
+package ps
+
+import (
+	"io"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+)
+
+func probe(b []byte) bool {
+	return b[0] == 0 && b[1] == 0 && b[2] == 1 && b[3] == StartCodePack
+}
+
+func handler(h *avutil.RegisterHandler, ext string) {
+	h.Ext = ext
+
+	h.Probe = probe
+
+	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
+		return NewDemuxer(r)
+	}
+
+	h.WriterMuxer = func(w io.Writer) av.Muxer {
+		return NewMuxer(w)
+	}
+
+	h.CodecTypes = CodecTypes
+}
+
+func Handler(h *avutil.RegisterHandler) {
+	handler(h, ".ps")
+}
+
+// MpgHandler registers the .mpg extension.
+func MpgHandler(h *avutil.RegisterHandler) {
+	handler(h, ".mpg")
+}
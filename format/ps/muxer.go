@@ -0,0 +1,205 @@
+package ps
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/h265parser"
+	"github.com/nareix/joy4/format/ts/tsio"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// Muxer writes a program stream the way GB28181 devices do: a pack header
+// before every frame, system header and PSM before every video keyframe,
+// and frames larger than a PES packet split into several PES packets.
+type Muxer struct {
+	w       io.Writer
+	streams []*Stream
+
+	hdr     []byte
+	peshdr  []byte
+	adtshdr []byte
+	gotpkt  bool
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{
+		w:       w,
+		hdr:     make([]byte, 512),
+		peshdr:  make([]byte, tsio.MaxPESHeaderLength),
+		adtshdr: make([]byte, aacparser.ADTSHeaderLength),
+	}
+}
+
+func (self *Muxer) newStream(codec av.CodecData) (err error) {
+	stream := &Stream{CodecData: codec, idx: len(self.streams)}
+	naudio, nvideo := 0, 0
+	for _, s := range self.streams {
+		if s.Type().IsAudio() {
+			naudio++
+		} else {
+			nvideo++
+		}
+	}
+	switch codec.Type() {
+	case av.H264:
+		stream.streamType = StreamTypeH264
+	case av.H265:
+		stream.streamType = StreamTypeH265
+	case av.AAC:
+		stream.streamType = StreamTypeAAC
+	case av.PCM_ALAW:
+		stream.streamType = StreamTypeG711A
+	case av.PCM_MULAW:
+		stream.streamType = StreamTypeG711U
+	default:
+		err = fmt.Errorf("ps: codec type=%s is not supported", codec.Type())
+		return
+	}
+	if codec.Type().IsAudio() {
+		stream.streamId = StreamIdAudio + uint8(naudio)
+	} else {
+		stream.streamId = StreamIdVideo + uint8(nvideo)
+	}
+	self.streams = append(self.streams, stream)
+	return
+}
+
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	self.streams = []*Stream{}
+	for _, codec := range streams {
+		if err = self.newStream(codec); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// fillMap writes the system header and PSM.
+func (self *Muxer) fillMap(b []byte) (n int) {
+	ids := []uint8{}
+	psm := PSM{}
+	for _, stream := range self.streams {
+		ids = append(ids, stream.streamId)
+		psm.Entries = append(psm.Entries, PSMEntry{
+			StreamType: stream.streamType,
+			StreamId:   stream.streamId,
+		})
+	}
+	n += FillSystemHeader(b[n:], ids)
+	n += psm.Marshal(b[n:])
+	return
+}
+
+func annexb(datav [][]byte, nalus [][]byte, aud []byte) [][]byte {
+	for i, nalu := range nalus {
+		if i == 0 {
+			datav = append(datav, aud)
+		} else {
+			datav = append(datav, h264parser.StartCodeBytes)
+		}
+		datav = append(datav, nalu)
+	}
+	return datav
+}
+
+func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	stream := self.streams[pkt.Idx]
+	pkt.Time += time.Second
+
+	var datav [][]byte
+	switch codec := stream.CodecData.(type) {
+	case aacparser.CodecData:
+		aacparser.FillADTSHeader(self.adtshdr, codec.Config, 1024, len(pkt.Data))
+		datav = [][]byte{self.adtshdr, pkt.Data}
+
+	case h264parser.CodecData:
+		nalus := [][]byte{}
+		if pkt.IsKeyFrame {
+			nalus = append(nalus, codec.SPS(), codec.PPS())
+		}
+		pktnalus, _ := h264parser.SplitNALUs(pkt.Data)
+		nalus = append(nalus, pktnalus...)
+		datav = annexb(datav, nalus, h264parser.AUDBytes)
+
+	case h265parser.CodecData:
+		nalus := [][]byte{}
+		if pkt.IsKeyFrame {
+			nalus = append(nalus, codec.VPS(), codec.SPS(), codec.PPS())
+		}
+		pktnalus, _ := h264parser.SplitNALUs(pkt.Data)
+		nalus = append(nalus, pktnalus...)
+		datav = annexb(datav, nalus, h265parser.AUDBytes)
+
+	default:
+		datav = [][]byte{pkt.Data}
+	}
+
+	n := FillPackHeader(self.hdr, pkt.Time)
+	if !self.gotpkt || (stream.Type().IsVideo() && pkt.IsKeyFrame) {
+		n += self.fillMap(self.hdr[n:])
+		self.gotpkt = true
+	}
+	if _, err = self.w.Write(self.hdr[:n]); err != nil {
+		return
+	}
+
+	return self.writePES(stream, datav, pkt.Time+pkt.CompositionTime, pkt.Time, pkt.CompositionTime != 0)
+}
+
+// writePES writes datav in PES packets of at most MaxPESLength bytes, the
+// first one carries PTS and DTS.
+func (self *Muxer) writePES(stream *Stream, datav [][]byte, pts, dts time.Duration, hasdts bool) (err error) {
+	datalen := 0
+	for _, b := range datav {
+		datalen += len(b)
+	}
+
+	first := true
+	for datalen > 0 {
+		var n int
+		if first {
+			if !hasdts {
+				dts = 0
+			}
+			n = tsio.FillPESHeader(self.peshdr, stream.streamId, 0, pts, dts)
+		} else {
+			n = tsio.FillPESHeader(self.peshdr, stream.streamId, 0, 0, 0)
+		}
+		size := datalen
+		if max := MaxPESLength - (n - 6); size > max {
+			size = max
+		}
+		pio.PutU16BE(self.peshdr[4:6], uint16(n-6+size))
+		if _, err = self.w.Write(self.peshdr[:n]); err != nil {
+			return
+		}
+
+		for left := size; left > 0; {
+			b := datav[0]
+			if len(b) > left {
+				b = b[:left]
+				datav[0] = datav[0][left:]
+			} else {
+				datav = datav[1:]
+			}
+			if _, err = self.w.Write(b); err != nil {
+				return
+			}
+			left -= len(b)
+		}
+		datalen -= size
+		first = false
+	}
+	return
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	pio.PutU32BE(self.hdr, 0x100|StartCodeEnd)
+	_, err = self.w.Write(self.hdr[:4])
+	return
+}
@@ -0,0 +1,251 @@
+// Package ps implements the MPEG-2 Program Stream as sent by NVRs and GB28181
+// devices: pack headers, system headers, the program stream map (PSM) and
+// PES packets of H264/H265/AAC/G.711.
+package ps
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/ts/tsio"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AAC, av.PCM_ALAW, av.PCM_MULAW}
+
+const (
+	StartCodeEnd    = 0xb9
+	StartCodePack   = 0xba
+	StartCodeSystem = 0xbb
+	StartCodePSM    = 0xbc
+)
+
+const (
+	StreamIdPrivate1 = 0xbd
+	StreamIdPadding  = 0xbe
+	StreamIdPrivate2 = 0xbf
+	StreamIdAudio    = 0xc0 // 0xc0-0xdf
+	StreamIdVideo    = 0xe0 // 0xe0-0xef
+)
+
+// Stream types used in the PSM, G.711 ones are the GB28181 values.
+const (
+	StreamTypeAAC   = 0x0f
+	StreamTypeH264  = 0x1b
+	StreamTypeH265  = 0x24
+	StreamTypeG711A = 0x90
+	StreamTypeG711U = 0x91
+)
+
+const (
+	PackHeaderLength = 14
+	MaxPESLength     = 0xffff
+)
+
+// muxRate is written in pack and system headers in units of 50 bytes/s.
+const muxRate = 50000
+
+var ErrParsePSM = fmt.Errorf("ps: invalid PSM")
+
+func isAudioStreamId(id uint8) bool {
+	return id >= 0xc0 && id <= 0xdf
+}
+
+func isVideoStreamId(id uint8) bool {
+	return id >= 0xe0 && id <= 0xef
+}
+
+// FillPackHeader writes a MPEG-2 pack header with system_clock_reference scr.
+func FillPackHeader(b []byte, scr time.Duration) (n int) {
+	pio.PutU32BE(b[0:4], 0x100|StartCodePack)
+	base := uint64(scr * tsio.PTS_HZ / time.Second)
+	// '01' SCR_base[32..30] marker SCR_base[29..15] marker SCR_base[14..0] marker SCR_ext(9) marker
+	b[4] = 0x44 | byte(base>>27)&0x38 | byte(base>>28)&0x03
+	b[5] = byte(base >> 20)
+	b[6] = 0x04 | byte(base>>12)&0xf8 | byte(base>>13)&0x03
+	b[7] = byte(base >> 5)
+	b[8] = 0x04 | byte(base<<3)&0xf8
+	b[9] = 0x01
+	// program_mux_rate(22) marker marker
+	pio.PutU24BE(b[10:13], muxRate<<2|3)
+	// reserved(5) pack_stuffing_length(3)=0
+	b[13] = 0xf8
+	return PackHeaderLength
+}
+
+// ParsePackHeader returns the length of a MPEG-1 or MPEG-2 pack header
+// including stuffing, b starts with the start code.
+func ParsePackHeader(b []byte) (hdrlen int, scr time.Duration, err error) {
+	if len(b) < 12 {
+		err = fmt.Errorf("ps: invalid pack header")
+		return
+	}
+	var base uint64
+	if b[4]>>6 == 1 {
+		if len(b) < PackHeaderLength {
+			err = fmt.Errorf("ps: invalid pack header")
+			return
+		}
+		base = uint64(b[4]&0x38)<<27 | uint64(b[4]&0x03)<<28 | uint64(b[5])<<20 |
+			uint64(b[6]&0xf8)<<12 | uint64(b[6]&0x03)<<13 | uint64(b[7])<<5 | uint64(b[8]>>3)
+		hdrlen = PackHeaderLength + int(b[13]&7)
+	} else {
+		// MPEG-1 '0010' SCR[32..30] marker SCR[29..15] marker SCR[14..0] marker
+		base = uint64(b[4]&0x0e)<<29 | uint64(pio.U16BE(b[5:])>>1)<<15 | uint64(pio.U16BE(b[7:])>>1)
+		hdrlen = 12
+	}
+	scr = time.Duration(base) * time.Second / tsio.PTS_HZ
+	return
+}
+
+// FillSystemHeader writes a system header listing streamids.
+func FillSystemHeader(b []byte, streamids []uint8) (n int) {
+	pio.PutU32BE(b[0:4], 0x100|StartCodeSystem)
+	n += 6
+	// marker rate_bound(22) marker
+	pio.PutU24BE(b[n:], 0x800001|muxRate<<1)
+	n += 3
+	audiobound, videobound := 0, 0
+	for _, id := range streamids {
+		if isAudioStreamId(id) {
+			audiobound++
+		} else {
+			videobound++
+		}
+	}
+	// audio_bound(6) fixed_flag(1) CSPS_flag(1)
+	b[n] = byte(audiobound << 2)
+	n++
+	// system_audio_lock_flag system_video_lock_flag marker video_bound(5)
+	b[n] = 0xe0 | byte(videobound)
+	n++
+	// packet_rate_restriction_flag reserved(7)
+	b[n] = 0x7f
+	n++
+	for _, id := range streamids {
+		b[n] = id
+		// '11' P-STD_buffer_bound_scale P-STD_buffer_size_bound(13)
+		if isAudioStreamId(id) {
+			pio.PutU16BE(b[n+1:], 0xc000|32) // 32*128 bytes
+		} else {
+			pio.PutU16BE(b[n+1:], 0xe000|400) // 400*1024 bytes
+		}
+		n += 3
+	}
+	pio.PutU16BE(b[4:6], uint16(n-6))
+	return
+}
+
+type PSMEntry struct {
+	StreamType  uint8
+	StreamId    uint8
+	Descriptors []tsio.Descriptor
+}
+
+// PSM is the program stream map.
+type PSM struct {
+	Version uint8
+	Entries []PSMEntry
+}
+
+func (self PSM) Len() (n int) {
+	// start code(32) length(16) flags(16) program_stream_info_length(16) elementary_stream_map_length(16)
+	n += 12
+	for _, entry := range self.Entries {
+		n += 4
+		for _, desc := range entry.Descriptors {
+			n += 2 + len(desc.Data)
+		}
+	}
+	// CRC_32
+	n += 4
+	return
+}
+
+// Marshal writes the whole PSM packet starting with its start code.
+func (self PSM) Marshal(b []byte) (n int) {
+	total := self.Len()
+	pio.PutU32BE(b[0:4], 0x100|StartCodePSM)
+	pio.PutU16BE(b[4:6], uint16(total-6))
+	// current_next_indicator(1)=1 single_extension_stream_flag(1)=0 reserved(1) version(5)
+	b[6] = 0x80 | 0x20 | self.Version&0x1f
+	// reserved(7) marker(1)
+	b[7] = 0xff
+	// program_stream_info_length(16)
+	pio.PutU16BE(b[8:10], 0)
+	pio.PutU16BE(b[10:12], uint16(total-12-4))
+	n += 12
+	for _, entry := range self.Entries {
+		b[n] = entry.StreamType
+		b[n+1] = entry.StreamId
+		hold := n + 2
+		n += 4
+		pos := n
+		for _, desc := range entry.Descriptors {
+			b[n] = desc.Tag
+			b[n+1] = byte(len(desc.Data))
+			n += 2
+			n += copy(b[n:], desc.Data)
+		}
+		pio.PutU16BE(b[hold:], uint16(n-pos))
+	}
+	tsio.PutCRC32(b[n:], b[:n])
+	n += 4
+	return
+}
+
+// Unmarshal parses a whole PSM packet starting with its start code.
+func (self *PSM) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 16 {
+		err = ErrParsePSM
+		return
+	}
+	size := 6 + int(pio.U16BE(b[4:6]))
+	if len(b) < size || size < 16 {
+		err = ErrParsePSM
+		return
+	}
+	b = b[:size]
+	self.Version = b[6] & 0x1f
+	n = 8
+	infolen := int(pio.U16BE(b[n:]))
+	n += 2 + infolen
+	if len(b) < n+2 {
+		err = ErrParsePSM
+		return
+	}
+	maplen := int(pio.U16BE(b[n:]))
+	n += 2
+	end := n + maplen
+	if end > len(b)-4 {
+		err = ErrParsePSM
+		return
+	}
+	self.Entries = nil
+	for n+4 <= end {
+		entry := PSMEntry{
+			StreamType: b[n],
+			StreamId:   b[n+1],
+		}
+		infolen := int(pio.U16BE(b[n+2:]))
+		n += 4
+		if n+infolen > end {
+			err = ErrParsePSM
+			return
+		}
+		for i := n; i+2 <= n+infolen; {
+			desclen := int(b[i+1])
+			if i+2+desclen > n+infolen {
+				err = ErrParsePSM
+				return
+			}
+			entry.Descriptors = append(entry.Descriptors, tsio.Descriptor{Tag: b[i], Data: b[i+2 : i+2+desclen]})
+			i += 2 + desclen
+		}
+		n += infolen
+		self.Entries = append(self.Entries, entry)
+	}
+	n = size
+	return
+}
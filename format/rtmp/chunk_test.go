@@ -0,0 +1,184 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/nareix/joy4/format/flv/flvio"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// chunkTestConn reads a crafted chunk stream and records what is written.
+type chunkTestConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (self *chunkTestConn) Read(p []byte) (int, error) {
+	return self.r.Read(p)
+}
+
+func (self *chunkTestConn) Write(p []byte) (int, error) {
+	return self.w.Write(p)
+}
+
+func newChunkTestConn(chunks ...[]byte) (*Conn, *chunkTestConn) {
+	nc := &chunkTestConn{r: bytes.NewReader(bytes.Join(chunks, nil))}
+	return NewConn(nc), nc
+}
+
+// chunkHeader builds a chunk header of type hdrtype on chunk stream csid. ts is
+// the timestamp or delta, written as extended timestamp when it does not fit
+// in 24 bits, or for type 3 chunks when ext is set.
+func chunkHeader(hdrtype uint8, csid uint8, ts uint32, ext bool, msgtypeid uint8, msgsid uint32, msgdatalen int) []byte {
+	b := []byte{hdrtype<<6 | csid}
+	ext = ext || ts >= FlvTimestampMax
+	if hdrtype <= 2 {
+		h := make([]byte, 3)
+		if ext {
+			pio.PutU24BE(h, FlvTimestampMax)
+		} else {
+			pio.PutU24BE(h, ts)
+		}
+		b = append(b, h...)
+	}
+	if hdrtype <= 1 {
+		h := make([]byte, 4)
+		pio.PutU24BE(h, uint32(msgdatalen))
+		h[3] = msgtypeid
+		b = append(b, h...)
+	}
+	if hdrtype == 0 {
+		h := make([]byte, 4)
+		pio.PutU32LE(h, msgsid)
+		b = append(b, h...)
+	}
+	if ext {
+		h := make([]byte, 4)
+		pio.PutU32BE(h, ts)
+		b = append(b, h...)
+	}
+	return b
+}
+
+// aacRaw returns an AAC raw audio message of n bytes.
+func aacRaw(n int) []byte {
+	b := make([]byte, n)
+	b[0] = 0xaf
+	b[1] = flvio.AAC_RAW
+	return b
+}
+
+func pollAudio(t *testing.T, conn *Conn, timestamp uint32, datalen int) {
+	t.Helper()
+	if err := conn.pollMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.msgtypeid != msgtypeidAudioMsg || conn.avtag.Type != flvio.TAG_AUDIO {
+		t.Fatalf("got message type %d", conn.msgtypeid)
+	}
+	if conn.timestamp != timestamp || len(conn.msgdata) != datalen {
+		t.Fatalf("got timestamp %#x length %d, want %#x %d", conn.timestamp, len(conn.msgdata), timestamp, datalen)
+	}
+}
+
+func TestChunkExtendedTimestamp(t *testing.T) {
+	const ts = 0x1000000
+	msg := aacRaw(200)
+	conn, _ := newChunkTestConn(
+		// type 0 with extended timestamp, split by the 128 bytes chunk size
+		chunkHeader(0, 4, ts, false, msgtypeidAudioMsg, 1, len(msg)), msg[:128],
+		chunkHeader(3, 4, ts, true, 0, 0, 0), msg[128:],
+		// type 3 after type 0 has its timestamp as delta
+		chunkHeader(3, 4, ts, true, 0, 0, 0), msg[:128],
+		chunkHeader(3, 4, ts, true, 0, 0, 0), msg[128:],
+		// type 1 with extended delta
+		chunkHeader(1, 4, ts, false, msgtypeidAudioMsg, 0, len(msg)), msg[:128],
+		chunkHeader(3, 4, ts, true, 0, 0, 0), msg[128:],
+		// type 2 and type 3 without
+		chunkHeader(2, 4, 40, false, 0, 0, 0), msg[:128],
+		chunkHeader(3, 4, 0, false, 0, 0, 0), msg[128:],
+		chunkHeader(3, 4, 0, false, 0, 0, 0), msg[:128],
+		chunkHeader(3, 4, 0, false, 0, 0, 0), msg[128:],
+	)
+	pollAudio(t, conn, ts, len(msg))
+	pollAudio(t, conn, 2*ts, len(msg))
+	pollAudio(t, conn, 3*ts, len(msg))
+	pollAudio(t, conn, 3*ts+40, len(msg))
+	pollAudio(t, conn, 3*ts+80, len(msg))
+}
+
+func TestChunkAbort(t *testing.T) {
+	msg := aacRaw(200)
+	abort := make([]byte, 4)
+	pio.PutU32BE(abort, 4)
+	conn, _ := newChunkTestConn(
+		chunkHeader(0, 4, 100, false, msgtypeidAudioMsg, 1, len(msg)), msg[:128],
+		// < Abort(csid) drops the rest of the message
+		chunkHeader(0, 2, 0, false, msgtypeidAbort, 0, len(abort)), abort,
+		chunkHeader(0, 4, 120, false, msgtypeidAudioMsg, 1, 10), msg[:10],
+	)
+	pollAudio(t, conn, 120, 10)
+}
+
+func TestChunkPing(t *testing.T) {
+	ping := []byte{0, eventtypePingRequest, 0x12, 0x34, 0x56, 0x78}
+	conn, nc := newChunkTestConn(
+		chunkHeader(0, 2, 0, false, msgtypeidUserControl, 0, len(ping)), ping,
+	)
+	if err := conn.pollMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.eventtype != eventtypePingRequest {
+		t.Fatalf("got event type %d", conn.eventtype)
+	}
+	// > PingResponse(timestamp)
+	want := append(chunkHeader(0, 2, 0, false, msgtypeidUserControl, 0, 6), 0, eventtypePingResponse, 0x12, 0x34, 0x56, 0x78)
+	if !bytes.Equal(nc.w.Bytes(), want) {
+		t.Fatalf("got response % x, want % x", nc.w.Bytes(), want)
+	}
+}
+
+func TestChunkAggregate(t *testing.T) {
+	audio := aacRaw(7)
+	video := []byte{0x17, flvio.AVC_NALU, 0, 0, 0, 0x65, 0x88}
+	var agg []byte
+	b := make([]byte, flvio.TagHeaderLength+flvio.TagTrailerLength)
+	for i, data := range [][]byte{audio, video} {
+		tagtype := uint8(flvio.TAG_AUDIO)
+		if i == 1 {
+			tagtype = flvio.TAG_VIDEO
+		}
+		n := flvio.FillTagHeader(b, tagtype, len(data), 5000+int32(i)*40)
+		agg = append(agg, b[:n]...)
+		agg = append(agg, data...)
+		// the last back pointer is left out
+		if i == 0 {
+			n = flvio.FillTagTrailer(b, len(data))
+			agg = append(agg, b[:n]...)
+		}
+	}
+	conn, _ := newChunkTestConn(
+		chunkHeader(0, 4, 1000, false, msgtypeidAggregate, 1, len(agg)), agg,
+	)
+	pollAudio(t, conn, 1000, len(audio))
+	if err := conn.pollMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.avtag.Type != flvio.TAG_VIDEO || conn.timestamp != 1040 || conn.msgsid != 1 {
+		t.Fatalf("got tag type %d timestamp %d msgsid %d", conn.avtag.Type, conn.timestamp, conn.msgsid)
+	}
+	if conn.avtag.FrameType != flvio.FRAME_KEY || !bytes.Equal(conn.avtag.Data, video[5:]) {
+		t.Fatalf("got video tag %+v", conn.avtag)
+	}
+
+	conn, _ = newChunkTestConn(
+		chunkHeader(0, 4, 1000, false, msgtypeidAggregate, 1, 5), []byte{flvio.TAG_AUDIO, 0, 0, 9, 0},
+	)
+	if err := conn.pollMsg(); err == nil {
+		t.Fatal("short aggregate message accepted")
+	}
+}
@@ -0,0 +1,563 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/flv/flvio"
+)
+
+// NetStream is a message stream of a server side Conn, created by the
+// createStream command. A connection can carry several of them, like a
+// multi-bitrate publisher or a player playing more than one stream. The
+// first stream published or played is the one the av.Demuxer and av.Muxer
+// methods of Conn work on.
+type NetStream struct {
+	ID uint32
+	// Name is the stream name of the last publish or play, URL the URL built
+	// from it and the connect parameters.
+	Name string
+	URL  *url.URL
+	// Start is the position play asked for, zero for live streams.
+	Start time.Duration
+
+	conn                *Conn
+	publishing, playing bool
+	closed              bool
+	paused              bool
+	noaudio, novideo    bool
+	prober              *flv.Prober
+	streams             []av.CodecData
+}
+
+func (self *NetStream) Publishing() bool {
+	self.conn.nsmu.Lock()
+	defer self.conn.nsmu.Unlock()
+	return self.publishing
+}
+
+func (self *NetStream) Playing() bool {
+	self.conn.nsmu.Lock()
+	defer self.conn.nsmu.Unlock()
+	return self.playing
+}
+
+// Paused reports whether the player paused the stream. WritePacket drops
+// packets while paused.
+func (self *NetStream) Paused() bool {
+	self.conn.nsmu.Lock()
+	defer self.conn.nsmu.Unlock()
+	return self.paused
+}
+
+// Closed reports whether the client sent closeStream or deleteStream.
+func (self *NetStream) Closed() bool {
+	self.conn.nsmu.Lock()
+	defer self.conn.nsmu.Unlock()
+	return self.closed
+}
+
+// Streams returns the codecs of a published stream once probed, or the ones
+// given to WriteHeader of a played stream.
+func (self *NetStream) Streams() []av.CodecData {
+	self.conn.nsmu.Lock()
+	defer self.conn.nsmu.Unlock()
+	return self.streams
+}
+
+// WriteHeader sends the metadata and sequence headers on a played stream.
+func (self *NetStream) WriteHeader(streams []av.CodecData) (err error) {
+	if err = self.conn.writeHeader(self.ID, streams); err != nil {
+		return
+	}
+	self.conn.nsmu.Lock()
+	self.streams = streams
+	self.conn.nsmu.Unlock()
+	return
+}
+
+// WritePacket sends a packet on a played stream. Packets are dropped while
+// the stream is paused or the player turned off receiveAudio or
+// receiveVideo, io.EOF is returned once the stream is closed.
+func (self *NetStream) WritePacket(pkt av.Packet) (err error) {
+	c := self.conn
+	c.nsmu.Lock()
+	closed, paused, noaudio, novideo, streams := self.closed, self.paused, self.noaudio, self.novideo, self.streams
+	c.nsmu.Unlock()
+
+	if closed {
+		err = io.EOF
+		return
+	}
+	if int(pkt.Idx) >= len(streams) {
+		err = fmt.Errorf("rtmp: NetStream %d: invalid packet index %d", self.ID, pkt.Idx)
+		return
+	}
+	typ := streams[pkt.Idx].Type()
+	if paused || (noaudio && typ.IsAudio()) || (novideo && typ.IsVideo()) {
+		return
+	}
+	return c.writePacket(self.ID, streams, pkt)
+}
+
+func (self *NetStream) WriteTrailer() (err error) {
+	return self.conn.WriteTrailer()
+}
+
+// NetStream returns the first published or played stream, nil before the
+// command stage is done.
+func (self *Conn) NetStream() *NetStream {
+	return self.netstream
+}
+
+// NetStreams returns the streams created on a server connection, by ID.
+func (self *Conn) NetStreams() (streams []*NetStream) {
+	self.nsmu.Lock()
+	defer self.nsmu.Unlock()
+	for _, ns := range self.netstreams {
+		streams = append(streams, ns)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].ID < streams[j].ID
+	})
+	return
+}
+
+func (self *Conn) getNetStream(id uint32, create bool) (ns *NetStream) {
+	self.nsmu.Lock()
+	defer self.nsmu.Unlock()
+	if ns = self.netstreams[id]; ns == nil && create {
+		ns = &NetStream{ID: id, conn: self}
+		self.netstreams[id] = ns
+		if id > self.lastmsgsid {
+			self.lastmsgsid = id
+		}
+	}
+	return
+}
+
+// ReadStreamPacket reads the next packet of any stream published on a server
+// connection. Packets of a stream are returned once its codecs are probed,
+// see NetStream.Streams. When a stream is unpublished its last result has
+// that stream and io.EOF; errors of the connection have a nil stream. Do not
+// mix with ReadPacket.
+func (self *Conn) ReadStreamPacket() (ns *NetStream, pkt av.Packet, err error) {
+	if err = self.prepare(stageCommandDone, prepareReading); err != nil {
+		return
+	}
+
+	for {
+		for _, s := range self.NetStreams() {
+			if s.prober != nil && s.prober.Probed() && !s.prober.Empty() {
+				ns, pkt = s, s.prober.PopPacket()
+				return
+			}
+		}
+
+		if err = self.pollMsg(); err != nil {
+			return
+		}
+
+		if self.gotcommand {
+			var closed *NetStream
+			if closed, err = self.handleStreamCommand(); err != nil {
+				return
+			}
+			if closed != nil && closed.prober != nil {
+				ns, err = closed, io.EOF
+				closed.prober = nil
+				return
+			}
+			continue
+		}
+
+		switch self.msgtypeid {
+		case msgtypeidVideoMsg, msgtypeidAudioMsg:
+		default:
+			continue
+		}
+
+		s := self.getNetStream(self.msgsid, false)
+		if s == nil || !s.Publishing() || s.prober == nil {
+			continue
+		}
+		if !s.prober.Probed() {
+			if err = s.prober.PushTag(self.avtag, int32(self.timestamp)); err != nil {
+				return
+			}
+			if s.prober.Probed() {
+				self.nsmu.Lock()
+				s.streams = s.prober.Streams
+				self.nsmu.Unlock()
+			}
+			continue
+		}
+		var ok bool
+		if pkt, ok = s.prober.TagToPacket(self.avtag, int32(self.timestamp)); ok {
+			ns = s
+			return
+		}
+	}
+}
+
+// HandleCommands reads and serves commands until the connection fails.
+// A server playing to a client runs it in its own goroutine, so pause, seek
+// and the other NetStream commands are answered while packets are written.
+// Media messages read meanwhile are dropped.
+func (self *Conn) HandleCommands() (err error) {
+	if err = self.prepare(stageCommandDone, 0); err != nil {
+		return
+	}
+	for {
+		if err = self.pollMsg(); err != nil {
+			return
+		}
+		if self.gotcommand {
+			if _, err = self.handleStreamCommand(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Pause asks the server to pause or resume the played stream at pos.
+func (self *Conn) Pause(pause bool, pos time.Duration) (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	// > pause()
+	if err = self.writeCommandMsg(8, self.avmsgsid, "pause", 0, nil, pause, float64(pos/time.Millisecond)); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
+
+// Seek asks the server to continue the played stream at pos.
+func (self *Conn) Seek(pos time.Duration) (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	// > seek()
+	if err = self.writeCommandMsg(8, self.avmsgsid, "seek", 0, nil, float64(pos/time.Millisecond)); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
+
+func (self *Conn) writeStatus(msgsid uint32, level, code, description string) (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	// > onStatus()
+	if err = self.writeCommandMsg(5, msgsid,
+		"onStatus", self.commandtransid, nil,
+		flvio.AMFMap{
+			"level":       level,
+			"code":        code,
+			"description": description,
+		},
+	); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
+
+func (self *Conn) writeCommandLocked(csid, msgsid uint32, args ...interface{}) (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	if err = self.writeCommandMsg(csid, msgsid, args...); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
+
+func (self *Conn) commandParam(i int) interface{} {
+	if i < len(self.commandparams) {
+		return self.commandparams[i]
+	}
+	return nil
+}
+
+func msToDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// handleStreamCommand serves the commands of a server connection after
+// connect. A rejected publish or play fails the command stage, later ones
+// are only answered with an error status. closed is set when a stream was
+// closed by the command.
+func (self *Conn) handleStreamCommand() (closed *NetStream, err error) {
+	if !self.isserver {
+		return
+	}
+	if Debug {
+		fmt.Printf("rtmp: < %s() msgsid=%d\n", self.commandname, self.msgsid)
+	}
+
+	switch self.commandname {
+	// < createStream
+	case "createStream":
+		self.nsmu.Lock()
+		self.lastmsgsid++
+		ns := &NetStream{ID: self.lastmsgsid, conn: self}
+		self.netstreams[ns.ID] = ns
+		self.nsmu.Unlock()
+		// > _result(streamid)
+		err = self.writeCommandLocked(3, 0, "_result", self.commandtransid, nil, ns.ID)
+
+	// < releaseStream("path")
+	case "releaseStream":
+		// > _result()
+		err = self.writeCommandLocked(3, 0, "_result", self.commandtransid, nil, nil)
+
+	// < FCPublish("path")
+	case "FCPublish":
+		name, _ := self.commandParam(0).(string)
+		// > onFCPublish()
+		err = self.writeCommandLocked(3, 0, "onFCPublish", 0, nil, flvio.AMFMap{
+			"code":        "NetStream.Publish.Start",
+			"description": name,
+		})
+
+	// < FCUnpublish("path")
+	case "FCUnpublish":
+		name, _ := self.commandParam(0).(string)
+		// > onFCUnpublish()
+		err = self.writeCommandLocked(3, 0, "onFCUnpublish", 0, nil, flvio.AMFMap{
+			"code":        "NetStream.Unpublish.Success",
+			"description": name,
+		})
+
+	// < publish("path")
+	case "publish":
+		err = self.handlePublish(self.getNetStream(self.msgsid, true))
+
+	// < play("path")
+	case "play":
+		err = self.handlePlay(self.getNetStream(self.msgsid, true))
+
+	// < closeStream()
+	case "closeStream":
+		if ns := self.getNetStream(self.msgsid, false); ns != nil {
+			closed = ns
+			err = self.closeNetStream(ns)
+		}
+
+	// < deleteStream(streamid)
+	case "deleteStream":
+		id, _ := self.commandParam(0).(float64)
+		if ns := self.getNetStream(uint32(id), false); ns != nil {
+			closed = ns
+			if err = self.closeNetStream(ns); err != nil {
+				return
+			}
+			self.nsmu.Lock()
+			delete(self.netstreams, ns.ID)
+			self.nsmu.Unlock()
+		}
+
+	// < pause(flag, position)
+	case "pause":
+		ns := self.getNetStream(self.msgsid, false)
+		if ns == nil || !ns.Playing() {
+			return
+		}
+		pause, _ := self.commandParam(0).(bool)
+		ms, _ := self.commandParam(1).(float64)
+		self.nsmu.Lock()
+		ns.paused = pause
+		self.nsmu.Unlock()
+		if self.OnPause != nil {
+			self.OnPause(ns, pause, msToDuration(ms))
+		}
+		if pause {
+			err = self.writeStatus(ns.ID, "status", "NetStream.Pause.Notify", "Paused "+ns.Name)
+		} else {
+			self.wmu.Lock()
+			err = self.writeStreamBegin(ns.ID)
+			self.wmu.Unlock()
+			if err != nil {
+				return
+			}
+			err = self.writeStatus(ns.ID, "status", "NetStream.Unpause.Notify", "Unpaused "+ns.Name)
+		}
+
+	// < seek(position)
+	case "seek":
+		ns := self.getNetStream(self.msgsid, false)
+		if ns == nil || !ns.Playing() {
+			return
+		}
+		ms, _ := self.commandParam(0).(float64)
+		var cberr error
+		if self.OnSeek == nil {
+			cberr = fmt.Errorf("seek not supported")
+		} else {
+			cberr = self.OnSeek(ns, msToDuration(ms))
+		}
+		if cberr != nil {
+			serr := toStatusError(cberr, "NetStream.Seek.Failed")
+			err = self.writeStatus(ns.ID, "error", serr.Code, serr.Description)
+			return
+		}
+		if err = self.writeStatus(ns.ID, "status", "NetStream.Seek.Notify", fmt.Sprintf("Seeking %d", int64(ms))); err != nil {
+			return
+		}
+		err = self.writeStatus(ns.ID, "status", "NetStream.Play.Start", "Start playing "+ns.Name)
+
+	// < receiveAudio(flag)
+	// < receiveVideo(flag)
+	case "receiveAudio", "receiveVideo":
+		ns := self.getNetStream(self.msgsid, false)
+		if ns == nil || !ns.Playing() {
+			return
+		}
+		flag, _ := self.commandParam(0).(bool)
+		self.nsmu.Lock()
+		if self.commandname == "receiveAudio" {
+			ns.noaudio = !flag
+		} else {
+			ns.novideo = !flag
+		}
+		self.nsmu.Unlock()
+		if flag {
+			if err = self.writeStatus(ns.ID, "status", "NetStream.Seek.Notify", "Seeking "+ns.Name); err != nil {
+				return
+			}
+			err = self.writeStatus(ns.ID, "status", "NetStream.Play.Start", "Start playing "+ns.Name)
+		}
+	}
+
+	// a rejected stream after the command stage does not end the connection
+	if _, ok := err.(*StatusError); ok && self.stage >= stageCommandDone {
+		if Debug {
+			fmt.Println("rtmp:", self.commandname, "rejected:", err)
+		}
+		err = nil
+	}
+	return
+}
+
+func (self *Conn) handlePublish(ns *NetStream) (err error) {
+	if len(self.commandparams) < 1 {
+		err = fmt.Errorf("rtmp: publish params invalid")
+		return
+	}
+	publishpath, _ := self.commandparams[0].(string)
+
+	var cberr error
+	if self.OnPublish != nil {
+		info := self.streamInfo(publishpath)
+		info.NetStream = ns
+		info.PublishType, _ = self.commandParam(1).(string)
+		cberr = self.OnPublish(self, info)
+	}
+	if cberr == nil && self.OnPlayOrPublish != nil {
+		cberr = self.OnPlayOrPublish(self.commandname, self.connectinfo.ConnectParams)
+	}
+	if cberr != nil {
+		err = self.rejectStream(ns.ID, cberr, "NetStream.Publish.BadName")
+		return
+	}
+
+	if err = self.writeStatus(ns.ID, "status", "NetStream.Publish.Start", "Start publishing"); err != nil {
+		return
+	}
+
+	self.nsmu.Lock()
+	ns.Name = publishpath
+	ns.URL = createURL(self.connectinfo.TcUrl, self.connectpath, publishpath)
+	ns.publishing, ns.playing, ns.closed = true, false, false
+	ns.prober = &flv.Prober{}
+	ns.streams = nil
+	self.nsmu.Unlock()
+
+	if self.netstream == nil {
+		self.netstream = ns
+		self.prober = ns.prober
+		self.avmsgsid = ns.ID
+		self.URL = ns.URL
+		self.publishing = true
+		self.reading = true
+	}
+	return
+}
+
+func (self *Conn) handlePlay(ns *NetStream) (err error) {
+	if len(self.commandparams) < 1 {
+		err = fmt.Errorf("rtmp: command play params invalid")
+		return
+	}
+	playpath, _ := self.commandparams[0].(string)
+
+	if self.OnPlay != nil {
+		info := self.streamInfo(playpath)
+		info.NetStream = ns
+		if cberr := self.OnPlay(self, info); cberr != nil {
+			err = self.rejectStream(ns.ID, cberr, "NetStream.Play.Failed")
+			return
+		}
+	}
+
+	var start time.Duration
+	if ms, ok := self.commandParam(1).(float64); ok && ms > 0 {
+		start = msToDuration(ms)
+	}
+
+	self.wmu.Lock()
+	// > streamBegin(streamid)
+	if err = self.writeStreamBegin(ns.ID); err == nil {
+		// > onStatus()
+		if err = self.writeCommandMsg(5, ns.ID,
+			"onStatus", self.commandtransid, nil,
+			flvio.AMFMap{
+				"level":       "status",
+				"code":        "NetStream.Play.Start",
+				"description": "Start live",
+			},
+		); err == nil {
+			// > |RtmpSampleAccess()
+			if err = self.writeDataMsg(5, ns.ID,
+				"|RtmpSampleAccess", true, true,
+			); err == nil {
+				err = self.flushWrite()
+			}
+		}
+	}
+	self.wmu.Unlock()
+	if err != nil {
+		return
+	}
+
+	self.nsmu.Lock()
+	ns.Name = playpath
+	ns.URL = createURL(self.connectinfo.TcUrl, self.connectpath, playpath)
+	ns.Start = start
+	ns.playing, ns.publishing, ns.closed, ns.paused = true, false, false, false
+	self.nsmu.Unlock()
+
+	if self.netstream == nil {
+		self.netstream = ns
+		self.avmsgsid = ns.ID
+		self.URL = ns.URL
+		self.playing = true
+		self.writing = true
+	}
+	return
+}
+
+func (self *Conn) closeNetStream(ns *NetStream) (err error) {
+	self.nsmu.Lock()
+	publishing, playing := ns.publishing, ns.playing
+	ns.publishing, ns.playing, ns.closed = false, false, true
+	self.nsmu.Unlock()
+
+	if publishing {
+		err = self.writeStatus(ns.ID, "status", "NetStream.Unpublish.Success", ns.Name+" is now unpublished.")
+	} else if playing {
+		err = self.writeStatus(ns.ID, "status", "NetStream.Play.Stop", "Stopped playing "+ns.Name)
+	}
+	return
+}
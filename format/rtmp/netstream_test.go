@@ -0,0 +1,225 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+)
+
+func testAACCodec() av.CodecData {
+	codec, _ := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	return codec
+}
+
+func TestNetStreamPauseSeek(t *testing.T) {
+	paused := make(chan bool, 2)
+	stopped := make(chan error, 1)
+	server := &Server{
+		HandlePlay: func(conn *Conn) {
+			seeks := make(chan time.Duration, 1)
+			conn.OnPause = func(ns *NetStream, pause bool, pos time.Duration) {
+				paused <- pause
+			}
+			conn.OnSeek = func(ns *NetStream, pos time.Duration) error {
+				seeks <- pos
+				return nil
+			}
+			if err := conn.WriteHeader([]av.CodecData{testAACCodec()}); err != nil {
+				stopped <- err
+				return
+			}
+			go conn.HandleCommands()
+
+			// a VOD stream of 20ms packets
+			var pos time.Duration
+			for {
+				select {
+				case pos = <-seeks:
+				default:
+				}
+				if err := conn.WritePacket(av.Packet{Time: pos, Data: make([]byte, 64)}); err != nil {
+					stopped <- err
+					return
+				}
+				conn.WriteTrailer()
+				pos += 20 * time.Millisecond
+				time.Sleep(time.Millisecond)
+			}
+		},
+	}
+	addr, _ := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := Dial(fmt.Sprintf("rtmp://%s/vod/test", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 5; i++ {
+		if _, err = conn.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = conn.Pause(true, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !<-paused {
+		t.Error("pause not notified")
+	}
+	if err = conn.Pause(false, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if <-paused {
+		t.Error("unpause not notified")
+	}
+
+	if err = conn.Seek(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		var pkt av.Packet
+		if pkt, err = conn.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Time >= time.Minute {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("seek not done")
+		}
+	}
+
+	// < closeStream() ends the played stream
+	if err = conn.writeCommandMsg(8, conn.avmsgsid, "closeStream", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.flushWrite(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-stopped:
+		if err != io.EOF {
+			t.Errorf("WritePacket returned %v after closeStream", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestNetStreamMultiPublish(t *testing.T) {
+	type result struct {
+		pkts map[string]int
+		err  error
+	}
+	done := make(chan result, 1)
+	server := &Server{
+		HandlePublish: func(conn *Conn) {
+			res := result{pkts: map[string]int{}}
+			ended := 0
+			for ended < 2 {
+				ns, pkt, err := conn.ReadStreamPacket()
+				if err == io.EOF && ns != nil {
+					ended++
+					continue
+				}
+				if err != nil {
+					res.err = err
+					break
+				}
+				if pkt.Idx != 0 || len(ns.Streams()) != 1 {
+					res.err = fmt.Errorf("stream %s: packet index %d of %v", ns.Name, pkt.Idx, ns.Streams())
+					break
+				}
+				res.pkts[ns.Name]++
+			}
+			if len(conn.NetStreams()) != 0 {
+				res.err = fmt.Errorf("streams not deleted: %v", conn.NetStreams())
+			}
+			conn.Close()
+			done <- res
+		},
+	}
+	addr, _ := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := Dial(fmt.Sprintf("rtmp://%s/live/high", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	streams := []av.CodecData{testAACCodec()}
+	if err = conn.WriteHeader(streams); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second stream on the same connection
+	// > createStream()
+	if err = conn.writeCommandMsg(3, 0, "createStream", 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.flushWrite(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err = conn.pollCommand(); err != nil {
+			t.Fatal(err)
+		}
+		if conn.commandname == "_result" && conn.commandtransid == 4 {
+			break
+		}
+	}
+	_, low := conn.checkCreateStreamResult()
+	if low == conn.avmsgsid {
+		t.Fatalf("createStream returned the same stream id %d", low)
+	}
+	// > publish("low")
+	if err = conn.writeCommandMsg(8, low, "publish", 0, nil, "low"); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.writeHeader(low, streams); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		pkt := av.Packet{Time: time.Duration(i) * 20 * time.Millisecond, Data: make([]byte, 64)}
+		if err = conn.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+		if i < 40 {
+			if err = conn.writePacket(low, streams, pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// > deleteStream(streamid)
+	for _, id := range []uint32{conn.avmsgsid, low} {
+		if err = conn.writeCommandMsg(3, 0, "deleteStream", 0, nil, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = conn.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.pkts["high"] != 50 || res.pkts["low"] != 40 {
+			t.Errorf("packets %v", res.pkts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,327 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+// Publisher pushes to an RTMP URL and redials when the connection drops.
+// During an outage WritePacket does not block: packets are buffered from the
+// next video keyframe and sent on the new connection after the header and
+// metadata, or dropped until the next video keyframe. Packet timestamps are passed through unchanged, so
+// the timeline continues across reconnects.
+type Publisher struct {
+	URL string
+	// DialTimeout and WriteTimeout are used for each connection.
+	// WriteTimeout is 10s by default so that a stalled connection is
+	// detected and redialed.
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MinBackoff and MaxBackoff bound the exponential delay between redials,
+	// 500ms and 30s by default.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRetries is the number of failed redials in a row after which
+	// WritePacket returns an error, zero means retry forever.
+	MaxRetries int
+
+	// BufferSize is the maximum number of packets kept during an outage,
+	// 1024 by default. When full the oldest packets are dropped up to the
+	// next video keyframe.
+	BufferSize int
+	// Replay sends the packets buffered during the outage on reconnect,
+	// starting at a video keyframe. Otherwise they are dropped and publishing resumes at the next video
+	// keyframe.
+	Replay bool
+
+	// OnDisconnect is called with the write error when the connection
+	// drops, OnReconnect after a successful redial.
+	OnDisconnect func(error)
+	OnReconnect  func(attempts int)
+
+	// mu guards the fields below, wmu serializes writes to conn so that
+	// network writes are not made under mu.
+	mu           sync.Mutex
+	wmu          sync.Mutex
+	conn         *Conn
+	streams      []av.CodecData
+	hasvideo     bool
+	buf          []av.Packet
+	waitkeyframe bool
+	err          error
+	closed       bool
+	done         chan struct{}
+}
+
+func NewPublisher(url string) *Publisher {
+	return &Publisher{URL: url}
+}
+
+func (self *Publisher) dial() (conn *Conn, err error) {
+	if conn, err = DialTimeout(self.URL, self.DialTimeout); err != nil {
+		return
+	}
+	conn.WriteTimeout = self.WriteTimeout
+	if conn.WriteTimeout <= 0 {
+		conn.WriteTimeout = 10 * time.Second
+	}
+	if err = conn.WriteHeader(self.streams); err != nil {
+		conn.Close()
+		return
+	}
+	return
+}
+
+// WriteHeader makes the first connection, without retries.
+func (self *Publisher) WriteHeader(streams []av.CodecData) (err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.streams = streams
+	self.hasvideo = false
+	for _, stream := range streams {
+		if stream.Type().IsVideo() {
+			self.hasvideo = true
+		}
+	}
+	self.done = make(chan struct{})
+
+	if self.conn, err = self.dial(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Publisher) isKeyFrame(pkt av.Packet) bool {
+	return !self.hasvideo || (pkt.IsKeyFrame && self.streams[pkt.Idx].Type().IsVideo())
+}
+
+// push adds a packet to the outage buffer.
+func (self *Publisher) push(pkt av.Packet) {
+	if self.waitkeyframe {
+		if !self.isKeyFrame(pkt) {
+			return
+		}
+		self.waitkeyframe = false
+	}
+	self.buf = append(self.buf, pkt)
+
+	bufsize := self.BufferSize
+	if bufsize <= 0 {
+		bufsize = 1024
+	}
+	if len(self.buf) > bufsize {
+		i := 1
+		for i < len(self.buf) && !self.isKeyFrame(self.buf[i]) {
+			i++
+		}
+		self.buf = append(self.buf[:0], self.buf[i:]...)
+		if len(self.buf) == 0 {
+			self.waitkeyframe = true
+		}
+	}
+}
+
+func (self *Publisher) WritePacket(pkt av.Packet) (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+
+	self.mu.Lock()
+	if self.err != nil {
+		err = self.err
+		self.mu.Unlock()
+		return
+	}
+	if self.closed {
+		self.mu.Unlock()
+		err = fmt.Errorf("rtmp: Publisher closed")
+		return
+	}
+	conn := self.conn
+	if conn == nil {
+		if self.Replay {
+			self.push(pkt)
+		}
+		self.mu.Unlock()
+		return
+	}
+	if self.waitkeyframe {
+		if !self.isKeyFrame(pkt) {
+			self.mu.Unlock()
+			return
+		}
+		self.waitkeyframe = false
+	}
+	self.mu.Unlock()
+
+	werr := conn.WritePacket(pkt)
+	if werr == nil {
+		return
+	}
+
+	self.mu.Lock()
+	conn.Close()
+	if self.closed || self.conn != conn {
+		self.mu.Unlock()
+		return
+	}
+	self.conn = nil
+	self.buf = nil
+	// pkt may be in the middle of a GOP
+	self.waitkeyframe = true
+	if self.Replay {
+		self.push(pkt)
+	}
+	go self.reconnect()
+	self.mu.Unlock()
+
+	if Debug {
+		fmt.Println("rtmp: publisher: disconnected:", werr)
+	}
+	if self.OnDisconnect != nil {
+		self.OnDisconnect(werr)
+	}
+	return
+}
+
+// trimToKeyFrame drops the buffered packets before the first video
+// keyframe, the rest of a GOP kept by a failed replay.
+func (self *Publisher) trimToKeyFrame() {
+	i := 0
+	for i < len(self.buf) && !self.isKeyFrame(self.buf[i]) {
+		i++
+	}
+	self.buf = self.buf[i:]
+	if len(self.buf) == 0 {
+		self.waitkeyframe = true
+	}
+}
+
+// replay sends the packets buffered during the outage on conn, which is
+// not shared yet, and makes it the connection once the buffer is empty.
+func (self *Publisher) replay(conn *Conn) (err error) {
+	for first := true; ; first = false {
+		self.mu.Lock()
+		if self.closed {
+			self.mu.Unlock()
+			err = fmt.Errorf("rtmp: Publisher closed")
+			return
+		}
+		if first {
+			self.trimToKeyFrame()
+		}
+		buf := self.buf
+		self.buf = nil
+		if len(buf) == 0 {
+			self.conn = conn
+			self.mu.Unlock()
+			return
+		}
+		self.mu.Unlock()
+
+		for i, pkt := range buf {
+			if err = conn.WritePacket(pkt); err != nil {
+				// keep the rest for the next connection
+				self.mu.Lock()
+				self.buf = append(buf[i:], self.buf...)
+				self.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func (self *Publisher) reconnect() {
+	minbackoff := self.MinBackoff
+	if minbackoff <= 0 {
+		minbackoff = 500 * time.Millisecond
+	}
+	maxbackoff := self.MaxBackoff
+	if maxbackoff <= 0 {
+		maxbackoff = 30 * time.Second
+	}
+
+	backoff := minbackoff
+	for attempts := 1; ; attempts++ {
+		select {
+		case <-self.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxbackoff {
+			backoff = maxbackoff
+		}
+
+		conn, err := self.dial()
+		if err == nil {
+			if err = self.replay(conn); err == nil {
+				if Debug {
+					fmt.Println("rtmp: publisher: reconnected after", attempts, "attempts")
+				}
+				if self.OnReconnect != nil {
+					self.OnReconnect(attempts)
+				}
+				return
+			}
+			conn.Close()
+			self.mu.Lock()
+			closed := self.closed
+			self.mu.Unlock()
+			if closed {
+				return
+			}
+		}
+
+		if Debug {
+			fmt.Println("rtmp: publisher: redial failed:", err)
+		}
+		if self.MaxRetries > 0 && attempts >= self.MaxRetries {
+			self.mu.Lock()
+			self.err = fmt.Errorf("rtmp: Publisher gave up after %d attempts: %s", attempts, err)
+			self.buf = nil
+			self.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Connected reports whether a connection is up.
+func (self *Publisher) Connected() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.conn != nil
+}
+
+func (self *Publisher) WriteTrailer() (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	self.mu.Lock()
+	conn := self.conn
+	self.mu.Unlock()
+	if conn != nil {
+		err = conn.WriteTrailer()
+	}
+	return
+}
+
+// Close stops reconnecting and closes the connection.
+func (self *Publisher) Close() (err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return
+	}
+	self.closed = true
+	if self.done != nil {
+		close(self.done)
+	}
+	if self.conn != nil {
+		err = self.conn.Close()
+		self.conn = nil
+	}
+	return
+}
@@ -0,0 +1,173 @@
+package rtmp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+func testPublisherReconnect(t *testing.T, replay bool) {
+	type session struct {
+		streams []av.CodecData
+		first   av.Packet
+		pkts    int
+	}
+	sessions := make(chan session, 2)
+	limits := make(chan int, 2)
+	// drop the first connection after 100 packets
+	limits <- 100
+	limits <- 30
+	server := &Server{
+		HandlePublish: func(conn *Conn) {
+			limit := <-limits
+			var s session
+			var err error
+			if s.streams, err = conn.Streams(); err != nil {
+				t.Error(err)
+			}
+			for {
+				pkt, err := conn.ReadPacket()
+				if err != nil {
+					break
+				}
+				if s.pkts == 0 {
+					s.first = pkt
+				}
+				s.pkts++
+				if s.pkts == limit {
+					break
+				}
+			}
+			conn.Close()
+			sessions <- s
+		},
+	}
+	addr, _ := startTestServer(t, server)
+	defer server.Close()
+
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reconnected := make(chan int, 1)
+	pub := NewPublisher(fmt.Sprintf("rtmp://%s/live/test", addr))
+	pub.MinBackoff = 10 * time.Millisecond
+	pub.Replay = replay
+	// callbacks may use the Publisher
+	pub.OnDisconnect = func(error) {
+		if pub.Connected() {
+			t.Error("connected in OnDisconnect")
+		}
+	}
+	pub.OnReconnect = func(attempts int) {
+		if !pub.Connected() {
+			t.Error("not connected in OnReconnect")
+		}
+		reconnected <- attempts
+	}
+	if err = pub.WriteHeader([]av.CodecData{codec}); err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	if pub.conn.WriteTimeout != 10*time.Second {
+		t.Errorf("got WriteTimeout %v", pub.conn.WriteTimeout)
+	}
+
+	for i := 0; i < 3000; i++ {
+		key := i%25 == 0
+		data := make([]byte, 4000)
+		data[3] = byte(len(data) - 4)
+		data[2] = byte((len(data) - 4) >> 8)
+		if key {
+			data[4] = 0x65
+		} else {
+			data[4] = 0x41
+		}
+		pkt := av.Packet{IsKeyFrame: key, Time: time.Duration(i) * 40 * time.Millisecond, Data: data}
+		if err = pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+		pub.WriteTrailer()
+		if len(sessions) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	first := <-sessions
+	if first.pkts != 100 {
+		t.Errorf("first session read %d packets", first.pkts)
+	}
+	select {
+	case <-reconnected:
+	default:
+		t.Fatal("no reconnect")
+	}
+	second := <-sessions
+	if len(second.streams) != 1 || second.streams[0].Type() != av.H264 {
+		t.Fatalf("second session streams %v", second.streams)
+	}
+	if second.first.Time <= first.first.Time || !second.first.IsKeyFrame {
+		t.Errorf("second session starts at %v keyframe=%v", second.first.Time, second.first.IsKeyFrame)
+	}
+}
+
+func TestPublisherReconnect(t *testing.T) {
+	testPublisherReconnect(t, false)
+}
+
+func TestPublisherReconnectReplay(t *testing.T) {
+	testPublisherReconnect(t, true)
+}
+
+func TestPublisherBuffer(t *testing.T) {
+	pub := &Publisher{
+		streams:    []av.CodecData{h264parser.CodecData{}, aacparser.CodecData{}},
+		hasvideo:   true,
+		BufferSize: 4,
+		// the connection dropped in the middle of a GOP
+		waitkeyframe: true,
+	}
+	video := func(tm int, key bool) av.Packet {
+		return av.Packet{Idx: 0, IsKeyFrame: key, Time: time.Duration(tm)}
+	}
+	times := func() (tms []int) {
+		for _, pkt := range pub.buf {
+			tms = append(tms, int(pkt.Time))
+		}
+		return
+	}
+
+	for _, pkt := range []av.Packet{video(1, false), {Idx: 1, Time: 2}, video(3, true), {Idx: 1, Time: 4}, video(5, false)} {
+		pub.push(pkt)
+	}
+	if got := fmt.Sprint(times()); got != "[3 4 5]" {
+		t.Errorf("buffered %s", got)
+	}
+
+	// when full the oldest GOP is dropped
+	pub.push(video(6, true))
+	pub.push(video(7, false))
+	if got := fmt.Sprint(times()); got != "[6 7]" {
+		t.Errorf("buffered %s", got)
+	}
+
+	// a failed replay keeps the rest of a GOP, which is not sent again
+	pub.buf = []av.Packet{video(7, false), {Idx: 1, Time: 8}, video(9, true), video(10, false)}
+	pub.trimToKeyFrame()
+	if got := fmt.Sprint(times()); got != "[9 10]" || pub.waitkeyframe {
+		t.Errorf("buffered %s", got)
+	}
+	pub.buf = []av.Packet{video(11, false)}
+	pub.trimToKeyFrame()
+	if len(pub.buf) != 0 || !pub.waitkeyframe {
+		t.Errorf("buffered %v", times())
+	}
+}
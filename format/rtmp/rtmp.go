@@ -3,10 +3,13 @@ package rtmp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/nareix/joy4/utils/bits/pio"
 	"github.com/nareix/joy4/av"
@@ -17,17 +20,26 @@ import (
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 var Debug bool
 
+// TLSConfig is used by Dial and DialTimeout for rtmps:// URLs. When nil or
+// without ServerName, the host of the URL is verified.
+var TLSConfig *tls.Config
+
 func ParseURL(uri string) (u *url.URL, err error) {
 	if u, err = url.Parse(uri); err != nil {
 		return
 	}
 	if _, _, serr := net.SplitHostPort(u.Host); serr != nil {
-		u.Host += ":1935"
+		if u.Scheme == "rtmps" {
+			u.Host += ":443"
+		} else {
+			u.Host += ":1935"
+		}
 	}
 	return
 }
@@ -37,6 +49,11 @@ func Dial(uri string) (conn *Conn, err error) {
 }
 
 func DialTimeout(uri string, timeout time.Duration) (conn *Conn, err error) {
+	return DialTLSTimeout(uri, timeout, TLSConfig)
+}
+
+// DialTLSTimeout is DialTimeout with the tls.Config used for rtmps:// URLs.
+func DialTLSTimeout(uri string, timeout time.Duration, config *tls.Config) (conn *Conn, err error) {
 	var u *url.URL
 	if u, err = ParseURL(uri); err != nil {
 		return
@@ -44,8 +61,21 @@ func DialTimeout(uri string, timeout time.Duration) (conn *Conn, err error) {
 
 	dailer := net.Dialer{Timeout: timeout}
 	var netconn net.Conn
-	if netconn, err = dailer.Dial("tcp", u.Host); err != nil {
-		return
+	if u.Scheme == "rtmps" {
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		if netconn, err = tls.DialWithDialer(&dailer, "tcp", u.Host, config); err != nil {
+			return
+		}
+	} else {
+		if netconn, err = dailer.Dial("tcp", u.Host); err != nil {
+			return
+		}
 	}
 
 	conn = NewConn(netconn)
@@ -53,21 +83,113 @@ func DialTimeout(uri string, timeout time.Duration) (conn *Conn, err error) {
 	return
 }
 
+// CommandInfo describes a connect, publish or play command for the
+// authorization hooks.
+type CommandInfo struct {
+	App   string // app without the query string
+	TcUrl string
+	// Stream is the stream name of publish or play without the query string,
+	// empty for connect.
+	Stream string
+	// Query holds the query parameters of tcUrl, app and the stream name, in
+	// increasing priority.
+	Query         url.Values
+	ConnectParams flvio.AMFMap
+	PublishType   string // "live", "record" or "append", publish only
+	// NetStream is the stream of publish or play, nil for connect.
+	NetStream *NetStream
+}
+
+// StatusError rejects a command with the given status code and
+// description. Hooks returning another error get the default code of the
+// stage and the error text as description.
+type StatusError struct {
+	Code        string
+	Description string
+}
+
+func (self *StatusError) Error() string {
+	return fmt.Sprintf("rtmp: %s: %s", self.Code, self.Description)
+}
+
+func toStatusError(err error, code string) *StatusError {
+	if serr, ok := err.(*StatusError); ok {
+		// hooks may return shared errors, fill in a copy
+		s := *serr
+		if s.Code == "" {
+			s.Code = code
+		}
+		return &s
+	}
+	return &StatusError{Code: code, Description: err.Error()}
+}
+
+func splitQuery(s string) (path, rawquery string) {
+	if i := strings.Index(s, "?"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
 type Server struct {
 	Addr          string
 	HandlePublish func(*Conn)
 	HandlePlay    func(*Conn)
 	HandleConn    func(*Conn)
+
+	// TLSConfig is used by ListenAndServeTLS, certificates loaded from
+	// files are added to a copy of it.
+	TLSConfig *tls.Config
+
+	// HandshakeTimeout bounds the handshake and command stage of a
+	// connection. ReadTimeout and WriteTimeout bound each network read and
+	// write after it. Zero means no timeout.
+	HandshakeTimeout time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+
+	// MaxConns limits the number of concurrent connections, new ones above
+	// it are closed right away. Zero means no limit.
+	MaxConns int
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*Conn]bool // true once publishing, drained on Shutdown
+
+	// OnConnect, OnPublish and OnPlay are called before the command is
+	// accepted. A non-nil error rejects it, see StatusError.
+	OnConnect func(*Conn, *CommandInfo) error
+	OnPublish func(*Conn, *CommandInfo) error
+	OnPlay    func(*Conn, *CommandInfo) error
 }
 
+// ErrServerClosed is returned by Serve, ListenAndServe and
+// ListenAndServeTLS after Shutdown or Close.
+var ErrServerClosed = errors.New("rtmp: Server closed")
+
 func (self *Server) handleConn(conn *Conn) (err error) {
+	defer self.untrackConn(conn)
+
+	if self.HandshakeTimeout > 0 {
+		conn.stageDeadline = time.Now().Add(self.HandshakeTimeout)
+	}
+
 	if self.HandleConn != nil {
+		// what HandleConn does with the conn is unknown, drain it like a
+		// publisher
+		self.setPublishing(conn)
 		self.HandleConn(conn)
 	} else {
 		if err = conn.prepare(stageCommandDone, 0); err != nil {
+			conn.Close()
 			return
 		}
 
+		if conn.publishing {
+			self.setPublishing(conn)
+		}
+
 		if conn.playing {
 			if self.HandlePlay != nil {
 				self.HandlePlay(conn)
@@ -102,9 +224,76 @@ func (self *Server) ListenAndServe() (err error) {
 		fmt.Println("rtmp: server: listening on", addr)
 	}
 
+	return self.Serve(listener)
+}
+
+// ListenAndServeTLS serves rtmps. Addr defaults to ":443". certFile and
+// keyFile may be empty when TLSConfig already has certificates.
+func (self *Server) ListenAndServeTLS(certFile, keyFile string) (err error) {
+	addr := self.Addr
+	if addr == "" {
+		addr = ":443"
+	}
+
+	config := &tls.Config{}
+	if self.TLSConfig != nil {
+		config = self.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			err = fmt.Errorf("rtmp: ListenAndServeTLS: %s", err)
+			return
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		err = fmt.Errorf("rtmp: ListenAndServeTLS: no certificate")
+		return
+	}
+
+	var listener net.Listener
+	if listener, err = tls.Listen("tcp", addr, config); err != nil {
+		return
+	}
+
+	if Debug {
+		fmt.Println("rtmp: server: listening tls on", addr)
+	}
+
+	return self.Serve(listener)
+}
+
+// Serve accepts connections on listener until it fails or the server is
+// shut down. The listener is closed when Serve returns.
+func (self *Server) Serve(listener net.Listener) (err error) {
+	defer listener.Close()
+
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		return ErrServerClosed
+	}
+	if self.listeners == nil {
+		self.listeners = map[net.Listener]struct{}{}
+	}
+	self.listeners[listener] = struct{}{}
+	self.mu.Unlock()
+
+	defer func() {
+		self.mu.Lock()
+		delete(self.listeners, listener)
+		self.mu.Unlock()
+	}()
+
 	for {
 		var netconn net.Conn
 		if netconn, err = listener.Accept(); err != nil {
+			self.mu.Lock()
+			if self.closed {
+				err = ErrServerClosed
+			}
+			self.mu.Unlock()
 			return
 		}
 
@@ -114,6 +303,20 @@ func (self *Server) ListenAndServe() (err error) {
 
 		conn := NewConn(netconn)
 		conn.isserver = true
+		conn.OnConnect = self.OnConnect
+		conn.OnPublish = self.OnPublish
+		conn.OnPlay = self.OnPlay
+		conn.ReadTimeout = self.ReadTimeout
+		conn.WriteTimeout = self.WriteTimeout
+
+		if !self.trackConn(conn) {
+			if Debug {
+				fmt.Println("rtmp: server: too many connections")
+			}
+			netconn.Close()
+			continue
+		}
+
 		go func() {
 			err := self.handleConn(conn)
 			if Debug {
@@ -123,6 +326,87 @@ func (self *Server) ListenAndServe() (err error) {
 	}
 }
 
+func (self *Server) trackConn(conn *Conn) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed || (self.MaxConns > 0 && len(self.conns) >= self.MaxConns) {
+		return false
+	}
+	if self.conns == nil {
+		self.conns = map[*Conn]bool{}
+	}
+	self.conns[conn] = false
+	return true
+}
+
+func (self *Server) untrackConn(conn *Conn) {
+	self.mu.Lock()
+	delete(self.conns, conn)
+	self.mu.Unlock()
+}
+
+func (self *Server) setPublishing(conn *Conn) {
+	self.mu.Lock()
+	if _, ok := self.conns[conn]; ok {
+		self.conns[conn] = true
+	}
+	self.mu.Unlock()
+}
+
+// NumConns returns the number of active connections.
+func (self *Server) NumConns() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.conns)
+}
+
+func (self *Server) closeLocked(all bool) (err error) {
+	self.closed = true
+	for listener := range self.listeners {
+		if cerr := listener.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn, publishing := range self.conns {
+		if all || !publishing {
+			conn.Close()
+		}
+	}
+	return
+}
+
+// Close stops the listeners and closes all connections.
+func (self *Server) Close() (err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.closeLocked(true)
+}
+
+var shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown stops the listeners, closes the connections that are not
+// publishing and waits for the publishers to finish. When ctx is done
+// first the remaining connections are closed and ctx.Err() is returned.
+func (self *Server) Shutdown(ctx context.Context) (err error) {
+	self.mu.Lock()
+	err = self.closeLocked(false)
+	self.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if self.NumConns() == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			self.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
 const (
 	stageHandshakeDone = iota + 1
 	stageCommandDone
@@ -138,6 +422,29 @@ type Conn struct {
 	URL             *url.URL
 	OnPlayOrPublish func(string, flvio.AMFMap) error
 
+	// Server side authorization hooks, set from Server.
+	OnConnect func(*Conn, *CommandInfo) error
+	OnPublish func(*Conn, *CommandInfo) error
+	OnPlay    func(*Conn, *CommandInfo) error
+
+	// OnPause and OnSeek are called for pause and seek of a played NetStream,
+	// see HandleCommands. Seeking fails with NetStream.Seek.Failed when
+	// OnSeek is nil or returns an error.
+	OnPause func(ns *NetStream, pause bool, pos time.Duration)
+	OnSeek  func(ns *NetStream, pos time.Duration) error
+
+	// ReadTimeout and WriteTimeout bound each network read and write when
+	// non-zero.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	stageDeadline                     time.Time
+	readDeadlineSet, writeDeadlineSet bool
+
+	// FourCcList is the Enhanced RTMP codecs the peer announced in connect
+	// or its result, nil if it didn't.
+	FourCcList []string
+
 	prober  *flv.Prober
 	streams []av.CodecData
 
@@ -166,18 +473,33 @@ type Conn struct {
 
 	avmsgsid uint32
 
+	// server side NetStreams by message stream ID, netstream is the first
+	// one published or played.
+	nsmu       sync.Mutex
+	netstreams map[uint32]*NetStream
+	lastmsgsid uint32
+	netstream  *NetStream
+
+	// wmu serializes writes of the reading goroutine, like acks and command
+	// responses, with the ones of the writing goroutine.
+	wmu sync.Mutex
+
 	gotcommand     bool
 	commandname    string
 	commandtransid float64
 	commandobj     flvio.AMFMap
 	commandparams  []interface{}
+	connectinfo    *CommandInfo
+	connectpath    string
 
 	gotmsg      bool
 	timestamp   uint32
+	msgsid      uint32
 	msgdata     []byte
 	msgtypeid   uint8
 	datamsgvals []interface{}
 	avtag       flvio.Tag
+	aggmsgs     []aggregateMsg
 
 	eventtype uint16
 }
@@ -200,16 +522,51 @@ func (self *txrxcount) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// timeoutIO sets the deadlines of the Conn before each network read and
+// write.
+type timeoutIO struct {
+	conn *Conn
+}
+
+func (self *Conn) deadline(timeout time.Duration) (t time.Time) {
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if !self.stageDeadline.IsZero() && (t.IsZero() || self.stageDeadline.Before(t)) {
+		t = self.stageDeadline
+	}
+	return
+}
+
+func (self timeoutIO) Read(p []byte) (n int, err error) {
+	c := self.conn
+	if t := c.deadline(c.ReadTimeout); !t.IsZero() || c.readDeadlineSet {
+		c.netconn.SetReadDeadline(t)
+		c.readDeadlineSet = !t.IsZero()
+	}
+	return c.netconn.Read(p)
+}
+
+func (self timeoutIO) Write(p []byte) (n int, err error) {
+	c := self.conn
+	if t := c.deadline(c.WriteTimeout); !t.IsZero() || c.writeDeadlineSet {
+		c.netconn.SetWriteDeadline(t)
+		c.writeDeadlineSet = !t.IsZero()
+	}
+	return c.netconn.Write(p)
+}
+
 func NewConn(netconn net.Conn) *Conn {
 	conn := &Conn{}
 	conn.prober = &flv.Prober{}
 	conn.netconn = netconn
 	conn.readcsmap = make(map[uint32]*chunkStream)
+	conn.netstreams = make(map[uint32]*NetStream)
 	conn.readMaxChunkSize = 128
 	conn.writeMaxChunkSize = 128
-	conn.bufr = bufio.NewReaderSize(netconn, pio.RecommendBufioSize)
-	conn.bufw = bufio.NewWriterSize(netconn, pio.RecommendBufioSize)
-	conn.txrxcount = &txrxcount{ReadWriter: netconn}
+	conn.txrxcount = &txrxcount{ReadWriter: timeoutIO{conn}}
+	conn.bufr = bufio.NewReaderSize(conn.txrxcount, pio.RecommendBufioSize)
+	conn.bufw = bufio.NewWriterSize(conn.txrxcount, pio.RecommendBufioSize)
 	conn.writebuf = make([]byte, 4096)
 	conn.readbuf = make([]byte, 4096)
 	return conn
@@ -234,6 +591,7 @@ func (self *chunkStream) Start() {
 
 const (
 	msgtypeidUserControl      = 4
+	msgtypeidAbort            = 2
 	msgtypeidAck              = 3
 	msgtypeidWindowAckSize    = 5
 	msgtypeidSetPeerBandwidth = 6
@@ -244,12 +602,15 @@ const (
 	msgtypeidDataMsgAMF3      = 15
 	msgtypeidVideoMsg         = 9
 	msgtypeidAudioMsg         = 8
+	msgtypeidAggregate        = 22
 )
 
 const (
 	eventtypeStreamBegin      = 0
 	eventtypeSetBufferLength  = 3
 	eventtypeStreamIsRecorded = 4
+	eventtypePingRequest      = 6
+	eventtypePingResponse     = 7
 )
 
 func (self *Conn) NetConn() net.Conn {
@@ -284,8 +645,28 @@ func (self *Conn) pollAVTag() (tag flvio.Tag, err error) {
 		if err = self.pollMsg(); err != nil {
 			return
 		}
+		if self.gotcommand {
+			if !self.isserver {
+				if serr := self.statusError(); serr != nil {
+					err = serr
+					return
+				}
+			} else if self.stage >= stageCommandDone {
+				if _, err = self.handleStreamCommand(); err != nil {
+					return
+				}
+				if self.netstream.Closed() {
+					err = io.EOF
+					return
+				}
+			}
+		}
 		switch self.msgtypeid {
 		case msgtypeidVideoMsg, msgtypeidAudioMsg:
+			// media of other NetStreams is read by ReadStreamPacket
+			if self.isserver && self.netstream != nil && self.msgsid != self.netstream.ID {
+				continue
+			}
 			tag = self.avtag
 			return
 		}
@@ -298,7 +679,13 @@ func (self *Conn) pollMsg() (err error) {
 	self.datamsgvals = nil
 	self.avtag = flvio.Tag{}
 	for {
-		if err = self.readChunk(); err != nil {
+		if len(self.aggmsgs) > 0 {
+			m := self.aggmsgs[0]
+			self.aggmsgs = self.aggmsgs[1:]
+			if err = self.handleMsg(m.timestamp, m.msgsid, m.msgtypeid, m.msgdata); err != nil {
+				return
+			}
+		} else if err = self.readChunk(); err != nil {
 			return
 		}
 		if self.gotmsg {
@@ -351,6 +738,61 @@ func createURL(tcurl, app, play string) (u *url.URL) {
 
 var CodecTypes = flv.CodecTypes
 
+// FourCcList is the Enhanced RTMP codecs announced to the peer.
+var FourCcList = []string{
+	flvio.FourCCString(flvio.FOURCC_AV01),
+	flvio.FourCCString(flvio.FOURCC_VP09),
+	flvio.FourCCString(flvio.FOURCC_HVC1),
+	flvio.FourCCString(flvio.FOURCC_AVC1),
+	flvio.FourCCString(flvio.FOURCC_OPUS),
+	flvio.FourCCString(flvio.FOURCC_MP4A),
+}
+
+func fourCcListToAMF(list []string) (arr flvio.AMFArray) {
+	for _, s := range list {
+		arr = append(arr, s)
+	}
+	return
+}
+
+func parseFourCcList(obj flvio.AMFMap) (list []string) {
+	arr, _ := obj["fourCcList"].(flvio.AMFArray)
+	for _, v := range arr {
+		if s, ok := v.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return
+}
+
+// checkFourCc refuses streams needing Enhanced RTMP when the peer announced
+// codecs without them, peers announcing nothing are trusted.
+func (self *Conn) checkFourCc(streams []av.CodecData) (err error) {
+	if self.FourCcList == nil {
+		return
+	}
+	for _, stream := range streams {
+		var tag flvio.Tag
+		var ok bool
+		if tag, ok, _ = flv.CodecDataToTag(stream); !ok || !tag.IsExHeader {
+			continue
+		}
+		fourcc := flvio.FourCCString(tag.FourCC)
+		found := false
+		for _, s := range self.FourCcList {
+			if s == fourcc || s == "*" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			err = fmt.Errorf("rtmp: peer doesn't support codec %s", fourcc)
+			return
+		}
+	}
+	return
+}
+
 func (self *Conn) writeBasicConf() (err error) {
 	// > SetChunkSize
 	if err = self.writeSetChunkSize(1024 * 1024 * 128); err != nil {
@@ -390,6 +832,7 @@ func (self *Conn) readConnect() (err error) {
 		return
 	}
 	connectpath, _ = _app.(string)
+	self.connectpath = connectpath
 
 	var tcurl string
 	if _tcurl, ok = self.commandobj["tcUrl"]; !ok {
@@ -399,17 +842,63 @@ func (self *Conn) readConnect() (err error) {
 		tcurl, _ = _tcurl.(string)
 	}
 	connectparams := self.commandobj
+	self.FourCcList = parseFourCcList(connectparams)
+
+	info := &CommandInfo{
+		TcUrl:         tcurl,
+		Query:         url.Values{},
+		ConnectParams: connectparams,
+	}
+	if u, _ := url.Parse(tcurl); u != nil {
+		for k, v := range u.Query() {
+			info.Query[k] = v
+		}
+	}
+	var rawquery string
+	info.App, rawquery = splitQuery(connectpath)
+	if q, _ := url.ParseQuery(rawquery); q != nil {
+		for k, v := range q {
+			info.Query[k] = v
+		}
+	}
+	self.connectinfo = info
 
 	if err = self.writeBasicConf(); err != nil {
 		return
 	}
 
+	if self.OnConnect != nil {
+		if cberr := self.OnConnect(self, info); cberr != nil {
+			serr := toStatusError(cberr, "NetConnection.Connect.Rejected")
+			// > _error("NetConnection.Connect.Rejected")
+			if err = self.writeCommandMsg(3, 0, "_error", self.commandtransid, nil,
+				flvio.AMFMap{
+					"level":       "error",
+					"code":        serr.Code,
+					"description": serr.Description,
+				},
+			); err != nil {
+				return
+			}
+			if err = self.flushWrite(); err != nil {
+				return
+			}
+			err = serr
+			return
+		}
+	}
+
+	props := flvio.AMFMap{
+		"fmtVer":       "FMS/3,0,1,123",
+		"capabilities": 31,
+	}
+	if self.FourCcList != nil {
+		props["fourCcList"] = fourCcListToAMF(FourCcList)
+	}
+
 	// > _result("NetConnection.Connect.Success")
 	if err = self.writeCommandMsg(3, 0, "_result", self.commandtransid,
-		flvio.AMFMap{
-			"fmtVer":       "FMS/3,0,1,123",
-			"capabilities": 31,
-		},
+		props,
 		flvio.AMFMap{
 			"level":          "status",
 			"code":           "NetConnection.Connect.Success",
@@ -429,115 +918,71 @@ func (self *Conn) readConnect() (err error) {
 			return
 		}
 		if self.gotcommand {
-			switch self.commandname {
-
-			// < createStream
-			case "createStream":
-				self.avmsgsid = uint32(1)
-				// > _result(streamid)
-				if err = self.writeCommandMsg(3, 0, "_result", self.commandtransid, nil, self.avmsgsid); err != nil {
-					return
-				}
-				if err = self.flushWrite(); err != nil {
-					return
-				}
-
-			// < publish("path")
-			case "publish":
-				if Debug {
-					fmt.Println("rtmp: < publish")
-				}
-
-				if len(self.commandparams) < 1 {
-					err = fmt.Errorf("rtmp: publish params invalid")
-					return
-				}
-				publishpath, _ := self.commandparams[0].(string)
-
-				var cberr error
-				if self.OnPlayOrPublish != nil {
-					cberr = self.OnPlayOrPublish(self.commandname, connectparams)
-				}
-
-				// > onStatus()
-				if err = self.writeCommandMsg(5, self.avmsgsid,
-					"onStatus", self.commandtransid, nil,
-					flvio.AMFMap{
-						"level":       "status",
-						"code":        "NetStream.Publish.Start",
-						"description": "Start publishing",
-					},
-				); err != nil {
-					return
-				}
-				if err = self.flushWrite(); err != nil {
-					return
-				}
-
-				if cberr != nil {
-					err = fmt.Errorf("rtmp: OnPlayOrPublish check failed")
-					return
-				}
-
-				self.URL = createURL(tcurl, connectpath, publishpath)
-				self.publishing = true
-				self.reading = true
-				self.stage++
+			if _, err = self.handleStreamCommand(); err != nil {
 				return
-
-			// < play("path")
-			case "play":
-				if Debug {
-					fmt.Println("rtmp: < play")
-				}
-
-				if len(self.commandparams) < 1 {
-					err = fmt.Errorf("rtmp: command play params invalid")
-					return
-				}
-				playpath, _ := self.commandparams[0].(string)
-
-				// > streamBegin(streamid)
-				if err = self.writeStreamBegin(self.avmsgsid); err != nil {
-					return
-				}
-
-				// > onStatus()
-				if err = self.writeCommandMsg(5, self.avmsgsid,
-					"onStatus", self.commandtransid, nil,
-					flvio.AMFMap{
-						"level":       "status",
-						"code":        "NetStream.Play.Start",
-						"description": "Start live",
-					},
-				); err != nil {
-					return
-				}
-
-				// > |RtmpSampleAccess()
-				if err = self.writeDataMsg(5, self.avmsgsid,
-					"|RtmpSampleAccess", true, true,
-				); err != nil {
-					return
-				}
-
-				if err = self.flushWrite(); err != nil {
-					return
-				}
-
-				self.URL = createURL(tcurl, connectpath, playpath)
-				self.playing = true
-				self.writing = true
+			}
+			if self.netstream != nil {
 				self.stage++
 				return
 			}
+		}
+	}
+
+	return
+}
 
+func (self *Conn) streamInfo(stream string) *CommandInfo {
+	info := *self.connectinfo
+	info.Query = url.Values{}
+	for k, v := range self.connectinfo.Query {
+		info.Query[k] = v
+	}
+	var rawquery string
+	info.Stream, rawquery = splitQuery(stream)
+	if q, _ := url.ParseQuery(rawquery); q != nil {
+		for k, v := range q {
+			info.Query[k] = v
 		}
 	}
+	return &info
+}
 
+// rejectStream answers a rejected publish or play with an error onStatus.
+func (self *Conn) rejectStream(msgsid uint32, cberr error, code string) (err error) {
+	serr := toStatusError(cberr, code)
+	if err = self.writeStatus(msgsid, "error", serr.Code, serr.Description); err != nil {
+		return
+	}
+	err = serr
 	return
 }
 
+// statusError returns the status of an _error or error level onStatus
+// command, nil otherwise.
+func (self *Conn) statusError() *StatusError {
+	if self.commandname != "_error" && self.commandname != "onStatus" {
+		return nil
+	}
+	for _, param := range self.commandparams {
+		obj, _ := param.(flvio.AMFMap)
+		if obj == nil {
+			continue
+		}
+		level, _ := obj["level"].(string)
+		if self.commandname == "onStatus" && level != "error" {
+			return nil
+		}
+		serr := &StatusError{}
+		serr.Code, _ = obj["code"].(string)
+		serr.Description, _ = obj["description"].(string)
+		return serr
+	}
+	if self.commandname == "_error" {
+		return &StatusError{}
+	}
+	return nil
+}
+
 func (self *Conn) checkConnectResult() (ok bool, errmsg string) {
 	if len(self.commandparams) < 1 {
 		errmsg = "params length < 1"
@@ -612,6 +1057,7 @@ func (self *Conn) writeConnect(path string) (err error) {
 			"audioCodecs":   4071,
 			"videoCodecs":   252,
 			"videoFunction": 1,
+			"fourCcList":    fourCcListToAMF(FourCcList),
 		},
 	); err != nil {
 		return
@@ -637,8 +1083,14 @@ func (self *Conn) writeConnect(path string) (err error) {
 				if Debug {
 					fmt.Printf("rtmp: < _result() of connect\n")
 				}
+				self.FourCcList = parseFourCcList(self.commandobj)
 				break
 			}
+			// < _error("NetConnection.Connect.Rejected")
+			if serr := self.statusError(); serr != nil {
+				err = serr
+				return
+			}
 		} else {
 			if self.msgtypeid == msgtypeidWindowAckSize {
 				if len(self.msgdata) == 4 {
@@ -840,6 +1292,9 @@ func (self *Conn) prepare(stage int, flags int) (err error) {
 				return
 			}
 		}
+		if self.stage >= stageCommandDone {
+			self.stageDeadline = time.Time{}
+		}
 	}
 	return
 }
@@ -857,14 +1312,23 @@ func (self *Conn) WritePacket(pkt av.Packet) (err error) {
 		return
 	}
 
-	stream := self.streams[pkt.Idx]
+	if self.netstream != nil {
+		return self.netstream.WritePacket(pkt)
+	}
+	return self.writePacket(self.avmsgsid, self.streams, pkt)
+}
+
+func (self *Conn) writePacket(msgsid uint32, streams []av.CodecData, pkt av.Packet) (err error) {
+	stream := streams[pkt.Idx]
 	tag, timestamp := flv.PacketToTag(pkt, stream)
 
 	if Debug {
 		fmt.Println("rtmp: WritePacket", pkt.Idx, pkt.Time, pkt.CompositionTime)
 	}
 
-	if err = self.writeAVTag(tag, int32(timestamp)); err != nil {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	if err = self.writeAVTag(tag, int32(timestamp), msgsid); err != nil {
 		return
 	}
 
@@ -872,6 +1336,8 @@ func (self *Conn) WritePacket(pkt av.Packet) (err error) {
 }
 
 func (self *Conn) WriteTrailer() (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
 	if err = self.flushWrite(); err != nil {
 		return
 	}
@@ -883,13 +1349,34 @@ func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
 		return
 	}
 
+	if self.netstream != nil {
+		if err = self.netstream.WriteHeader(streams); err != nil {
+			return
+		}
+	} else if err = self.writeHeader(self.avmsgsid, streams); err != nil {
+		return
+	}
+
+	self.streams = streams
+	self.stage++
+	return
+}
+
+func (self *Conn) writeHeader(msgsid uint32, streams []av.CodecData) (err error) {
+	if err = self.checkFourCc(streams); err != nil {
+		return
+	}
+
 	var metadata flvio.AMFMap
 	if metadata, err = flv.NewMetadataByStreams(streams); err != nil {
 		return
 	}
 
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+
 	// > onMetaData()
-	if err = self.writeDataMsg(5, self.avmsgsid, "onMetaData", metadata); err != nil {
+	if err = self.writeDataMsg(5, msgsid, "onMetaData", metadata); err != nil {
 		return
 	}
 
@@ -902,14 +1389,12 @@ func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
 			return
 		}
 		if ok {
-			if err = self.writeAVTag(tag, 0); err != nil {
+			if err = self.writeAVTag(tag, 0, msgsid); err != nil {
 				return
 			}
 		}
 	}
 
-	self.streams = streams
-	self.stage++
 	return
 }
 
@@ -983,7 +1468,7 @@ func (self *Conn) writeAMF0Msg(msgtypeid uint8, csid, msgsid uint32, args ...int
 	return
 }
 
-func (self *Conn) writeAVTag(tag flvio.Tag, ts int32) (err error) {
+func (self *Conn) writeAVTag(tag flvio.Tag, ts int32, msgsid uint32) (err error) {
 	var msgtypeid uint8
 	var csid uint32
 	var data []byte
@@ -1007,7 +1492,7 @@ func (self *Conn) writeAVTag(tag flvio.Tag, ts int32) (err error) {
 
 	b := self.tmpwbuf(actualChunkHeaderLength + flvio.MaxTagSubHeaderLength)
 	hdrlen := tag.FillHeader(b[actualChunkHeaderLength:])
-	self.fillChunkHeader(b, csid, ts, msgtypeid, self.avmsgsid, hdrlen+len(data))
+	self.fillChunkHeader(b, csid, ts, msgtypeid, msgsid, hdrlen+len(data))
 	n := hdrlen + actualChunkHeaderLength
 
 	if n+len(data) > self.writeMaxChunkSize {
@@ -1023,6 +1508,21 @@ func (self *Conn) writeAVTag(tag flvio.Tag, ts int32) (err error) {
 	return
 }
 
+func (self *Conn) writePingResponse(timestamp uint32) (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+	b := self.tmpwbuf(chunkHeaderLength + 6)
+	n := self.fillChunkHeader(b, 2, 0, msgtypeidUserControl, 0, 6)
+	pio.PutU16BE(b[n:], eventtypePingResponse)
+	n += 2
+	pio.PutU32BE(b[n:], timestamp)
+	n += 4
+	if _, err = self.bufw.Write(b[:n]); err != nil {
+		return
+	}
+	return self.flushWrite()
+}
+
 func (self *Conn) writeStreamBegin(msgsid uint32) (err error) {
 	b := self.tmpwbuf(chunkHeaderLength + 6)
 	n := self.fillChunkHeader(b, 2, 0, msgtypeidUserControl, 0, 6)
@@ -1172,6 +1672,8 @@ func (self *Conn) readChunk() (err error) {
 		} else {
 			cs.hastimeext = false
 		}
+		// a type 3 chunk after type 0 has the timestamp as delta
+		cs.timedelta = timestamp
 		cs.timenow = timestamp
 		cs.Start()
 
@@ -1246,29 +1748,19 @@ func (self *Conn) readChunk() (err error) {
 		cs.Start()
 
 	case 3:
-		if cs.msgdataleft == 0 {
-			switch cs.msghdrtype {
-			case 0:
-				if cs.hastimeext {
-					if _, err = io.ReadFull(self.bufr, b[:4]); err != nil {
-						return
-					}
-					n += 4
-					timestamp = pio.U32BE(b)
-					cs.timenow = timestamp
-				}
-			case 1, 2:
-				if cs.hastimeext {
-					if _, err = io.ReadFull(self.bufr, b[:4]); err != nil {
-						return
-					}
-					n += 4
-					timestamp = pio.U32BE(b)
-				} else {
-					timestamp = cs.timedelta
-				}
-				cs.timenow += timestamp
+		// the extended timestamp is repeated in every type 3 chunk of the
+		// chunk stream, continuation chunks included
+		timestamp = cs.timedelta
+		if cs.hastimeext {
+			if _, err = io.ReadFull(self.bufr, b[:4]); err != nil {
+				return
 			}
+			n += 4
+			timestamp = pio.U32BE(b)
+		}
+		if cs.msgdataleft == 0 {
+			cs.timedelta = timestamp
+			cs.timenow += timestamp
 			cs.Start()
 		}
 
@@ -1307,7 +1799,10 @@ func (self *Conn) readChunk() (err error) {
 
 	self.ackn += uint32(n)
 	if self.readAckSize != 0 && self.ackn > self.readAckSize {
-		if err = self.writeAck(self.ackn); err != nil {
+		self.wmu.Lock()
+		err = self.writeAck(self.ackn)
+		self.wmu.Unlock()
+		if err != nil {
 			return
 		}
 		self.ackn = 0
@@ -1317,44 +1812,84 @@ func (self *Conn) readChunk() (err error) {
 }
 
 func (self *Conn) handleCommandMsgAMF0(b []byte) (n int, err error) {
-	var name, transid, obj interface{}
-	var size int
-
-	if name, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
-		return
-	}
-	n += size
-	if transid, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
+	// the arguments share one reference table
+	var vals []interface{}
+	if vals, err = flvio.ParseAMF0Vals(b); err != nil {
 		return
 	}
-	n += size
-	if obj, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
+	if len(vals) < 3 {
+		err = fmt.Errorf("rtmp: CommandMsgAMF0 has %d values", len(vals))
 		return
 	}
-	n += size
+	n = len(b)
 
 	var ok bool
-	if self.commandname, ok = name.(string); !ok {
+	if self.commandname, ok = vals[0].(string); !ok {
 		err = fmt.Errorf("rtmp: CommandMsgAMF0 command is not string")
 		return
 	}
-	self.commandtransid, _ = transid.(float64)
-	self.commandobj, _ = obj.(flvio.AMFMap)
-	self.commandparams = []interface{}{}
+	self.commandtransid, _ = vals[1].(float64)
+	self.commandobj, _ = vals[2].(flvio.AMFMap)
+	self.commandparams = append([]interface{}{}, vals[3:]...)
 
-	for n < len(b) {
-		if obj, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
-			return
-		}
-		n += size
-		self.commandparams = append(self.commandparams, obj)
-	}
-	if n < len(b) {
-		err = fmt.Errorf("rtmp: CommandMsgAMF0 left bytes=%d", len(b)-n)
+	self.gotcommand = true
+	return
+}
+
+func (self *Conn) handleDataMsgAMF0(b []byte) (err error) {
+	var vals []interface{}
+	if vals, err = flvio.ParseAMF0Vals(b); err != nil {
 		return
 	}
+	self.datamsgvals = append(self.datamsgvals, vals...)
+	return
+}
 
-	self.gotcommand = true
+type aggregateMsg struct {
+	timestamp uint32
+	msgsid    uint32
+	msgtypeid uint8
+	msgdata   []byte
+}
+
+// parseAggregate splits an aggregate message into its audio, video and data
+// messages, stored as FLV tags with back pointers. Their timestamps are
+// shifted so the first one has the timestamp of the aggregate message.
+func parseAggregate(timestamp uint32, msgsid uint32, b []byte) (msgs []aggregateMsg, err error) {
+	var offset uint32
+	for len(b) > 0 {
+		if len(b) < flvio.TagHeaderLength {
+			err = fmt.Errorf("rtmp: short sub message of Aggregate")
+			return
+		}
+		var tag flvio.Tag
+		var ts int32
+		var datalen int
+		if tag, ts, datalen, err = flvio.ParseTagHeader(b); err != nil {
+			err = fmt.Errorf("rtmp: Aggregate sub message type=%d invalid", b[0])
+			return
+		}
+		b = b[flvio.TagHeaderLength:]
+		if len(b) < datalen {
+			err = fmt.Errorf("rtmp: short sub message of Aggregate")
+			return
+		}
+		if len(msgs) == 0 {
+			offset = timestamp - uint32(ts)
+		}
+		msgs = append(msgs, aggregateMsg{
+			timestamp: uint32(ts) + offset,
+			msgsid:    msgsid,
+			msgtypeid: tag.Type,
+			msgdata:   b[:datalen],
+		})
+		b = b[datalen:]
+		if len(b) < flvio.TagTrailerLength {
+			// some servers omit the last back pointer
+			break
+		}
+		b = b[flvio.TagTrailerLength:]
+	}
 	return
 }
 
@@ -1362,6 +1897,7 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 	self.msgdata = msgdata
 	self.msgtypeid = msgtypeid
 	self.timestamp = timestamp
+	self.msgsid = msgsid
 
 	switch msgtypeid {
 	case msgtypeidCommandMsgAMF0:
@@ -1374,7 +1910,7 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 			err = fmt.Errorf("rtmp: short packet of CommandMsgAMF3")
 			return
 		}
-		// skip first byte
+		// skip format byte, values switch to AMF3 with the avmplus marker
 		if _, err = self.handleCommandMsgAMF0(msgdata[1:]); err != nil {
 			return
 		}
@@ -1385,21 +1921,46 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 			return
 		}
 		self.eventtype = pio.U16BE(msgdata)
-
-	case msgtypeidDataMsgAMF0:
-		b := msgdata
-		n := 0
-		for n < len(b) {
-			var obj interface{}
-			var size int
-			if obj, size, err = flvio.ParseAMF0Val(b[n:]); err != nil {
+		if self.eventtype == eventtypePingRequest {
+			if len(msgdata) < 6 {
+				err = fmt.Errorf("rtmp: short packet of PingRequest")
+				return
+			}
+			// > PingResponse(timestamp)
+			if err = self.writePingResponse(pio.U32BE(msgdata[2:])); err != nil {
 				return
 			}
-			n += size
-			self.datamsgvals = append(self.datamsgvals, obj)
 		}
-		if n < len(b) {
-			err = fmt.Errorf("rtmp: DataMsgAMF0 left bytes=%d", len(b)-n)
+
+	case msgtypeidAbort:
+		if len(msgdata) < 4 {
+			err = fmt.Errorf("rtmp: short packet of Abort")
+			return
+		}
+		if cs := self.readcsmap[pio.U32BE(msgdata)]; cs != nil {
+			cs.msgdataleft = 0
+			cs.msgdata = nil
+		}
+		return
+
+	case msgtypeidAggregate:
+		if self.aggmsgs, err = parseAggregate(timestamp, msgsid, msgdata); err != nil {
+			return
+		}
+		return
+
+	case msgtypeidDataMsgAMF0:
+		if err = self.handleDataMsgAMF0(msgdata); err != nil {
+			return
+		}
+
+	case msgtypeidDataMsgAMF3:
+		if len(msgdata) < 1 {
+			err = fmt.Errorf("rtmp: short packet of DataMsgAMF3")
+			return
+		}
+		// skip format byte, values switch to AMF3 with the avmplus marker
+		if err = self.handleDataMsgAMF0(msgdata[1:]); err != nil {
 			return
 		}
 
@@ -1647,7 +2208,7 @@ func (self closeConn) Close() error {
 
 func Handler(h *avutil.RegisterHandler) {
 	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
-		if !strings.HasPrefix(uri, "rtmp://") {
+		if !strings.HasPrefix(uri, "rtmp://") && !strings.HasPrefix(uri, "rtmps://") {
 			return
 		}
 		ok = true
@@ -1656,7 +2217,7 @@ func Handler(h *avutil.RegisterHandler) {
 	}
 
 	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
-		if !strings.HasPrefix(uri, "rtmp://") {
+		if !strings.HasPrefix(uri, "rtmp://") && !strings.HasPrefix(uri, "rtmps://") {
 			return
 		}
 		ok = true
@@ -0,0 +1,127 @@
+package rtmp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+)
+
+func selfSignedCert(t *testing.T) (cert tls.Certificate, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(leaf)
+	cert = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	return
+}
+
+func TestRTMPS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		url     string
+		streams []av.CodecData
+		pkts    int
+		err     error
+	}
+	done := make(chan result, 1)
+	server := &Server{
+		HandlePublish: func(conn *Conn) {
+			var res result
+			res.url = conn.URL.String()
+			if res.streams, res.err = conn.Streams(); res.err == nil {
+				for ; res.pkts < 25; res.pkts++ {
+					if _, res.err = conn.ReadPacket(); res.err != nil {
+						break
+					}
+				}
+			}
+			conn.Close()
+			done <- res
+		},
+	}
+	go server.Serve(listener)
+
+	uri := fmt.Sprintf("rtmps://%s/live/test", listener.Addr())
+	if _, err = DialTimeout(uri, time.Second); err == nil {
+		t.Fatal("self-signed certificate accepted without RootCAs")
+	}
+
+	conn, err := DialTLSTimeout(uri, time.Second, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	codec, _ := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err = conn.WriteHeader([]av.CodecData{codec}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		pkt := av.Packet{Time: time.Duration(i) * 20 * time.Millisecond, Data: make([]byte, 64)}
+		if err = conn.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = conn.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.url != "rtmps://"+listener.Addr().String()+"/live/test" {
+			t.Errorf("url %s", res.url)
+		}
+		if len(res.streams) != 1 || res.streams[0].Type() != av.AAC || res.pkts != 25 {
+			t.Errorf("streams %v packets %d", res.streams, res.pkts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
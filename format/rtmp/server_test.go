@@ -0,0 +1,348 @@
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/format/flv/flvio"
+)
+
+func startTestServer(t *testing.T, server *Server) (addr string, served chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served = make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	return listener.Addr().String(), served
+}
+
+func waitClosed(t *testing.T, conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want connection closed by server, got %v", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan bool, 1)
+	published := make(chan int, 1)
+	server := &Server{
+		HandlePublish: func(conn *Conn) {
+			started <- true
+			n := 0
+			for {
+				if _, err := conn.ReadPacket(); err != nil {
+					break
+				}
+				n++
+			}
+			published <- n
+		},
+	}
+	addr, served := startTestServer(t, server)
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	pub, err := Dial(fmt.Sprintf("rtmp://%s/live/test", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, _ := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+	})
+	if err = pub.WriteHeader([]av.CodecData{codec}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		pkt := av.Packet{Time: time.Duration(i) * 20 * time.Millisecond, Data: make([]byte, 64)}
+		if err = pub.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = pub.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	if err = <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	waitClosed(t, idle, time.Second)
+	if _, err = net.Dial("tcp", addr); err == nil {
+		t.Error("server still accepting")
+	}
+
+	// the publisher is drained
+	select {
+	case err = <-shutdown:
+		t.Fatalf("Shutdown returned %v with an active publisher", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	pub.Close()
+	if n := <-published; n < 10 {
+		t.Errorf("read %d packets", n)
+	}
+	if err = <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	server := &Server{
+		HandshakeTimeout: 200 * time.Millisecond,
+		MaxConns:         1,
+	}
+	addr, _ := startTestServer(t, server)
+	defer server.Close()
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	for server.NumConns() != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	waitClosed(t, second, time.Second)
+
+	start := time.Now()
+	waitClosed(t, first, 2*time.Second)
+	if time.Since(start) > time.Second {
+		t.Errorf("handshake timeout took %v", time.Since(start))
+	}
+}
+
+func TestStatusErrorShared(t *testing.T) {
+	errBadKey := &StatusError{Description: "bad key"}
+	if serr := toStatusError(errBadKey, "NetStream.Publish.BadName"); serr.Code != "NetStream.Publish.BadName" {
+		t.Errorf("got code %q", serr.Code)
+	}
+	if serr := toStatusError(errBadKey, "NetStream.Play.Failed"); serr.Code != "NetStream.Play.Failed" {
+		t.Errorf("got code %q", serr.Code)
+	}
+	if errBadKey.Code != "" {
+		t.Errorf("shared error changed to %q", errBadKey.Code)
+	}
+}
+
+func TestServerConnectLenient(t *testing.T) {
+	server := &Server{}
+	addr, _ := startTestServer(t, server)
+	defer server.Close()
+
+	netconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConn(netconn)
+	defer conn.Close()
+	if err = conn.handshakeClient(); err != nil {
+		t.Fatal(err)
+	}
+	// > connect() with app and tcUrl of the wrong types
+	if err = conn.writeCommandMsg(3, 0, "connect", 1, flvio.AMFMap{"app": nil, "tcUrl": float64(5)}); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.flushWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.pollCommand(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.commandname != "_result" {
+		t.Errorf("got %s()", conn.commandname)
+	}
+}
+
+// testClient connects with a raw client, the caller reads the answer.
+func testClient(t *testing.T, addr string, params flvio.AMFMap) *Conn {
+	netconn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConn(netconn)
+	if err = conn.handshakeClient(); err != nil {
+		t.Fatal(err)
+	}
+	// > connect()
+	if err = conn.writeCommandMsg(3, 0, "connect", 1, params); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.flushWrite(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// testCommand sends a command and returns the answer, a _result, _error or
+// onStatus.
+func testCommand(t *testing.T, conn *Conn, csid, msgsid uint32, args ...interface{}) {
+	if err := conn.writeCommandMsg(csid, msgsid, args...); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.flushWrite(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err := conn.pollCommand(); err != nil {
+			t.Fatal(err)
+		}
+		switch conn.commandname {
+		case "_result", "_error", "onStatus":
+			return
+		}
+	}
+}
+
+func TestServerHookInfo(t *testing.T) {
+	infos := make(chan *CommandInfo, 3)
+	hook := func(conn *Conn, info *CommandInfo) error {
+		infos <- info
+		return nil
+	}
+	server := &Server{
+		OnConnect: hook,
+		OnPublish: hook,
+		OnPlay:    hook,
+	}
+	addr, _ := startTestServer(t, server)
+	defer server.Close()
+
+	for _, command := range []string{"publish", "play"} {
+		tcurl := fmt.Sprintf("rtmp://%s/live?tc=1&x=tc", addr)
+		conn := testClient(t, addr, flvio.AMFMap{"app": "live?app=1&x=app", "tcUrl": tcurl})
+		defer conn.Close()
+		if err := conn.pollCommand(); err != nil {
+			t.Fatal(err)
+		}
+		if conn.commandname != "_result" {
+			t.Fatalf("connect got %s()", conn.commandname)
+		}
+		info := <-infos
+		if info.App != "live" || info.TcUrl != tcurl || info.Stream != "" || info.ConnectParams["app"] != "live?app=1&x=app" {
+			t.Errorf("connect got %+v", info)
+		}
+		// app overrides tcUrl
+		if q := info.Query.Encode(); q != "app=1&tc=1&x=app" {
+			t.Errorf("connect got query %s", q)
+		}
+
+		testCommand(t, conn, 3, 0, "createStream", 2, nil)
+		_, msgsid := conn.checkCreateStreamResult()
+		testCommand(t, conn, 8, msgsid, command, 0, nil, "test?s=1&x=stream", "live")
+		if serr := conn.statusError(); serr != nil {
+			t.Fatalf("%s got %v", command, serr)
+		}
+		info = <-infos
+		if info.App != "live" || info.TcUrl != tcurl || info.Stream != "test" || info.NetStream == nil || info.NetStream.ID != msgsid {
+			t.Errorf("%s got %+v", command, info)
+		}
+		// the stream name overrides app and tcUrl
+		if q := info.Query.Encode(); q != "app=1&s=1&tc=1&x=stream" {
+			t.Errorf("%s got query %s", command, q)
+		}
+		if command == "publish" && info.PublishType != "live" {
+			t.Errorf("publish got type %q", info.PublishType)
+		}
+	}
+}
+
+func TestServerHookReject(t *testing.T) {
+	errBadKey := &StatusError{Description: "bad key"}
+	server := &Server{
+		OnConnect: func(conn *Conn, info *CommandInfo) error {
+			if info.Query.Get("reject") == "connect" {
+				return &StatusError{Code: "NetConnection.Connect.Banned", Description: "banned"}
+			}
+			return nil
+		},
+		OnPublish: func(conn *Conn, info *CommandInfo) error {
+			return errBadKey
+		},
+		OnPlay: func(conn *Conn, info *CommandInfo) error {
+			return fmt.Errorf("no such stream")
+		},
+	}
+	addr, _ := startTestServer(t, server)
+	defer server.Close()
+
+	check := func(what string, err error, code, description string) {
+		serr, _ := err.(*StatusError)
+		if serr == nil {
+			t.Errorf("%s got %v", what, err)
+			return
+		}
+		if serr.Code != code || serr.Description != description {
+			t.Errorf("%s got %+v", what, serr)
+		}
+	}
+
+	// < _error() for connect
+	conn := testClient(t, addr, flvio.AMFMap{"app": "live?reject=connect", "tcUrl": "rtmp://" + addr + "/live"})
+	if err := conn.pollCommand(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.commandname != "_error" {
+		t.Errorf("connect got %s()", conn.commandname)
+	}
+	check("connect", conn.statusError(), "NetConnection.Connect.Banned", "banned")
+	conn.Close()
+
+	conn, err := Dial(fmt.Sprintf("rtmp://%s/live?reject=connect/test", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Streams()
+	check("client connect", err, "NetConnection.Connect.Banned", "banned")
+	conn.Close()
+
+	// < onStatus() for publish, with the default code of a shared error
+	conn = testClient(t, addr, flvio.AMFMap{"app": "live", "tcUrl": "rtmp://" + addr + "/live"})
+	if err = conn.pollCommand(); err != nil {
+		t.Fatal(err)
+	}
+	testCommand(t, conn, 3, 0, "createStream", 2, nil)
+	_, msgsid := conn.checkCreateStreamResult()
+	testCommand(t, conn, 8, msgsid, "publish", 0, nil, "test", "live")
+	if conn.commandname != "onStatus" || conn.msgsid != msgsid {
+		t.Errorf("publish got %s() on stream %d", conn.commandname, conn.msgsid)
+	}
+	check("publish", conn.statusError(), "NetStream.Publish.BadName", "bad key")
+	conn.Close()
+
+	conn, err = Dial(fmt.Sprintf("rtmp://%s/live/test", addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.ReadPacket()
+	check("client play", err, "NetStream.Play.Failed", "no such stream")
+	conn.Close()
+}
@@ -2,6 +2,7 @@ package ts
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"time"
 	"github.com/nareix/joy4/utils/bits/pio"
@@ -12,15 +13,100 @@ import (
 	"io"
 )
 
+// ErrStreamsChanged is returned by ReadPacket once all packets of the old
+// streams were read after the PMT of the selected program changed.
+// Streams returns the new streams afterwards.
+var ErrStreamsChanged = fmt.Errorf("ts: streams changed")
+
+var (
+	ErrSyncLost       = fmt.Errorf("ts: sync byte lost")
+	ErrTransportError = fmt.Errorf("ts: transport_error_indicator set")
+	ErrContinuity     = fmt.Errorf("ts: continuity counter error")
+	ErrDamagedPES     = fmt.Errorf("ts: damaged PES packet")
+)
+
+// Stats counts TS packets read and errors found by the demuxer.
+type Stats struct {
+	Packets          int64
+	SyncLosses       int64
+	TransportErrors  int64
+	ContinuityErrors int64
+	DamagedPES       int64
+}
+
+// Cue is a SCTE-35 splice_info_section read from the selected program,
+// PTS is in the same time base as packet times.
+type Cue struct {
+	PID    uint16
+	PTS    time.Duration
+	HasPTS bool
+	Info   *tsio.SpliceInfo
+}
+
+// ServiceInfo describes a service (program) listed in the DVB SDT.
+type ServiceInfo struct {
+	ServiceId    uint16 // program number
+	ServiceType  uint8
+	ProviderName string
+	ServiceName  string
+}
+
+// ProgramStream is an elementary stream listed in a PMT.
+type ProgramStream struct {
+	PID        uint16
+	StreamType uint8
+	Supported  bool
+}
+
+// Program is an entry of the PAT, Streams is nil until its PMT was read.
+type Program struct {
+	Number  uint16
+	PMTPID  uint16
+	PCRPID  uint16
+	Version uint8
+	Streams []ProgramStream
+}
+
 type Demuxer struct {
+	// ProgramNumber or PMTPID select the program to demux, by default the
+	// first program in the PAT is used.
+	ProgramNumber uint16
+	PMTPID        uint16
+
+	// KeepDamagedPES returns PES packets which lost TS packets or were
+	// truncated instead of dropping them, they are still reported.
+	KeepDamagedPES bool
+
+	// OnError is called for every error found in the stream together with
+	// the updated counters, pid is 0x1fff when the packet is unknown.
+	OnError func(pid uint16, err error, stats Stats)
+
+	// OnCue is called for SCTE-35 cues of the selected program.
+	OnCue func(cue Cue)
+
+	// OnServiceInfo is called when a new version of the SDT was read.
+	OnServiceInfo func(services []ServiceInfo)
+
 	r *bufio.Reader
 
 	pkts []av.Packet
 
-	pat     *tsio.PAT
-	pmt     *tsio.PMT
-	streams []*Stream
-	tshdr   []byte
+	pat      *tsio.PAT
+	programs []*Program
+	sections map[uint16][]byte
+	program  *Program
+	streams  []*Stream
+	cuepids  []uint16
+	tshdr    []byte
+
+	services   []ServiceInfo
+	sdtversion int
+
+	changed      bool
+	pktsbeforechange int
+
+	lastcc map[uint16]uint8
+	stats  Stats
 
 	stage int
 }
@@ -29,6 +115,106 @@ func NewDemuxer(r io.Reader) *Demuxer {
 	return &Demuxer{
 		tshdr: make([]byte, 188),
 		r: bufio.NewReaderSize(r, pio.RecommendBufioSize),
+		sections: map[uint16][]byte{},
+		lastcc: map[uint16]uint8{},
+		sdtversion: -1,
+	}
+}
+
+// Services returns the services of the last SDT read, it is empty if the
+// stream has no SDT or it was not read yet.
+func (self *Demuxer) Services() []ServiceInfo {
+	return self.services
+}
+
+// Stats returns the packet and error counters.
+func (self *Demuxer) Stats() Stats {
+	return self.stats
+}
+
+func (self *Demuxer) report(pid uint16, err error) {
+	switch err {
+	case ErrSyncLost:
+		self.stats.SyncLosses++
+	case ErrTransportError:
+		self.stats.TransportErrors++
+	case ErrContinuity:
+		self.stats.ContinuityErrors++
+	case ErrDamagedPES:
+		self.stats.DamagedPES++
+	}
+	if self.OnError != nil {
+		self.OnError(pid, err, self.stats)
+	}
+}
+
+// readSync reads the next TS packet, skipping bytes until a sync byte is
+// found which is followed by another one a packet later.
+func (self *Demuxer) readSync() (err error) {
+	if _, err = io.ReadFull(self.r, self.tshdr); err != nil {
+		return
+	}
+	if self.tshdr[0] == 0x47 {
+		return
+	}
+
+	self.report(0x1fff, ErrSyncLost)
+	for {
+		i := bytes.IndexByte(self.tshdr[1:], 0x47)
+		if i == -1 {
+			if _, err = io.ReadFull(self.r, self.tshdr); err != nil {
+				return
+			}
+			if self.tshdr[0] != 0x47 {
+				continue
+			}
+		} else {
+			n := copy(self.tshdr, self.tshdr[i+1:])
+			if _, err = io.ReadFull(self.r, self.tshdr[n:]); err != nil {
+				return
+			}
+		}
+		if next, _ := self.r.Peek(1); len(next) == 0 || next[0] == 0x47 {
+			return
+		}
+		self.tshdr[0] = 0
+	}
+}
+
+// checkContinuity returns false for duplicate packets which must be skipped.
+func (self *Demuxer) checkContinuity(pid uint16) bool {
+	if pid == 0x1fff {
+		return true
+	}
+	cc := self.tshdr[3]&0xf
+	haspayload := self.tshdr[3]&0x10 != 0
+	discontinuity := self.tshdr[3]&0x20 != 0 && self.tshdr[4] > 0 && self.tshdr[5]&0x80 != 0
+
+	last, ok := self.lastcc[pid]
+	self.lastcc[pid] = cc
+	if !ok || discontinuity {
+		return true
+	}
+	if !haspayload {
+		return true
+	}
+	if cc == last {
+		return false
+	}
+	if cc != (last+1)&0xf {
+		self.report(pid, ErrContinuity)
+		self.damage(pid)
+	}
+	return true
+}
+
+// damage marks the PES or PSI section being collected on pid as broken.
+func (self *Demuxer) damage(pid uint16) {
+	delete(self.sections, pid)
+	for _, stream := range self.streams {
+		if stream.pid == pid && stream.data != nil {
+			stream.damaged = true
+		}
 	}
 }
 
@@ -42,10 +228,40 @@ func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
 	return
 }
 
+// Programs reads until the PMTs of all programs in the PAT were seen and
+// returns them, including streams of types the demuxer can not handle.
+func (self *Demuxer) Programs() (programs []Program, err error) {
+	for {
+		if self.pat != nil {
+			n := 0
+			for _, program := range self.programs {
+				if program.Streams != nil {
+					n++
+				}
+			}
+			if n == len(self.programs) {
+				break
+			}
+		}
+		if err = self.poll(); err != nil {
+			return
+		}
+	}
+	for _, program := range self.programs {
+		programs = append(programs, *program)
+	}
+	return
+}
+
 func (self *Demuxer) probe() (err error) {
 	if self.stage == 0 {
 		for {
-			if self.pmt != nil {
+			if self.program == nil && self.pat != nil {
+				if err = self.selectProgram(); err != nil {
+					return
+				}
+			}
+			if self.program != nil {
 				n := 0
 				for _, stream := range self.streams {
 					if stream.CodecData != nil {
@@ -70,7 +286,16 @@ func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
 		return
 	}
 
-	for len(self.pkts) == 0 {
+	for {
+		if self.changed && self.pktsbeforechange == 0 {
+			self.changed = false
+			self.stage = 0
+			err = ErrStreamsChanged
+			return
+		}
+		if len(self.pkts) > 0 {
+			break
+		}
 		if err = self.poll(); err != nil {
 			return
 		}
@@ -78,57 +303,239 @@ func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
 
 	pkt = self.pkts[0]
 	self.pkts = self.pkts[1:]
+	if self.changed {
+		self.pktsbeforechange--
+	}
 	return
 }
 
 func (self *Demuxer) poll() (err error) {
 	if err = self.readTSPacket(); err == io.EOF {
-		var n int
-		if n, err = self.payloadEnd(); err != nil {
-			return
-		}
-		if n == 0 {
-			err = io.EOF
+		if self.payloadEnd() > 0 {
+			err = nil
 		}
 	}
 	return
 }
 
-func (self *Demuxer) initPMT(payload []byte) (err error) {
-	var psihdrlen int
-	var datalen int
-	if _, _, psihdrlen, datalen, err = tsio.ParsePSI(payload); err != nil {
+// selectProgram picks the program to demux once its PMT was read.
+func (self *Demuxer) selectProgram() (err error) {
+	var program *Program
+	for _, p := range self.programs {
+		if self.PMTPID != 0 {
+			if p.PMTPID == self.PMTPID {
+				program = p
+				break
+			}
+		} else if self.ProgramNumber != 0 {
+			if p.Number == self.ProgramNumber {
+				program = p
+				break
+			}
+		} else {
+			program = p
+			break
+		}
+	}
+	if program == nil {
+		if self.PMTPID != 0 {
+			err = fmt.Errorf("ts: program with PMT pid=%d not found", self.PMTPID)
+		} else if self.ProgramNumber != 0 {
+			err = fmt.Errorf("ts: program number=%d not found", self.ProgramNumber)
+		} else {
+			err = fmt.Errorf("ts: no program found in PAT")
+		}
 		return
 	}
-	self.pmt = &tsio.PMT{}
-	if _, err = self.pmt.Unmarshal(payload[psihdrlen:psihdrlen+datalen]); err != nil {
+	if program.Streams == nil {
 		return
 	}
+	self.program = program
+	self.initStreams()
+	return
+}
 
+func (self *Demuxer) initStreams() {
 	self.streams = []*Stream{}
-	for i, info := range self.pmt.ElementaryStreamInfos {
+	self.cuepids = nil
+	for _, info := range self.program.Streams {
+		if !info.Supported {
+			continue
+		}
+		if info.StreamType == tsio.ElementaryStreamTypeSCTE35 {
+			self.cuepids = append(self.cuepids, info.PID)
+			continue
+		}
 		stream := &Stream{}
-		stream.idx = i
+		stream.idx = len(self.streams)
 		stream.demuxer = self
-		stream.pid = info.ElementaryPID
+		stream.pid = info.PID
 		stream.streamType = info.StreamType
-		switch info.StreamType {
-		case tsio.ElementaryStreamTypeH264:
-			self.streams = append(self.streams, stream)
-		case tsio.ElementaryStreamTypeAdtsAAC:
-			self.streams = append(self.streams, stream)
+		self.streams = append(self.streams, stream)
+	}
+}
+
+func isSupportedStreamType(streamType uint8) bool {
+	switch streamType {
+	case tsio.ElementaryStreamTypeH264, tsio.ElementaryStreamTypeAdtsAAC, tsio.ElementaryStreamTypeSCTE35:
+		return true
+	}
+	return false
+}
+
+// splitSections cuts the complete PSI sections from the start of buf, rest
+// is the incomplete section following them.
+func splitSections(buf []byte) (sections [][]byte, rest []byte) {
+	// table_id(8) section_length(16), 0xff is stuffing up to the packet end
+	for len(buf) >= 3 && buf[0] != 0xff {
+		size := 3+int(pio.U16BE(buf[1:])&0xfff)
+		if len(buf) < size {
+			break
 		}
+		// returned with a zero pointer_field in front
+		sections = append(sections, append([]byte{0}, buf[:size]...))
+		buf = buf[size:]
+	}
+	if len(buf) > 0 && buf[0] != 0xff {
+		rest = buf
 	}
 	return
 }
 
-func (self *Demuxer) payloadEnd() (n int, err error) {
-	for _, stream := range self.streams {
-		var i int
-		if i, err = stream.payloadEnd(); err != nil {
+// readSections collects PSI sections which may span several TS packets or
+// share one.
+func (self *Demuxer) readSections(pid uint16, start bool, payload []byte) (sections [][]byte) {
+	pending, ok := self.sections[pid]
+	delete(self.sections, pid)
+
+	var buf []byte
+	if start {
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
 			return
 		}
-		n += i
+		pointer := int(payload[0])
+		if ok {
+			// the bytes before the pointed to section end the pending one
+			sections, _ = splitSections(append(pending, payload[1:1+pointer]...))
+		}
+		buf = payload[1+pointer:]
+	} else if ok {
+		buf = append(pending, payload...)
+	} else {
+		return
+	}
+
+	more, rest := splitSections(buf)
+	sections = append(sections, more...)
+	if rest != nil {
+		self.sections[pid] = append([]byte{}, rest...)
+	}
+	return
+}
+
+func (self *Demuxer) handlePAT(section []byte) (err error) {
+	var tableid uint8
+	var psihdrlen, datalen int
+	var current bool
+	if tableid, _, _, current, psihdrlen, datalen, err = tsio.ParsePSIVersion(section); err != nil {
+		return
+	}
+	if tableid != tsio.TableIdPAT || !current {
+		return
+	}
+	// a corrupted PAT must not replace the program list
+	if !tsio.CheckPSICRC(section, psihdrlen, datalen) {
+		err = fmt.Errorf("ts: PAT CRC invalid")
+		return
+	}
+	pat := &tsio.PAT{}
+	if _, err = pat.Unmarshal(section[psihdrlen:psihdrlen+datalen]); err != nil {
+		return
+	}
+
+	programs := []*Program{}
+	for _, entry := range pat.Entries {
+		if entry.ProgramNumber == 0 {
+			continue
+		}
+		var program *Program
+		for _, old := range self.programs {
+			if old.Number == entry.ProgramNumber && old.PMTPID == entry.ProgramMapPID {
+				program = old
+				break
+			}
+		}
+		if program == nil {
+			program = &Program{Number: entry.ProgramNumber, PMTPID: entry.ProgramMapPID}
+		}
+		programs = append(programs, program)
+	}
+	self.pat = pat
+	self.programs = programs
+	return
+}
+
+func (self *Demuxer) handlePMT(pid uint16, section []byte) (err error) {
+	var tableid, version uint8
+	var tableext uint16
+	var psihdrlen, datalen int
+	var current bool
+	if tableid, tableext, version, current, psihdrlen, datalen, err = tsio.ParsePSIVersion(section); err != nil {
+		return
+	}
+	if tableid != tsio.TableIdPMT || !current {
+		return
+	}
+	// programs can share a PMT pid, table_id_extension is the program number
+	var program *Program
+	for _, p := range self.programs {
+		if p.PMTPID == pid && p.Number == tableext {
+			program = p
+			break
+		}
+	}
+	if program == nil || (program.Streams != nil && version == program.Version) {
+		return
+	}
+	// drop corrupted sections rather than reinitialising the streams
+	if !tsio.CheckPSICRC(section, psihdrlen, datalen) {
+		err = fmt.Errorf("ts: PMT CRC invalid")
+		return
+	}
+	pmt := &tsio.PMT{}
+	if _, err = pmt.Unmarshal(section[psihdrlen:psihdrlen+datalen]); err != nil {
+		return
+	}
+
+	reinit := program == self.program && program.Streams != nil
+	program.Version = version
+	program.PCRPID = pmt.PCRPID
+	program.Streams = []ProgramStream{}
+	for _, info := range pmt.ElementaryStreamInfos {
+		program.Streams = append(program.Streams, ProgramStream{
+			PID: info.ElementaryPID,
+			StreamType: info.StreamType,
+			Supported: isSupportedStreamType(info.StreamType),
+		})
+	}
+
+	if reinit {
+		if self.stage > 0 {
+			// packets of the old streams are returned before ErrStreamsChanged
+			self.payloadEnd()
+			if !self.changed {
+				self.changed = true
+				self.pktsbeforechange = len(self.pkts)
+			}
+		}
+		self.initStreams()
+	}
+	return
+}
+
+func (self *Demuxer) payloadEnd() (n int) {
+	for _, stream := range self.streams {
+		n += stream.payloadEnd()
 	}
 	return
 }
@@ -139,50 +546,138 @@ func (self *Demuxer) readTSPacket() (err error) {
 	var start bool
 	var iskeyframe bool
 
-	if _, err = io.ReadFull(self.r, self.tshdr); err != nil {
+	if err = self.readSync(); err != nil {
+		return
+	}
+	self.stats.Packets++
+
+	pid = uint16(self.tshdr[1]&0x1f)<<8|uint16(self.tshdr[2])
+	if self.tshdr[1]&0x80 != 0 {
+		self.report(pid, ErrTransportError)
+		self.damage(pid)
+		return
+	}
+	if !self.checkContinuity(pid) {
 		return
 	}
 
-	if pid, start, iskeyframe, hdrlen, err = tsio.ParseTSHeader(self.tshdr); err != nil {
+	if _, start, iskeyframe, hdrlen, err = tsio.ParseTSHeader(self.tshdr); err != nil {
+		self.report(pid, err)
+		self.damage(pid)
+		err = nil
 		return
 	}
 	payload := self.tshdr[hdrlen:]
 
-	if self.pat == nil {
-		if pid == 0 {
-			var psihdrlen int
-			var datalen int
-			if _, _, psihdrlen, datalen, err = tsio.ParsePSI(payload); err != nil {
-				return
+	// errors in the payload are reported and the stream goes on
+	if pid == tsio.PAT_PID {
+		for _, section := range self.readSections(pid, start, payload) {
+			if err = self.handlePAT(section); err != nil {
+				self.report(pid, err)
+				err = nil
 			}
-			self.pat = &tsio.PAT{}
-			if _, err = self.pat.Unmarshal(payload[psihdrlen:psihdrlen+datalen]); err != nil {
-				return
+		}
+		return
+	}
+
+	if pid == tsio.SDT_PID {
+		for _, section := range self.readSections(pid, start, payload) {
+			if err = self.handleSDT(section); err != nil {
+				self.report(pid, err)
+				err = nil
 			}
 		}
-	} else if self.pmt == nil {
-		for _, entry := range self.pat.Entries {
-			if entry.ProgramMapPID == pid {
-				if err = self.initPMT(payload); err != nil {
-					return
+		return
+	}
+
+	for _, program := range self.programs {
+		if program.PMTPID == pid {
+			for _, section := range self.readSections(pid, start, payload) {
+				if err = self.handlePMT(pid, section); err != nil {
+					self.report(pid, err)
+					err = nil
 				}
-				break
 			}
+			return
 		}
-	} else {
-		for _, stream := range self.streams {
-			if pid == stream.pid {
-				if err = stream.handleTSPacket(start, iskeyframe, payload); err != nil {
-					return
-				}
-				break
+	}
+
+	for _, cuepid := range self.cuepids {
+		if pid == cuepid {
+			for _, section := range self.readSections(pid, start, payload) {
+				self.handleSCTE35(pid, section)
 			}
+			return
+		}
+	}
+
+	for _, stream := range self.streams {
+		if pid == stream.pid {
+			stream.handleTSPacket(start, iskeyframe, payload)
+			break
 		}
 	}
 
 	return
 }
 
+func (self *Demuxer) handleSDT(section []byte) (err error) {
+	var tableid, version uint8
+	var psihdrlen, datalen int
+	var current bool
+	if tableid, _, version, current, psihdrlen, datalen, err = tsio.ParsePSIVersion(section); err != nil {
+		return
+	}
+	// SDT_PID also carries the SDT of other transport streams and BAT
+	if tableid != tsio.TableIdSDTActual || !current || int(version) == self.sdtversion {
+		return
+	}
+	if !tsio.CheckPSICRC(section, psihdrlen, datalen) {
+		err = fmt.Errorf("ts: SDT CRC invalid")
+		return
+	}
+	sdt := &tsio.SDT{}
+	if _, err = sdt.Unmarshal(section[psihdrlen:psihdrlen+datalen]); err != nil {
+		return
+	}
+
+	services := []ServiceInfo{}
+	for _, service := range sdt.Services {
+		info := ServiceInfo{ServiceId: service.ServiceId}
+		for _, desc := range service.Descriptors {
+			if desc.Tag == tsio.ServiceDescriptorTag {
+				if sd, err := tsio.ParseServiceDescriptor(desc); err == nil {
+					info.ServiceType = sd.ServiceType
+					info.ProviderName = sd.ProviderName
+					info.ServiceName = sd.ServiceName
+				}
+			}
+		}
+		services = append(services, info)
+	}
+	self.services = services
+	self.sdtversion = int(version)
+	if self.OnServiceInfo != nil {
+		self.OnServiceInfo(services)
+	}
+	return
+}
+
+func (self *Demuxer) handleSCTE35(pid uint16, section []byte) {
+	// skip pointer_field
+	section = section[1+int(section[0]):]
+	info := &tsio.SpliceInfo{}
+	if _, err := info.Unmarshal(section); err != nil {
+		self.report(pid, err)
+		return
+	}
+	if self.OnCue != nil {
+		cue := Cue{PID: pid, Info: info}
+		cue.PTS, cue.HasPTS = info.SplicePTS()
+		self.OnCue(cue)
+	}
+}
+
 func (self *Stream) addPacket(payload []byte, timedelta time.Duration) {
 	dts := self.dts
 	pts := self.pts
@@ -203,29 +698,50 @@ func (self *Stream) addPacket(payload []byte, timedelta time.Duration) {
 	demuxer.pkts = append(demuxer.pkts, pkt)
 }
 
-func (self *Stream) payloadEnd() (n int, err error) {
+// drop throws away the PES packet being collected after err.
+func (self *Stream) drop(err error) {
+	self.data = nil
+	self.damaged = false
+	self.demuxer.stats.DamagedPES++
+	self.demuxer.report(self.pid, err)
+}
+
+func (self *Stream) payloadEnd() (n int) {
 	payload := self.data
 	if payload == nil {
 		return
 	}
+	self.data = nil
 	if self.datalen != 0 && len(payload) != self.datalen {
-		err = fmt.Errorf("ts: packet size mismatch size=%d correct=%d", len(payload), self.datalen)
-		return
+		self.damaged = true
+		if len(payload) > self.datalen {
+			payload = payload[:self.datalen]
+		}
+	}
+	if self.damaged {
+		self.damaged = false
+		self.demuxer.report(self.pid, ErrDamagedPES)
+		if !self.demuxer.KeepDamagedPES {
+			return
+		}
 	}
-	self.data = nil
 
 	switch self.streamType {
 	case tsio.ElementaryStreamTypeAdtsAAC:
-		var config aacparser.MPEG4AudioConfig
-
 		delta := time.Duration(0)
 		for len(payload) > 0 {
-			var hdrlen, framelen, samples int
-			if config, hdrlen, framelen, samples, err = aacparser.ParseADTSHeader(payload); err != nil {
+			config, hdrlen, framelen, samples, err := aacparser.ParseADTSHeader(payload)
+			if err == nil && framelen > len(payload) {
+				err = fmt.Errorf("ts: ADTS frame truncated")
+			}
+			if err != nil {
+				// frames before the broken one are kept
+				self.drop(err)
 				return
 			}
 			if self.CodecData == nil {
 				if self.CodecData, err = aacparser.NewCodecDataFromMPEG4AudioConfig(config); err != nil {
+					self.demuxer.report(self.pid, err)
 					return
 				}
 			}
@@ -258,8 +774,9 @@ func (self *Stream) payloadEnd() (n int, err error) {
 		}
 
 		if self.CodecData == nil && len(sps) > 0 && len(pps) > 0 {
+			var err error
 			if self.CodecData, err = h264parser.NewCodecDataFromSPSAndPPS(sps, pps); err != nil {
-				return
+				self.demuxer.report(self.pid, err)
 			}
 		}
 	}
@@ -267,15 +784,18 @@ func (self *Stream) payloadEnd() (n int, err error) {
 	return
 }
 
-func (self *Stream) handleTSPacket(start bool, iskeyframe bool, payload []byte) (err error) {
+func (self *Stream) handleTSPacket(start bool, iskeyframe bool, payload []byte) {
 	if start {
-		if _, err = self.payloadEnd(); err != nil {
-			return
+		self.payloadEnd()
+		hdrlen, _, datalen, pts, dts, err := tsio.ParsePESHeader(payload)
+		if err == nil && hdrlen > len(payload) {
+			err = tsio.ErrPESHeader
 		}
-		var hdrlen int
-		if hdrlen, _, self.datalen, self.pts, self.dts, err = tsio.ParsePESHeader(payload); err != nil {
+		if err != nil {
+			self.drop(err)
 			return
 		}
+		self.datalen, self.pts, self.dts = datalen, pts, dts
 		self.iskeyframe = iskeyframe
 		if self.datalen == 0 {
 			self.data = make([]byte, 0, 4096)
@@ -283,8 +803,7 @@ func (self *Stream) handleTSPacket(start bool, iskeyframe bool, payload []byte)
 			self.data = make([]byte, 0, self.datalen)
 		}
 		self.data = append(self.data, payload[hdrlen:]...)
-	} else {
+	} else if self.data != nil {
 		self.data = append(self.data, payload...)
 	}
-	return
 }
@@ -0,0 +1,347 @@
+package ts
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/format/ts/tsio"
+)
+
+// tsBuilder writes crafted TS packets.
+type tsBuilder struct {
+	bytes.Buffer
+	cc map[uint16]uint8
+}
+
+func newTSBuilder() *tsBuilder {
+	return &tsBuilder{cc: map[uint16]uint8{}}
+}
+
+// packet writes one TS packet, a payload shorter than 184 bytes is preceded
+// by adaptation field stuffing.
+func (self *tsBuilder) packet(pid uint16, start bool, payload []byte) {
+	b := make([]byte, 188)
+	b[0] = 0x47
+	b[1] = uint8(pid>>8) & 0x1f
+	if start {
+		b[1] |= 0x40
+	}
+	b[2] = uint8(pid)
+	b[3] = 0x10 | self.cc[pid]
+	self.cc[pid] = (self.cc[pid] + 1) & 0xf
+	n := 4
+	if len(payload) < 184 {
+		b[3] |= 0x20
+		b[4] = uint8(183 - len(payload))
+		n++
+		if b[4] > 0 {
+			b[5] = 0
+			n++
+			for ; n < 188-len(payload); n++ {
+				b[n] = 0xff
+			}
+		}
+	}
+	copy(b[n:], payload)
+	self.Write(b)
+}
+
+// data splits data into packets of pid.
+func (self *tsBuilder) data(pid uint16, data []byte) {
+	for start := true; start || len(data) > 0; start = false {
+		n := len(data)
+		if n > 184 {
+			n = 184
+		}
+		self.packet(pid, start, data[:n])
+		data = data[n:]
+	}
+}
+
+// psi returns a section with a zero pointer_field in front.
+func psi(tableid uint8, tableext uint16, version uint8, data []byte) []byte {
+	b := make([]byte, tsio.PSIHeaderLength+len(data)+4)
+	copy(b[tsio.PSIHeaderLength:], data)
+	tsio.FillPSI(b, tableid, tableext, len(data))
+	b[6] = 0x3<<6 | version<<1 | 1
+	end := tsio.PSIHeaderLength + len(data)
+	tsio.PutCRC32(b[end:], b[1:end])
+	return b
+}
+
+func patSection(entries ...tsio.PATEntry) []byte {
+	pat := tsio.PAT{Entries: entries}
+	b := make([]byte, pat.Len())
+	pat.Marshal(b)
+	return psi(tsio.TableIdPAT, tsio.TableExtPAT, 0, b)
+}
+
+func pmtSection(number uint16, version uint8, pids ...uint16) []byte {
+	pmt := tsio.PMT{PCRPID: pids[0]}
+	for _, pid := range pids {
+		pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos, tsio.ElementaryStreamInfo{
+			StreamType:    tsio.ElementaryStreamTypeAdtsAAC,
+			ElementaryPID: pid,
+		})
+	}
+	b := make([]byte, pmt.Len())
+	pmt.Marshal(b)
+	return psi(tsio.TableIdPMT, number, version, b)
+}
+
+var testAACConfig = aacparser.MPEG4AudioConfig{
+	ObjectType:      aacparser.AOT_AAC_LC,
+	SampleRateIndex: 4,
+	ChannelConfig:   2,
+}
+
+// aacPES returns a PES packet of one ADTS frame filled with marker.
+func aacPES(pts time.Duration, marker byte) []byte {
+	return aacPESSize(pts, marker, 16)
+}
+
+func aacPESSize(pts time.Duration, marker byte, size int) []byte {
+	frame := make([]byte, aacparser.ADTSHeaderLength+size)
+	aacparser.FillADTSHeader(frame, testAACConfig, 1024, size)
+	for i := aacparser.ADTSHeaderLength; i < len(frame); i++ {
+		frame[i] = marker
+	}
+	h := make([]byte, tsio.MaxPESHeaderLength)
+	n := tsio.FillPESHeader(h, tsio.StreamIdAAC, len(frame), pts, 0)
+	return append(h[:n], frame...)
+}
+
+// readMarkers reads all packets and returns the marker of each.
+func readMarkers(t *testing.T, demuxer *Demuxer) (markers []byte) {
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		markers = append(markers, pkt.Data[0])
+	}
+}
+
+func TestDemuxerSharedSections(t *testing.T) {
+	w := newTSBuilder()
+	w.data(tsio.PAT_PID, patSection(
+		tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: 0x1000},
+		tsio.PATEntry{ProgramNumber: 2, ProgramMapPID: 0x1000},
+		tsio.PATEntry{ProgramNumber: 3, ProgramMapPID: 0x1000},
+	))
+	// the PMT of program 1 spans two packets, the ones of program 2 and 3
+	// follow it in the second one
+	pmt1 := pmtSection(1, 0, 0x100, 0x101, 0x102, 0x103, 0x104, 0x105, 0x106, 0x107, 0x108, 0x109,
+		0x10a, 0x10b, 0x10c, 0x10d, 0x10e, 0x10f, 0x110, 0x111, 0x112, 0x113, 0x114, 0x115, 0x116, 0x117,
+		0x118, 0x119, 0x11a, 0x11b, 0x11c, 0x11d, 0x11e, 0x11f, 0x120, 0x121, 0x122, 0x123, 0x124, 0x125)
+	pmt2 := pmtSection(2, 0, 0x200)[1:]
+	pmt3 := pmtSection(3, 0, 0x300)[1:]
+	w.packet(0x1000, true, pmt1[:184])
+	rest := pmt1[184:]
+	payload := append([]byte{uint8(len(rest))}, rest...)
+	payload = append(payload, pmt2...)
+	payload = append(payload, pmt3...)
+	w.packet(0x1000, true, payload)
+
+	programs, err := NewDemuxer(bytes.NewReader(w.Bytes())).Programs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(programs) != 3 || len(programs[0].Streams) != 38 || programs[1].Streams[0].PID != 0x200 || programs[2].Streams[0].PID != 0x300 {
+		t.Errorf("got programs %+v", programs)
+	}
+}
+
+func TestDemuxerPATCRC(t *testing.T) {
+	w := newTSBuilder()
+	w.data(tsio.PAT_PID, patSection(tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: 0x1000}))
+	pat := patSection(tsio.PATEntry{ProgramNumber: 2, ProgramMapPID: 0x1001})
+	pat[len(pat)-1] ^= 0xff
+	w.data(tsio.PAT_PID, pat)
+	w.data(0x1000, pmtSection(1, 0, 0x100))
+
+	programs, err := NewDemuxer(bytes.NewReader(w.Bytes())).Programs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(programs) != 1 || programs[0].Number != 1 {
+		t.Errorf("got programs %+v", programs)
+	}
+}
+
+func TestDemuxerProgramSelection(t *testing.T) {
+	w := newTSBuilder()
+	w.data(tsio.PAT_PID, patSection(
+		tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: 0x1000},
+		tsio.PATEntry{ProgramNumber: 2, ProgramMapPID: 0x1001},
+	))
+	w.data(0x1000, pmtSection(1, 0, 0x100))
+	w.data(0x1001, pmtSection(2, 0, 0x101))
+	for i := 0; i < 3; i++ {
+		w.data(0x100, aacPES(time.Duration(i+1)*time.Second, 1))
+		w.data(0x101, aacPES(time.Duration(i+1)*time.Second, 2))
+	}
+
+	for _, c := range []struct {
+		number, pmtpid uint16
+		marker         byte
+	}{
+		{0, 0, 1},
+		{2, 0, 2},
+		{0, 0x1000, 1},
+		{1, 0x1001, 2},
+	} {
+		demuxer := NewDemuxer(bytes.NewReader(w.Bytes()))
+		demuxer.ProgramNumber = c.number
+		demuxer.PMTPID = c.pmtpid
+		markers := readMarkers(t, demuxer)
+		if !bytes.Equal(markers, []byte{c.marker, c.marker, c.marker}) {
+			t.Errorf("program %d pmt pid %d: got %v", c.number, c.pmtpid, markers)
+		}
+	}
+
+	demuxer := NewDemuxer(bytes.NewReader(w.Bytes()))
+	demuxer.ProgramNumber = 3
+	if _, err := demuxer.Streams(); err == nil {
+		t.Error("missing program selected")
+	}
+}
+
+func TestDemuxerPMTUpdate(t *testing.T) {
+	w := newTSBuilder()
+	w.data(tsio.PAT_PID, patSection(tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: 0x1000}))
+	w.data(0x1000, pmtSection(1, 0, 0x100))
+	w.data(0x100, aacPES(time.Second, 1))
+	w.data(0x100, aacPES(2*time.Second, 1))
+	// repeated PMT of the same version changes nothing
+	w.data(0x1000, pmtSection(1, 0, 0x100))
+	w.data(0x100, aacPES(3*time.Second, 1))
+	// the audio moves to another pid and a second track is added
+	w.data(0x1000, pmtSection(1, 1, 0x101, 0x102))
+	w.data(0x101, aacPES(4*time.Second, 2))
+	w.data(0x102, aacPES(4*time.Second, 3))
+	w.data(0x101, aacPES(5*time.Second, 2))
+
+	demuxer := NewDemuxer(bytes.NewReader(w.Bytes()))
+	streams, err := demuxer.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 {
+		t.Fatalf("got %d streams", len(streams))
+	}
+	var markers []byte
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == ErrStreamsChanged {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		markers = append(markers, pkt.Data[0])
+	}
+	if !bytes.Equal(markers, []byte{1, 1, 1}) {
+		t.Errorf("got %v before the change", markers)
+	}
+
+	if streams, err = demuxer.Streams(); err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 {
+		t.Fatalf("got %d streams after the change", len(streams))
+	}
+	if markers = readMarkers(t, demuxer); !bytes.Equal(markers, []byte{2, 2, 3}) {
+		t.Errorf("got %v after the change", markers)
+	}
+}
+
+func TestDemuxerErrorRecovery(t *testing.T) {
+	w := newTSBuilder()
+	w.data(tsio.PAT_PID, patSection(tsio.PATEntry{ProgramNumber: 1, ProgramMapPID: 0x1000}))
+	w.data(0x1000, pmtSection(1, 0, 0x100))
+	// PES packets of two TS packets each
+	pes := func(i int) []byte {
+		return aacPESSize(time.Duration(i+1)*time.Second, byte(i), 300)
+	}
+	w.data(0x100, pes(0))
+
+	// a lost packet damages the PES packet it belongs to
+	b := pes(1)
+	w.packet(0x100, true, b[:184])
+	w.cc[0x100]++
+	w.data(0x100, pes(2))
+
+	// duplicate packets are skipped
+	w.data(0x100, pes(3))
+	w.Write(w.Bytes()[w.Len()-188:])
+
+	// junk between packets
+	w.Write([]byte{0, 1, 0x47, 2, 3})
+	w.data(0x100, pes(4))
+
+	// a broken PES header
+	b = pes(5)
+	b[2] = 2
+	w.data(0x100, b)
+	w.data(0x100, pes(6))
+
+	// a broken ADTS header
+	b = pes(7)
+	b[14] = 0
+	w.data(0x100, b)
+
+	// the transport error indicator
+	b = pes(8)
+	w.packet(0x100, true, b[:184])
+	w.packet(0x100, false, b[184:])
+	w.Bytes()[w.Len()-188+1] |= 0x80
+
+	// a PAT with a wrong CRC
+	pat := patSection(tsio.PATEntry{ProgramNumber: 2, ProgramMapPID: 0x1001})
+	pat[len(pat)-1] ^= 0xff
+	w.data(tsio.PAT_PID, pat)
+	w.data(0x100, pes(9))
+
+	var errs []string
+	demuxer := NewDemuxer(bytes.NewReader(w.Bytes()))
+	demuxer.OnError = func(pid uint16, err error, stats Stats) {
+		errs = append(errs, fmt.Sprintf("%#x: %s", pid, err))
+	}
+	markers := readMarkers(t, demuxer)
+	if !bytes.Equal(markers, []byte{0, 2, 3, 4, 6, 9}) {
+		t.Errorf("got packets %v", markers)
+	}
+	want := Stats{
+		Packets:          int64(w.Len() / 188),
+		SyncLosses:       1,
+		TransportErrors:  1,
+		ContinuityErrors: 2,
+		DamagedPES:       4,
+	}
+	if stats := demuxer.Stats(); stats != want {
+		t.Errorf("got stats %+v, want %+v", stats, want)
+	}
+	wanterrs := []string{
+		"0x100: " + ErrContinuity.Error(),
+		"0x100: " + ErrDamagedPES.Error(),
+		"0x1fff: " + ErrSyncLost.Error(),
+		"0x100: " + tsio.ErrPESHeader.Error(),
+		"0x100: aacparser: not adts header",
+		"0x100: " + ErrTransportError.Error(),
+		"0x0: ts: PAT CRC invalid",
+		// the counter of the packet with the error is unknown
+		"0x100: " + ErrContinuity.Error(),
+		"0x100: " + ErrDamagedPES.Error(),
+	}
+	if fmt.Sprint(errs) != fmt.Sprint(wanterrs) {
+		t.Errorf("got errors\n%s\nwant\n%s", errs, wanterrs)
+	}
+}
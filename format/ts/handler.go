@@ -21,6 +21,32 @@ func Handler(h *avutil.RegisterHandler) {
 		return NewMuxer(w)
 	}
 
+	h.UrlDemuxer = func(uri string) (ok bool, demuxer av.DemuxCloser, err error) {
+		if _, ok = udpURL(uri); !ok {
+			return
+		}
+		var d *Demuxer
+		var r *UDPReader
+		if d, r, err = OpenUDP(uri); err != nil {
+			return
+		}
+		demuxer = udpDemuxer{Demuxer: d, r: r}
+		return
+	}
+
+	h.UrlMuxer = func(uri string) (ok bool, muxer av.MuxCloser, err error) {
+		if _, ok = udpURL(uri); !ok {
+			return
+		}
+		var m *Muxer
+		var w *UDPWriter
+		if m, w, err = CreateUDP(uri); err != nil {
+			return
+		}
+		muxer = udpMuxer{Muxer: m, w: w}
+		return
+	}
+
 	h.CodecTypes = CodecTypes
 }
 
@@ -1,22 +1,51 @@
 package ts
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/aacparser"
 	"github.com/nareix/joy4/codec/h264parser"
 	"github.com/nareix/joy4/format/ts/tsio"
+	"github.com/nareix/joy4/utils/bits/pio"
 	"io"
 	"time"
 )
 
 var CodecTypes = []av.CodecType{av.H264, av.AAC}
 
+const NullPID = 0x1fff
+
 type Muxer struct {
 	w                        io.Writer
 	streams                  []*Stream
 	PaddingToMakeCounterCont bool
 
+	// PIDs are used for the streams in WriteHeader order, by default 0x100, 0x101...
+	PIDs   []uint16
+	PMTPID uint16 // default tsio.PMT_PID
+	// PCRPID carries the PCR, by default the first video stream or else the
+	// first stream. A PID not used by any stream gets PCR only packets.
+	PCRPID uint16
+	// SCTE35PID lists a SCTE-35 stream in the PMT for WriteSpliceInfo.
+	SCTE35PID uint16
+
+	// ServiceName and ServiceProvider make the muxer write a DVB SDT
+	// together with PAT/PMT.
+	ServiceName     string
+	ServiceProvider string
+
+	// Setting PCRInterval or MuxRate enables the PCR-accurate mode: PCR is
+	// written every PCRInterval (default 40ms) at the PCR PID only, PAT/PMT
+	// are repeated every PSIInterval (default 100ms), and PES timestamps lead
+	// the PCR by MuxDelay (default 700ms).
+	PCRInterval time.Duration
+	PSIInterval time.Duration
+	MuxDelay    time.Duration
+	// MuxRate in bits per second makes the output constant bitrate: PCR is
+	// derived from the byte position and null packets fill the gaps.
+	MuxRate int
+
 	psidata []byte
 	peshdr  []byte
 	tshdr   []byte
@@ -25,6 +54,22 @@ type Muxer struct {
 	nalus   [][]byte
 
 	tswpat, tswpmt *tsio.TSWriter
+	tswscte35      *tsio.TSWriter
+	tswsdt         *tsio.TSWriter
+	sdtdata        []byte
+	pcrpid         uint16
+
+	accurate  bool
+	stagebuf  *bytes.Buffer
+	pktbuf    []byte
+	gotpkt    bool
+	nbytes    int64
+	clockbase time.Duration
+	clocknow  time.Duration
+	lastpcr   time.Duration
+	lastpsi   time.Duration
+	nullcc    uint8
+	pcrcc     uint8
 }
 
 func NewMuxer(w io.Writer) *Muxer {
@@ -55,6 +100,9 @@ func (self *Muxer) newStream(codec av.CodecData) (err error) {
 	}
 
 	pid := uint16(len(self.streams) + 0x100)
+	if i := len(self.streams); i < len(self.PIDs) {
+		pid = self.PIDs[i]
+	}
 	stream := &Stream{
 		muxer:     self,
 		CodecData: codec,
@@ -65,13 +113,22 @@ func (self *Muxer) newStream(codec av.CodecData) (err error) {
 	return
 }
 
+// out is where TS packets go, in the PCR-accurate mode they are staged and
+// written one by one by flushStage.
+func (self *Muxer) out() io.Writer {
+	if self.accurate {
+		return self.stagebuf
+	}
+	return self.w
+}
+
 func (self *Muxer) writePaddingTSPackets(tsw *tsio.TSWriter) (err error) {
 	for tsw.ContinuityCounter&0xf != 0x0 {
-		if err = tsw.WritePackets(self.w, self.datav[:0], 0, false, true); err != nil {
+		if err = tsw.WritePackets(self.out(), self.datav[:0], 0, false, true); err != nil {
 			return
 		}
 	}
-	return
+	return self.flushStage()
 }
 
 func (self *Muxer) WriteTrailer() (err error) {
@@ -91,15 +148,22 @@ func (self *Muxer) SetWriter(w io.Writer) {
 }
 
 func (self *Muxer) WritePATPMT() (err error) {
+	if err = self.writePATPMT(self.out()); err != nil {
+		return
+	}
+	return self.flushStage()
+}
+
+func (self *Muxer) writePATPMT(w io.Writer) (err error) {
 	pat := tsio.PAT{
 		Entries: []tsio.PATEntry{
-			{ProgramNumber: 1, ProgramMapPID: tsio.PMT_PID},
+			{ProgramNumber: 1, ProgramMapPID: self.tswpmt.PID()},
 		},
 	}
 	patlen := pat.Marshal(self.psidata[tsio.PSIHeaderLength:])
 	n := tsio.FillPSI(self.psidata, tsio.TableIdPAT, tsio.TableExtPAT, patlen)
 	self.datav[0] = self.psidata[:n]
-	if err = self.tswpat.WritePackets(self.w, self.datav[:1], 0, false, true); err != nil {
+	if err = self.tswpat.WritePackets(w, self.datav[:1], 0, false, true); err != nil {
 		return
 	}
 
@@ -120,9 +184,17 @@ func (self *Muxer) WritePATPMT() (err error) {
 	}
 
 	pmt := tsio.PMT{
-		PCRPID:                0x100,
+		PCRPID:                self.pcrpid,
 		ElementaryStreamInfos: elemStreams,
 	}
+	if self.tswscte35 != nil {
+		// registration_descriptor with format_identifier CUEI
+		pmt.ProgramDescriptors = append(pmt.ProgramDescriptors, tsio.Descriptor{Tag: 0x05, Data: []byte("CUEI")})
+		pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos, tsio.ElementaryStreamInfo{
+			StreamType:    tsio.ElementaryStreamTypeSCTE35,
+			ElementaryPID: self.tswscte35.PID(),
+		})
+	}
 	pmtlen := pmt.Len()
 	if pmtlen+tsio.PSIHeaderLength > len(self.psidata) {
 		err = fmt.Errorf("ts: pmt too large")
@@ -131,13 +203,50 @@ func (self *Muxer) WritePATPMT() (err error) {
 	pmt.Marshal(self.psidata[tsio.PSIHeaderLength:])
 	n = tsio.FillPSI(self.psidata, tsio.TableIdPMT, tsio.TableExtPMT, pmtlen)
 	self.datav[0] = self.psidata[:n]
-	if err = self.tswpmt.WritePackets(self.w, self.datav[:1], 0, false, true); err != nil {
+	if err = self.tswpmt.WritePackets(w, self.datav[:1], 0, false, true); err != nil {
 		return
 	}
 
+	if self.tswsdt != nil {
+		self.datav[0] = self.sdtdata
+		if err = self.tswsdt.WritePackets(w, self.datav[:1], 0, false, true); err != nil {
+			return
+		}
+	}
+
 	return
 }
 
+func (self *Muxer) initSDT() {
+	servicetype := uint8(tsio.ServiceTypeDigitalRadio)
+	for _, stream := range self.streams {
+		if stream.Type().IsVideo() {
+			servicetype = tsio.ServiceTypeDigitalTV
+			break
+		}
+	}
+	desc := tsio.ServiceDescriptor{
+		ServiceType:  servicetype,
+		ProviderName: self.ServiceProvider,
+		ServiceName:  self.ServiceName,
+	}
+	sdt := tsio.SDT{
+		OriginalNetworkId: 1,
+		Services: []tsio.SDTService{
+			{
+				ServiceId:     1,
+				RunningStatus: tsio.RunningStatusRunning,
+				Descriptors:   []tsio.Descriptor{desc.Descriptor()},
+			},
+		},
+	}
+	sdtlen := sdt.Len()
+	self.sdtdata = make([]byte, tsio.PSIHeaderLength+sdtlen+4)
+	sdt.Marshal(self.sdtdata[tsio.PSIHeaderLength:])
+	tsio.FillPSI(self.sdtdata, tsio.TableIdSDTActual, tsio.TableExtPAT, sdtlen)
+	self.tswsdt = tsio.NewTSWriter(tsio.SDT_PID)
+}
+
 func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	self.streams = []*Stream{}
 	for _, stream := range streams {
@@ -146,16 +255,196 @@ func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 		}
 	}
 
+	if self.PMTPID != 0 {
+		self.tswpmt = tsio.NewTSWriter(self.PMTPID)
+	}
+	if self.SCTE35PID != 0 {
+		self.tswscte35 = tsio.NewTSWriter(self.SCTE35PID)
+	}
+	if self.ServiceName != "" || self.ServiceProvider != "" {
+		self.initSDT()
+	}
+	self.pcrpid = self.PCRPID
+	if self.pcrpid == 0 && len(self.streams) > 0 {
+		self.pcrpid = self.streams[0].pid
+		for _, stream := range self.streams {
+			if stream.Type().IsVideo() {
+				self.pcrpid = stream.pid
+				break
+			}
+		}
+	}
+
+	if self.PCRInterval > 0 || self.MuxRate > 0 {
+		self.accurate = true
+		if self.PCRInterval == 0 {
+			self.PCRInterval = time.Millisecond * 40
+		}
+		if self.PSIInterval == 0 {
+			self.PSIInterval = time.Millisecond * 100
+		}
+		if self.MuxDelay == 0 {
+			self.MuxDelay = time.Millisecond * 700
+		}
+		self.stagebuf = &bytes.Buffer{}
+		self.pktbuf = make([]byte, 188)
+		// PAT/PMT go out with the first packet once the clock is known
+		return
+	}
+
 	if err = self.WritePATPMT(); err != nil {
 		return
 	}
 	return
 }
 
+// WriteSpliceInfo writes a SCTE-35 section on SCTE35PID. Splice times are
+// in the time base of packets given to WritePacket.
+func (self *Muxer) WriteSpliceInfo(info tsio.SpliceInfo) (err error) {
+	if self.tswscte35 == nil {
+		err = fmt.Errorf("ts: SCTE35PID not set")
+		return
+	}
+	// WritePacket shifts timestamps by one second
+	info.PTSAdjustment += time.Second
+	b := make([]byte, 1+info.Len())
+	n := 1 + info.Marshal(b[1:])
+	self.datav[0] = b[:n]
+	if err = self.tswscte35.WritePackets(self.out(), self.datav[:1], 0, false, true); err != nil {
+		return
+	}
+	return self.flushStage()
+}
+
+// clock returns the PCR value of the next TS packet.
+func (self *Muxer) clock() time.Duration {
+	if self.MuxRate > 0 {
+		return self.clockbase + time.Duration(self.nbytes*8)*time.Second/time.Duration(self.MuxRate)
+	}
+	return self.clocknow
+}
+
+func (self *Muxer) emit(b []byte) (err error) {
+	if _, err = self.w.Write(b); err != nil {
+		return
+	}
+	self.nbytes += int64(len(b))
+	if pio.U16BE(b[1:3])&0x1fff == self.pcrpid && b[3]&0x10 != 0 {
+		self.pcrcc = b[3] & 0xf
+	}
+	return
+}
+
+// emitDue writes PAT/PMT and PCR packets when their interval has passed.
+func (self *Muxer) emitDue() (err error) {
+	if self.clock()-self.lastpsi >= self.PSIInterval {
+		self.lastpsi = self.clock()
+		b := &bytes.Buffer{}
+		if err = self.writePATPMT(b); err != nil {
+			return
+		}
+		for data := b.Bytes(); len(data) >= 188; data = data[188:] {
+			if err = self.emit(data[:188]); err != nil {
+				return
+			}
+		}
+	}
+
+	if self.clock()-self.lastpcr >= self.PCRInterval {
+		pcr := self.clock()
+		self.lastpcr = pcr
+
+		// adaptation field only, the continuity counter does not advance
+		b := self.pktbuf
+		b[0] = 0x47
+		pio.PutU16BE(b[1:3], self.pcrpid&0x1fff)
+		b[3] = 0x20 | self.pcrcc
+		b[4] = 183
+		b[5] = 0x10 // PCR flag
+		pio.PutU48BE(b[6:12], tsio.TimeToPCR(pcr))
+		for i := 12; i < 188; i++ {
+			b[i] = 0xff
+		}
+		if err = self.emit(b); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *Muxer) emitNull() (err error) {
+	b := self.pktbuf
+	b[0] = 0x47
+	pio.PutU16BE(b[1:3], NullPID)
+	b[3] = 0x10 | self.nullcc&0xf
+	self.nullcc++
+	for i := 4; i < 188; i++ {
+		b[i] = 0xff
+	}
+	return self.emit(b)
+}
+
+// flushStage writes the staged TS packets, putting PAT/PMT and PCR
+// packets in between when they are due.
+func (self *Muxer) flushStage() (err error) {
+	if !self.accurate || !self.gotpkt {
+		return
+	}
+	data := self.stagebuf.Bytes()
+	for ; len(data) >= 188; data = data[188:] {
+		if err = self.emitDue(); err != nil {
+			return
+		}
+		if err = self.emit(data[:188]); err != nil {
+			return
+		}
+	}
+	self.stagebuf.Reset()
+	return
+}
+
+// advanceClock moves the mux clock up to the time the PES with dts has to
+// start being sent, stuffing null packets in the CBR mode.
+func (self *Muxer) advanceClock(dts time.Duration) (err error) {
+	target := dts - self.MuxDelay
+	if !self.gotpkt {
+		self.gotpkt = true
+		self.clockbase = target
+		self.clocknow = target
+		self.lastpcr = target - self.PCRInterval
+		self.lastpsi = target - self.PSIInterval
+		self.pcrcc = 0xf
+	}
+	if self.MuxRate > 0 {
+		for self.clock() < target {
+			if err = self.emitDue(); err != nil {
+				return
+			}
+			if self.clock() >= target {
+				break
+			}
+			if err = self.emitNull(); err != nil {
+				return
+			}
+		}
+	} else if target > self.clocknow {
+		self.clocknow = target
+	}
+	return
+}
+
 func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 	stream := self.streams[pkt.Idx]
 	pkt.Time += time.Second
 
+	pcr := pkt.Time
+	if self.accurate {
+		pcr = 0
+		if err = self.advanceClock(pkt.Time); err != nil {
+			return
+		}
+	}
+
 	switch stream.Type() {
 	case av.AAC:
 		codec := stream.CodecData.(aacparser.CodecData)
@@ -166,7 +455,7 @@ func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 		self.datav[1] = self.adtshdr
 		self.datav[2] = pkt.Data
 
-		if err = stream.tsw.WritePackets(self.w, self.datav[:3], pkt.Time, true, false); err != nil {
+		if err = stream.tsw.WritePackets(self.out(), self.datav[:3], pcr, true, false); err != nil {
 			return
 		}
 
@@ -196,10 +485,13 @@ func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
 		n := tsio.FillPESHeader(self.peshdr, tsio.StreamIdH264, -1, pkt.Time+pkt.CompositionTime, pkt.Time)
 		datav[0] = self.peshdr[:n]
 
-		if err = stream.tsw.WritePackets(self.w, datav, pkt.Time, pkt.IsKeyFrame, false); err != nil {
+		if err = stream.tsw.WritePackets(self.out(), datav, pcr, pkt.IsKeyFrame, false); err != nil {
 			return
 		}
 	}
 
+	if err = self.flushStage(); err != nil {
+		return
+	}
 	return
 }
@@ -1,5 +1,7 @@
 package tsio
 
+import "github.com/nareix/joy4/utils/bits/pio"
+
 var ieeeCrc32Tbl = []uint32{
 	0x00000000, 0xB71DC104, 0x6E3B8209, 0xD926430D, 0xDC760413, 0x6B6BC517,
 	0xB24D861A, 0x0550471E, 0xB8ED0826, 0x0FF0C922, 0xD6D68A2F, 0x61CB4B2B,
@@ -53,3 +55,28 @@ func calcCRC32(crc uint32, data []byte) uint32 {
 	return crc
 }
 
+
+// CheckPSICRC verifies CRC_32 of a section parsed by ParsePSI, h starts
+// with the pointer field.
+func CheckPSICRC(h []byte, hdrlen int, datalen int) bool {
+	// table_id is followed by 7 bytes of header
+	start, end := hdrlen-8, hdrlen+datalen
+	if start < 0 || len(h) < end+4 {
+		return false
+	}
+	return calcCRC32(0xffffffff, h[start:end]) == pio.U32LE(h[end:])
+}
+
+// PutCRC32 writes the MPEG-2 CRC_32 of data to b.
+func PutCRC32(b []byte, data []byte) {
+	pio.PutU32LE(b, calcCRC32(0xffffffff, data))
+}
+
+// CheckCRC32 reports whether the last 4 bytes of b are the MPEG-2 CRC_32 of
+// the bytes before them.
+func CheckCRC32(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	return calcCRC32(0xffffffff, b[:len(b)-4]) == pio.U32LE(b[len(b)-4:])
+}
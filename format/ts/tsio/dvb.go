@@ -0,0 +1,514 @@
+package tsio
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// DVB service information, ETSI EN 300 468.
+
+const (
+	NIT_PID = 0x10
+	SDT_PID = 0x11
+	EIT_PID = 0x12
+)
+
+const (
+	TableIdNITActual = 0x40
+	TableIdNITOther  = 0x41
+	TableIdSDTActual = 0x42
+	TableIdSDTOther  = 0x46
+	TableIdEITActual = 0x4e // present/following
+	TableIdEITOther  = 0x4f // present/following
+)
+
+const (
+	NetworkNameDescriptorTag = 0x40
+	ServiceDescriptorTag     = 0x48
+	ShortEventDescriptorTag  = 0x4d
+)
+
+const (
+	ServiceTypeDigitalTV    = 0x01
+	ServiceTypeDigitalRadio = 0x02
+)
+
+const (
+	RunningStatusUndefined  = 0
+	RunningStatusNotRunning = 1
+	RunningStatusStartsSoon = 2
+	RunningStatusPausing    = 3
+	RunningStatusRunning    = 4
+)
+
+var ErrParseSDT = fmt.Errorf("invalid SDT")
+var ErrParseNIT = fmt.Errorf("invalid NIT")
+var ErrParseEIT = fmt.Errorf("invalid EIT")
+var ErrParseDescriptor = fmt.Errorf("invalid descriptor")
+
+func descsLen(descs []Descriptor) (n int) {
+	for _, desc := range descs {
+		n += 2 + len(desc.Data)
+	}
+	return
+}
+
+// dvbString strips the character table selector of a DVB text, the rest is
+// returned as is.
+func dvbString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	switch {
+	case b[0] == 0x10:
+		if len(b) < 3 {
+			return ""
+		}
+		b = b[3:]
+	case b[0] == 0x1f:
+		if len(b) < 2 {
+			return ""
+		}
+		b = b[2:]
+	case b[0] < 0x20:
+		b = b[1:]
+	}
+	return string(b)
+}
+
+// dvbText encodes a DVB text, non ASCII strings are marked as UTF-8.
+func dvbText(s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 && utf8.ValidString(s) {
+			return append([]byte{0x15}, s...)
+		}
+	}
+	return []byte(s)
+}
+
+// ServiceDescriptor is service_descriptor of a SDT service.
+type ServiceDescriptor struct {
+	ServiceType  uint8
+	ProviderName string
+	ServiceName  string
+}
+
+func (self ServiceDescriptor) Descriptor() Descriptor {
+	provider := dvbText(self.ProviderName)
+	name := dvbText(self.ServiceName)
+	b := make([]byte, 0, 3+len(provider)+len(name))
+	b = append(b, self.ServiceType, byte(len(provider)))
+	b = append(b, provider...)
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	return Descriptor{Tag: ServiceDescriptorTag, Data: b}
+}
+
+func ParseServiceDescriptor(desc Descriptor) (self ServiceDescriptor, err error) {
+	b := desc.Data
+	if desc.Tag != ServiceDescriptorTag || len(b) < 2 {
+		err = ErrParseDescriptor
+		return
+	}
+	self.ServiceType = b[0]
+	n := 2 + int(b[1])
+	if len(b) < n+1 || len(b) < n+1+int(b[n]) {
+		err = ErrParseDescriptor
+		return
+	}
+	self.ProviderName = dvbString(b[2:n])
+	self.ServiceName = dvbString(b[n+1 : n+1+int(b[n])])
+	return
+}
+
+// ShortEventDescriptor is short_event_descriptor of an EIT event.
+type ShortEventDescriptor struct {
+	Language  string // ISO 639-2 code
+	EventName string
+	Text      string
+}
+
+func (self ShortEventDescriptor) Descriptor() Descriptor {
+	name := dvbText(self.EventName)
+	text := dvbText(self.Text)
+	b := make([]byte, 3, 5+len(name)+len(text))
+	copy(b, self.Language)
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	b = append(b, byte(len(text)))
+	b = append(b, text...)
+	return Descriptor{Tag: ShortEventDescriptorTag, Data: b}
+}
+
+func ParseShortEventDescriptor(desc Descriptor) (self ShortEventDescriptor, err error) {
+	b := desc.Data
+	if desc.Tag != ShortEventDescriptorTag || len(b) < 4 {
+		err = ErrParseDescriptor
+		return
+	}
+	self.Language = string(b[0:3])
+	n := 4 + int(b[3])
+	if len(b) < n+1 || len(b) < n+1+int(b[n]) {
+		err = ErrParseDescriptor
+		return
+	}
+	self.EventName = dvbString(b[4:n])
+	self.Text = dvbString(b[n+1 : n+1+int(b[n])])
+	return
+}
+
+func NetworkNameDescriptor(name string) Descriptor {
+	return Descriptor{Tag: NetworkNameDescriptorTag, Data: dvbText(name)}
+}
+
+func ParseNetworkNameDescriptor(desc Descriptor) (name string, err error) {
+	if desc.Tag != NetworkNameDescriptorTag {
+		err = ErrParseDescriptor
+		return
+	}
+	name = dvbString(desc.Data)
+	return
+}
+
+type SDTService struct {
+	ServiceId           uint16
+	EITSchedule         bool
+	EITPresentFollowing bool
+	RunningStatus       uint8
+	FreeCAMode          bool
+	Descriptors         []Descriptor
+}
+
+// SDT is the service description section data, the table id extension is
+// transport_stream_id.
+type SDT struct {
+	OriginalNetworkId uint16
+	Services          []SDTService
+}
+
+func (self SDT) Len() (n int) {
+	// original_network_id(16) reserved(8)
+	n += 3
+	for _, service := range self.Services {
+		// service_id(16) flags(8) running_status(3) free_CA_mode(1) descriptors_loop_length(12)
+		n += 5
+		n += descsLen(service.Descriptors)
+	}
+	return
+}
+
+func (self SDT) Marshal(b []byte) (n int) {
+	pio.PutU16BE(b[n:], self.OriginalNetworkId)
+	n += 2
+	b[n] = 0xff
+	n++
+
+	for _, service := range self.Services {
+		pio.PutU16BE(b[n:], service.ServiceId)
+		n += 2
+		// reserved(6) EIT_schedule_flag(1) EIT_present_following_flag(1)
+		flags := uint8(0xfc)
+		if service.EITSchedule {
+			flags |= 2
+		}
+		if service.EITPresentFollowing {
+			flags |= 1
+		}
+		b[n] = flags
+		n++
+		v := uint16(service.RunningStatus&7)<<13 | uint16(descsLen(service.Descriptors))&0xfff
+		if service.FreeCAMode {
+			v |= 1 << 12
+		}
+		pio.PutU16BE(b[n:], v)
+		n += 2
+		n += fillDescs(b[n:], service.Descriptors)
+	}
+	return
+}
+
+func (self *SDT) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 3 {
+		err = ErrParseSDT
+		return
+	}
+	self.OriginalNetworkId = pio.U16BE(b[n:])
+	n += 3
+
+	for n < len(b) {
+		if len(b) < n+5 {
+			err = ErrParseSDT
+			return
+		}
+		var service SDTService
+		service.ServiceId = pio.U16BE(b[n:])
+		n += 2
+		service.EITSchedule = b[n]&2 != 0
+		service.EITPresentFollowing = b[n]&1 != 0
+		n++
+		v := pio.U16BE(b[n:])
+		service.RunningStatus = uint8(v >> 13)
+		service.FreeCAMode = v&(1<<12) != 0
+		desclen := int(v & 0xfff)
+		n += 2
+		if len(b) < n+desclen {
+			err = ErrParseSDT
+			return
+		}
+		if service.Descriptors, err = parseDescs(b[n : n+desclen]); err != nil {
+			err = ErrParseSDT
+			return
+		}
+		n += desclen
+		self.Services = append(self.Services, service)
+	}
+	return
+}
+
+type NITTransport struct {
+	TransportStreamId uint16
+	OriginalNetworkId uint16
+	Descriptors       []Descriptor
+}
+
+// NIT is the network information section data, the table id extension is
+// network_id.
+type NIT struct {
+	NetworkDescriptors []Descriptor
+	Transports         []NITTransport
+}
+
+func (self NIT) Len() (n int) {
+	// reserved(4) network_descriptors_length(12)
+	n += 2
+	n += descsLen(self.NetworkDescriptors)
+	// reserved(4) transport_stream_loop_length(12)
+	n += 2
+	for _, ts := range self.Transports {
+		// transport_stream_id(16) original_network_id(16) reserved(4) transport_descriptors_length(12)
+		n += 6
+		n += descsLen(ts.Descriptors)
+	}
+	return
+}
+
+func (self NIT) Marshal(b []byte) (n int) {
+	pio.PutU16BE(b[n:], 0xf000|uint16(descsLen(self.NetworkDescriptors))&0xfff)
+	n += 2
+	n += fillDescs(b[n:], self.NetworkDescriptors)
+
+	hold := n
+	n += 2
+	pos := n
+	for _, ts := range self.Transports {
+		pio.PutU16BE(b[n:], ts.TransportStreamId)
+		n += 2
+		pio.PutU16BE(b[n:], ts.OriginalNetworkId)
+		n += 2
+		pio.PutU16BE(b[n:], 0xf000|uint16(descsLen(ts.Descriptors))&0xfff)
+		n += 2
+		n += fillDescs(b[n:], ts.Descriptors)
+	}
+	pio.PutU16BE(b[hold:], 0xf000|uint16(n-pos)&0xfff)
+	return
+}
+
+func (self *NIT) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 2 {
+		err = ErrParseNIT
+		return
+	}
+	desclen := int(pio.U16BE(b[n:]) & 0xfff)
+	n += 2
+	if len(b) < n+desclen+2 {
+		err = ErrParseNIT
+		return
+	}
+	if self.NetworkDescriptors, err = parseDescs(b[n : n+desclen]); err != nil {
+		err = ErrParseNIT
+		return
+	}
+	n += desclen
+
+	looplen := int(pio.U16BE(b[n:]) & 0xfff)
+	n += 2
+	if len(b) < n+looplen {
+		err = ErrParseNIT
+		return
+	}
+	end := n + looplen
+	for n < end {
+		if end < n+6 {
+			err = ErrParseNIT
+			return
+		}
+		var ts NITTransport
+		ts.TransportStreamId = pio.U16BE(b[n:])
+		n += 2
+		ts.OriginalNetworkId = pio.U16BE(b[n:])
+		n += 2
+		desclen := int(pio.U16BE(b[n:]) & 0xfff)
+		n += 2
+		if end < n+desclen {
+			err = ErrParseNIT
+			return
+		}
+		if ts.Descriptors, err = parseDescs(b[n : n+desclen]); err != nil {
+			err = ErrParseNIT
+			return
+		}
+		n += desclen
+		self.Transports = append(self.Transports, ts)
+	}
+	return
+}
+
+type EITEvent struct {
+	EventId       uint16
+	StartTime     time.Time // UTC, zero if undefined
+	Duration      time.Duration
+	RunningStatus uint8
+	FreeCAMode    bool
+	Descriptors   []Descriptor
+}
+
+// EIT is the event information section data, the table id extension is
+// service_id.
+type EIT struct {
+	TransportStreamId        uint16
+	OriginalNetworkId        uint16
+	SegmentLastSectionNumber uint8
+	LastTableId              uint8
+	Events                   []EITEvent
+}
+
+func bcd(v int) byte {
+	return byte(v/10<<4 | v%10)
+}
+
+func unbcd(b byte) int {
+	return int(b>>4)*10 + int(b&0xf)
+}
+
+func putBCDDuration(b []byte, dur time.Duration) {
+	secs := int(dur / time.Second)
+	b[0] = bcd(secs / 3600 % 100)
+	b[1] = bcd(secs / 60 % 60)
+	b[2] = bcd(secs % 60)
+}
+
+func bcdDuration(b []byte) time.Duration {
+	secs := unbcd(b[0])*3600 + unbcd(b[1])*60 + unbcd(b[2])
+	return time.Duration(secs) * time.Second
+}
+
+// putMJDTime writes a 40 bit Modified Julian Date and BCD UTC time.
+func putMJDTime(b []byte, tm time.Time) {
+	if tm.IsZero() {
+		for i := 0; i < 5; i++ {
+			b[i] = 0xff
+		}
+		return
+	}
+	secs := tm.Unix()
+	// MJD 40587 is 1970-01-01
+	pio.PutU16BE(b, uint16(secs/86400+40587))
+	putBCDDuration(b[2:], time.Duration(secs%86400)*time.Second)
+}
+
+func mjdTime(b []byte) time.Time {
+	if pio.U32BE(b) == 0xffffffff && b[4] == 0xff {
+		return time.Time{}
+	}
+	days := int64(pio.U16BE(b)) - 40587
+	return time.Unix(days*86400, 0).Add(bcdDuration(b[2:])).UTC()
+}
+
+func (self EIT) Len() (n int) {
+	// transport_stream_id(16) original_network_id(16)
+	// segment_last_section_number(8) last_table_id(8)
+	n += 6
+	for _, event := range self.Events {
+		// event_id(16) start_time(40) duration(24)
+		// running_status(3) free_CA_mode(1) descriptors_loop_length(12)
+		n += 12
+		n += descsLen(event.Descriptors)
+	}
+	return
+}
+
+func (self EIT) Marshal(b []byte) (n int) {
+	pio.PutU16BE(b[n:], self.TransportStreamId)
+	n += 2
+	pio.PutU16BE(b[n:], self.OriginalNetworkId)
+	n += 2
+	b[n] = self.SegmentLastSectionNumber
+	n++
+	b[n] = self.LastTableId
+	n++
+
+	for _, event := range self.Events {
+		pio.PutU16BE(b[n:], event.EventId)
+		n += 2
+		putMJDTime(b[n:], event.StartTime)
+		n += 5
+		putBCDDuration(b[n:], event.Duration)
+		n += 3
+		v := uint16(event.RunningStatus&7)<<13 | uint16(descsLen(event.Descriptors))&0xfff
+		if event.FreeCAMode {
+			v |= 1 << 12
+		}
+		pio.PutU16BE(b[n:], v)
+		n += 2
+		n += fillDescs(b[n:], event.Descriptors)
+	}
+	return
+}
+
+func (self *EIT) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 6 {
+		err = ErrParseEIT
+		return
+	}
+	self.TransportStreamId = pio.U16BE(b[n:])
+	n += 2
+	self.OriginalNetworkId = pio.U16BE(b[n:])
+	n += 2
+	self.SegmentLastSectionNumber = b[n]
+	n++
+	self.LastTableId = b[n]
+	n++
+
+	for n < len(b) {
+		if len(b) < n+12 {
+			err = ErrParseEIT
+			return
+		}
+		var event EITEvent
+		event.EventId = pio.U16BE(b[n:])
+		n += 2
+		event.StartTime = mjdTime(b[n:])
+		n += 5
+		event.Duration = bcdDuration(b[n:])
+		n += 3
+		v := pio.U16BE(b[n:])
+		event.RunningStatus = uint8(v >> 13)
+		event.FreeCAMode = v&(1<<12) != 0
+		desclen := int(v & 0xfff)
+		n += 2
+		if len(b) < n+desclen {
+			err = ErrParseEIT
+			return
+		}
+		if event.Descriptors, err = parseDescs(b[n : n+desclen]); err != nil {
+			err = ErrParseEIT
+			return
+		}
+		n += desclen
+		self.Events = append(self.Events, event)
+	}
+	return
+}
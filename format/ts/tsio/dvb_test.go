@@ -0,0 +1,128 @@
+package tsio
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSDTRoundTrip(t *testing.T) {
+	sdt := SDT{
+		OriginalNetworkId: 0x233a,
+		Services: []SDTService{
+			{
+				ServiceId:           1,
+				EITPresentFollowing: true,
+				RunningStatus:       RunningStatusRunning,
+				Descriptors: []Descriptor{ServiceDescriptor{
+					ServiceType:  ServiceTypeDigitalTV,
+					ProviderName: "joy4",
+					ServiceName:  "Ünïcode TV",
+				}.Descriptor()},
+			},
+			{
+				ServiceId:     2,
+				EITSchedule:   true,
+				RunningStatus: RunningStatusNotRunning,
+				FreeCAMode:    true,
+			},
+		},
+	}
+	b := make([]byte, sdt.Len())
+	if n := sdt.Marshal(b); n != len(b) {
+		t.Errorf("marshaled %d of %d bytes", n, len(b))
+	}
+	got := SDT{}
+	if _, err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Services) == 2 && got.Services[1].Descriptors == nil {
+		got.Services[1].Descriptors = sdt.Services[1].Descriptors
+	}
+	if !reflect.DeepEqual(got, sdt) {
+		t.Errorf("got %+v", got)
+	}
+	sd, err := ParseServiceDescriptor(got.Services[0].Descriptors[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.ServiceName != "Ünïcode TV" || sd.ProviderName != "joy4" || sd.ServiceType != ServiceTypeDigitalTV {
+		t.Errorf("got %+v", sd)
+	}
+}
+
+func TestNITRoundTrip(t *testing.T) {
+	nit := NIT{
+		NetworkDescriptors: []Descriptor{NetworkNameDescriptor("joy4 network")},
+		Transports: []NITTransport{
+			{TransportStreamId: 1, OriginalNetworkId: 0x233a, Descriptors: []Descriptor{{Tag: 0x41, Data: []byte{0, 1, 1}}}},
+			{TransportStreamId: 2, OriginalNetworkId: 0x233a},
+		},
+	}
+	b := make([]byte, nit.Len())
+	if n := nit.Marshal(b); n != len(b) {
+		t.Errorf("marshaled %d of %d bytes", n, len(b))
+	}
+	got := NIT{}
+	if _, err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Transports) == 2 && got.Transports[1].Descriptors == nil {
+		got.Transports[1].Descriptors = nit.Transports[1].Descriptors
+	}
+	if !reflect.DeepEqual(got, nit) {
+		t.Errorf("got %+v", got)
+	}
+	if name, err := ParseNetworkNameDescriptor(got.NetworkDescriptors[0]); err != nil || name != "joy4 network" {
+		t.Errorf("got network name %q %v", name, err)
+	}
+}
+
+func TestEITRoundTrip(t *testing.T) {
+	eit := EIT{
+		TransportStreamId:        1,
+		OriginalNetworkId:        0x233a,
+		SegmentLastSectionNumber: 1,
+		LastTableId:              TableIdEITActual,
+		Events: []EITEvent{
+			{
+				EventId:       100,
+				StartTime:     time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC),
+				Duration:      time.Hour + 30*time.Minute,
+				RunningStatus: RunningStatusRunning,
+				Descriptors: []Descriptor{ShortEventDescriptor{
+					Language:  "eng",
+					EventName: "News",
+					Text:      "The news of the day",
+				}.Descriptor()},
+			},
+			{
+				EventId:       101,
+				Duration:      45 * time.Minute,
+				RunningStatus: RunningStatusUndefined,
+				FreeCAMode:    true,
+			},
+		},
+	}
+	b := make([]byte, eit.Len())
+	if n := eit.Marshal(b); n != len(b) {
+		t.Errorf("marshaled %d of %d bytes", n, len(b))
+	}
+	got := EIT{}
+	if _, err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Events) == 2 && got.Events[1].Descriptors == nil {
+		got.Events[1].Descriptors = eit.Events[1].Descriptors
+	}
+	if !reflect.DeepEqual(got, eit) {
+		t.Errorf("got %+v", got)
+	}
+	se, err := ParseShortEventDescriptor(got.Events[0].Descriptors[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if se != (ShortEventDescriptor{Language: "eng", EventName: "News", Text: "The news of the day"}) {
+		t.Errorf("got %+v", se)
+	}
+}
@@ -0,0 +1,766 @@
+package tsio
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// SCTE-35 splice information, see ANSI/SCTE 35.
+
+const (
+	ElementaryStreamTypeSCTE35 = 0x86
+	TableIdSCTE35              = 0xfc
+)
+
+const (
+	SpliceNull                 = 0x00
+	SpliceSchedule             = 0x04
+	SpliceInsertCommand        = 0x05
+	TimeSignalCommand          = 0x06
+	BandwidthReservation       = 0x07
+	SplicePrivateCommand       = 0xff
+	SegmentationDescriptorTag  = 0x02
+	SpliceDescriptorIdentifier = 0x43554549 // CUEI
+)
+
+// Segmentation type ids of segmentation_descriptor.
+const (
+	SegmentationProgramStart              = 0x10
+	SegmentationProgramEnd                = 0x11
+	SegmentationChapterStart              = 0x20
+	SegmentationChapterEnd                = 0x21
+	SegmentationBreakStart                = 0x22
+	SegmentationBreakEnd                  = 0x23
+	SegmentationProviderAdStart           = 0x30
+	SegmentationProviderAdEnd             = 0x31
+	SegmentationDistributorAdStart        = 0x32
+	SegmentationDistributorAdEnd          = 0x33
+	SegmentationProviderPlacementStart    = 0x34
+	SegmentationProviderPlacementEnd      = 0x35
+	SegmentationDistributorPlacementStart = 0x36
+	SegmentationDistributorPlacementEnd   = 0x37
+	SegmentationProviderOverlayStart      = 0x38
+	SegmentationProviderOverlayEnd        = 0x39
+	SegmentationDistributorOverlayStart   = 0x3a
+	SegmentationDistributorOverlayEnd     = 0x3b
+	SegmentationProviderPromoStart        = 0x44
+	SegmentationProviderPromoEnd          = 0x45
+	SegmentationDistributorPromoStart     = 0x46
+	SegmentationDistributorPromoEnd       = 0x47
+)
+
+var ErrParseSCTE35 = fmt.Errorf("invalid SCTE-35 section")
+
+const pts33Mask = 1<<33 - 1
+
+func ptsToTime(ts uint64) time.Duration {
+	return time.Duration(ts&pts33Mask) * time.Second / PTS_HZ
+}
+
+// timeToPTS rounds, so times from ptsToTime give back the same PTS.
+func timeToPTS(tm time.Duration) uint64 {
+	return uint64((tm*PTS_HZ+time.Second/2)/time.Second) & pts33Mask
+}
+
+// SpliceTime is splice_time(), PTS is only valid when Specified.
+type SpliceTime struct {
+	Specified bool
+	PTS       time.Duration
+}
+
+func (self SpliceTime) len() int {
+	if self.Specified {
+		return 5
+	}
+	return 1
+}
+
+func (self SpliceTime) marshal(b []byte) (n int) {
+	if self.Specified {
+		pts := timeToPTS(self.PTS)
+		b[0] = 0x80 | 0x7e | byte(pts>>32)&1
+		pio.PutU32BE(b[1:], uint32(pts))
+		return 5
+	}
+	b[0] = 0x7f
+	return 1
+}
+
+func (self *SpliceTime) unmarshal(b []byte) (n int, err error) {
+	if len(b) < 1 {
+		err = ErrParseSCTE35
+		return
+	}
+	self.Specified = b[0]&0x80 != 0
+	if !self.Specified {
+		return 1, nil
+	}
+	if len(b) < 5 {
+		err = ErrParseSCTE35
+		return
+	}
+	self.PTS = ptsToTime(uint64(b[0]&1)<<32 | uint64(pio.U32BE(b[1:])))
+	return 5, nil
+}
+
+type SpliceComponent struct {
+	Tag        uint8
+	SpliceTime SpliceTime
+}
+
+// SpliceInsert is the splice_insert() command.
+type SpliceInsert struct {
+	EventId         uint32
+	CancelIndicator bool
+	OutOfNetwork    bool
+	ProgramSplice   bool
+	SpliceImmediate bool
+	SpliceTime      SpliceTime // with ProgramSplice and not SpliceImmediate
+	Components      []SpliceComponent
+	HasDuration     bool
+	AutoReturn      bool
+	BreakDuration   time.Duration
+	UniqueProgramId uint16
+	AvailNum        uint8
+	AvailsExpected  uint8
+}
+
+func (self SpliceInsert) Len() (n int) {
+	n += 5
+	if self.CancelIndicator {
+		return
+	}
+	n++
+	if self.ProgramSplice {
+		if !self.SpliceImmediate {
+			n += self.SpliceTime.len()
+		}
+	} else {
+		n++
+		for _, c := range self.Components {
+			n++
+			if !self.SpliceImmediate {
+				n += c.SpliceTime.len()
+			}
+		}
+	}
+	if self.HasDuration {
+		n += 5
+	}
+	n += 4
+	return
+}
+
+func (self SpliceInsert) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[n:], self.EventId)
+	n += 4
+	b[n] = 0x7f
+	if self.CancelIndicator {
+		b[n] |= 0x80
+		n++
+		return
+	}
+	n++
+
+	b[n] = 0x0f
+	if self.OutOfNetwork {
+		b[n] |= 0x80
+	}
+	if self.ProgramSplice {
+		b[n] |= 0x40
+	}
+	if self.HasDuration {
+		b[n] |= 0x20
+	}
+	if self.SpliceImmediate {
+		b[n] |= 0x10
+	}
+	n++
+
+	if self.ProgramSplice {
+		if !self.SpliceImmediate {
+			n += self.SpliceTime.marshal(b[n:])
+		}
+	} else {
+		b[n] = byte(len(self.Components))
+		n++
+		for _, c := range self.Components {
+			b[n] = c.Tag
+			n++
+			if !self.SpliceImmediate {
+				n += c.SpliceTime.marshal(b[n:])
+			}
+		}
+	}
+
+	if self.HasDuration {
+		n += marshalBreakDuration(b[n:], self.AutoReturn, self.BreakDuration)
+	}
+
+	pio.PutU16BE(b[n:], self.UniqueProgramId)
+	n += 2
+	b[n] = self.AvailNum
+	n++
+	b[n] = self.AvailsExpected
+	n++
+	return
+}
+
+func (self *SpliceInsert) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 5 {
+		err = ErrParseSCTE35
+		return
+	}
+	self.EventId = pio.U32BE(b[n:])
+	n += 4
+	self.CancelIndicator = b[n]&0x80 != 0
+	n++
+	if self.CancelIndicator {
+		return
+	}
+
+	if len(b) < n+1 {
+		err = ErrParseSCTE35
+		return
+	}
+	flags := b[n]
+	n++
+	self.OutOfNetwork = flags&0x80 != 0
+	self.ProgramSplice = flags&0x40 != 0
+	self.HasDuration = flags&0x20 != 0
+	self.SpliceImmediate = flags&0x10 != 0
+
+	var i int
+	if self.ProgramSplice {
+		if !self.SpliceImmediate {
+			if i, err = self.SpliceTime.unmarshal(b[n:]); err != nil {
+				return
+			}
+			n += i
+		}
+	} else {
+		if len(b) < n+1 {
+			err = ErrParseSCTE35
+			return
+		}
+		count := int(b[n])
+		n++
+		for j := 0; j < count; j++ {
+			if len(b) < n+1 {
+				err = ErrParseSCTE35
+				return
+			}
+			c := SpliceComponent{Tag: b[n]}
+			n++
+			if !self.SpliceImmediate {
+				if i, err = c.SpliceTime.unmarshal(b[n:]); err != nil {
+					return
+				}
+				n += i
+			}
+			self.Components = append(self.Components, c)
+		}
+	}
+
+	if self.HasDuration {
+		if len(b) < n+5 {
+			err = ErrParseSCTE35
+			return
+		}
+		self.AutoReturn, self.BreakDuration = unmarshalBreakDuration(b[n:])
+		n += 5
+	}
+
+	if len(b) < n+4 {
+		err = ErrParseSCTE35
+		return
+	}
+	self.UniqueProgramId = pio.U16BE(b[n:])
+	n += 2
+	self.AvailNum = b[n]
+	n++
+	self.AvailsExpected = b[n]
+	n++
+	return
+}
+
+func marshalBreakDuration(b []byte, autoreturn bool, dur time.Duration) int {
+	ts := timeToPTS(dur)
+	b[0] = 0x7e | byte(ts>>32)&1
+	if autoreturn {
+		b[0] |= 0x80
+	}
+	pio.PutU32BE(b[1:], uint32(ts))
+	return 5
+}
+
+func unmarshalBreakDuration(b []byte) (autoreturn bool, dur time.Duration) {
+	autoreturn = b[0]&0x80 != 0
+	dur = ptsToTime(uint64(b[0]&1)<<32 | uint64(pio.U32BE(b[1:])))
+	return
+}
+
+type SegmentationComponent struct {
+	Tag       uint8
+	PTSOffset time.Duration
+}
+
+// SegmentationDescriptor is segmentation_descriptor() of a splice_info_section.
+type SegmentationDescriptor struct {
+	EventId               uint32
+	CancelIndicator       bool
+	ProgramSegmentation   bool
+	HasDuration           bool
+	DeliveryNotRestricted bool
+	WebDeliveryAllowed    bool
+	NoRegionalBlackout    bool
+	ArchiveAllowed        bool
+	DeviceRestrictions    uint8
+	Components            []SegmentationComponent
+	Duration              time.Duration
+	UPIDType              uint8
+	UPID                  []byte
+	TypeId                uint8
+	SegmentNum            uint8
+	SegmentsExpected      uint8
+	HasSubSegments        bool
+	SubSegmentNum         uint8
+	SubSegmentsExpected   uint8
+}
+
+func segmentationHasSubSegments(typeid uint8) bool {
+	switch typeid {
+	case SegmentationProviderPlacementStart, SegmentationDistributorPlacementStart,
+		SegmentationProviderOverlayStart, SegmentationDistributorOverlayStart,
+		SegmentationProviderPromoStart, SegmentationDistributorPromoStart:
+		return true
+	}
+	return false
+}
+
+// Len returns the length of the descriptor data after splice_descriptor_tag
+// and descriptor_length.
+func (self SegmentationDescriptor) Len() (n int) {
+	n += 4 // identifier
+	n += 4 + 1
+	if self.CancelIndicator {
+		return
+	}
+	n++
+	if !self.ProgramSegmentation {
+		n += 1 + 6*len(self.Components)
+	}
+	if self.HasDuration {
+		n += 5
+	}
+	n += 2 + len(self.UPID)
+	n += 3
+	if self.HasSubSegments {
+		n += 2
+	}
+	return
+}
+
+func (self SegmentationDescriptor) Marshal(b []byte) (n int) {
+	pio.PutU32BE(b[n:], SpliceDescriptorIdentifier)
+	n += 4
+	pio.PutU32BE(b[n:], self.EventId)
+	n += 4
+	b[n] = 0x7f
+	if self.CancelIndicator {
+		b[n] |= 0x80
+		n++
+		return
+	}
+	n++
+
+	var flags byte
+	if self.ProgramSegmentation {
+		flags |= 0x80
+	}
+	if self.HasDuration {
+		flags |= 0x40
+	}
+	if self.DeliveryNotRestricted {
+		flags |= 0x20 | 0x1f
+	} else {
+		if self.WebDeliveryAllowed {
+			flags |= 0x10
+		}
+		if self.NoRegionalBlackout {
+			flags |= 0x08
+		}
+		if self.ArchiveAllowed {
+			flags |= 0x04
+		}
+		flags |= self.DeviceRestrictions & 0x3
+	}
+	b[n] = flags
+	n++
+
+	if !self.ProgramSegmentation {
+		b[n] = byte(len(self.Components))
+		n++
+		for _, c := range self.Components {
+			b[n] = c.Tag
+			n++
+			ts := timeToPTS(c.PTSOffset)
+			b[n] = 0xfe | byte(ts>>32)&1
+			pio.PutU32BE(b[n+1:], uint32(ts))
+			n += 5
+		}
+	}
+
+	if self.HasDuration {
+		ts := uint64(self.Duration * PTS_HZ / time.Second)
+		b[n] = byte(ts >> 32)
+		pio.PutU32BE(b[n+1:], uint32(ts))
+		n += 5
+	}
+
+	b[n] = self.UPIDType
+	n++
+	b[n] = byte(len(self.UPID))
+	n++
+	n += copy(b[n:], self.UPID)
+
+	b[n] = self.TypeId
+	n++
+	b[n] = self.SegmentNum
+	n++
+	b[n] = self.SegmentsExpected
+	n++
+	if self.HasSubSegments {
+		b[n] = self.SubSegmentNum
+		n++
+		b[n] = self.SubSegmentsExpected
+		n++
+	}
+	return
+}
+
+func (self *SegmentationDescriptor) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 9 {
+		err = ErrParseSCTE35
+		return
+	}
+	n += 4 // identifier
+	self.EventId = pio.U32BE(b[n:])
+	n += 4
+	self.CancelIndicator = b[n]&0x80 != 0
+	n++
+	if self.CancelIndicator {
+		return
+	}
+
+	if len(b) < n+1 {
+		err = ErrParseSCTE35
+		return
+	}
+	flags := b[n]
+	n++
+	self.ProgramSegmentation = flags&0x80 != 0
+	self.HasDuration = flags&0x40 != 0
+	self.DeliveryNotRestricted = flags&0x20 != 0
+	if !self.DeliveryNotRestricted {
+		self.WebDeliveryAllowed = flags&0x10 != 0
+		self.NoRegionalBlackout = flags&0x08 != 0
+		self.ArchiveAllowed = flags&0x04 != 0
+		self.DeviceRestrictions = flags & 0x3
+	}
+
+	if !self.ProgramSegmentation {
+		if len(b) < n+1 {
+			err = ErrParseSCTE35
+			return
+		}
+		count := int(b[n])
+		n++
+		if len(b) < n+6*count {
+			err = ErrParseSCTE35
+			return
+		}
+		for i := 0; i < count; i++ {
+			c := SegmentationComponent{Tag: b[n]}
+			c.PTSOffset = ptsToTime(uint64(b[n+1]&1)<<32 | uint64(pio.U32BE(b[n+2:])))
+			self.Components = append(self.Components, c)
+			n += 6
+		}
+	}
+
+	if self.HasDuration {
+		if len(b) < n+5 {
+			err = ErrParseSCTE35
+			return
+		}
+		ts := uint64(b[n])<<32 | uint64(pio.U32BE(b[n+1:]))
+		self.Duration = time.Duration(ts) * time.Second / PTS_HZ
+		n += 5
+	}
+
+	if len(b) < n+2 {
+		err = ErrParseSCTE35
+		return
+	}
+	self.UPIDType = b[n]
+	upidlen := int(b[n+1])
+	n += 2
+	if len(b) < n+upidlen+3 {
+		err = ErrParseSCTE35
+		return
+	}
+	self.UPID = append([]byte{}, b[n:n+upidlen]...)
+	n += upidlen
+
+	self.TypeId = b[n]
+	self.SegmentNum = b[n+1]
+	self.SegmentsExpected = b[n+2]
+	n += 3
+	if segmentationHasSubSegments(self.TypeId) && len(b) >= n+2 {
+		self.HasSubSegments = true
+		self.SubSegmentNum = b[n]
+		self.SubSegmentsExpected = b[n+1]
+		n += 2
+	}
+	return
+}
+
+// SpliceDescriptor is a splice descriptor other than segmentation_descriptor,
+// Data follows the identifier.
+type SpliceDescriptor struct {
+	Tag        uint8
+	Identifier uint32
+	Data       []byte
+}
+
+// SpliceInfo is a splice_info_section. Insert or TimeSignal is set according
+// to CommandType, Command holds the raw bytes of other commands.
+type SpliceInfo struct {
+	ProtocolVersion uint8
+	PTSAdjustment   time.Duration
+	CWIndex         uint8
+	Tier            uint16
+	CommandType     uint8
+	Insert          *SpliceInsert
+	TimeSignal      *SpliceTime
+	Command         []byte
+
+	SegmentationDescriptors []SegmentationDescriptor
+	Descriptors             []SpliceDescriptor
+}
+
+// SplicePTS returns the splice time of the command with PTSAdjustment applied.
+func (self SpliceInfo) SplicePTS() (pts time.Duration, ok bool) {
+	var st SpliceTime
+	switch {
+	case self.Insert != nil && self.Insert.ProgramSplice && !self.Insert.SpliceImmediate:
+		st = self.Insert.SpliceTime
+	case self.Insert != nil && len(self.Insert.Components) > 0 && !self.Insert.SpliceImmediate:
+		st = self.Insert.Components[0].SpliceTime
+	case self.TimeSignal != nil:
+		st = *self.TimeSignal
+	}
+	if !st.Specified {
+		return
+	}
+	pts = ptsToTime(timeToPTS(st.PTS) + timeToPTS(self.PTSAdjustment))
+	ok = true
+	return
+}
+
+func (self SpliceInfo) commandLen() int {
+	switch {
+	case self.Insert != nil:
+		return self.Insert.Len()
+	case self.TimeSignal != nil:
+		return self.TimeSignal.len()
+	}
+	return len(self.Command)
+}
+
+// Len returns the length of the whole section including table_id and CRC_32.
+func (self SpliceInfo) Len() (n int) {
+	n += 3 + 11
+	n += self.commandLen()
+	n += 2
+	for _, desc := range self.SegmentationDescriptors {
+		n += 2 + desc.Len()
+	}
+	for _, desc := range self.Descriptors {
+		n += 2 + 4 + len(desc.Data)
+	}
+	n += 4
+	return
+}
+
+func (self SpliceInfo) Marshal(b []byte) (n int) {
+	total := self.Len()
+
+	b[n] = TableIdSCTE35
+	n++
+	// section_syntax_indicator(1)=0 private_indicator(1)=0 sap_type(2)=3 section_length(12)
+	pio.PutU16BE(b[n:], 0x3000|uint16(total-3)&0xfff)
+	n += 2
+	b[n] = self.ProtocolVersion
+	n++
+
+	// encrypted_packet(1)=0 encryption_algorithm(6)=0 pts_adjustment(33)
+	adj := timeToPTS(self.PTSAdjustment)
+	b[n] = byte(adj>>32) & 1
+	pio.PutU32BE(b[n+1:], uint32(adj))
+	n += 5
+	b[n] = self.CWIndex
+	n++
+
+	cmdlen := self.commandLen()
+	// tier(12) splice_command_length(12)
+	pio.PutU24BE(b[n:], uint32(self.Tier&0xfff)<<12|uint32(cmdlen&0xfff))
+	n += 3
+
+	switch {
+	case self.Insert != nil:
+		b[n] = SpliceInsertCommand
+		n++
+		n += self.Insert.Marshal(b[n:])
+	case self.TimeSignal != nil:
+		b[n] = TimeSignalCommand
+		n++
+		n += self.TimeSignal.marshal(b[n:])
+	default:
+		b[n] = self.CommandType
+		n++
+		n += copy(b[n:], self.Command)
+	}
+
+	desclenpos := n
+	n += 2
+	for _, desc := range self.SegmentationDescriptors {
+		b[n] = SegmentationDescriptorTag
+		b[n+1] = byte(desc.Len())
+		n += 2
+		n += desc.Marshal(b[n:])
+	}
+	for _, desc := range self.Descriptors {
+		b[n] = desc.Tag
+		b[n+1] = byte(4 + len(desc.Data))
+		n += 2
+		pio.PutU32BE(b[n:], desc.Identifier)
+		n += 4
+		n += copy(b[n:], desc.Data)
+	}
+	pio.PutU16BE(b[desclenpos:], uint16(n-desclenpos-2))
+
+	PutCRC32(b[n:], b[:n])
+	n += 4
+	return
+}
+
+// Unmarshal parses a whole splice_info_section starting at table_id.
+func (self *SpliceInfo) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 3 || b[0] != TableIdSCTE35 {
+		err = ErrParseSCTE35
+		return
+	}
+	seclen := int(pio.U16BE(b[1:]) & 0xfff)
+	if len(b) < 3+seclen || seclen < 11+2+4 {
+		err = ErrParseSCTE35
+		return
+	}
+	b = b[:3+seclen]
+	if !CheckCRC32(b) {
+		err = fmt.Errorf("SCTE-35 section CRC invalid")
+		return
+	}
+	n += 3
+
+	self.ProtocolVersion = b[n]
+	n++
+	if b[n]&0x80 != 0 {
+		err = fmt.Errorf("encrypted SCTE-35 section not supported")
+		return
+	}
+	self.PTSAdjustment = ptsToTime(uint64(b[n]&1)<<32 | uint64(pio.U32BE(b[n+1:])))
+	n += 5
+	self.CWIndex = b[n]
+	n++
+	v := pio.U24BE(b[n:])
+	self.Tier = uint16(v >> 12)
+	cmdlen := int(v & 0xfff)
+	n += 3
+	self.CommandType = b[n]
+	n++
+
+	end := len(b) - 4
+	if cmdlen == 0xfff {
+		// legacy value meaning the length is unknown
+		cmdlen = -1
+	} else if n+cmdlen > end {
+		err = ErrParseSCTE35
+		return
+	}
+	cmd := b[n:end]
+	if cmdlen >= 0 {
+		cmd = b[n : n+cmdlen]
+	}
+
+	var i int
+	switch self.CommandType {
+	case SpliceInsertCommand:
+		self.Insert = &SpliceInsert{}
+		if i, err = self.Insert.Unmarshal(cmd); err != nil {
+			return
+		}
+	case TimeSignalCommand:
+		self.TimeSignal = &SpliceTime{}
+		if i, err = self.TimeSignal.unmarshal(cmd); err != nil {
+			return
+		}
+	case SpliceNull:
+	default:
+		i = len(cmd)
+		self.Command = append([]byte{}, cmd...)
+	}
+	if cmdlen >= 0 {
+		i = cmdlen
+	}
+	n += i
+
+	if n+2 > end {
+		err = ErrParseSCTE35
+		return
+	}
+	desclen := int(pio.U16BE(b[n:]))
+	n += 2
+	if n+desclen > end {
+		err = ErrParseSCTE35
+		return
+	}
+	descs := b[n : n+desclen]
+	for len(descs) >= 2 {
+		tag := descs[0]
+		length := int(descs[1])
+		if len(descs) < 2+length || length < 4 {
+			err = ErrParseSCTE35
+			return
+		}
+		data := descs[2 : 2+length]
+		if tag == SegmentationDescriptorTag && pio.U32BE(data) == SpliceDescriptorIdentifier {
+			var desc SegmentationDescriptor
+			if _, err = desc.Unmarshal(data); err != nil {
+				return
+			}
+			self.SegmentationDescriptors = append(self.SegmentationDescriptors, desc)
+		} else {
+			self.Descriptors = append(self.Descriptors, SpliceDescriptor{
+				Tag:        tag,
+				Identifier: pio.U32BE(data),
+				Data:       append([]byte{}, data[4:]...),
+			})
+		}
+		descs = descs[2+length:]
+	}
+	n = len(b)
+	return
+}
@@ -0,0 +1,117 @@
+package tsio
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpliceInfoSample(t *testing.T) {
+	// splice_insert sample of ANSI/SCTE 35
+	b, _ := base64.StdEncoding.DecodeString("/DAvAAAAAAAA///wFAVIAACPf+/+c2nALv4AUsz1AAAAAAAKAAhDVUVJAAABNWLbowo=")
+	info := &SpliceInfo{}
+	n, err := info.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) {
+		t.Errorf("parsed %d of %d bytes", n, len(b))
+	}
+	insert := info.Insert
+	if info.CommandType != SpliceInsertCommand || insert == nil {
+		t.Fatalf("got %+v", info)
+	}
+	if insert.EventId != 0x4800008f || !insert.OutOfNetwork || !insert.ProgramSplice || !insert.HasDuration || !insert.AutoReturn {
+		t.Errorf("got %+v", insert)
+	}
+	if timeToPTS(insert.SpliceTime.PTS) != 0x07369c02e || timeToPTS(insert.BreakDuration) != 0x00052ccf5 {
+		t.Errorf("got splice time %v duration %v", insert.SpliceTime.PTS, insert.BreakDuration)
+	}
+	if len(info.Descriptors) != 1 || info.Descriptors[0].Identifier != SpliceDescriptorIdentifier || !bytes.Equal(info.Descriptors[0].Data, []byte{0, 0, 1, 0x35}) {
+		t.Errorf("got descriptors %+v", info.Descriptors)
+	}
+
+	out := make([]byte, info.Len())
+	if n = info.Marshal(out); n != len(out) || !bytes.Equal(out, b) {
+		t.Errorf("marshaled % x", out[:n])
+	}
+
+	b[len(b)-1] ^= 0xff
+	if _, err = (&SpliceInfo{}).Unmarshal(b); err == nil {
+		t.Error("wrong CRC accepted")
+	}
+}
+
+func TestSpliceInfoRoundTrip(t *testing.T) {
+	for _, info := range []SpliceInfo{
+		{
+			CommandType: SpliceInsertCommand,
+			Tier:        0xfff,
+			Insert: &SpliceInsert{
+				EventId:         7,
+				OutOfNetwork:    true,
+				ProgramSplice:   true,
+				SpliceTime:      SpliceTime{Specified: true, PTS: 10 * time.Second},
+				HasDuration:     true,
+				AutoReturn:      true,
+				BreakDuration:   30 * time.Second,
+				UniqueProgramId: 1,
+				AvailNum:        1,
+				AvailsExpected:  2,
+			},
+		},
+		{
+			CommandType: SpliceInsertCommand,
+			Tier:        0xfff,
+			Insert: &SpliceInsert{
+				EventId:         8,
+				SpliceImmediate: true,
+				Components:      []SpliceComponent{{Tag: 1}, {Tag: 2}},
+			},
+		},
+		{
+			CommandType:   TimeSignalCommand,
+			PTSAdjustment: time.Second,
+			Tier:          0xfff,
+			TimeSignal:    &SpliceTime{Specified: true, PTS: 20 * time.Second},
+			SegmentationDescriptors: []SegmentationDescriptor{{
+				EventId:               9,
+				ProgramSegmentation:   true,
+				HasDuration:           true,
+				DeliveryNotRestricted: true,
+				Duration:              60 * time.Second,
+				UPIDType:              0x09,
+				UPID:                  []byte("SIGNAL:1"),
+				TypeId:                SegmentationProviderPlacementStart,
+				SegmentNum:            1,
+				SegmentsExpected:      2,
+				HasSubSegments:        true,
+				SubSegmentNum:         1,
+				SubSegmentsExpected:   4,
+			}},
+		},
+		{
+			CommandType: SpliceNull,
+			Tier:        0xfff,
+		},
+	} {
+		b := make([]byte, info.Len())
+		if n := info.Marshal(b); n != len(b) {
+			t.Errorf("marshaled %d of %d bytes", n, len(b))
+		}
+		got := SpliceInfo{}
+		n, err := got.Unmarshal(b)
+		if err != nil {
+			t.Errorf("command %d: %s", info.CommandType, err)
+			continue
+		}
+		if n != len(b) || !reflect.DeepEqual(got, info) {
+			t.Errorf("command %d: got %+v", info.CommandType, got)
+		}
+		if pts, ok := got.SplicePTS(); info.TimeSignal != nil && (!ok || pts != 21*time.Second) {
+			t.Errorf("got splice PTS %v %v", pts, ok)
+		}
+	}
+}
@@ -140,7 +140,7 @@ func (self PMT) Len() (n int) {
 	return
 }
 
-func (self PMT) fillDescs(b []byte, descs []Descriptor) (n int) {
+func fillDescs(b []byte, descs []Descriptor) (n int) {
 	for _, desc := range descs {
 		b[n] = desc.Tag
 		n++
@@ -161,7 +161,7 @@ func (self PMT) Marshal(b []byte) (n int) {
 	hold := n
 	n += 2
 	pos := n
-	n += self.fillDescs(b[n:], self.ProgramDescriptors)
+	n += fillDescs(b[n:], self.ProgramDescriptors)
 	desclen := n-pos
 	pio.PutU16BE(b[hold:], uint16(desclen)|0xf<<12)
 
@@ -177,7 +177,7 @@ func (self PMT) Marshal(b []byte) (n int) {
 		hold := n
 		n += 2
 		pos := n
-		n += self.fillDescs(b[n:], info.Descriptors)
+		n += fillDescs(b[n:], info.Descriptors)
 		desclen := n-pos
 		pio.PutU16BE(b[hold:], uint16(desclen)|0x3c<<10)
 	}
@@ -185,7 +185,7 @@ func (self PMT) Marshal(b []byte) (n int) {
 	return
 }
 
-func (self PMT) parseDescs(b []byte) (descs []Descriptor, err error) {
+func parseDescs(b []byte) (descs []Descriptor, err error) {
 	n := 0
 	for n < len(b) {
 		if n+2 <= len(b) {
@@ -193,7 +193,7 @@ func (self PMT) parseDescs(b []byte) (descs []Descriptor, err error) {
 			desc.Tag = b[n]
 			desc.Data = make([]byte, b[n+1])
 			n += 2
-			if n+len(desc.Data) < len(b) {
+			if n+len(desc.Data) <= len(b) {
 				copy(desc.Data, b[n:])
 				descs = append(descs, desc)
 				n += len(desc.Data)
@@ -233,7 +233,7 @@ func (self *PMT) Unmarshal(b []byte) (n int, err error) {
 			err = ErrParsePMT
 			return
 		}
-		if self.ProgramDescriptors, err = self.parseDescs(b[n:n+desclen]); err != nil {
+		if self.ProgramDescriptors, err = parseDescs(b[n:n+desclen]); err != nil {
 			return
 		}
 		n += desclen
@@ -264,7 +264,7 @@ func (self *PMT) Unmarshal(b []byte) (n int, err error) {
 				err = ErrParsePMT
 				return
 			}
-			if info.Descriptors, err = self.parseDescs(b[n:n+desclen]); err != nil {
+			if info.Descriptors, err = parseDescs(b[n:n+desclen]); err != nil {
 				return
 			}
 			n += desclen
@@ -277,6 +277,12 @@ func (self *PMT) Unmarshal(b []byte) (n int, err error) {
 }
 
 func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int, err error) {
+	tableid, tableext, _, _, hdrlen, datalen, err = ParsePSIVersion(h)
+	return
+}
+
+// ParsePSIVersion is ParsePSI also returning version_number and current_next_indicator.
+func ParsePSIVersion(h []byte) (tableid uint8, tableext uint16, version uint8, current bool, hdrlen int, datalen int, err error) {
 	if len(h) < 8 {
 		err = ErrPSIHeader
 		return
@@ -302,8 +308,8 @@ func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int
 	tableid = h[hdrlen]
 	hdrlen++
 
-	// section_syntax_indicator(1)=1,private_bit(1)=0,reserved(2)=3,unused(2)=0,section_length(10)
-	datalen = int(pio.U16BE(h[hdrlen:]))&0x3ff - 9
+	// section_syntax_indicator(1)=1,private_bit(1),reserved(2)=3,section_length(12)
+	datalen = int(pio.U16BE(h[hdrlen:]))&0xfff - 9
 	hdrlen += 2
 
 	if datalen < 0 {
@@ -318,6 +324,8 @@ func ParsePSI(h []byte) (tableid uint8, tableext uint16, hdrlen int, datalen int
 	// resverd(2)=3
 	// version(5)
 	// Current_next_indicator(1)
+	version = (h[hdrlen]>>1)&0x1f
+	current = h[hdrlen]&1 != 0
 	hdrlen++
 
 	// section_number(8)
@@ -410,7 +418,7 @@ const (
 )
 
 func ParsePESHeader(h []byte) (hdrlen int, streamid uint8, datalen int, pts, dts time.Duration, err error) {
-	if h[0] != 0 || h[1] != 0 || h[2] != 1 {
+	if len(h) < 9 || h[0] != 0 || h[1] != 0 || h[2] != 1 {
 		err = ErrPESHeader
 		return
 	}
@@ -515,6 +523,10 @@ func NewTSWriter(pid uint16) *TSWriter {
 	return w
 }
 
+func (self *TSWriter) PID() uint16 {
+	return pio.U16BE(self.tshdr[1:3])&0x1fff
+}
+
 func (self *TSWriter) WritePackets(w io.Writer, datav [][]byte, pcr time.Duration, sync bool, paddata bool) (err error) {
 	datavlen := pio.VecLen(datav)
 	writev := make([][]byte, len(datav))
@@ -583,7 +595,11 @@ func ParseTSHeader(tshdr []byte) (pid uint16, start bool, iskeyframe bool, hdrle
 	hdrlen += 4
 	if tshdr[3]&0x20 != 0 {
 		hdrlen += int(tshdr[4])+1
-		iskeyframe = tshdr[5]&0x40 != 0
+		if hdrlen > len(tshdr) {
+			err = fmt.Errorf("tshdr adaptation field length invalid")
+			return
+		}
+		iskeyframe = tshdr[4] > 0 && tshdr[5]&0x40 != 0
 	}
 	return
 }
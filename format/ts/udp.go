@@ -0,0 +1,312 @@
+package ts
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/nareix/joy4/format/ts/tsio"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// DatagramSize is the usual payload of TS over UDP, 7 TS packets.
+const DatagramSize = 7 * 188
+
+// UDPReader receives TS over unicast or multicast UDP. Datagrams are queued
+// in arrival order by a goroutine, so that short stalls of the demuxer do not
+// make the socket drop them.
+type UDPReader struct {
+	conn    *net.UDPConn
+	queue   chan []byte
+	closed  chan struct{}
+	buf     []byte
+	err     error
+	dropped int64
+}
+
+// ListenUDP receives datagrams sent to addr, a multicast group is joined on
+// the interface named iface or on the system default if it is empty.
+// queuesize is the number of datagrams buffered, default 1024.
+func ListenUDP(addr string, iface string, queuesize int) (self *UDPReader, err error) {
+	var uaddr *net.UDPAddr
+	if uaddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return
+	}
+
+	var conn *net.UDPConn
+	if uaddr.IP != nil && uaddr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if iface != "" {
+			if ifi, err = net.InterfaceByName(iface); err != nil {
+				return
+			}
+		}
+		if conn, err = net.ListenMulticastUDP("udp", ifi, uaddr); err != nil {
+			return
+		}
+	} else {
+		if conn, err = net.ListenUDP("udp", uaddr); err != nil {
+			return
+		}
+	}
+	conn.SetReadBuffer(4 * 1024 * 1024)
+
+	if queuesize <= 0 {
+		queuesize = 1024
+	}
+	self = &UDPReader{
+		conn:   conn,
+		queue:  make(chan []byte, queuesize),
+		closed: make(chan struct{}),
+	}
+	go self.recv()
+	return
+}
+
+func (self *UDPReader) recv() {
+	defer close(self.queue)
+	for {
+		b := make([]byte, 65536)
+		n, err := self.conn.Read(b)
+		if err != nil {
+			self.err = err
+			return
+		}
+		select {
+		case self.queue <- b[:n]:
+		case <-self.closed:
+			return
+		default:
+			// the queue is full, losing the newest datagram keeps order
+			atomic.AddInt64(&self.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of datagrams lost because the queue was full.
+func (self *UDPReader) Dropped() int64 {
+	return atomic.LoadInt64(&self.dropped)
+}
+
+// LocalAddr returns the address the reader is bound to.
+func (self *UDPReader) LocalAddr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+func (self *UDPReader) Read(p []byte) (n int, err error) {
+	for len(self.buf) == 0 {
+		var ok bool
+		if self.buf, ok = <-self.queue; !ok {
+			select {
+			case <-self.closed:
+				err = io.EOF
+			default:
+				err = self.err
+			}
+			return
+		}
+	}
+	n = copy(p, self.buf)
+	self.buf = self.buf[n:]
+	return
+}
+
+func (self *UDPReader) Close() error {
+	select {
+	case <-self.closed:
+		return nil
+	default:
+	}
+	close(self.closed)
+	return self.conn.Close()
+}
+
+// UDPWriter sends TS packets in datagrams of DatagramSize bytes. Datagrams
+// carrying a PCR are held back until the wall clock reaches it, so that a
+// file is sent at its real rate.
+type UDPWriter struct {
+	conn *net.UDPConn
+	buf  []byte
+
+	haspcr   bool
+	basepcr  time.Duration
+	basewall time.Time
+	lastpcr  time.Duration
+}
+
+// DialUDP sends to addr, a unicast or multicast address. localaddr selects
+// the source address and so the interface, it can be empty.
+func DialUDP(addr string, localaddr string) (self *UDPWriter, err error) {
+	var raddr, laddr *net.UDPAddr
+	if raddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return
+	}
+	if localaddr != "" {
+		if laddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(localaddr, "0")); err != nil {
+			return
+		}
+	}
+	var conn *net.UDPConn
+	if conn, err = net.DialUDP("udp", laddr, raddr); err != nil {
+		return
+	}
+	conn.SetWriteBuffer(4 * 1024 * 1024)
+	self = &UDPWriter{
+		conn: conn,
+		buf:  make([]byte, 0, DatagramSize),
+	}
+	return
+}
+
+func packetPCR(b []byte) (pcr time.Duration, ok bool) {
+	// adaptation_field_control has adaptation field, PCR_flag
+	if b[3]&0x20 != 0 && b[4] >= 7 && b[5]&0x10 != 0 {
+		v := uint64(pio.U16BE(b[6:]))<<32 | uint64(pio.U32BE(b[8:]))
+		return tsio.PCRToTime(v), true
+	}
+	return
+}
+
+func (self *UDPWriter) pace() {
+	var pcr time.Duration
+	var ok bool
+	for i := 0; i+188 <= len(self.buf); i += 188 {
+		if pcr, ok = packetPCR(self.buf[i : i+188]); ok {
+			break
+		}
+	}
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if self.haspcr && pcr >= self.lastpcr && pcr-self.lastpcr < time.Second {
+		wait := self.basewall.Add(pcr - self.basepcr).Sub(now)
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		if wait > -time.Second {
+			self.lastpcr = pcr
+			return
+		}
+	}
+	// first PCR, PCR discontinuity or too late to catch up
+	self.haspcr = true
+	self.basepcr, self.basewall = pcr, now
+	self.lastpcr = pcr
+}
+
+func (self *UDPWriter) send() (err error) {
+	self.pace()
+	_, err = self.conn.Write(self.buf)
+	self.buf = self.buf[:0]
+	return
+}
+
+func (self *UDPWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c := copy(self.buf[len(self.buf):DatagramSize], p)
+		self.buf = self.buf[:len(self.buf)+c]
+		p = p[c:]
+		n += c
+		if len(self.buf) == DatagramSize {
+			if err = self.send(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Flush sends the buffered TS packets even if they do not fill a datagram.
+func (self *UDPWriter) Flush() (err error) {
+	if len(self.buf) > 0 {
+		return self.send()
+	}
+	return
+}
+
+func (self *UDPWriter) Close() (err error) {
+	if err = self.Flush(); err != nil {
+		self.conn.Close()
+		return
+	}
+	return self.conn.Close()
+}
+
+type udpDemuxer struct {
+	*Demuxer
+	r *UDPReader
+}
+
+func (self udpDemuxer) Close() error {
+	return self.r.Close()
+}
+
+type udpMuxer struct {
+	*Muxer
+	w *UDPWriter
+}
+
+// Close flushes and closes the socket, WriteTrailer is left to the caller.
+func (self udpMuxer) Close() error {
+	return self.w.Close()
+}
+
+// udpURL parses udp://[@]host:port?options, the @ of ffmpeg style URLs is
+// ignored.
+func udpURL(uri string) (u *url.URL, ok bool) {
+	var err error
+	if u, err = url.Parse(uri); err != nil || u.Scheme != "udp" {
+		return
+	}
+	if u.Port() == "" {
+		return
+	}
+	ok = true
+	return
+}
+
+// OpenUDP opens a demuxer reading udp://[@]host:port, the query may set
+// iface (multicast interface name) and queue (datagrams buffered).
+func OpenUDP(uri string) (demuxer *Demuxer, r *UDPReader, err error) {
+	u, ok := udpURL(uri)
+	if !ok {
+		err = fmt.Errorf("ts: invalid udp url %s", uri)
+		return
+	}
+	query := u.Query()
+	queuesize, _ := strconv.Atoi(query.Get("queue"))
+	if r, err = ListenUDP(u.Host, query.Get("iface"), queuesize); err != nil {
+		return
+	}
+	demuxer = NewDemuxer(r)
+	return
+}
+
+// CreateUDP creates a muxer sending to udp://host:port, the query may set
+// localaddr (source address), pcrinterval (milliseconds, default 40) and
+// muxrate (bits per second).
+func CreateUDP(uri string) (muxer *Muxer, w *UDPWriter, err error) {
+	u, ok := udpURL(uri)
+	if !ok {
+		err = fmt.Errorf("ts: invalid udp url %s", uri)
+		return
+	}
+	query := u.Query()
+	if w, err = DialUDP(u.Host, query.Get("localaddr")); err != nil {
+		return
+	}
+	muxer = NewMuxer(w)
+	// pacing needs PCR at regular intervals
+	muxer.PCRInterval = time.Millisecond * 40
+	if ms, _ := strconv.Atoi(query.Get("pcrinterval")); ms > 0 {
+		muxer.PCRInterval = time.Duration(ms) * time.Millisecond
+	}
+	muxer.MuxRate, _ = strconv.Atoi(query.Get("muxrate"))
+	return
+}
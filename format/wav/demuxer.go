@@ -0,0 +1,170 @@
+package wav
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// PacketSamples is the number of samples per channel in a packet read by
+// Demuxer.
+var PacketSamples = 1024
+
+type Demuxer struct {
+	r         *bufio.Reader
+	format    Format
+	codecdata av.AudioCodecData
+	datasize  int64
+	samples   int64
+	stage     int
+}
+
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r: bufio.NewReaderSize(r, pio.RecommendBufioSize),
+	}
+}
+
+// Format returns the fmt chunk.
+func (self *Demuxer) Format() (format Format, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	format = self.format
+	return
+}
+
+func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+	streams = []av.CodecData{self.codecdata}
+	return
+}
+
+func (self *Demuxer) probe() (err error) {
+	if self.stage != 0 {
+		return
+	}
+
+	hdr := make([]byte, 12)
+	if _, err = io.ReadFull(self.r, hdr); err != nil {
+		return
+	}
+	if string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WAVE" {
+		err = fmt.Errorf("wav: RIFF/WAVE header not found")
+		return
+	}
+
+	gotfmt := false
+	for {
+		if _, err = io.ReadFull(self.r, hdr[:8]); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("wav: data chunk not found")
+			}
+			return
+		}
+		id := string(hdr[0:4])
+		size := int64(pio.U32LE(hdr[4:8]))
+
+		if id == "data" {
+			if !gotfmt {
+				err = fmt.Errorf("wav: fmt chunk not found")
+				return
+			}
+			// written by streaming muxers which can not seek back
+			if size == 0 || size == 0xffffffff {
+				size = -1
+			}
+			self.datasize = size
+			break
+		}
+
+		// chunks are padded to even sizes
+		skip := size + size&1
+		if id == "fmt " {
+			// the size is not trusted, only the extensible fields are read
+			n := size
+			if n > 40 {
+				n = 40
+			}
+			b := make([]byte, n)
+			if _, err = io.ReadFull(self.r, b); err != nil {
+				return
+			}
+			if err = self.format.Unmarshal(b); err != nil {
+				return
+			}
+			if self.codecdata, err = self.format.CodecData(); err != nil {
+				return
+			}
+			gotfmt = true
+			skip -= n
+		}
+		if _, err = self.r.Discard(int(skip)); err != nil {
+			return
+		}
+	}
+
+	self.stage++
+	return
+}
+
+func (self *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if err = self.probe(); err != nil {
+		return
+	}
+
+	blockalign := int64(self.format.BlockAlign())
+	size := int64(PacketSamples) * blockalign
+	if self.datasize >= 0 {
+		if self.datasize < size {
+			size = self.datasize / blockalign * blockalign
+		}
+		if size == 0 {
+			err = io.EOF
+			return
+		}
+	}
+
+	b := make([]byte, size)
+	var n int
+	if n, err = io.ReadFull(self.r, b); err != nil {
+		if err != io.ErrUnexpectedEOF {
+			return
+		}
+		err = nil
+		b = b[:int64(n)/blockalign*blockalign]
+		if len(b) == 0 {
+			err = io.EOF
+			return
+		}
+	}
+	if self.datasize >= 0 {
+		self.datasize -= int64(len(b))
+	}
+
+	pkt.Time = time.Duration(self.samples) * time.Second / time.Duration(self.format.SampleRate)
+	pkt.IsKeyFrame = true
+	self.samples += int64(len(b)) / blockalign
+	if self.format.Tag == FormatPCM && self.format.BitsPerSample == 24 {
+		b = expand24(b)
+	}
+	pkt.Data = b
+	return
+}
+
+// expand24 converts packed 24 bit samples to S32.
+func expand24(b []byte) (out []byte) {
+	out = make([]byte, len(b)/3*4)
+	for i, j := 0, 0; i+3 <= len(b); i, j = i+3, j+4 {
+		out[j+1] = b[i]
+		out[j+2] = b[i+1]
+		out[j+3] = b[i+2]
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package wav
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+func chunk(id string, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data)+1)
+	copy(b, id)
+	pio.PutU32LE(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)&1 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := append([]byte("WAVE"), bytes.Join(chunks, nil)...)
+	return chunk("RIFF", body)
+}
+
+func fmtChunk(format Format) []byte {
+	b := make([]byte, format.Len())
+	format.Marshal(b)
+	return chunk("fmt ", b)
+}
+
+func readAll(t *testing.T, demuxer *Demuxer) (pkts []av.Packet) {
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestDemuxerPCM(t *testing.T) {
+	data := make([]byte, 3000*4)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	format := Format{Tag: FormatPCM, Channels: 2, SampleRate: 44100, BitsPerSample: 16}
+	// an odd sized chunk before the data
+	demuxer := NewDemuxer(bytes.NewReader(riff(fmtChunk(format), chunk("LIST", []byte{1, 2, 3}), chunk("data", data))))
+	streams, err := demuxer.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acodec := streams[0].(av.AudioCodecData)
+	if acodec.SampleFormat() != av.S16 || acodec.SampleRate() != 44100 || acodec.ChannelLayout() != av.CH_STEREO {
+		t.Errorf("got %v %d %v", acodec.SampleFormat(), acodec.SampleRate(), acodec.ChannelLayout())
+	}
+
+	pkts := readAll(t, demuxer)
+	if len(pkts) != 3 || len(pkts[2].Data) != 952*4 {
+		t.Fatalf("got %d packets", len(pkts))
+	}
+	if pkts[1].Time != 1024*time.Second/44100 {
+		t.Errorf("second packet at %v", pkts[1].Time)
+	}
+	var got []byte
+	for _, pkt := range pkts {
+		got = append(got, pkt.Data...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data differs")
+	}
+}
+
+func TestDemuxerExtensible(t *testing.T) {
+	format := Format{
+		Tag:           FormatPCM,
+		Extensible:    true,
+		Channels:      6,
+		SampleRate:    48000,
+		BitsPerSample: 16,
+		ValidBits:     16,
+		ChannelMask:   SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerLowFreq | SpeakerBackLeft | SpeakerBackRight,
+	}
+	demuxer := NewDemuxer(bytes.NewReader(riff(fmtChunk(format), chunk("data", make([]byte, 12*10)))))
+	got, err := demuxer.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != format {
+		t.Errorf("got format %+v", got)
+	}
+	streams, _ := demuxer.Streams()
+	cl := av.CH_FRONT_LEFT | av.CH_FRONT_RIGHT | av.CH_FRONT_CENTER | av.CH_LOW_FREQ | av.CH_BACK_LEFT | av.CH_BACK_RIGHT
+	if layout := streams[0].(av.AudioCodecData).ChannelLayout(); layout != cl {
+		t.Errorf("got channel layout %v", layout)
+	}
+	if pkts := readAll(t, demuxer); len(pkts) != 1 || len(pkts[0].Data) != 120 {
+		t.Errorf("got %d packets", len(pkts))
+	}
+}
+
+func TestDemuxer24Bit(t *testing.T) {
+	format := Format{Tag: FormatPCM, Channels: 1, SampleRate: 8000, BitsPerSample: 24}
+	demuxer := NewDemuxer(bytes.NewReader(riff(fmtChunk(format), chunk("data", []byte{1, 2, 3, 4, 5, 6}))))
+	streams, err := demuxer.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf := streams[0].(av.AudioCodecData).SampleFormat(); sf != av.S32 {
+		t.Errorf("got sample format %v", sf)
+	}
+	pkts := readAll(t, demuxer)
+	if len(pkts) != 1 || !bytes.Equal(pkts[0].Data, []byte{0, 1, 2, 3, 0, 4, 5, 6}) {
+		t.Errorf("got packets %v", pkts)
+	}
+}
+
+func TestDemuxerFmtSize(t *testing.T) {
+	format := Format{Tag: FormatPCM, Channels: 1, SampleRate: 8000, BitsPerSample: 8}
+	b := make([]byte, 50)
+	format.Marshal(b)
+
+	// extra bytes after the fields are skipped
+	demuxer := NewDemuxer(bytes.NewReader(riff(chunk("fmt ", b), chunk("data", []byte{1, 2, 3}))))
+	if pkts := readAll(t, demuxer); len(pkts) != 1 || !bytes.Equal(pkts[0].Data, []byte{1, 2, 3}) {
+		t.Errorf("got packets %v", pkts)
+	}
+
+	// a huge size is not allocated
+	file := riff(chunk("fmt ", b))
+	pio.PutU32LE(file[16:], 0xfffffff0)
+	if _, err := NewDemuxer(bytes.NewReader(file)).Streams(); err == nil {
+		t.Error("truncated fmt chunk accepted")
+	}
+}
+
+func TestMuxerRoundTrip(t *testing.T) {
+	codecdata := codec.NewPCMCodecData(av.S16, 16000, av.CH_MONO)
+	data := []byte{1, 2, 3, 4, 5, 6}
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "out.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	stream := &bytes.Buffer{}
+	for _, w := range []io.Writer{file, stream} {
+		muxer := NewMuxer(w)
+		if err = muxer.WriteHeader([]av.CodecData{codecdata}); err != nil {
+			t.Fatal(err)
+		}
+		if err = muxer.WritePacket(av.Packet{Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		if err = muxer.WriteTrailer(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// sizes are fixed up in the file and unknown in the stream
+	for _, r := range []io.Reader{file, stream} {
+		pkts := readAll(t, NewDemuxer(r))
+		if len(pkts) != 1 || !bytes.Equal(pkts[0].Data, data) {
+			t.Errorf("got packets %v", pkts)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package wav
+
+import (
+	"io"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+)
+
+func Handler(h *avutil.RegisterHandler) {
+	h.Ext = ".wav"
+
+	h.Probe = func(b []byte) bool {
+		return string(b[0:4]) == "RIFF" && string(b[8:12]) == "WAVE"
+	}
+
+	h.ReaderDemuxer = func(r io.Reader) av.Demuxer {
+		return NewDemuxer(r)
+	}
+
+	h.WriterMuxer = func(w io.Writer) av.Muxer {
+		return NewMuxer(w)
+	}
+
+	h.CodecTypes = CodecTypes
+}
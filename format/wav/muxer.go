@@ -0,0 +1,121 @@
+package wav
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+// Muxer writes a WAVE file. Sizes are 0xffffffff, which readers take as
+// unknown, unless the writer is seekable and WriteTrailer can fix them up.
+type Muxer struct {
+	w    io.Writer
+	ws   io.WriteSeeker
+	base int64
+
+	format   Format
+	datasize int64
+	factPos  int64
+	dataPos  int64
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	self := &Muxer{w: w}
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if pos, err := ws.Seek(0, 1); err == nil {
+			self.ws = ws
+			self.base = pos
+		}
+	}
+	return self
+}
+
+func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
+	if len(streams) != 1 || !streams[0].Type().IsAudio() {
+		err = fmt.Errorf("wav: must be only one audio stream")
+		return
+	}
+	if self.format, err = NewFormat(streams[0].(av.AudioCodecData)); err != nil {
+		return
+	}
+
+	fmtlen := self.format.Len()
+	b := make([]byte, 12+8+fmtlen+12+8)
+	n := 0
+	copy(b[n:], "RIFF")
+	pio.PutU32LE(b[n+4:], 0xffffffff)
+	copy(b[n+8:], "WAVE")
+	n += 12
+
+	copy(b[n:], "fmt ")
+	pio.PutU32LE(b[n+4:], uint32(fmtlen))
+	n += 8
+	n += self.format.Marshal(b[n:])
+
+	if self.format.Tag != FormatPCM {
+		// non PCM files carry the sample count
+		copy(b[n:], "fact")
+		pio.PutU32LE(b[n+4:], 4)
+		pio.PutU32LE(b[n+8:], 0xffffffff)
+		self.factPos = int64(n + 8)
+		n += 12
+	}
+
+	copy(b[n:], "data")
+	pio.PutU32LE(b[n+4:], 0xffffffff)
+	n += 8
+	self.dataPos = int64(n)
+
+	_, err = self.w.Write(b[:n])
+	return
+}
+
+func (self *Muxer) WritePacket(pkt av.Packet) (err error) {
+	if _, err = self.w.Write(pkt.Data); err != nil {
+		return
+	}
+	self.datasize += int64(len(pkt.Data))
+	return
+}
+
+func (self *Muxer) putU32At(pos int64, v int64) (err error) {
+	if v > 0xffffffff {
+		v = 0xffffffff
+	}
+	b := make([]byte, 4)
+	pio.PutU32LE(b, uint32(v))
+	if _, err = self.ws.Seek(self.base+pos, 0); err != nil {
+		return
+	}
+	_, err = self.w.Write(b)
+	return
+}
+
+func (self *Muxer) WriteTrailer() (err error) {
+	end := self.dataPos + self.datasize
+	if self.datasize&1 != 0 {
+		if _, err = self.w.Write([]byte{0}); err != nil {
+			return
+		}
+		end++
+	}
+	if self.ws == nil {
+		return
+	}
+
+	if err = self.putU32At(4, end-8); err != nil {
+		return
+	}
+	if self.factPos != 0 {
+		if err = self.putU32At(self.factPos, self.datasize/int64(self.format.BlockAlign())); err != nil {
+			return
+		}
+	}
+	if err = self.putU32At(self.dataPos-4, self.datasize); err != nil {
+		return
+	}
+	_, err = self.ws.Seek(self.base+end, 0)
+	return
+}
@@ -0,0 +1,263 @@
+// Package wav reads and writes RIFF/WAVE files of PCM, IEEE float and G.711
+// audio.
+package wav
+
+import (
+	"fmt"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+var CodecTypes = []av.CodecType{av.PCM, av.PCM_ALAW, av.PCM_MULAW}
+
+const (
+	FormatPCM        = 0x0001
+	FormatIEEEFloat  = 0x0003
+	FormatALaw       = 0x0006
+	FormatMuLaw      = 0x0007
+	FormatExtensible = 0xfffe
+)
+
+// Speaker positions of the extensible channel mask.
+const (
+	SpeakerFrontLeft   = 0x1
+	SpeakerFrontRight  = 0x2
+	SpeakerFrontCenter = 0x4
+	SpeakerLowFreq     = 0x8
+	SpeakerBackLeft    = 0x10
+	SpeakerBackRight   = 0x20
+	SpeakerBackCenter  = 0x100
+	SpeakerSideLeft    = 0x200
+	SpeakerSideRight   = 0x400
+)
+
+var speakers = []struct {
+	mask uint32
+	ch   av.ChannelLayout
+}{
+	{SpeakerFrontLeft, av.CH_FRONT_LEFT},
+	{SpeakerFrontRight, av.CH_FRONT_RIGHT},
+	{SpeakerFrontCenter, av.CH_FRONT_CENTER},
+	{SpeakerLowFreq, av.CH_LOW_FREQ},
+	{SpeakerBackLeft, av.CH_BACK_LEFT},
+	{SpeakerBackRight, av.CH_BACK_RIGHT},
+	{SpeakerBackCenter, av.CH_BACK_CENTER},
+	{SpeakerSideLeft, av.CH_SIDE_LEFT},
+	{SpeakerSideRight, av.CH_SIDE_RIGHT},
+}
+
+// defaultMasks are the speaker positions of files without a channel mask.
+var defaultMasks = []uint32{
+	0,
+	SpeakerFrontCenter,
+	SpeakerFrontLeft | SpeakerFrontRight,
+	SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter,
+	SpeakerFrontLeft | SpeakerFrontRight | SpeakerBackLeft | SpeakerBackRight,
+	SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerBackLeft | SpeakerBackRight,
+	SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerLowFreq | SpeakerBackLeft | SpeakerBackRight,
+	SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerLowFreq | SpeakerBackLeft | SpeakerBackRight | SpeakerBackCenter,
+	SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerLowFreq | SpeakerBackLeft | SpeakerBackRight | SpeakerSideLeft | SpeakerSideRight,
+}
+
+func maskToChannelLayout(mask uint32, channels int) (cl av.ChannelLayout) {
+	for _, s := range speakers {
+		if mask&s.mask != 0 {
+			cl |= s.ch
+		}
+	}
+	if cl.Count() != channels {
+		if channels < len(defaultMasks) {
+			return maskToChannelLayout(defaultMasks[channels], channels)
+		}
+		// positions unknown, only the count matters
+		cl = av.ChannelLayout(1<<uint(channels) - 1)
+	}
+	return
+}
+
+func channelLayoutToMask(cl av.ChannelLayout) (mask uint32) {
+	for _, s := range speakers {
+		if cl&s.ch != 0 {
+			mask |= s.mask
+		}
+	}
+	return
+}
+
+// extensibleGUID is KSDATAFORMAT_SUBTYPE_* without its first two bytes,
+// which are the format tag.
+var extensibleGUID = []byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71}
+
+// Format is the fmt chunk, Tag is the sub format of extensible ones.
+type Format struct {
+	Tag           uint16
+	Extensible    bool
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	ValidBits     int
+	ChannelMask   uint32
+}
+
+func (self Format) BlockAlign() int {
+	return (self.BitsPerSample + 7) / 8 * self.Channels
+}
+
+// Len returns the size of the chunk payload.
+func (self Format) Len() int {
+	switch {
+	case self.Extensible:
+		return 40
+	case self.Tag == FormatPCM:
+		return 16
+	}
+	return 18
+}
+
+func (self Format) Marshal(b []byte) (n int) {
+	if self.Extensible {
+		pio.PutU16LE(b[0:2], FormatExtensible)
+	} else {
+		pio.PutU16LE(b[0:2], self.Tag)
+	}
+	pio.PutU16LE(b[2:4], uint16(self.Channels))
+	pio.PutU32LE(b[4:8], uint32(self.SampleRate))
+	pio.PutU32LE(b[8:12], uint32(self.SampleRate*self.BlockAlign()))
+	pio.PutU16LE(b[12:14], uint16(self.BlockAlign()))
+	pio.PutU16LE(b[14:16], uint16(self.BitsPerSample))
+	n = 16
+	switch {
+	case self.Extensible:
+		pio.PutU16LE(b[16:18], 22)
+		pio.PutU16LE(b[18:20], uint16(self.ValidBits))
+		pio.PutU32LE(b[20:24], self.ChannelMask)
+		pio.PutU16LE(b[24:26], self.Tag)
+		copy(b[26:40], extensibleGUID)
+		n = 40
+	case self.Tag != FormatPCM:
+		// cbSize
+		pio.PutU16LE(b[16:18], 0)
+		n = 18
+	}
+	return
+}
+
+func (self *Format) Unmarshal(b []byte) (err error) {
+	if len(b) < 16 {
+		err = fmt.Errorf("wav: invalid fmt chunk")
+		return
+	}
+	self.Tag = pio.U16LE(b[0:2])
+	self.Channels = int(pio.U16LE(b[2:4]))
+	self.SampleRate = int(pio.U32LE(b[4:8]))
+	self.BitsPerSample = int(pio.U16LE(b[14:16]))
+	self.ValidBits = self.BitsPerSample
+	if self.Tag == FormatExtensible {
+		if len(b) < 40 {
+			err = fmt.Errorf("wav: invalid extensible fmt chunk")
+			return
+		}
+		if valid := int(pio.U16LE(b[18:20])); valid > 0 {
+			self.ValidBits = valid
+		}
+		self.ChannelMask = pio.U32LE(b[20:24])
+		self.Tag = pio.U16LE(b[24:26])
+		self.Extensible = true
+		if string(b[26:40]) != string(extensibleGUID) {
+			err = fmt.Errorf("wav: unknown extensible sub format")
+			return
+		}
+	}
+	if self.Channels == 0 || self.SampleRate == 0 || self.BitsPerSample == 0 {
+		err = fmt.Errorf("wav: invalid fmt chunk")
+		return
+	}
+	return
+}
+
+// CodecData returns the codec of a parsed fmt chunk, 24 bit PCM is read as
+// S32.
+func (self Format) CodecData() (codecdata av.AudioCodecData, err error) {
+	cl := maskToChannelLayout(self.ChannelMask, self.Channels)
+	switch self.Tag {
+	case FormatPCM:
+		var sf av.SampleFormat
+		switch self.BitsPerSample {
+		case 8:
+			sf = av.U8
+		case 16:
+			sf = av.S16
+		case 24, 32:
+			sf = av.S32
+		default:
+			err = fmt.Errorf("wav: %d bits PCM is not supported", self.BitsPerSample)
+			return
+		}
+		codecdata = codec.NewPCMCodecData(sf, self.SampleRate, cl)
+
+	case FormatIEEEFloat:
+		var sf av.SampleFormat
+		switch self.BitsPerSample {
+		case 32:
+			sf = av.FLT
+		case 64:
+			sf = av.DBL
+		default:
+			err = fmt.Errorf("wav: %d bits float is not supported", self.BitsPerSample)
+			return
+		}
+		codecdata = codec.NewPCMCodecData(sf, self.SampleRate, cl)
+
+	case FormatALaw, FormatMuLaw:
+		if self.SampleRate != 8000 || self.Channels != 1 || self.BitsPerSample != 8 {
+			err = fmt.Errorf("wav: G.711 must be 8kHz mono")
+			return
+		}
+		if self.Tag == FormatALaw {
+			codecdata = codec.NewPCMAlawCodecData()
+		} else {
+			codecdata = codec.NewPCMMulawCodecData()
+		}
+
+	default:
+		err = fmt.Errorf("wav: format tag 0x%x is not supported", self.Tag)
+	}
+	return
+}
+
+// NewFormat returns the fmt chunk to write codecdata, the extensible form is
+// used for more than 2 channels or more than 16 bits as Windows expects.
+func NewFormat(codecdata av.AudioCodecData) (self Format, err error) {
+	self.Channels = codecdata.ChannelLayout().Count()
+	self.SampleRate = codecdata.SampleRate()
+	switch codecdata.Type() {
+	case av.PCM_ALAW:
+		self.Tag = FormatALaw
+		self.BitsPerSample = 8
+	case av.PCM_MULAW:
+		self.Tag = FormatMuLaw
+		self.BitsPerSample = 8
+	case av.PCM:
+		switch codecdata.SampleFormat() {
+		case av.U8, av.S16, av.S32:
+			self.Tag = FormatPCM
+		case av.FLT, av.DBL:
+			self.Tag = FormatIEEEFloat
+		default:
+			err = fmt.Errorf("wav: sample format %v is not supported", codecdata.SampleFormat())
+			return
+		}
+		self.BitsPerSample = codecdata.SampleFormat().BytesPerSample() * 8
+	default:
+		err = fmt.Errorf("wav: codec type=%v is not supported", codecdata.Type())
+		return
+	}
+	self.ValidBits = self.BitsPerSample
+	if self.Channels > 2 || (self.Tag == FormatPCM && self.BitsPerSample > 16) {
+		self.ChannelMask = channelLayoutToMask(codecdata.ChannelLayout())
+		self.Extensible = true
+	}
+	return
+}
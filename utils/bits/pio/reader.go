@@ -11,6 +11,12 @@ func U16BE(b []byte) (i uint16) {
 	return
 }
 
+func U16LE(b []byte) (i uint16) {
+	i = uint16(b[1])
+	i <<= 8; i |= uint16(b[0])
+	return
+}
+
 func I16BE(b []byte) (i int16) {
 	i = int16(b[0])
 	i <<= 8; i |= int16(b[1])
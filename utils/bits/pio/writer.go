@@ -15,6 +15,11 @@ func PutU16BE(b []byte, v uint16) {
 	b[1] = byte(v)
 }
 
+func PutU16LE(b []byte, v uint16) {
+	b[0] = byte(v)
+	b[1] = byte(v>>8)
+}
+
 func PutI24BE(b []byte, v int32) {
 	b[0] = byte(v>>16)
 	b[1] = byte(v>>8)